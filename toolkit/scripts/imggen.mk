@@ -125,6 +125,7 @@ $(image_package_cache_summary): $(go-imagepkgfetcher) $(chroot_worker) $(imggen_
 		--tdnf-worker=$(chroot_worker) \
 		--tls-cert=$(TLS_CERT) \
 		--tls-key=$(TLS_KEY) \
+		--ca-bundle=$(CA_CERT) \
 		$(foreach repo, $(imagefetcher_local_repo) $(imagefetcher_cloned_repo) $(REPO_LIST),--repo-file="$(repo)" ) \
 		$(imagepkgfetcher_extra_flags) \
 		--input-summary-file=$(IMAGE_CACHE_SUMMARY) \
@@ -208,6 +209,7 @@ $(image_external_package_cache_summary): $(cached_file) $(go-imagepkgfetcher) $(
 		--package-graph=$(graph_file) \
 		--tls-cert=$(TLS_CERT) \
 		--tls-key=$(TLS_KEY) \
+		--ca-bundle=$(CA_CERT) \
 		$(foreach repo, $(imagefetcher_local_repo) $(imagefetcher_cloned_repo) $(REPO_LIST),--repo-file="$(repo)" ) \
 		$(imagepkgfetcher_extra_flags) \
 		--input-summary-file=$(IMAGE_CACHE_SUMMARY) \
@@ -137,6 +137,7 @@ $(graph_file): $(specs_file) $(go-grapher) $(toolchain_rpms) $(TOOLCHAIN_MANIFES
 		--toolchain-rpms-dir=$(TOOLCHAIN_RPMS_DIR) \
 		--tls-cert=$(TLS_CERT) \
 		--tls-key=$(TLS_KEY) \
+		--ca-bundle=$(CA_CERT) \
 		--tmp-dir=$(grapher_working_dir) \
 		--tdnf-worker=$(chroot_worker) \
 		$(foreach repo, $(pkggen_local_repo) $(graphpkgfetcher_cloned_repo) $(REPO_LIST), --repo-file=$(repo))
@@ -202,6 +203,7 @@ $(cached_file): $(graph_file) $(go-graphpkgfetcher) $(chroot_worker) $(pkggen_lo
 		--toolchain-manifest=$(TOOLCHAIN_MANIFEST) \
 		--tls-cert=$(TLS_CERT) \
 		--tls-key=$(TLS_KEY) \
+		--ca-bundle=$(CA_CERT) \
 		$(foreach repo, $(pkggen_local_repo) $(graphpkgfetcher_cloned_repo) $(REPO_LIST),--repo-file=$(repo) ) \
 		$(graphpkgfetcher_extra_flags) \
 		$(logging_command) \
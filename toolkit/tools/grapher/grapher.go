@@ -32,6 +32,7 @@ var (
 	usePMCtoResolveCycles = app.Flag("usePMCtoresolvecycles", "Cycles will be resolved by downloading rpm packages from PMC if locally unavailable").Bool()
 	tlsClientCert         = app.Flag("tls-cert", "TLS client certificate to use when downloading files.").String()
 	tlsClientKey          = app.Flag("tls-key", "TLS client key to use when downloading files.").String()
+	caBundle              = app.Flag("ca-bundle", "Additional CA certificates to trust when verifying the server certificates of HTTPS repos.").String()
 
 	resolveCyclesFromUpstream     = app.Flag("resolve-cycles-from-upstream", "Let grapher resolve cycles by marking rpms available in repo as remote").Bool()
 	outDir                        = exe.OutputDirFlag(app, "Directory to download packages into.")
@@ -83,7 +84,8 @@ func main() {
 
 	var cloner *rpmrepocloner.RpmRepoCloner = nil
 	if *resolveCyclesFromUpstream {
-		cloner, err = rpmrepocloner.ConstructCloner(*outDir, *tmpDir, *workerTar, *existingRpmsDir, *existingToolchainRpmDir, *tlsClientCert, *tlsClientKey, *repoFiles)
+		const expandRepoTemplates = false
+		cloner, err = rpmrepocloner.ConstructCloner(*outDir, *tmpDir, *workerTar, *existingRpmsDir, *existingToolchainRpmDir, *tlsClientCert, *tlsClientKey, *caBundle, *repoFiles, expandRepoTemplates, "", 0, nil)
 		if err != nil {
 			logger.Log.Panic(err)
 		}
@@ -0,0 +1,457 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pausabletimeout"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/shell"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
+)
+
+// Repo IDs listed for the packages copied from '--local-repo-dir' and downloaded from '--oci-repo'.
+const (
+	localRepoID = "local-repo-dir"
+	ociRepoID   = "oci-repo"
+)
+
+// nodeCloner is the part of the cloner used to resolve a single node.
+type nodeCloner interface {
+	WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error)
+	WhatProvidesByRepo(ctx context.Context, pkgVer *pkgjson.PackageVer) (packagesByRepo map[string][]string, err error)
+	PrioritizeCandidates(ctx context.Context, pkgVer *pkgjson.PackageVer, candidates []string) (prioritizedCandidates []string, err error)
+	CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error)
+}
+
+// sharedCloner serializes the use of a single cloner by concurrent resolution workers. Nodes waiting for the cloner
+// don't use up their timeout.
+type sharedCloner struct {
+	lock   sync.Mutex
+	cloner *rpmrepocloner.RpmRepoCloner
+}
+
+// providesCache remembers the results of WhatProvides lookups for the whole run, shared by all resolution workers.
+// Capabilities no repo offers are remembered too, other failures are not as they may be transient.
+type providesCache struct {
+	lock    sync.Mutex
+	results map[string]providesResult // PackageVer query -> result of its lookup
+	lookups int
+	hits    int
+}
+
+type providesResult struct {
+	packageNames []string
+	err          error
+}
+
+// batchProvider looks up the providers of many capabilities at once, keyed by the PackageVer's String().
+type batchProvider interface {
+	SupportsBatchProvides() bool
+	WhatProvidesBatch(pkgVers []*pkgjson.PackageVer) (providers map[string][]string, err error)
+}
+
+// cachingCloner serves repeated WhatProvides lookups from a providesCache.
+type cachingCloner struct {
+	nodeCloner
+	cache *providesCache
+}
+
+// localRepoCloner resolves nodes from the '--local-repo-dir' repository before any repo of the wrapped cloner.
+// Packages from the local repository are copied into the clone directory instead of being cloned.
+type localRepoCloner struct {
+	nodeCloner
+	lock   sync.Mutex
+	repo   *rpmrepocloner.LocalRepo
+	outDir string
+}
+
+// ociRepoCloner resolves nodes from the '--oci-repo' registry repository before any repo of the wrapped cloner.
+// Packages from the registry are downloaded into the clone directory instead of being cloned.
+type ociRepoCloner struct {
+	nodeCloner
+	lock   sync.Mutex
+	repo   *rpmrepocloner.OCIRepo
+	outDir string
+}
+
+// postCloneHookCloner runs the '--post-clone-hook' command for every RPM added to the clone directory by a clone.
+type postCloneHookCloner struct {
+	nodeCloner
+	lock    sync.Mutex // Serializes the clones, so the RPMs added by each clone can be told apart
+	command []string
+	fatal   bool
+	outDir  string
+}
+
+func (s *sharedCloner) WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	pausabletimeout.Lock(ctx, &s.lock)
+	defer s.lock.Unlock()
+	return s.cloner.WhatProvides(pkgVer)
+}
+
+func (s *sharedCloner) WhatProvidesByRepo(ctx context.Context, pkgVer *pkgjson.PackageVer) (packagesByRepo map[string][]string, err error) {
+	pausabletimeout.Lock(ctx, &s.lock)
+	defer s.lock.Unlock()
+	return s.cloner.WhatProvidesByRepo(pkgVer)
+}
+
+func (s *sharedCloner) PrioritizeCandidates(ctx context.Context, pkgVer *pkgjson.PackageVer, candidates []string) (prioritizedCandidates []string, err error) {
+	pausabletimeout.Lock(ctx, &s.lock)
+	defer s.lock.Unlock()
+	return s.cloner.PrioritizeCandidates(pkgVer, candidates)
+}
+
+func (s *sharedCloner) CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	pausabletimeout.Lock(ctx, &s.lock)
+	defer s.lock.Unlock()
+	return s.cloner.CloneAndListPackages(cloneDeps, packagesToClone...)
+}
+
+// use runs 'action' with exclusive access to the cloner.
+func (s *sharedCloner) use(action func(cloner *rpmrepocloner.RpmRepoCloner)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	action(s.cloner)
+}
+
+func newProvidesCache() *providesCache {
+	return &providesCache{
+		results: make(map[string]providesResult),
+	}
+}
+
+// stats returns the number of lookups made through the cache and how many of them were served from it.
+func (p *providesCache) stats() (lookups, hits int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.lookups, p.hits
+}
+
+// prefill looks up the providers of all nodes which need a lookup with batched queries and caches the results, so
+// resolving the nodes doesn't run a lookup per node. Skipped if the repos don't support batched queries, as it would
+// only move the lookups up front. Failures are only logged, the nodes then look up their providers one at a time.
+func (p *providesCache) prefill(provider batchProvider, nodes []*pkggraph.PkgNode, hostProvidedCapabilities map[string]*pkgjson.PackageVer) {
+	if !provider.SupportsBatchProvides() {
+		return
+	}
+
+	p.lock.Lock()
+	queries := make(map[string]bool)
+	pkgVers := []*pkgjson.PackageVer{}
+	for _, n := range nodes {
+		query := n.VersionedPkg.String()
+		if _, found := p.results[query]; found || queries[query] || hostProvides(hostProvidedCapabilities, n.VersionedPkg) {
+			continue
+		}
+		queries[query] = true
+		pkgVers = append(pkgVers, n.VersionedPkg)
+	}
+	p.lock.Unlock()
+
+	if len(pkgVers) == 0 {
+		return
+	}
+
+	providers, err := provider.WhatProvidesBatch(pkgVers)
+	if err != nil {
+		logger.Log.Warnf("Failed to look up the providers of %d node(s) at once, looking them up one at a time: %s", len(pkgVers), err)
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, pkgVer := range pkgVers {
+		packageNames, found := providers[pkgVer.String()]
+		if !found {
+			p.results[pkgVer.String()] = providesResult{err: fmt.Errorf("%w: could not resolve %s", rpmrepocloner.ErrPackageNotFound, pkgVer.Name)}
+			continue
+		}
+		p.results[pkgVer.String()] = providesResult{packageNames: packageNames}
+	}
+	logger.Log.Debugf("Looked up the providers of %d node(s) at once, %d of them are provided.", len(pkgVers), len(providers))
+}
+
+// WhatProvides returns the cached result of an earlier lookup of the same query, or runs the lookup.
+// Workers making the same lookup at the same time may both query the cloner.
+func (c *cachingCloner) WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	query := pkgVer.String()
+
+	c.cache.lock.Lock()
+	c.cache.lookups++
+	result, found := c.cache.results[query]
+	if found {
+		c.cache.hits++
+	}
+	c.cache.lock.Unlock()
+
+	if found {
+		logger.Log.Debugf("Using the cached lookup of '%v'.", pkgVer)
+		return append([]string(nil), result.packageNames...), result.err
+	}
+
+	packageNames, err = c.nodeCloner.WhatProvides(ctx, pkgVer)
+	if err != nil && !errors.Is(err, rpmrepocloner.ErrPackageNotFound) {
+		return
+	}
+
+	c.cache.lock.Lock()
+	c.cache.results[query] = providesResult{packageNames: append([]string(nil), packageNames...), err: err}
+	c.cache.lock.Unlock()
+	return
+}
+
+// newLocalRepoCloner wraps 'cloner' to resolve nodes from the repository in 'repoDir' first, copying its packages
+// into 'outDir'. Returns 'cloner' itself if 'repoDir' is empty.
+func newLocalRepoCloner(cloner nodeCloner, repoDir, outDir string) (wrapped nodeCloner, err error) {
+	if strings.TrimSpace(repoDir) == "" {
+		return cloner, nil
+	}
+
+	repo, err := rpmrepocloner.ReadLocalRepo(repoDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '--local-repo-dir':\n%w", err)
+	}
+	return &localRepoCloner{nodeCloner: cloner, repo: repo, outDir: outDir}, nil
+}
+
+// WhatProvides returns the local repository's packages providing 'pkgVer', or looks them up in the wrapped cloner
+// if it has none.
+func (c *localRepoCloner) WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	packageNames, err = c.repo.WhatProvides(pkgVer)
+	if !errors.Is(err, rpmrepocloner.ErrPackageNotFound) {
+		return
+	}
+	return c.nodeCloner.WhatProvides(ctx, pkgVer)
+}
+
+// CloneAndListPackages copies the requested packages found in the local repository into the clone directory and clones
+// the others with the wrapped cloner. If 'cloneDeps' is set, the requirements of the copied packages are cloned
+// the same way. The copied packages are listed under the localRepoID repo ID.
+func (c *localRepoCloner) CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	pausabletimeout.Lock(ctx, &c.lock)
+	defer c.lock.Unlock()
+
+	allPackagesPrebuilt = true
+	clonedPackages = make(map[string]string)
+	copiedPackages := make(map[string]bool)
+	pendingPackages := append([]*pkgjson.PackageVer(nil), packagesToClone...)
+	for len(pendingPackages) > 0 {
+		pkgVer := pendingPackages[0]
+		pendingPackages = pendingPackages[1:]
+
+		localPackage, found, lookupErr := c.localPackage(pkgVer)
+		if lookupErr != nil {
+			return false, nil, lookupErr
+		}
+		if !found {
+			var (
+				prebuilt        bool
+				wrappedPackages map[string]string
+			)
+
+			prebuilt, wrappedPackages, err = c.nodeCloner.CloneAndListPackages(ctx, cloneDeps, pkgVer)
+			if err != nil {
+				return
+			}
+			allPackagesPrebuilt = allPackagesPrebuilt && prebuilt
+			for rpmFile, repoID := range wrappedPackages {
+				clonedPackages[rpmFile] = repoID
+			}
+			continue
+		}
+
+		allPackagesPrebuilt = false
+		if copiedPackages[localPackage] {
+			continue
+		}
+		copiedPackages[localPackage] = true
+
+		rpmPath, _ := c.repo.RPMPath(localPackage)
+		logger.Log.Debugf("Copying (%s) from the local repo.", localPackage)
+		err = file.Copy(rpmPath, rpmPackageToRPMPath(localPackage, c.outDir))
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to copy '%s' from the local repo:\n%w", localPackage, err)
+		}
+		clonedPackages[filepath.Base(rpmPackageToRPMPath(localPackage, c.outDir))] = localRepoID
+
+		if cloneDeps {
+			var requires []*pkgjson.PackageVer
+
+			requires, err = c.repo.Requires(localPackage)
+			if err != nil {
+				return
+			}
+			pendingPackages = append(pendingPackages, requires...)
+		}
+	}
+
+	return
+}
+
+// localPackage finds the local repository's package to copy for 'pkgVer', which is either the exact name of one
+// of its packages or a capability, like the requirements of the copied packages.
+func (c *localRepoCloner) localPackage(pkgVer *pkgjson.PackageVer) (packageName string, found bool, err error) {
+	if _, found = c.repo.RPMPath(pkgVer.Name); found {
+		return pkgVer.Name, true, nil
+	}
+
+	packageNames, err := c.repo.WhatProvides(pkgVer)
+	if errors.Is(err, rpmrepocloner.ErrPackageNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return
+	}
+	return packageNames[0], true, nil
+}
+
+// newOCIRepoCloner wraps 'cloner' to resolve nodes from the OCI registry repository at 'repoURL' first, downloading
+// its packages into 'outDir'. The password is read from the 'passwordEnv' environment variable.
+// Returns 'cloner' itself if 'repoURL' is empty.
+func newOCIRepoCloner(cloner nodeCloner, repoURL, username, passwordEnv, outDir string) (wrapped nodeCloner, err error) {
+	if strings.TrimSpace(repoURL) == "" {
+		return cloner, nil
+	}
+
+	password := ""
+	if strings.TrimSpace(passwordEnv) != "" {
+		var found bool
+
+		password, found = os.LookupEnv(passwordEnv)
+		if !found {
+			return nil, fmt.Errorf("environment variable '%s' with the '--oci-repo' password is not set", passwordEnv)
+		}
+	}
+
+	repo, err := rpmrepocloner.ReadOCIRepo(repoURL, username, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '--oci-repo':\n%w", err)
+	}
+	return &ociRepoCloner{nodeCloner: cloner, repo: repo, outDir: outDir}, nil
+}
+
+// WhatProvides returns the registry's packages providing 'pkgVer', or looks them up in the wrapped cloner
+// if it has none.
+func (c *ociRepoCloner) WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	packageNames, err = c.repo.WhatProvides(pkgVer)
+	if !errors.Is(err, rpmrepocloner.ErrPackageNotFound) {
+		return
+	}
+	return c.nodeCloner.WhatProvides(ctx, pkgVer)
+}
+
+// CloneAndListPackages downloads the requested packages found in the registry into the clone directory and clones
+// the others with the wrapped cloner. The registry has no dependency information, so only the others' dependencies
+// are cloned. The downloaded packages are listed under the ociRepoID repo ID.
+func (c *ociRepoCloner) CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	pausabletimeout.Lock(ctx, &c.lock)
+	defer c.lock.Unlock()
+
+	allPackagesPrebuilt = true
+	clonedPackages = make(map[string]string)
+	for _, pkgVer := range packagesToClone {
+		if !c.repo.HasPackage(pkgVer.Name) {
+			var (
+				prebuilt        bool
+				wrappedPackages map[string]string
+			)
+
+			prebuilt, wrappedPackages, err = c.nodeCloner.CloneAndListPackages(ctx, cloneDeps, pkgVer)
+			if err != nil {
+				return
+			}
+			allPackagesPrebuilt = allPackagesPrebuilt && prebuilt
+			for rpmFile, repoID := range wrappedPackages {
+				clonedPackages[rpmFile] = repoID
+			}
+			continue
+		}
+
+		allPackagesPrebuilt = false
+		var rpmPath string
+		rpmPath, err = c.repo.Download(pkgVer.Name, c.outDir)
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to download '%s' from the OCI repo:\n%w", pkgVer.Name, err)
+		}
+		clonedPackages[filepath.Base(rpmPath)] = ociRepoID
+	}
+
+	return
+}
+
+// newPostCloneHookCloner wraps 'cloner' to run 'command' for every RPM its clones add to 'outDir'.
+// Returns 'cloner' itself if 'command' is empty.
+func newPostCloneHookCloner(cloner nodeCloner, command string, fatal bool, outDir string) nodeCloner {
+	commandFields := strings.Fields(command)
+	if len(commandFields) == 0 {
+		return cloner
+	}
+	return &postCloneHookCloner{nodeCloner: cloner, command: commandFields, fatal: fatal, outDir: outDir}
+}
+
+// CloneAndListPackages clones the packages with the wrapped cloner, then runs the hook for each RPM added to the clone
+// directory. Only the clones are serialized, the hooks of concurrent resolution workers may run at the same time.
+func (c *postCloneHookCloner) CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	newRPMs, allPackagesPrebuilt, clonedPackages, err := c.cloneAndListNewRPMs(ctx, cloneDeps, packagesToClone...)
+	if err != nil {
+		return
+	}
+
+	for _, rpmPath := range newRPMs {
+		logger.Log.Debugf("Running the post-clone hook for '%s'.", rpmPath)
+		args := append(append([]string{}, c.command[1:]...), rpmPath)
+		_, stderr, hookErr := shell.Execute(c.command[0], args...)
+		if hookErr == nil {
+			continue
+		}
+
+		if c.fatal {
+			return false, nil, fmt.Errorf("post-clone hook failed for '%s':\n%w\n%s", rpmPath, hookErr, stderr)
+		}
+		logger.Log.Warnf("Post-clone hook failed for '%s': %s\n%s", rpmPath, hookErr, stderr)
+	}
+	return
+}
+
+// cloneAndListNewRPMs clones the packages with the wrapped cloner and returns the sorted paths of the RPMs it added
+// to the clone directory, along with the packages listed by the wrapped cloner.
+func (c *postCloneHookCloner) cloneAndListNewRPMs(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (newRPMs []string, allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	pausabletimeout.Lock(ctx, &c.lock)
+	defer c.lock.Unlock()
+
+	existingRPMs, err := filepath.Glob(filepath.Join(c.outDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	allPackagesPrebuilt, clonedPackages, err = c.nodeCloner.CloneAndListPackages(ctx, cloneDeps, packagesToClone...)
+	if err != nil {
+		return
+	}
+
+	currentRPMs, err := filepath.Glob(filepath.Join(c.outDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	existing := sliceutils.SliceToSet(existingRPMs)
+	for _, rpmPath := range currentRPMs {
+		if !existing[rpmPath] {
+			newRPMs = append(newRPMs, rpmPath)
+		}
+	}
+	return
+}
@@ -0,0 +1,274 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldCacheRepeatedLookups(t *testing.T) {
+	counter := &fakeCloner{missing: map[string]bool{"missing": true}}
+	cloner := &cachingCloner{nodeCloner: counter, cache: newProvidesCache()}
+
+	for i := 0; i < 2; i++ {
+		packageNames, err := cloner.WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "libssl.so"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"libssl-1.0-1.cm2.x86_64"}, packageNames)
+
+		_, err = cloner.WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "missing"})
+		assert.ErrorIs(t, err, rpmrepocloner.ErrPackageNotFound)
+	}
+	assert.Equal(t, map[string]int{"libssl.so": 1, "missing": 1}, counter.lookups)
+
+	// Different version constraints are separate lookups.
+	_, err := cloner.WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "libssl.so", Condition: ">=", Version: "3.0"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counter.lookups["libssl.so"])
+
+	lookups, hits := cloner.cache.stats()
+	assert.Equal(t, 5, lookups)
+	assert.Equal(t, 2, hits)
+}
+
+func TestShouldNotCacheFailedLookups(t *testing.T) {
+	failingCloner := &fakeCloner{lookupErr: fmt.Errorf("repo metadata unavailable")}
+	cloner := &cachingCloner{nodeCloner: failingCloner, cache: newProvidesCache()}
+
+	for i := 0; i < 2; i++ {
+		_, err := cloner.WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "zlib"})
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, failingCloner.lookups["zlib"])
+}
+
+// recordingBatchProvider serves batched lookups from 'providers', keyed by package name, and records every batch.
+type recordingBatchProvider struct {
+	batched   bool
+	providers map[string][]string
+	batches   [][]string
+}
+
+func (b *recordingBatchProvider) SupportsBatchProvides() bool {
+	return b.batched
+}
+
+func (b *recordingBatchProvider) WhatProvidesBatch(pkgVers []*pkgjson.PackageVer) (providers map[string][]string, err error) {
+	names := []string{}
+	providers = make(map[string][]string)
+	for _, pkgVer := range pkgVers {
+		names = append(names, pkgVer.Name)
+		if packageNames, found := b.providers[pkgVer.Name]; found {
+			providers[pkgVer.String()] = packageNames
+		}
+	}
+	b.batches = append(b.batches, names)
+	return
+}
+
+func TestShouldPrefillLookupsWithSingleBatch(t *testing.T) {
+	nodes := []*pkggraph.PkgNode{}
+	for _, name := range []string{"bash", "zlib", "bash", "missing", "host-tool"} {
+		nodes = append(nodes, &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: name}, State: pkggraph.StateUnresolved})
+	}
+	hostProvided := map[string]*pkgjson.PackageVer{"host-tool": {Name: "host-tool"}}
+
+	provider := &recordingBatchProvider{
+		batched: true,
+		providers: map[string][]string{
+			"bash": {"bash-5.1.8-2.cm2.x86_64"},
+			"zlib": {"zlib-1.2.13-1.cm2.x86_64"},
+		},
+	}
+	counter := &fakeCloner{}
+	cloner := &cachingCloner{nodeCloner: counter, cache: newProvidesCache()}
+
+	cloner.cache.prefill(provider, nodes, hostProvided)
+	assert.Equal(t, [][]string{{"bash", "zlib", "missing"}}, provider.batches)
+
+	packageNames, err := cloner.WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "bash"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bash-5.1.8-2.cm2.x86_64"}, packageNames)
+	_, err = cloner.WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "missing"})
+	assert.ErrorIs(t, err, rpmrepocloner.ErrPackageNotFound)
+	assert.Empty(t, counter.lookups)
+
+	// Without batched queries the nodes keep looking up their providers one at a time.
+	unbatchedProvider := &recordingBatchProvider{}
+	unbatchedCache := newProvidesCache()
+	unbatchedCache.prefill(unbatchedProvider, nodes, hostProvided)
+	assert.Empty(t, unbatchedProvider.batches)
+	assert.Empty(t, unbatchedCache.results)
+}
+
+const testLocalRepoMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo">
+  <data type="primary">
+    <location href="repodata/primary.xml"/>
+  </data>
+</repomd>
+`
+
+const testLocalRepoPrimary = `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="2">
+<package type="rpm">
+  <name>internal-tool</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1.cm2"/>
+  <location href="internal-tool-1.0-1.cm2.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="internal-tool" flags="EQ" epoch="0" ver="1.0" rel="1.cm2"/>
+    </rpm:provides>
+    <rpm:requires>
+      <rpm:entry name="libinternal.so.1()(64bit)"/>
+      <rpm:entry name="glibc"/>
+    </rpm:requires>
+  </format>
+</package>
+<package type="rpm">
+  <name>internal-libs</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1.cm2"/>
+  <location href="internal-libs-1.0-1.cm2.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="libinternal.so.1()(64bit)"/>
+    </rpm:provides>
+  </format>
+</package>
+</metadata>
+`
+
+func TestShouldResolveNodeFromLocalRepoDir(t *testing.T) {
+	repoDir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(repoDir, "repodata"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "repodata", "repomd.xml"), []byte(testLocalRepoMetadata), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, "repodata", "primary.xml"), []byte(testLocalRepoPrimary), 0644))
+	for _, rpmFile := range []string{"internal-tool-1.0-1.cm2.x86_64.rpm", "internal-libs-1.0-1.cm2.x86_64.rpm"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(repoDir, rpmFile), []byte(rpmFile), 0644))
+	}
+
+	outDir := t.TempDir()
+	remote := &fakeCloner{}
+	cloner, err := newLocalRepoCloner(remote, repoDir, outDir)
+	assert.NoError(t, err)
+
+	packages := newFetchedPackageSet()
+	localNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "internal-tool", Condition: ">=", Version: "1.0"}, State: pkggraph.StateUnresolved}
+	_, err = resolveSingleNode(context.Background(), cloner, localNode, packages, newTestResolveOptions(outDir))
+	assert.NoError(t, err)
+	assert.Equal(t, pkggraph.StateCached, localNode.State)
+	assert.Equal(t, filepath.Join(outDir, "internal-tool-1.0-1.cm2.x86_64.rpm"), localNode.RpmPath)
+
+	// The local requirements are copied too, the others are cloned from the remote repos.
+	for _, rpmFile := range []string{"internal-tool-1.0-1.cm2.x86_64.rpm", "internal-libs-1.0-1.cm2.x86_64.rpm"} {
+		exists, err := file.PathExists(filepath.Join(outDir, rpmFile))
+		assert.NoError(t, err)
+		assert.True(t, exists, "(%s) was not copied", rpmFile)
+	}
+	assert.Equal(t, []string{"glibc"}, remote.cloned)
+
+	remoteNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "bash"}, State: pkggraph.StateUnresolved}
+	_, err = resolveSingleNode(context.Background(), cloner, remoteNode, packages, newTestResolveOptions(outDir))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(outDir, "bash-1.0-1.cm2.x86_64.rpm"), remoteNode.RpmPath)
+	assert.Equal(t, []string{"glibc", "bash-1.0-1.cm2.x86_64"}, remote.cloned)
+
+	unchanged, err := newLocalRepoCloner(remote, "", outDir)
+	assert.NoError(t, err)
+	assert.Equal(t, remote, unchanged)
+}
+
+func TestShouldResolveNodeFromOCIRepo(t *testing.T) {
+	const (
+		rpmContents = "internal-tool rpm"
+		nevra       = "internal-tool-1.0-1.cm2.x86_64"
+	)
+
+	hash := sha256.Sum256([]byte(rpmContents))
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/mariner/rpms/tags/list":
+			fmt.Fprint(w, `{"name": "mariner/rpms", "tags": ["internal-tool-1.0"]}`)
+		case "/v2/mariner/rpms/manifests/internal-tool-1.0":
+			fmt.Fprintf(w, `{"schemaVersion": 2, "layers": [{"digest": %q}], "annotations": {%q: %q}}`, digest, rpmrepocloner.OCIAnnotationNEVRA, nevra)
+		case "/v2/mariner/rpms/blobs/" + digest:
+			fmt.Fprint(w, rpmContents)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	outDir := t.TempDir()
+	remote := &fakeCloner{}
+	cloner, err := newOCIRepoCloner(remote, server.URL+"/mariner/rpms", "", "", outDir)
+	assert.NoError(t, err)
+
+	packages := newFetchedPackageSet()
+	ociNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "internal-tool"}, State: pkggraph.StateUnresolved}
+	_, err = resolveSingleNode(context.Background(), cloner, ociNode, packages, newTestResolveOptions(outDir))
+	assert.NoError(t, err)
+	assert.Equal(t, pkggraph.StateCached, ociNode.State)
+	assert.Equal(t, filepath.Join(outDir, nevra+".rpm"), ociNode.RpmPath)
+
+	downloaded, err := os.ReadFile(ociNode.RpmPath)
+	assert.NoError(t, err)
+	assert.Equal(t, rpmContents, string(downloaded))
+	assert.Empty(t, remote.cloned)
+
+	remoteNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "bash"}, State: pkggraph.StateUnresolved}
+	_, err = resolveSingleNode(context.Background(), cloner, remoteNode, packages, newTestResolveOptions(outDir))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bash-1.0-1.cm2.x86_64"}, remote.cloned)
+}
+
+func TestShouldRunPostCloneHookOncePerDownloadedRPM(t *testing.T) {
+	scriptDir := t.TempDir()
+	invocationsFile := filepath.Join(scriptDir, "invocations")
+	hookScript := filepath.Join(scriptDir, "hook.sh")
+	assert.NoError(t, os.WriteFile(hookScript, []byte(fmt.Sprintf("#!/bin/sh\necho \"$1 $2\" >> %s\n", invocationsFile)), 0755))
+
+	outDir := t.TempDir()
+	cloner := newPostCloneHookCloner(&fakeCloner{deps: map[string][]string{"zlib-1.0-1.cm2.x86_64": {"glibc-2.35-1.cm2.x86_64"}}, outDir: outDir}, hookScript+" --sign", true, outDir)
+
+	packages := newFetchedPackageSet()
+	for _, name := range []string{"zlib", "bash"} {
+		node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: name}, State: pkggraph.StateUnresolved}
+		_, err := resolveSingleNode(context.Background(), cloner, node, packages, newTestResolveOptions(outDir))
+		assert.NoError(t, err)
+	}
+
+	invocations, err := os.ReadFile(invocationsFile)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"--sign " + filepath.Join(outDir, "glibc-2.35-1.cm2.x86_64.rpm"),
+		"--sign " + filepath.Join(outDir, "zlib-1.0-1.cm2.x86_64.rpm"),
+		"--sign " + filepath.Join(outDir, "bash-1.0-1.cm2.x86_64.rpm"),
+	}, strings.Split(strings.TrimSpace(string(invocations)), "\n"))
+
+	failingCloner := newPostCloneHookCloner(&fakeCloner{outDir: outDir}, "false", true, outDir)
+	_, _, err = failingCloner.CloneAndListPackages(context.Background(), false, &pkgjson.PackageVer{Name: "gcc-12.2.0-1.cm2.x86_64"})
+	assert.ErrorContains(t, err, "post-clone hook failed")
+
+	warningCloner := newPostCloneHookCloner(&fakeCloner{outDir: outDir}, "false", false, outDir)
+	_, _, err = warningCloner.CloneAndListPackages(context.Background(), false, &pkgjson.PackageVer{Name: "make-4.3-1.cm2.x86_64"})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,367 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/tdnf"
+)
+
+// Supported values of '--preview-repo-priority'.
+const (
+	previewRepoPriorityNormal   = "normal"
+	previewRepoPriorityFallback = "fallback"
+)
+
+// Constructors of the network and the local-only cloners.
+var (
+	newCloner      = rpmrepocloner.ConstructCloner
+	newLocalCloner = rpmrepocloner.ConstructLocalCloner
+)
+
+// writeInlineRepoFile writes the '--repo-url' definitions into a single repo file inside 'dir'.
+func writeInlineRepoFile(inlineRepos []string, dir string) (repoFile string, err error) {
+	const inlineRepoFileName = "inline.repo"
+
+	repoFileContents := strings.Builder{}
+	for _, inlineRepo := range inlineRepos {
+		var repoDefinition string
+		repoDefinition, err = formatInlineRepo(inlineRepo)
+		if err != nil {
+			return
+		}
+		repoFileContents.WriteString(repoDefinition)
+	}
+
+	repoFile = filepath.Join(dir, inlineRepoFileName)
+	err = file.Write(repoFileContents.String(), repoFile)
+	return
+}
+
+// formatInlineRepo turns a comma separated list of "key=value" repo options into a repo file section.
+// The "id" key names the section and either "baseurl", "metalink" or "mirrorlist" is required. All other keys
+// are passed through as repo options.
+func formatInlineRepo(inlineRepo string) (repoDefinition string, err error) {
+	const (
+		idKey      = "id"
+		nameKey    = "name"
+		enabledKey = "enabled"
+	)
+
+	repoID := ""
+	hasLocation := false
+	options := []string{}
+	optionKeys := make(map[string]bool)
+	for _, option := range strings.Split(inlineRepo, ",") {
+		key, value, found := strings.Cut(option, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !found || key == "" || value == "" {
+			return "", fmt.Errorf("invalid option (%s) in inline repo (%s), expected 'key=value'", option, inlineRepo)
+		}
+		if optionKeys[key] {
+			return "", fmt.Errorf("option (%s) is set more than once in inline repo (%s)", key, inlineRepo)
+		}
+		optionKeys[key] = true
+
+		if key == idKey {
+			repoID = value
+			continue
+		}
+		if tdnf.RepoURLRegex.MatchString(option) {
+			hasLocation = true
+		}
+		options = append(options, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	if repoID == "" {
+		return "", fmt.Errorf("inline repo (%s) has no '%s'", inlineRepo, idKey)
+	}
+	if !hasLocation {
+		return "", fmt.Errorf("inline repo (%s) has no 'baseurl', 'metalink' or 'mirrorlist'", inlineRepo)
+	}
+
+	if !optionKeys[nameKey] {
+		options = append([]string{fmt.Sprintf("%s=%s", nameKey, repoID)}, options...)
+	}
+	if !optionKeys[enabledKey] {
+		options = append(options, fmt.Sprintf("%s=1", enabledKey))
+	}
+
+	repoDefinition = fmt.Sprintf("[%s]\n%s\n\n", repoID, strings.Join(options, "\n"))
+	return
+}
+
+func setupCloner() (cloner *rpmrepocloner.RpmRepoCloner, err error) {
+	if *replayFile != "" && *recordFile != "" {
+		return nil, fmt.Errorf("'--record-file' can't be used together with '--replay-file'")
+	}
+
+	if *staleTmpAge > 0 {
+		_, err = rpmrepocloner.SweepStaleTmpDir(*tmpDir, *staleTmpAge)
+		if err != nil {
+			return
+		}
+	}
+
+	// Replayed runs never access the repos, only the local RPMs are needed.
+	if *replayFile != "" {
+		cloner, err = newLocalCloner(*outDir, *tmpDir, *workertar, *existingRpmDir, *existingToolchainRpmDir)
+		if err != nil {
+			err = fmt.Errorf("failed to setup new local cloner:\n%w", err)
+		}
+		return
+	}
+
+	if *offline {
+		err = checkOfflineFlags()
+		if err != nil {
+			return
+		}
+
+		cloner, err = newLocalCloner(*outDir, *tmpDir, *workertar, *existingRpmDir, *existingToolchainRpmDir)
+		if err != nil {
+			err = fmt.Errorf("failed to setup new local cloner:\n%w", err)
+		}
+		return
+	}
+
+	tlsIdentity, err := tlsClientIdentityFromEnv(*tlsClientCert, *tlsClientKey, *tlsCertEnv, *tlsKeyEnv)
+	if err != nil {
+		return
+	}
+
+	proxy, err := rpmrepocloner.NewProxyConfig(*httpProxy, *httpsProxy, *noProxy)
+	if err != nil {
+		return
+	}
+
+	repoDefinitions := *repoFiles
+	if len(*repoURLs) > 0 {
+		var inlineRepoDir string
+		inlineRepoDir, err = os.MkdirTemp(*tmpDir, "inlinerepos")
+		if err != nil {
+			return
+		}
+		// The cloner copies the definitions into its chroot, the file is not needed afterwards.
+		defer os.RemoveAll(inlineRepoDir)
+
+		var inlineRepoFile string
+		inlineRepoFile, err = writeInlineRepoFile(*repoURLs, inlineRepoDir)
+		if err != nil {
+			err = fmt.Errorf("failed to create inline repo definitions:\n%w", err)
+			return
+		}
+		repoDefinitions = append(repoDefinitions, inlineRepoFile)
+	}
+
+	var metadataCache *rpmrepocloner.MetadataCache
+	if *metadataCacheDir != "" {
+		metadataCache = &rpmrepocloner.MetadataCache{
+			Dir:          *metadataCacheDir,
+			MaxAge:       *metadataMaxAge,
+			ForceRefresh: *refreshMetadata,
+		}
+	}
+
+	// Create the worker environment
+	cloner, err = newCloner(*outDir, *tmpDir, *workertar, *existingRpmDir, *existingToolchainRpmDir, *tlsClientCert, *tlsClientKey, *caBundle, repoDefinitions, !*noRepoTemplate, *rpmmdSnapshotDir, *maxMetadataRefresh, metadataCache)
+	if err != nil {
+		err = fmt.Errorf("failed to setup new cloner:\n%w", err)
+		return
+	}
+
+	enabledRepos := rpmrepocloner.RepoFlagAll
+	if !*usePreviewRepo && *previewRepoPriority != previewRepoPriorityFallback {
+		enabledRepos = enabledRepos & ^rpmrepocloner.RepoFlagPreview
+	}
+	if *disableUpstreamRepos {
+		enabledRepos = enabledRepos & ^rpmrepocloner.RepoFlagUpstream
+	}
+	if *disableDefaultRepos {
+		enabledRepos = enabledRepos & ^rpmrepocloner.RepoFlagMarinerDefaults
+	}
+	cloner.SetEnabledRepos(enabledRepos)
+
+	if tlsIdentity != nil {
+		err = cloner.SetTLSClientIdentity(tlsIdentity)
+		if err != nil {
+			cloner.Close()
+			cloner = nil
+			return
+		}
+	}
+
+	// Must precede the mirrors, so they are probed through the proxies.
+	if proxy.IsEnabled() {
+		err = cloner.SetProxy(proxy)
+		if err != nil {
+			err = fmt.Errorf("failed to configure the proxies:\n%w", err)
+			cloner.Close()
+			cloner = nil
+			return
+		}
+	}
+
+	if *repoMirrorsFile != "" {
+		err = setRepoMirrors(cloner, *repoMirrorsFile)
+		if err != nil {
+			cloner.Close()
+			cloner = nil
+			return
+		}
+	}
+
+	if len(*repoPriorities) > 0 {
+		err = setRepoPriorities(cloner, *repoPriorities)
+		if err != nil {
+			cloner.Close()
+			cloner = nil
+			return
+		}
+	}
+
+	// Must follow the '--repo-priority' values to rank the preview repo below all of them.
+	if *previewRepoPriority == previewRepoPriorityFallback {
+		err = cloner.UsePreviewRepoAsFallback()
+		if err != nil {
+			err = fmt.Errorf("failed to lower the priority of the preview repo:\n%w", err)
+			cloner.Close()
+			cloner = nil
+			return
+		}
+	}
+
+	if *maxBandwidth > 0 {
+		err = cloner.SetMaxDownloadBandwidth(int64(*maxBandwidth))
+		if err != nil {
+			err = fmt.Errorf("failed to limit the download bandwidth:\n%w", err)
+			cloner.Close()
+			cloner = nil
+		}
+	}
+	return
+}
+
+// setRepoPriorities parses the '--repo-priority' values and applies them to the cloner.
+func setRepoPriorities(cloner *rpmrepocloner.RpmRepoCloner, priorityFlags map[string]string) (err error) {
+	priorities, err := parseRepoPriorities(priorityFlags)
+	if err != nil {
+		return
+	}
+
+	err = cloner.SetRepoPriorities(priorities)
+	if err != nil {
+		return fmt.Errorf("failed to set the repo priorities:\n%w", err)
+	}
+	return
+}
+
+// parseRepoPriorities converts the '--repo-priority' values into integer priorities keyed by repo ID.
+func parseRepoPriorities(priorityFlags map[string]string) (priorities map[string]int, err error) {
+	priorities = make(map[string]int, len(priorityFlags))
+	for repoID, value := range priorityFlags {
+		var priority int
+
+		priority, err = strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority '%s' for repo (%s):\n%w", value, repoID, err)
+		}
+		priorities[strings.TrimSpace(repoID)] = priority
+	}
+	return
+}
+
+// checkOfflineFlags fails if '--offline' is combined with flags which configure remote repos or downloads.
+func checkOfflineFlags() (err error) {
+	networkFlags := []struct {
+		name string
+		set  bool
+	}{
+		{"--repo-file", len(*repoFiles) > 0},
+		{"--repo-url", len(*repoURLs) > 0},
+		{"--repo-mirrors-file", *repoMirrorsFile != ""},
+		{"--repo-priority", len(*repoPriorities) > 0},
+		{"--use-preview-repo", *usePreviewRepo},
+		{"--preview-repo-priority", *previewRepoPriority == previewRepoPriorityFallback},
+		{"--rpmmd-snapshot-dir", *rpmmdSnapshotDir != ""},
+		{"--oci-repo", *ociRepo != ""},
+		{"--tls-cert", strings.TrimSpace(*tlsClientCert) != ""},
+		{"--tls-key", strings.TrimSpace(*tlsClientKey) != ""},
+		{"--tls-cert-env", *tlsCertEnv != ""},
+		{"--tls-key-env", *tlsKeyEnv != ""},
+		{"--ca-bundle", strings.TrimSpace(*caBundle) != ""},
+		{"--http-proxy", *httpProxy != ""},
+		{"--https-proxy", *httpsProxy != ""},
+		{"--max-bandwidth", *maxBandwidth > 0},
+		{"--try-download-delta-rpms", *tryDownloadDeltaRPMs},
+	}
+
+	conflictingFlags := []string{}
+	for _, flag := range networkFlags {
+		if flag.set {
+			conflictingFlags = append(conflictingFlags, fmt.Sprintf("'%s'", flag.name))
+		}
+	}
+
+	if len(conflictingFlags) > 0 {
+		return fmt.Errorf("'--offline' can't be used together with %s", strings.Join(conflictingFlags, ", "))
+	}
+	return
+}
+
+// tlsClientIdentityFromEnv reads the TLS client certificate and key from the environment variables named by 'certEnv'
+// and 'keyEnv'. Returns nil if neither is set. Client certificates may either come from files or from the environment.
+func tlsClientIdentityFromEnv(certFile, keyFile, certEnv, keyEnv string) (identity *rpmrepocloner.TLSClientIdentity, err error) {
+	certEnv, keyEnv = strings.TrimSpace(certEnv), strings.TrimSpace(keyEnv)
+	if certEnv == "" && keyEnv == "" {
+		return
+	}
+
+	if certEnv == "" || keyEnv == "" {
+		return nil, fmt.Errorf("'--tls-cert-env' and '--tls-key-env' must be used together")
+	}
+
+	if strings.TrimSpace(certFile) != "" || strings.TrimSpace(keyFile) != "" {
+		return nil, fmt.Errorf("'--tls-cert' and '--tls-key' can't be used together with '--tls-cert-env' and '--tls-key-env'")
+	}
+
+	certPEM, found := os.LookupEnv(certEnv)
+	if !found || strings.TrimSpace(certPEM) == "" {
+		return nil, fmt.Errorf("environment variable '%s' with the TLS client certificate is not set", certEnv)
+	}
+
+	keyPEM, found := os.LookupEnv(keyEnv)
+	if !found || strings.TrimSpace(keyPEM) == "" {
+		return nil, fmt.Errorf("environment variable '%s' with the TLS client key is not set", keyEnv)
+	}
+
+	identity, err = rpmrepocloner.NewTLSClientIdentity([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS client identity from '%s' and '%s':\n%w", certEnv, keyEnv, err)
+	}
+	return
+}
+
+// setRepoMirrors configures the cloner with the mirrors from a JSON file mapping repo IDs to lists of base URLs.
+func setRepoMirrors(cloner *rpmrepocloner.RpmRepoCloner, mirrorsFile string) (err error) {
+	mirrors := map[string][]string{}
+	err = jsonutils.ReadJSONFile(mirrorsFile, &mirrors)
+	if err != nil {
+		return fmt.Errorf("failed to read repo mirrors from '%s':\n%w", mirrorsFile, err)
+	}
+
+	err = cloner.SetRepoMirrors(mirrors)
+	if err != nil {
+		return fmt.Errorf("failed to configure repo mirrors from '%s':\n%w", mirrorsFile, err)
+	}
+	return
+}
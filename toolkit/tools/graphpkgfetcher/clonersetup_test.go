@@ -0,0 +1,149 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldFormatInlineRepo(t *testing.T) {
+	repoDefinition, err := formatInlineRepo("id=mirror, baseurl=https://example.com/repo/$basearch ,priority=10")
+	assert.NoError(t, err)
+	assert.Equal(t, "[mirror]\nname=mirror\nbaseurl=https://example.com/repo/$basearch\npriority=10\nenabled=1\n\n", repoDefinition)
+
+	repoDefinition, err = formatInlineRepo("id=mirror,name=My mirror,metalink=https://example.com/metalink,enabled=0")
+	assert.NoError(t, err)
+	assert.Equal(t, "[mirror]\nname=My mirror\nmetalink=https://example.com/metalink\nenabled=0\n\n", repoDefinition)
+}
+
+func TestShouldRejectInvalidInlineRepos(t *testing.T) {
+	for _, inlineRepo := range []string{
+		"baseurl=https://example.com/repo",
+		"id=mirror",
+		"id=mirror,baseurl",
+		"id=mirror,baseurl=https://example.com/a,baseurl=https://example.com/b",
+	} {
+		_, err := formatInlineRepo(inlineRepo)
+		assert.Error(t, err, inlineRepo)
+	}
+}
+
+// newTestTLSClientIdentity creates a self-signed client certificate for 'commonName' and its key, PEM encoded.
+func newTestTLSClientIdentity(t *testing.T, commonName string) (certPEM, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return
+}
+
+func TestShouldLoadTLSClientIdentityFromEnv(t *testing.T) {
+	certPEM, keyPEM := newTestTLSClientIdentity(t, "ci-client")
+	t.Setenv("TEST_TLS_CERT", certPEM)
+	t.Setenv("TEST_TLS_KEY", keyPEM)
+
+	identity, err := tlsClientIdentityFromEnv("", "", "TEST_TLS_CERT", "TEST_TLS_KEY")
+	assert.NoError(t, err)
+	if assert.NotNil(t, identity) {
+		assert.Equal(t, "ci-client", identity.Certificate.Subject.CommonName)
+	}
+
+	identity, err = tlsClientIdentityFromEnv("", "", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, identity)
+}
+
+func TestShouldRejectInvalidTLSClientIdentityFlags(t *testing.T) {
+	certPEM, keyPEM := newTestTLSClientIdentity(t, "ci-client")
+	_, otherKeyPEM := newTestTLSClientIdentity(t, "other-client")
+	t.Setenv("TEST_TLS_CERT", certPEM)
+	t.Setenv("TEST_TLS_KEY", keyPEM)
+	t.Setenv("TEST_TLS_OTHER_KEY", otherKeyPEM)
+	t.Setenv("TEST_TLS_EMPTY", "")
+
+	_, err := tlsClientIdentityFromEnv("", "", "TEST_TLS_CERT", "")
+	assert.ErrorContains(t, err, "must be used together")
+
+	_, err = tlsClientIdentityFromEnv("/certs/client.crt", "/certs/client.key", "TEST_TLS_CERT", "TEST_TLS_KEY")
+	assert.ErrorContains(t, err, "can't be used together")
+
+	_, err = tlsClientIdentityFromEnv("", "", "TEST_TLS_CERT", "TEST_TLS_EMPTY")
+	assert.ErrorContains(t, err, "'TEST_TLS_EMPTY' with the TLS client key is not set")
+
+	_, err = tlsClientIdentityFromEnv("", "", "TEST_TLS_CERT", "TEST_TLS_OTHER_KEY")
+	assert.ErrorContains(t, err, "invalid TLS client certificate or key")
+}
+
+func TestShouldParseRepoPriorities(t *testing.T) {
+	priorities, err := parseRepoPriorities(map[string]string{"internal": "10", "upstream": " 90 "})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"internal": 10, "upstream": 90}, priorities)
+
+	_, err = parseRepoPriorities(map[string]string{"internal": "high"})
+	assert.ErrorContains(t, err, "invalid priority 'high' for repo (internal)")
+}
+
+func TestShouldOnlyConstructLocalClonerOffline(t *testing.T) {
+	oldOffline, oldNewCloner, oldNewLocalCloner := *offline, newCloner, newLocalCloner
+	defer func() {
+		*offline, newCloner, newLocalCloner = oldOffline, oldNewCloner, oldNewLocalCloner
+	}()
+	*offline = true
+
+	networkClonerBuilt := false
+	newCloner = func(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir, tlsCert, tlsKey, caBundle string, repoDefinitions []string, expandRepoTemplates bool, rpmmdSnapshotDir string, maxMetadataRefreshPerHost int, metadataCache *rpmrepocloner.MetadataCache) (*rpmrepocloner.RpmRepoCloner, error) {
+		networkClonerBuilt = true
+		return nil, fmt.Errorf("network cloner constructed")
+	}
+	localClonerBuilt := false
+	newLocalCloner = func(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir string) (*rpmrepocloner.RpmRepoCloner, error) {
+		localClonerBuilt = true
+		return &rpmrepocloner.RpmRepoCloner{}, nil
+	}
+
+	cloner, err := setupCloner()
+	assert.NoError(t, err)
+	assert.NotNil(t, cloner)
+	assert.True(t, localClonerBuilt)
+	assert.False(t, networkClonerBuilt)
+}
+
+func TestShouldRejectNetworkFlagsOffline(t *testing.T) {
+	oldRepoURLs, oldCABundle := *repoURLs, *caBundle
+	defer func() {
+		*repoURLs, *caBundle = oldRepoURLs, oldCABundle
+	}()
+
+	assert.NoError(t, checkOfflineFlags())
+
+	*repoURLs, *caBundle = []string{"https://packages.example.com/base"}, "/certs/ca.pem"
+	err := checkOfflineFlags()
+	assert.EqualError(t, err, "'--offline' can't be used together with '--repo-url', '--ca-bundle'")
+}
@@ -0,0 +1,280 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
+)
+
+// resolveCompetingPackagesGlobally runs the competing packages resolution over the union of all candidates fetched for
+// any node, so the chosen RPMs form a set which can be installed together. Cached nodes whose RPM would not be installed
+// are re-assigned to an RPM from the installable set providing the same name, if there is one.
+func resolveCompetingPackagesGlobally(dependencyGraph *pkggraph.PkgGraph, fetchedPackages map[string]bool, outDir string) (err error) {
+	timestamp.StartEvent("global competing resolution", nil)
+	defer timestamp.StopEvent(nil)
+
+	candidatePaths := []string{}
+	for _, fetchedPackage := range sliceutils.SetToSlice(fetchedPackages) {
+		rpmPath := rpmPackageToRPMPath(fetchedPackage, outDir)
+		exists, err := file.PathExists(rpmPath)
+		if err != nil {
+			return err
+		}
+		if exists {
+			candidatePaths = append(candidatePaths, rpmPath)
+		}
+	}
+
+	if len(candidatePaths) < 2 {
+		return
+	}
+	sort.Strings(candidatePaths)
+
+	logger.Log.Infof("Resolving competing packages across %d candidate(s).", len(candidatePaths))
+	resolvedRPMs, err := rpm.ResolveCompetingPackages(*tmpDir, candidatePaths...)
+	if err != nil {
+		return
+	}
+	sort.Strings(resolvedRPMs)
+
+	resolvedPaths := make(map[string]bool)
+	for _, resolvedRPM := range resolvedRPMs {
+		resolvedPaths[rpmPackageToRPMPath(resolvedRPM, outDir)] = true
+	}
+
+	// Lazily built index of the capabilities provided by each installable RPM.
+	var providesIndex map[string][]providingRPM
+	for _, n := range dependencyGraph.AllRunNodes() {
+		if n.State != pkggraph.StateCached || resolvedPaths[n.RpmPath] || filepath.Dir(n.RpmPath) != filepath.Clean(outDir) {
+			continue
+		}
+
+		if providesIndex == nil {
+			providesIndex = buildProvidesIndex(resolvedRPMs, outDir)
+		}
+
+		replacement, found := selectReplacement(providesIndex[n.VersionedPkg.Name], n.VersionedPkg)
+		if !found {
+			logger.Log.Warnf("'%s' for '%v' competes with other packages, but no installable alternative provides it.", filepath.Base(n.RpmPath), n.VersionedPkg)
+			continue
+		}
+
+		logger.Log.Infof("Globally consistent resolution replaces '%s' with '%s' to provide '%v'.", filepath.Base(n.RpmPath), filepath.Base(replacement), n.VersionedPkg)
+		n.RpmPath = replacement
+	}
+
+	return
+}
+
+// providingRPM is an RPM providing a capability, along with the provided version.
+type providingRPM struct {
+	rpmPath string
+	provide *pkgjson.PackageVer
+}
+
+// buildProvidesIndex maps each capability name provided by the RPMs to the RPMs providing it.
+func buildProvidesIndex(rpmPackages []string, outDir string) (providesIndex map[string][]providingRPM) {
+	providesIndex = make(map[string][]providingRPM)
+	for _, rpmPackage := range rpmPackages {
+		rpmPath := rpmPackageToRPMPath(rpmPackage, outDir)
+		packageInfo, err := rpm.ReadPackageHeader(rpmPath)
+		if err != nil {
+			logger.Log.Warnf("Failed to read the provides of '%s': %s", rpmPath, err)
+			continue
+		}
+
+		for _, provide := range packageInfo.Provides {
+			providedVer := capabilityToPackageVer(provide)
+			providesIndex[providedVer.Name] = append(providesIndex[providedVer.Name], providingRPM{rpmPath: rpmPath, provide: providedVer})
+		}
+	}
+
+	return
+}
+
+// selectReplacement returns the highest versioned RPM among 'providers' whose provide matches the version constraint
+// of 'pkgVer'.
+func selectReplacement(providers []providingRPM, pkgVer *pkgjson.PackageVer) (rpmPath string, found bool) {
+	var highestVersion string
+	for _, provider := range providers {
+		if !isCapabilityProvided([]*pkgjson.PackageVer{provider.provide}, pkgVer) {
+			logger.Log.Debugf("'%s' provides '%v', which doesn't satisfy '%v'.", filepath.Base(provider.rpmPath), provider.provide, pkgVer)
+			continue
+		}
+
+		version := packageVersionFromRPM(filepath.Base(provider.rpmPath))
+		if !found || rpm.CompareVersions(version, highestVersion) > 0 {
+			rpmPath, highestVersion, found = provider.rpmPath, version, true
+		}
+	}
+
+	return
+}
+
+// expandRuntimeClosure fetches packages until every runtime requirement of every RPM in the clone directory is
+// provided by another RPM in the clone directory. Fails if some requirements cannot be fetched.
+func expandRuntimeClosure(cloner *rpmrepocloner.RpmRepoCloner) (err error) {
+	const cloneDeps = true
+
+	timestamp.StartEvent("compute full closure", nil)
+	defer timestamp.StopEvent(nil)
+
+	var (
+		provided         = make(map[string][]*pkgjson.PackageVer)
+		requires         = make(map[string][]string)
+		unfetchableReqs  = make(map[string]bool)
+		previousRPMCount = -1
+	)
+
+	for iteration := 1; ; iteration++ {
+		var rpmPaths []string
+
+		rpmPaths, err = filepath.Glob(filepath.Join(cloner.CloneDirectory(), "*.rpm"))
+		if err != nil {
+			return
+		}
+
+		// Stop once fetching the missing requirements no longer adds any packages.
+		if len(rpmPaths) == previousRPMCount {
+			break
+		}
+		previousRPMCount = len(rpmPaths)
+
+		for _, rpmPath := range rpmPaths {
+			if _, found := requires[rpmPath]; found {
+				continue
+			}
+
+			var packageInfo *rpm.PackageInfo
+			packageInfo, err = rpm.ReadPackageHeader(rpmPath)
+			if err != nil {
+				return fmt.Errorf("failed to read the header of '%s':\n%w", rpmPath, err)
+			}
+			addRuntimeClosureEntries(rpmPath, packageInfo, provided, requires)
+		}
+
+		missingReqs := findMissingRequirements(requires, provided)
+		logger.Log.Infof("Full closure pass %d: %d package(s), %d missing requirement(s).", iteration, len(rpmPaths), len(missingReqs))
+		if len(missingReqs) == 0 {
+			return
+		}
+
+		for _, missingReq := range missingReqs {
+			if unfetchableReqs[missingReq] {
+				continue
+			}
+
+			// The version constraint is checked again in the next pass, once the latest provider has been fetched.
+			missingReqName := strings.Fields(missingReq)[0]
+			_, cloneErr := cloner.CloneRawPackageNames(cloneDeps, missingReqName)
+			if cloneErr != nil {
+				logger.Log.Debugf("Failed to fetch a package providing '%s':\n%s", missingReq, cloneErr)
+				unfetchableReqs[missingReq] = true
+			}
+		}
+	}
+
+	missingReqs := findMissingRequirements(requires, provided)
+	if len(missingReqs) > 0 {
+		err = fmt.Errorf("runtime requirements not provided by any fetched package: %v", missingReqs)
+	}
+
+	return
+}
+
+// addRuntimeClosureEntries records the provides, including the files, and the requires of a single RPM.
+func addRuntimeClosureEntries(rpmPath string, packageInfo *rpm.PackageInfo, provided map[string][]*pkgjson.PackageVer, requires map[string][]string) {
+	const (
+		rpmlibPrefix   = "rpmlib("
+		richDepsPrefix = "("
+	)
+
+	for _, provide := range packageInfo.Provides {
+		providedVer := capabilityToPackageVer(provide)
+		provided[providedVer.Name] = append(provided[providedVer.Name], providedVer)
+	}
+	for _, providedFile := range packageInfo.Files {
+		provided[providedFile] = append(provided[providedFile], &pkgjson.PackageVer{Name: providedFile})
+	}
+
+	// Always create the entry to mark the RPM as processed.
+	requires[rpmPath] = []string{}
+	for _, require := range packageInfo.Requires {
+		// Features of RPM itself and rich dependencies are left for TDNF to verify.
+		if strings.HasPrefix(require, rpmlibPrefix) || strings.HasPrefix(require, richDepsPrefix) {
+			continue
+		}
+
+		if strings.TrimSpace(require) != "" {
+			requires[rpmPath] = append(requires[rpmPath], require)
+		}
+	}
+}
+
+// capabilityToPackageVer parses a capability (e.g. "glibc >= 2.35"). Capabilities which don't parse are
+// treated as unversioned.
+func capabilityToPackageVer(capability string) (pkgVer *pkgjson.PackageVer) {
+	pkgVer, err := pkgjson.PackageStringToPackageVer(capability)
+	if err != nil {
+		logger.Log.Debugf("Ignoring the version of capability '%s': %s", capability, err)
+		pkgVer = &pkgjson.PackageVer{Name: strings.Fields(capability)[0]}
+	}
+	return
+}
+
+// isCapabilityProvided returns true if any of the 'provides' of the required capability's name matches its version
+// constraint. Unversioned provides match any constraint.
+func isCapabilityProvided(provides []*pkgjson.PackageVer, required *pkgjson.PackageVer) bool {
+	requiredInterval, err := required.Interval()
+	if err != nil {
+		logger.Log.Warnf("Not checking the version of requirement '%v': %s", required, err)
+		return len(provides) > 0
+	}
+
+	for _, provide := range provides {
+		providedInterval, err := provide.Interval()
+		if err != nil {
+			logger.Log.Warnf("Ignoring invalid provide '%v': %s", provide, err)
+			continue
+		}
+		if providedInterval.Satisfies(&requiredInterval) {
+			return true
+		}
+	}
+	return false
+}
+
+// findMissingRequirements returns the sorted list of requirements not matched by any of the 'provided' capabilities.
+func findMissingRequirements(requires map[string][]string, provided map[string][]*pkgjson.PackageVer) (missingReqs []string) {
+	missingReqsSet := make(map[string]bool)
+	for _, rpmRequires := range requires {
+		for _, require := range rpmRequires {
+			if missingReqsSet[require] {
+				continue
+			}
+
+			requiredVer := capabilityToPackageVer(require)
+			if !isCapabilityProvided(provided[requiredVer.Name], requiredVer) {
+				missingReqsSet[require] = true
+			}
+		}
+	}
+
+	missingReqs = sliceutils.SetToSlice(missingReqsSet)
+	sort.Strings(missingReqs)
+
+	return
+}
@@ -0,0 +1,79 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldMatchRuntimeRequirementsAgainstFilesAndVersions(t *testing.T) {
+	provided := make(map[string][]*pkgjson.PackageVer)
+	requires := make(map[string][]string)
+
+	addRuntimeClosureEntries("/out/app-1.0-1.cm2.x86_64.rpm", &rpm.PackageInfo{
+		Provides: []string{"app = 1.0-1.cm2"},
+		Requires: []string{"/bin/sh", "/usr/bin/python3", "zlib >= 1.3", "glibc >= 2.35", "rpmlib(CompressedFileNames) <= 3.0.4-1", "(bash or zsh)"},
+	}, provided, requires)
+	addRuntimeClosureEntries("/out/bash-5.1.8-2.cm2.x86_64.rpm", &rpm.PackageInfo{
+		Provides: []string{"bash = 5.1.8-2.cm2"},
+		Files:    []string{"/bin/sh", "/usr/bin/bash"},
+	}, provided, requires)
+	addRuntimeClosureEntries("/out/zlib-1.2.13-1.cm2.x86_64.rpm", &rpm.PackageInfo{
+		Provides: []string{"zlib = 1.2.13-1.cm2"},
+	}, provided, requires)
+	addRuntimeClosureEntries("/out/glibc-2.35-3.cm2.x86_64.rpm", &rpm.PackageInfo{
+		Provides: []string{"glibc = 2.35-3.cm2"},
+	}, provided, requires)
+
+	assert.Equal(t, []string{"/usr/bin/python3", "zlib >= 1.3"}, findMissingRequirements(requires, provided))
+
+	addRuntimeClosureEntries("/out/zlib-1.3-1.cm2.x86_64.rpm", &rpm.PackageInfo{
+		Provides: []string{"zlib = 1.3-1.cm2"},
+	}, provided, requires)
+	assert.Equal(t, []string{"/usr/bin/python3"}, findMissingRequirements(requires, provided))
+}
+
+func TestShouldReplaceWithHighestProviderMatchingTheNodesVersion(t *testing.T) {
+	providers := []providingRPM{
+		{rpmPath: "/out/zlib-1.2.13-1.cm2.x86_64.rpm", provide: &pkgjson.PackageVer{Name: "zlib", Condition: "=", Version: "1.2.13-1.cm2"}},
+		{rpmPath: "/out/zlib-1.3-2.cm2.x86_64.rpm", provide: &pkgjson.PackageVer{Name: "zlib", Condition: "=", Version: "1.3-2.cm2"}},
+		{rpmPath: "/out/zlib-1.3-10.cm2.x86_64.rpm", provide: &pkgjson.PackageVer{Name: "zlib", Condition: "=", Version: "1.3-10.cm2"}},
+		{rpmPath: "/out/zlib-2.0-1.cm2.x86_64.rpm", provide: &pkgjson.PackageVer{Name: "zlib", Condition: "=", Version: "2.0-1.cm2"}},
+	}
+
+	replacement, found := selectReplacement(providers, &pkgjson.PackageVer{Name: "zlib"})
+	assert.True(t, found)
+	assert.Equal(t, "/out/zlib-2.0-1.cm2.x86_64.rpm", replacement)
+
+	replacement, found = selectReplacement(providers, &pkgjson.PackageVer{Name: "zlib", Condition: "<", Version: "2.0"})
+	assert.True(t, found)
+	assert.Equal(t, "/out/zlib-1.3-10.cm2.x86_64.rpm", replacement)
+
+	replacement, found = selectReplacement(providers, &pkgjson.PackageVer{Name: "zlib", Condition: "=", Version: "1.2.13"})
+	assert.True(t, found)
+	assert.Equal(t, "/out/zlib-1.2.13-1.cm2.x86_64.rpm", replacement)
+
+	_, found = selectReplacement(providers, &pkgjson.PackageVer{Name: "zlib", Condition: ">=", Version: "3.0"})
+	assert.False(t, found)
+}
+
+func TestShouldIndexVersionedProvidesOfInstallableRPMs(t *testing.T) {
+	const headerFixturesDir = "../internal/rpm/testdata/headers"
+
+	providesIndex := buildProvidesIndex([]string{"header-1.0-1.cm2.x86_64", "missing-1.0-1.cm2.x86_64"}, headerFixturesDir)
+	assert.Len(t, providesIndex, 3)
+
+	fixturePath := filepath.Join(headerFixturesDir, "header-1.0-1.cm2.x86_64.rpm")
+	assert.Equal(t, []providingRPM{{rpmPath: fixturePath, provide: &pkgjson.PackageVer{Name: "header", Condition: "=", Version: "2:1.0-1.cm2"}}}, providesIndex["header"])
+
+	_, found := selectReplacement(providesIndex["header"], &pkgjson.PackageVer{Name: "header", Condition: ">=", Version: "2:1.0"})
+	assert.True(t, found)
+	_, found = selectReplacement(providesIndex["header"], &pkgjson.PackageVer{Name: "header", Condition: ">=", Version: "3:1.0"})
+	assert.False(t, found)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+)
+
+// validateGraph reads a graph file and checks it for structural problems. It never touches any package repositories.
+func validateGraph(graphFile string) (err error) {
+	dependencyGraph, err := pkggraph.ReadDOTGraphFile(graphFile)
+	if err != nil {
+		return fmt.Errorf("failed to read graph file '%s':\n%w", graphFile, err)
+	}
+
+	err = dependencyGraph.Validate()
+	if err != nil {
+		return
+	}
+
+	reportCycles(dependencyGraph)
+
+	logger.Log.Infof("Graph '%s' is valid (%d nodes).", graphFile, dependencyGraph.Nodes().Len())
+	return
+}
+
+// writeDependencyClosure writes the run nodes of the 'rootNames' packages and everything they depend on to 'outputFile'.
+func writeDependencyClosure(graphFile string, rootNames []string, outputFile string) (err error) {
+	dependencyGraph, err := pkggraph.ReadDOTGraphFile(graphFile)
+	if err != nil {
+		return fmt.Errorf("failed to read graph file '%s':\n%w", graphFile, err)
+	}
+
+	roots := []*pkggraph.PkgNode{}
+	for _, rootName := range rootNames {
+		lookupEntry, err := dependencyGraph.FindBestPkgNode(&pkgjson.PackageVer{Name: rootName})
+		if err != nil {
+			return fmt.Errorf("failed to find package '%s':\n%w", rootName, err)
+		}
+		if lookupEntry == nil {
+			return fmt.Errorf("no node in '%s' provides '%s'", graphFile, rootName)
+		}
+		roots = append(roots, lookupEntry.RunNode)
+	}
+
+	closure, err := dependencyGraph.DependencyClosure(roots)
+	if err != nil {
+		return
+	}
+
+	logger.Log.Infof("Dependency closure of %v has %d node(s).", rootNames, closure.Nodes().Len())
+	return pkggraph.WriteDOTGraphFile(closure, outputFile)
+}
+
+// printGraphDiff prints the node differences between the 'baselineFile' and the 'graphFile' graphs.
+func printGraphDiff(baselineFile, graphFile string) (err error) {
+	baselineGraph, err := pkggraph.ReadDOTGraphFile(baselineFile)
+	if err != nil {
+		return fmt.Errorf("failed to read graph file '%s':\n%w", baselineFile, err)
+	}
+
+	dependencyGraph, err := pkggraph.ReadDOTGraphFile(graphFile)
+	if err != nil {
+		return fmt.Errorf("failed to read graph file '%s':\n%w", graphFile, err)
+	}
+
+	diff := pkggraph.DiffGraphs(baselineGraph, dependencyGraph)
+	for _, line := range formatGraphDiff(diff) {
+		fmt.Println(line)
+	}
+
+	logger.Log.Infof("Graph '%s' has %d added, %d removed, and %d changed node(s) compared to '%s'.", graphFile, len(diff.Added), len(diff.Removed), len(diff.Changed), baselineFile)
+	return
+}
+
+// formatGraphDiff lists the added nodes with a '+' prefix, the removed ones with a '-' prefix,
+// and the changed ones with a '~' prefix followed by their old and new friendly names.
+func formatGraphDiff(diff pkggraph.GraphDiff) (lines []string) {
+	for _, node := range diff.Added {
+		lines = append(lines, fmt.Sprintf("+ %s", node.FriendlyName()))
+	}
+	for _, node := range diff.Removed {
+		lines = append(lines, fmt.Sprintf("- %s", node.FriendlyName()))
+	}
+	for _, change := range diff.Changed {
+		lines = append(lines, fmt.Sprintf("~ %s -> %s", change.Old.FriendlyName(), change.New.FriendlyName()))
+	}
+	return
+}
+
+// printGraphStats prints the census of a graph's nodes and edges.
+func printGraphStats(dependencyGraph *pkggraph.PkgGraph, graphFile string) {
+	fmt.Printf("Graph '%s':\n", graphFile)
+	for _, line := range formatGraphStats(dependencyGraph.Stats()) {
+		fmt.Println(line)
+	}
+}
+
+// formatGraphStats lists the number of nodes of each type and state, followed by the totals. Types and states without
+// any node are listed with a zero count, so tables of different graphs line up.
+func formatGraphStats(stats pkggraph.GraphStats) (lines []string) {
+	const rowFormat = "  %-16s %8d"
+
+	lines = append(lines, "By type:")
+	for nodeType := pkggraph.TypeUnknown + 1; nodeType < pkggraph.TypeMAX; nodeType++ {
+		lines = append(lines, fmt.Sprintf(rowFormat, nodeType, stats.NodesByType[nodeType]))
+	}
+
+	lines = append(lines, "By state:")
+	for nodeState := pkggraph.StateUnknown + 1; nodeState < pkggraph.StateMAX; nodeState++ {
+		lines = append(lines, fmt.Sprintf(rowFormat, nodeState, stats.NodesByState[nodeState]))
+	}
+
+	lines = append(lines, "Totals:")
+	lines = append(lines, fmt.Sprintf(rowFormat, "Nodes", stats.Nodes))
+	lines = append(lines, fmt.Sprintf(rowFormat, "Edges", stats.Edges))
+	return
+}
+
+// reportCycles logs the dependency cycles of the graph. Cycles do not make a graph invalid, the scheduler breaks them
+// before building, but an unexpected one usually points at a spec introducing a circular build dependency.
+func reportCycles(dependencyGraph *pkggraph.PkgGraph) {
+	const maxReportedCycles = 20
+
+	cycles := dependencyGraph.FindCycles()
+	for i, cycle := range cycles {
+		if i == maxReportedCycles {
+			logger.Log.Warnf("... and %d more cycle(s)", len(cycles)-maxReportedCycles)
+			break
+		}
+		logger.Log.Warnf("Dependency cycle: %s", pkggraph.FormatCycle(cycle))
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldFormatGraphDiff(t *testing.T) {
+	oldGraph := pkggraph.NewPkgGraph()
+	_, err := oldGraph.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "zlib"})
+	assert.NoError(t, err)
+	_, err = oldGraph.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "python2"})
+	assert.NoError(t, err)
+
+	newGraph := pkggraph.NewPkgGraph()
+	zlibNode, err := newGraph.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "zlib"})
+	assert.NoError(t, err)
+	zlibNode.State = pkggraph.StateCached
+	_, err = newGraph.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "python3"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"+ python3--REMOTE<Unresolved>",
+		"- python2--REMOTE<Unresolved>",
+		"~ zlib--REMOTE<Unresolved> -> zlib--REMOTE<Cached>",
+	}, formatGraphDiff(pkggraph.DiffGraphs(oldGraph, newGraph)))
+}
+
+func TestShouldFormatGraphStats(t *testing.T) {
+	lines := formatGraphStats(pkggraph.GraphStats{
+		Nodes:        3,
+		Edges:        2,
+		NodesByType:  map[pkggraph.NodeType]int{pkggraph.TypeRemoteRun: 3},
+		NodesByState: map[pkggraph.NodeState]int{pkggraph.StateUnresolved: 2, pkggraph.StateCached: 1},
+	})
+
+	assert.Contains(t, lines, "  Remote                  3")
+	assert.Contains(t, lines, "  Build                   0")
+	assert.Contains(t, lines, "  Unresolved              2")
+	assert.Contains(t, lines, "  Cached                  1")
+	assert.Equal(t, []string{"Totals:", "  Nodes                   3", "  Edges                   2"}, lines[len(lines)-3:])
+}
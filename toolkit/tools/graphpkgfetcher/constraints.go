@@ -0,0 +1,527 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
+)
+
+// versionPin pins a package to an exact "<version>-<release>.<dist>" on one or all architectures.
+type versionPin struct {
+	Name    string `json:"Name"`
+	Version string `json:"Version"`
+	Arch    string `json:"Arch,omitempty"` // Empty to pin the package on all architectures
+}
+
+// versionPinsContents is the format of the '--version-pins-file'.
+type versionPinsContents struct {
+	Pins []versionPin `json:"Pins"`
+}
+
+// versionPins maps package names to their pinned versions keyed by architecture, with "" for all architectures.
+type versionPins map[string]map[string]string
+
+// lockedPackage locks a node to the exact package it was resolved to.
+type lockedPackage struct {
+	Node  string `json:"Node"`  // The node's versioned package, as printed by 'pkgjson.PackageVer.String()'
+	NEVRA string `json:"NEVRA"` // "<name>-<version>-<release>.<dist>.<arch>" of the package
+}
+
+// lockFileContents is the format of the '--lock-file-out' and '--lock-file-in' files.
+type lockFileContents struct {
+	Packages     []lockedPackage `json:"Packages"`
+	Dependencies []string        `json:"Dependencies,omitempty"` // "<name>-<version>-<release>.<dist>.<arch>" of every RPM in the cache
+}
+
+// packageLock maps the nodes' versioned packages to the only packages they may be resolved to.
+// A node is locked to several packages if it was resolved differently in graphs of different architectures.
+type packageLock map[string]map[string]bool
+
+// repoPolicyContents is the format of the '--repo-policy-file'.
+type repoPolicyContents struct {
+	AllowedRepos map[string]string `json:"AllowedRepos"` // Package name glob -> ID of the only repo packages matching it may come from
+}
+
+// repoPolicy maps package name globs to the ID of the only repo packages matching them may be cloned from.
+type repoPolicy map[string]string
+
+// errLockedPackageUnavailable marks nodes whose package from '--lock-file-in' is not available, which fail the fetch even in best-effort mode.
+var errLockedPackageUnavailable = errors.New("locked package unavailable")
+
+// readVersionPins reads the '--version-pins-file'. Returns empty pins if 'path' is empty.
+func readVersionPins(path string) (pins versionPins, err error) {
+	pins = make(versionPins)
+	if strings.TrimSpace(path) == "" {
+		return
+	}
+
+	var pinsFile versionPinsContents
+	err = jsonutils.ReadJSONFile(path, &pinsFile)
+	if err != nil {
+		return
+	}
+
+	for _, pin := range pinsFile.Pins {
+		if pin.Name == "" || pin.Version == "" {
+			return nil, fmt.Errorf("invalid pin (%+v), both 'Name' and 'Version' are required", pin)
+		}
+
+		if pins[pin.Name] == nil {
+			pins[pin.Name] = make(map[string]string)
+		}
+
+		if previousVersion, found := pins[pin.Name][pin.Arch]; found && previousVersion != pin.Version {
+			return nil, fmt.Errorf("conflicting pins for '%s' (arch: '%s'): '%s' and '%s'", pin.Name, pin.Arch, previousVersion, pin.Version)
+		}
+		pins[pin.Name][pin.Arch] = pin.Version
+	}
+
+	logger.Log.Debugf("Read version pins for %d package(s) from '%s'.", len(pins), path)
+	return
+}
+
+// pinnedVersion returns the version a package is pinned to on 'arch'. Pins for the exact architecture
+// take precedence over pins for all architectures.
+func (p versionPins) pinnedVersion(name, arch string) (version string, found bool) {
+	archPins := p[name]
+	if archPins == nil {
+		return
+	}
+
+	version, found = archPins[arch]
+	if !found {
+		version, found = archPins[""]
+	}
+
+	return
+}
+
+// readLocalBuiltVersions returns the highest "<version>-<release>" of each package in the architecture
+// sub-directories of 'rpmDir'.
+func readLocalBuiltVersions(rpmDir string) (versions map[string]string, err error) {
+	rpmPaths, err := filepath.Glob(filepath.Join(rpmDir, "*", "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	versions = make(map[string]string)
+	for _, rpmPath := range rpmPaths {
+		rpmPackage := filepath.Base(rpmPath)
+		version := packageVersionFromRPM(rpmPackage)
+		if version == "" {
+			continue
+		}
+
+		name := packageNameFromRPM(rpmPackage)
+		if highestVersion, found := versions[name]; !found || rpm.CompareVersions(version, highestVersion) > 0 {
+			versions[name] = version
+		}
+	}
+	return
+}
+
+// rejectDowngrades drops all candidate packages "<name>-<version>-<release>.<dist>.<arch>" with a lower version than
+// the package of the same name in 'localVersions', e.g. because a repo serves a stale index. Candidates without a local
+// build are kept. Fails if all candidates would be downgrades.
+func rejectDowngrades(candidates []string, localVersions map[string]string) (keptCandidates []string, err error) {
+	if len(localVersions) == 0 {
+		return candidates, nil
+	}
+
+	rejectedCandidates := []string{}
+	for _, candidate := range candidates {
+		localVersion, found := localVersions[packageNameFromRPM(candidate)]
+		if found && rpm.CompareVersions(packageVersionFromRPM(candidate), localVersion) < 0 {
+			logger.Log.Warnf("Skipping '%s', it is a downgrade of the locally built version '%s'.", candidate, localVersion)
+			rejectedCandidates = append(rejectedCandidates, candidate)
+			continue
+		}
+
+		keptCandidates = append(keptCandidates, candidate)
+	}
+
+	if len(keptCandidates) == 0 {
+		err = fmt.Errorf("all candidates are older than the locally built packages: %v", rejectedCandidates)
+	}
+
+	return
+}
+
+// applyVersionPins drops all candidate packages "<name>-<version>-<release>.<dist>.<arch>" not matching their pin.
+// Candidates without a pin are kept. Fails if pins removed all candidates.
+func applyVersionPins(candidates []string, pins versionPins) (pinnedCandidates []string, err error) {
+	if len(pins) == 0 {
+		return candidates, nil
+	}
+
+	rejectedCandidates := []string{}
+	for _, candidate := range candidates {
+		if pinnedVersion, violated := violatesVersionPin(candidate, pins); violated {
+			logger.Log.Debugf("Skipping '%s', '%s' is pinned to version '%s'.", candidate, packageNameFromRPM(candidate), pinnedVersion)
+			rejectedCandidates = append(rejectedCandidates, candidate)
+			continue
+		}
+
+		pinnedCandidates = append(pinnedCandidates, candidate)
+	}
+
+	if len(pinnedCandidates) == 0 {
+		err = fmt.Errorf("none of the candidates match their pinned versions: %v", rejectedCandidates)
+	}
+
+	return
+}
+
+// violatesVersionPin returns true with the pinned version if the package "<name>-<version>-<release>.<dist>.<arch>"
+// is pinned to another version on its architecture.
+func violatesVersionPin(rpmPackage string, pins versionPins) (pinnedVersion string, violated bool) {
+	name := packageNameFromRPM(rpmPackage)
+	arch := rpmPackage[strings.LastIndex(rpmPackage, ".")+1:]
+
+	pinnedVersion, found := pins.pinnedVersion(name, arch)
+	if !found {
+		return
+	}
+
+	version := strings.TrimSuffix(strings.TrimPrefix(rpmPackage, name+"-"), "."+arch)
+	return pinnedVersion, version != pinnedVersion
+}
+
+// unpinnedPackagesIn returns the sorted RPM files among a node's 'clonedPackages' not matching their version pin.
+func unpinnedPackagesIn(clonedPackages map[string]string, pins versionPins) (unpinnedRPMs []string) {
+	for rpmFile := range clonedPackages {
+		if _, violated := violatesVersionPin(strings.TrimSuffix(rpmFile, ".rpm"), pins); violated {
+			unpinnedRPMs = append(unpinnedRPMs, rpmFile)
+		}
+	}
+
+	sort.Strings(unpinnedRPMs)
+	return
+}
+
+// unlockedPackagesIn returns the sorted RPM files among a node's 'clonedPackages' missing from 'lockedDependencies'.
+// Nothing is missing if 'lockedDependencies' is nil.
+func unlockedPackagesIn(clonedPackages map[string]string, lockedDependencies map[string]bool) (unlockedRPMs []string) {
+	if lockedDependencies == nil {
+		return
+	}
+
+	for rpmFile := range clonedPackages {
+		if !lockedDependencies[strings.TrimSuffix(rpmFile, ".rpm")] {
+			unlockedRPMs = append(unlockedRPMs, rpmFile)
+		}
+	}
+
+	sort.Strings(unlockedRPMs)
+	return
+}
+
+// readLockFile reads the '--lock-file-in'. Returns a nil lock if 'path' is empty, and nil 'lockedDependencies'
+// if the lock file doesn't list the dependencies.
+func readLockFile(path string) (lock packageLock, lockedDependencies map[string]bool, err error) {
+	if strings.TrimSpace(path) == "" {
+		return
+	}
+
+	var lockFile lockFileContents
+	err = jsonutils.ReadJSONFile(path, &lockFile)
+	if err != nil {
+		return
+	}
+
+	lock = make(packageLock)
+	for _, locked := range lockFile.Packages {
+		if locked.Node == "" || locked.NEVRA == "" {
+			return nil, nil, fmt.Errorf("invalid locked package (%+v), both 'Node' and 'NEVRA' are required", locked)
+		}
+
+		if lock[locked.Node] == nil {
+			lock[locked.Node] = make(map[string]bool)
+		}
+		lock[locked.Node][locked.NEVRA] = true
+	}
+
+	if len(lockFile.Dependencies) > 0 {
+		lockedDependencies = sliceutils.SliceToSet(lockFile.Dependencies)
+		for _, nevras := range lock {
+			for nevra := range nevras {
+				lockedDependencies[nevra] = true
+			}
+		}
+	} else {
+		logger.Log.Warnf("The lock file '%s' doesn't list the dependencies, only the nodes' packages are locked.", path)
+	}
+
+	logger.Log.Debugf("Read locked packages for %d node(s) from '%s'.", len(lock), path)
+	return
+}
+
+// graphPackageLock returns the packages all resolved remote and prebuilt nodes of 'dependencyGraphs' were resolved to.
+func graphPackageLock(dependencyGraphs ...*pkggraph.PkgGraph) (lock packageLock) {
+	lock = make(packageLock)
+	for _, dependencyGraph := range dependencyGraphs {
+		for _, n := range dependencyGraph.AllNodes() {
+			if n.Type != pkggraph.TypeRemoteRun && n.Type != pkggraph.TypePreBuilt {
+				continue
+			}
+			if n.State == pkggraph.StateUnresolved || n.RpmPath == "" || n.RpmPath == pkggraph.NoRPMPath {
+				continue
+			}
+
+			node := n.VersionedPkg.String()
+			if lock[node] == nil {
+				lock[node] = make(map[string]bool)
+			}
+			lock[node][strings.TrimSuffix(filepath.Base(n.RpmPath), ".rpm")] = true
+		}
+	}
+	return
+}
+
+// writeLockFile writes the package every resolved node of 'dependencyGraphs' was resolved to into 'outputFile',
+// sorted by node and package, along with every RPM in 'cloneDir' the nodes' clones may pull in.
+func writeLockFile(dependencyGraphs []*pkggraph.PkgGraph, cloneDir, outputFile string) (err error) {
+	lock := graphPackageLock(dependencyGraphs...)
+
+	rpmPaths, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	lockFile := lockFileContents{
+		Packages: []lockedPackage{},
+	}
+	for _, rpmPath := range rpmPaths {
+		lockFile.Dependencies = append(lockFile.Dependencies, strings.TrimSuffix(filepath.Base(rpmPath), ".rpm"))
+	}
+	for node, nevras := range lock {
+		for nevra := range nevras {
+			lockFile.Packages = append(lockFile.Packages, lockedPackage{Node: node, NEVRA: nevra})
+		}
+	}
+	sort.Slice(lockFile.Packages, func(i, j int) bool {
+		if lockFile.Packages[i].Node != lockFile.Packages[j].Node {
+			return lockFile.Packages[i].Node < lockFile.Packages[j].Node
+		}
+		return lockFile.Packages[i].NEVRA < lockFile.Packages[j].NEVRA
+	})
+
+	err = jsonutils.WriteJSONFile(outputFile, lockFile)
+	if err != nil {
+		return fmt.Errorf("failed to write '%s':\n%w", outputFile, err)
+	}
+
+	logger.Log.Infof("Wrote %d locked package(s) for %d node(s) to '%s'.", len(lockFile.Packages), len(lock), outputFile)
+	return
+}
+
+// applyPackageLock drops all candidate packages "<name>-<version>-<release>.<dist>.<arch>" the node providing 'pkgVer'
+// is not locked to. Nodes missing from the lock keep all their candidates. Fails if none of the locked packages
+// is among the candidates, e.g. because a repo dropped or replaced it.
+func applyPackageLock(pkgVer *pkgjson.PackageVer, candidates []string, lock packageLock) (lockedCandidates []string, err error) {
+	if lock == nil {
+		return candidates, nil
+	}
+
+	lockedNEVRAs, found := lock[pkgVer.String()]
+	if !found {
+		logger.Log.Warnf("'%v' is not in the lock file, resolving it to any of its candidates.", pkgVer)
+		return candidates, nil
+	}
+
+	for _, candidate := range candidates {
+		if lockedNEVRAs[candidate] {
+			lockedCandidates = append(lockedCandidates, candidate)
+			continue
+		}
+		logger.Log.Debugf("Skipping '%s', '%v' is locked to: %v.", candidate, pkgVer, sliceutils.SetToSlice(lockedNEVRAs))
+	}
+
+	if len(lockedCandidates) == 0 {
+		lockedPackages := sliceutils.SetToSlice(lockedNEVRAs)
+		sort.Strings(lockedPackages)
+		err = fmt.Errorf("%w: none of the candidates %v is a locked package %v", errLockedPackageUnavailable, candidates, lockedPackages)
+	}
+
+	return
+}
+
+// readRepoPolicy reads the '--repo-policy-file'. An empty path results in an empty policy.
+func readRepoPolicy(path string) (policy repoPolicy, err error) {
+	policy = make(repoPolicy)
+	if strings.TrimSpace(path) == "" {
+		return
+	}
+
+	var policyFile repoPolicyContents
+	err = jsonutils.ReadJSONFile(path, &policyFile)
+	if err != nil {
+		return
+	}
+
+	for pattern, repoID := range policyFile.AllowedRepos {
+		_, err = filepath.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid package name glob '%s':\n%w", pattern, err)
+		}
+		if strings.TrimSpace(repoID) == "" {
+			return nil, fmt.Errorf("no repo allowed for '%s'", pattern)
+		}
+		policy[pattern] = repoID
+	}
+
+	logger.Log.Debugf("Read repo restrictions for %d package glob(s) from '%s'.", len(policy), path)
+	return
+}
+
+// allowedRepo returns the only repo a package may come from. If several globs match the package, the longest one wins.
+func (p repoPolicy) allowedRepo(packageName string) (repoID string, restricted bool) {
+	longestPattern := ""
+	for pattern, patternRepoID := range p {
+		matches, _ := filepath.Match(pattern, packageName)
+		if !matches || len(pattern) < len(longestPattern) || (restricted && len(pattern) == len(longestPattern) && pattern > longestPattern) {
+			continue
+		}
+		longestPattern, repoID, restricted = pattern, patternRepoID, true
+	}
+	return
+}
+
+// applyRepoPolicy drops the candidates restricted by the policy to a repo which does not offer them. Candidates only
+// offered by the local toolchain, built, or cache repos are not restricted. Fails if no candidate is left.
+func applyRepoPolicy(ctx context.Context, cloner nodeCloner, pkgVer *pkgjson.PackageVer, candidates []string, policy repoPolicy) (allowedCandidates []string, err error) {
+	if len(policy) == 0 {
+		return candidates, nil
+	}
+
+	var (
+		packagesByRepo map[string][]string
+		rejections     []string
+	)
+	for _, candidate := range candidates {
+		allowedRepoID, restricted := policy.allowedRepo(packageNameFromRPM(candidate))
+		if !restricted {
+			allowedCandidates = append(allowedCandidates, candidate)
+			continue
+		}
+
+		// Only query the repos once a candidate is actually restricted, the query covers all enabled repos.
+		if packagesByRepo == nil {
+			packagesByRepo, err = cloner.WhatProvidesByRepo(ctx, pkgVer)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find the repos offering '%v':\n%w", pkgVer, err)
+			}
+		}
+
+		offeringRepos := []string{}
+		for repoID, repoPackages := range packagesByRepo {
+			if sliceutils.Contains(repoPackages, candidate, sliceutils.StringMatch) {
+				offeringRepos = append(offeringRepos, repoID)
+			}
+		}
+		sort.Strings(offeringRepos)
+
+		if len(offeringRepos) == 0 || sliceutils.Contains(offeringRepos, allowedRepoID, sliceutils.StringMatch) {
+			allowedCandidates = append(allowedCandidates, candidate)
+			continue
+		}
+
+		logger.Log.Warnf("Rejecting '%s', it may only come from repo '%s' but is offered by %v.", candidate, allowedRepoID, offeringRepos)
+		rejections = append(rejections, fmt.Sprintf("'%s' may only come from repo '%s' but is offered by %v", candidate, allowedRepoID, offeringRepos))
+	}
+
+	if len(allowedCandidates) == 0 {
+		return nil, fmt.Errorf("all packages providing '%v' are rejected by the repo policy: %s", pkgVer, strings.Join(rejections, "; "))
+	}
+	return
+}
+
+// readListFile reads a list of package or capability names, one per line. Empty lines and lines starting with '#'
+// are ignored. Returns an empty set if 'path' is empty.
+func readListFile(path string) (names map[string]bool, err error) {
+	names = make(map[string]bool)
+	if strings.TrimSpace(path) == "" {
+		return
+	}
+
+	lines, err := file.ReadLines(path)
+	if err != nil {
+		return
+	}
+
+	for _, line := range lines {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		names[name] = true
+	}
+
+	logger.Log.Debugf("Read %d name(s) from '%s'.", len(names), path)
+	return
+}
+
+// readHostProvidedFile reads the capabilities from '--host-provided-file', keyed by their names. Each line holds
+// a capability, optionally followed by its version, e.g. "glibc = 2.35-3.cm2".
+func readHostProvidedFile(path string) (capabilities map[string]*pkgjson.PackageVer, err error) {
+	lines, err := readListFile(path)
+	if err != nil {
+		return
+	}
+
+	capabilities = make(map[string]*pkgjson.PackageVer, len(lines))
+	for line := range lines {
+		capability, err := pkgjson.PackageStringToPackageVer(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host-provided capability '%s':\n%w", line, err)
+		}
+		if capability.Condition != "" && capability.Condition != "=" {
+			return nil, fmt.Errorf("host-provided capability '%s' must list an exact version", line)
+		}
+		if _, found := capabilities[capability.Name]; found {
+			return nil, fmt.Errorf("host-provided capability '%s' is listed more than once", capability.Name)
+		}
+		capabilities[capability.Name] = capability
+	}
+	return
+}
+
+// hostProvides returns true if the build environment provides 'pkgVer' in a version matching its condition.
+// A capability listed without a version matches any condition.
+func hostProvides(hostProvidedCapabilities map[string]*pkgjson.PackageVer, pkgVer *pkgjson.PackageVer) bool {
+	hostCapability, found := hostProvidedCapabilities[pkgVer.Name]
+	if !found {
+		return false
+	}
+
+	hostInterval, err := hostCapability.Interval()
+	if err != nil {
+		logger.Log.Warnf("Ignoring invalid host-provided capability '%v': %s", hostCapability, err)
+		return false
+	}
+	requiredInterval, err := pkgVer.Interval()
+	if err != nil {
+		logger.Log.Warnf("Not checking whether the host provides '%v': %s", pkgVer, err)
+		return false
+	}
+
+	if !hostInterval.Satisfies(&requiredInterval) {
+		logger.Log.Debugf("The host provides '%v', which doesn't satisfy '%v'.", hostCapability, pkgVer)
+		return false
+	}
+	return true
+}
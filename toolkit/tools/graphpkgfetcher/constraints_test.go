@@ -0,0 +1,277 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldPreferArchSpecificPins(t *testing.T) {
+	pins := versionPins{
+		"gcc": {
+			"":        "12.2.0-1.cm2",
+			"aarch64": "12.1.0-3.cm2",
+		},
+	}
+
+	candidates := []string{
+		"gcc-12.2.0-1.cm2.x86_64",
+		"gcc-12.1.0-3.cm2.x86_64",
+		"gcc-12.2.0-1.cm2.aarch64",
+		"gcc-12.1.0-3.cm2.aarch64",
+		"glibc-2.35-3.cm2.x86_64",
+	}
+
+	pinnedCandidates, err := applyVersionPins(candidates, pins)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gcc-12.2.0-1.cm2.x86_64", "gcc-12.1.0-3.cm2.aarch64", "glibc-2.35-3.cm2.x86_64"}, pinnedCandidates)
+}
+
+func TestShouldFailWhenNoCandidateMatchesPin(t *testing.T) {
+	pins := versionPins{
+		"gcc": {"x86_64": "13.0.0-1.cm2"},
+	}
+
+	_, err := applyVersionPins([]string{"gcc-12.2.0-1.cm2.x86_64"}, pins)
+	assert.Error(t, err)
+}
+
+func TestShouldFailNodePullingInUnpinnedDependency(t *testing.T) {
+	outDir := t.TempDir()
+	cloner := &fakeCloner{
+		deps:   map[string][]string{"gdb-1.0-1.cm2.x86_64": {"gcc-13.0.0-1.cm2.x86_64", "zlib-1.0-1.cm2.x86_64"}},
+		outDir: outDir,
+	}
+	pins := versionPins{"gcc": {"": "12.2.0-1.cm2"}}
+
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "gdb"}, State: pkggraph.StateUnresolved}
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: outDir, pins: pins})
+	assert.ErrorContains(t, err, "not matching their version pins 'gcc-13.0.0-1.cm2.x86_64.rpm'")
+	assert.Equal(t, pkggraph.StateUnresolved, node.State)
+	assert.NoFileExists(t, filepath.Join(outDir, "gcc-13.0.0-1.cm2.x86_64.rpm"))
+
+	// Dependencies matching their pin are fine.
+	cloner.deps["gdb-1.0-1.cm2.x86_64"] = []string{"gcc-12.2.0-1.cm2.x86_64"}
+	_, err = resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: outDir, pins: pins})
+	assert.NoError(t, err)
+	assert.Equal(t, pkggraph.StateCached, node.State)
+}
+
+func TestShouldRejectConflictingPins(t *testing.T) {
+	pinsFile := filepath.Join(t.TempDir(), "pins.json")
+	err := os.WriteFile(pinsFile, []byte(`{"Pins": [
+		{"Name": "gcc", "Version": "12.2.0-1.cm2", "Arch": "x86_64"},
+		{"Name": "gcc", "Version": "12.1.0-3.cm2", "Arch": "x86_64"}
+	]}`), 0644)
+	assert.NoError(t, err)
+
+	_, err = readVersionPins(pinsFile)
+	assert.Error(t, err)
+}
+
+func TestShouldRoundTripLockFile(t *testing.T) {
+	g := pkggraph.NewPkgGraph()
+	addNode := func(name string, state pkggraph.NodeState, nodeType pkggraph.NodeType, rpmPath string) {
+		_, err := g.AddPkgNode(&pkgjson.PackageVer{Name: name}, state, nodeType, pkggraph.NoSRPMPath, rpmPath, pkggraph.NoSpecPath, pkggraph.NoSourceDir, pkggraph.NoArchitecture, pkggraph.NoSourceRepo)
+		assert.NoError(t, err)
+	}
+
+	addNode("zlib", pkggraph.StateCached, pkggraph.TypeRemoteRun, "/cache/zlib-1.2.13-1.cm2.x86_64.rpm")
+	addNode("gcc", pkggraph.StateUpToDate, pkggraph.TypePreBuilt, "/cache/gcc-12.2.0-1.cm2.x86_64.rpm")
+	addNode("missing", pkggraph.StateUnresolved, pkggraph.TypeRemoteRun, pkggraph.NoRPMPath)
+	addNode("bash", pkggraph.StateUpToDate, pkggraph.TypeLocalRun, "/out/bash-5.1.8-2.cm2.x86_64.rpm")
+
+	cloneDir := t.TempDir()
+	for _, rpmFile := range []string{"zlib-1.2.13-1.cm2.x86_64.rpm", "glibc-2.35-3.cm2.x86_64.rpm"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(cloneDir, rpmFile), []byte(rpmFile), 0644))
+	}
+
+	lockFile := filepath.Join(t.TempDir(), "lock.json")
+	err := writeLockFile([]*pkggraph.PkgGraph{g}, cloneDir, lockFile)
+	assert.NoError(t, err)
+
+	lock, lockedDependencies, err := readLockFile(lockFile)
+	assert.NoError(t, err)
+	assert.Equal(t, packageLock{
+		(&pkgjson.PackageVer{Name: "zlib"}).String(): {"zlib-1.2.13-1.cm2.x86_64": true},
+		(&pkgjson.PackageVer{Name: "gcc"}).String():  {"gcc-12.2.0-1.cm2.x86_64": true},
+	}, lock)
+	assert.Equal(t, map[string]bool{
+		"zlib-1.2.13-1.cm2.x86_64": true,
+		"gcc-12.2.0-1.cm2.x86_64":  true,
+		"glibc-2.35-3.cm2.x86_64":  true,
+	}, lockedDependencies)
+
+	lockedCandidates, err := applyPackageLock(&pkgjson.PackageVer{Name: "zlib"}, []string{"zlib-1.3-1.cm2.x86_64", "zlib-1.2.13-1.cm2.x86_64"}, lock)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"zlib-1.2.13-1.cm2.x86_64"}, lockedCandidates)
+
+	// Nodes missing from the lock keep all candidates.
+	lockedCandidates, err = applyPackageLock(&pkgjson.PackageVer{Name: "glibc"}, []string{"glibc-2.35-3.cm2.x86_64"}, lock)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"glibc-2.35-3.cm2.x86_64"}, lockedCandidates)
+}
+
+func TestShouldRejectDriftedLockedPackage(t *testing.T) {
+	pkgVer := &pkgjson.PackageVer{Name: "zlib"}
+	options := newTestResolveOptions("/cache")
+	options.lock = packageLock{
+		pkgVer.String(): {"zlib-1.2.13-1.cm2.x86_64": true},
+	}
+
+	node := &pkggraph.PkgNode{VersionedPkg: pkgVer, State: pkggraph.StateUnresolved, RpmPath: pkggraph.NoRPMPath}
+	cloner := &fakeCloner{providers: []string{"zlib-1.2.13-2.cm2.x86_64"}}
+
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+	assert.ErrorIs(t, err, errLockedPackageUnavailable)
+	assert.Empty(t, cloner.cloned)
+	assert.Equal(t, pkggraph.NoRPMPath, node.RpmPath)
+
+	cloner.providers = []string{"zlib-1.2.13-2.cm2.x86_64", "zlib-1.2.13-1.cm2.x86_64"}
+	_, err = resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"zlib-1.2.13-1.cm2.x86_64"}, cloner.cloned)
+	assert.Equal(t, rpmPackageToRPMPath("zlib-1.2.13-1.cm2.x86_64", "/cache"), node.RpmPath)
+}
+
+func TestShouldRejectInvalidLockedPackage(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "lock.json")
+	err := os.WriteFile(lockFile, []byte(`{"Packages": [{"Node": "zlib"}]}`), 0644)
+	assert.NoError(t, err)
+
+	_, _, err = readLockFile(lockFile)
+	assert.Error(t, err)
+}
+
+func TestShouldRejectDependencyMissingFromLock(t *testing.T) {
+	outDir := t.TempDir()
+	pkgVer := &pkgjson.PackageVer{Name: "curl"}
+	options := newTestResolveOptions(outDir)
+	options.lock = packageLock{pkgVer.String(): {"curl-1.0-1.cm2.x86_64": true}}
+	options.lockedDependencies = map[string]bool{"curl-1.0-1.cm2.x86_64": true, "openssl-1.1.1k-9.cm2.x86_64": true}
+
+	cloner := &fakeCloner{
+		deps:   map[string][]string{"curl-1.0-1.cm2.x86_64": {"openssl-1.1.1k-10.cm2.x86_64"}},
+		outDir: outDir,
+	}
+	node := &pkggraph.PkgNode{VersionedPkg: pkgVer, State: pkggraph.StateUnresolved, RpmPath: pkggraph.NoRPMPath}
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+	assert.ErrorIs(t, err, errLockedPackageUnavailable)
+	assert.ErrorContains(t, err, "missing from the lock file 'openssl-1.1.1k-10.cm2.x86_64.rpm'")
+	assert.NoFileExists(t, filepath.Join(outDir, "openssl-1.1.1k-10.cm2.x86_64.rpm"))
+
+	cloner.deps["curl-1.0-1.cm2.x86_64"] = []string{"openssl-1.1.1k-9.cm2.x86_64"}
+	_, err = resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+	assert.NoError(t, err)
+
+	// Lock files without the dependencies only lock the nodes' packages.
+	options.lockedDependencies = nil
+	cloner.deps["curl-1.0-1.cm2.x86_64"] = []string{"openssl-1.1.1k-10.cm2.x86_64"}
+	_, err = resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+	assert.NoError(t, err)
+}
+
+func TestShouldResolveFromAllowedRepo(t *testing.T) {
+	cloner := &fakeCloner{
+		providers: []string{"openssl-1.1.1k-9.cm2.x86_64", "openssl-1.1.1k-10.cm2.x86_64"},
+		packagesByRepo: map[string][]string{
+			"internal-hardened": {"openssl-1.1.1k-9.cm2.x86_64"},
+			"mariner-official":  {"openssl-1.1.1k-10.cm2.x86_64"},
+		},
+	}
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "openssl"}, State: pkggraph.StateUnresolved}
+	policy := repoPolicy{"*": "mariner-official", "openssl*": "internal-hardened"}
+
+	resolution, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: "/cache", policy: policy})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resolution.candidates)
+	assert.Equal(t, []string{"openssl-1.1.1k-9.cm2.x86_64"}, cloner.cloned)
+	assert.Equal(t, pkggraph.StateCached, node.State)
+}
+
+func TestShouldRejectProviderFromDisallowedRepo(t *testing.T) {
+	cloner := &fakeCloner{
+		providers:      []string{"openssl-1.1.1k-10.cm2.x86_64"},
+		packagesByRepo: map[string][]string{"mariner-official": {"openssl-1.1.1k-10.cm2.x86_64"}},
+	}
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "openssl"}, State: pkggraph.StateUnresolved}
+	policy := repoPolicy{"openssl*": "internal-hardened"}
+
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: "/cache", policy: policy})
+	assert.ErrorContains(t, err, "rejected by the repo policy")
+	assert.ErrorContains(t, err, "'openssl-1.1.1k-10.cm2.x86_64' may only come from repo 'internal-hardened' but is offered by [mariner-official]")
+	assert.Empty(t, cloner.cloned)
+	assert.Equal(t, pkggraph.StateUnresolved, node.State)
+}
+
+func TestShouldPreferLongestRepoPolicyGlob(t *testing.T) {
+	policy := repoPolicy{"*": "mariner-official", "openssl*": "internal-hardened", "openssl-libs": "legacy"}
+
+	repoID, restricted := policy.allowedRepo("openssl-libs")
+	assert.True(t, restricted)
+	assert.Equal(t, "legacy", repoID)
+
+	repoID, restricted = policy.allowedRepo("openssl")
+	assert.True(t, restricted)
+	assert.Equal(t, "internal-hardened", repoID)
+
+	_, restricted = repoPolicy{"openssl*": "internal-hardened"}.allowedRepo("zlib")
+	assert.False(t, restricted)
+}
+
+func TestShouldReadHostProvidedCapabilities(t *testing.T) {
+	hostProvidedFile := filepath.Join(t.TempDir(), "host-provided.txt")
+	err := os.WriteFile(hostProvidedFile, []byte("# Provided by the build container\nglibc = 2.35-3.cm2\n/bin/sh\n"), 0644)
+	assert.NoError(t, err)
+
+	capabilities, err := readHostProvidedFile(hostProvidedFile)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*pkgjson.PackageVer{
+		"glibc":   {Name: "glibc", Condition: "=", Version: "2.35-3.cm2"},
+		"/bin/sh": {Name: "/bin/sh"},
+	}, capabilities)
+
+	err = os.WriteFile(hostProvidedFile, []byte("glibc >= 2.35\n"), 0644)
+	assert.NoError(t, err)
+	_, err = readHostProvidedFile(hostProvidedFile)
+	assert.ErrorContains(t, err, "exact version")
+}
+
+func TestShouldOnlyMarkNodesSatisfiedByHostVersionAsHostProvided(t *testing.T) {
+	options := newTestResolveOptions("/cache")
+	options.hostProvidedCapabilities = map[string]*pkgjson.PackageVer{
+		"glibc":   {Name: "glibc", Condition: "=", Version: "2.35-3.cm2"},
+		"/bin/sh": {Name: "/bin/sh"},
+	}
+	cloner := &fakeCloner{providers: []string{"glibc-2.36-1.cm2.x86_64"}}
+
+	for _, pkgVer := range []*pkgjson.PackageVer{
+		{Name: "glibc"},
+		{Name: "glibc", Condition: ">=", Version: "2.30"},
+		{Name: "/bin/sh", Condition: ">=", Version: "5.0"},
+	} {
+		node := &pkggraph.PkgNode{VersionedPkg: pkgVer, State: pkggraph.StateUnresolved, RpmPath: "stale.rpm"}
+		resolution, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+		assert.NoError(t, err)
+		assert.True(t, resolution.hostProvided, pkgVer.String())
+		assert.Equal(t, pkggraph.StateUpToDate, node.State)
+		assert.Equal(t, pkggraph.NoRPMPath, node.RpmPath)
+	}
+	assert.Empty(t, cloner.lookups)
+
+	newerNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "glibc", Condition: ">=", Version: "2.36"}, State: pkggraph.StateUnresolved}
+	resolution, err := resolveSingleNode(context.Background(), cloner, newerNode, newFetchedPackageSet(), options)
+	assert.NoError(t, err)
+	assert.False(t, resolution.hostProvided)
+	assert.Equal(t, pkggraph.StateCached, newerNode.State)
+	assert.Equal(t, "/cache/glibc-2.36-1.cm2.x86_64.rpm", newerNode.RpmPath)
+	assert.Equal(t, 1, cloner.lookups["glibc"])
+}
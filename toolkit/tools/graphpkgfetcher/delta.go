@@ -0,0 +1,214 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/exe"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/scheduler/schedulerutils"
+)
+
+// downloadDeltaNodes will look at the final cached graph we saved and see if any RPMS can be download instead of built.
+// If the previous part of the fetcher worked well we should be able to download only the delta RPMs we need
+// to build our packages or image (i.e. we should be able to create a subgraph just like we would for the build step)
+//   - dependencyGraph: The graph to use to find the packages we need to build. Should have any caching operations already
+//     performed on it. Will be updated with the paths to the delta RPMs we download.
+//   - cloner: The cloner to use to download the RPMs
+//
+// We also access the package list related globals:
+//   - pkgsToBuild: The list of packages to build
+//   - pkgsToRebuild: The list of packages to rebuild
+//   - pkgsToIgnore: The list of packages to ignore
+//   - imageConfig: The image config to use to find the packages we need to build
+//   - baseDirPath: The base directory to use to find the packages we need to build
+func downloadDeltaNodes(dependencyGraph *pkggraph.PkgGraph, cloner *rpmrepocloner.RpmRepoCloner) (err error) {
+	const (
+		useImplicitForOptimization = true
+	)
+
+	timestamp.StartEvent("delta package download", nil)
+	defer timestamp.StopEvent(nil)
+
+	// Generate the list of packages that need to be built. If none are requested then all packages will be built. We
+	// don't care about explicit rebuilds here since we are going to rebuild them anyway.
+	packageVersToBuild, _, _, err := schedulerutils.ParseAndGeneratePackageBuildList(dependencyGraph, exe.ParseListArgument(*pkgsToBuild), exe.ParseListArgument(*pkgsToRebuild), exe.ParseListArgument(*pkgsToIgnore), *imageConfig, *baseDirPath)
+	if err != nil {
+		err = fmt.Errorf("unable to generate package build list to calculate delta downloads:\n%w", err)
+		return
+	}
+
+	// Generate the list of tests that need to be ran. If none are requested then all packages will be built. We
+	// don't care about explicit rebuilds here since we are going to rebuild them anyway.
+	testVersToRun, _, _, err := schedulerutils.ParseAndGeneratePackageTestList(dependencyGraph, exe.ParseListArgument(*testsToRun), exe.ParseListArgument(*testsToRerun), exe.ParseListArgument(*testsToIgnore), *imageConfig, *baseDirPath)
+	if err != nil {
+		err = fmt.Errorf("unable to generate package build list to calculate delta downloads:\n%w", err)
+		return
+	}
+
+	// We will heavily modify this graph so it should not be used for anything else, create a copy of it to work with.
+	deltaPkgGraphCopy, err := dependencyGraph.DeepCopy()
+	if err != nil {
+		err = fmt.Errorf("failed to copy graph for delta package downloading:\n%w", err)
+		return
+	}
+
+	isGraphOptimized, deltaPkgGraphCopy, _, err := schedulerutils.PrepareGraphForBuild(deltaPkgGraphCopy, packageVersToBuild, testVersToRun, useImplicitForOptimization)
+	if err != nil {
+		err = fmt.Errorf("failed to initialize graph for delta package downloading:\n%w", err)
+		return
+	}
+
+	if !isGraphOptimized {
+		logger.Log.Warnf("Delta fetcher was unable to prune the build graph. All possible build nodes will be included so delta package downloading will be very slow!")
+	}
+
+	err = downloadAllAvailableDeltaRPMs(dependencyGraph, deltaPkgGraphCopy, cloner)
+	if err != nil {
+		err = fmt.Errorf("failed to download delta RPMs:\n%w", err)
+		return
+	}
+
+	return
+}
+
+// downloadAllAvailableDeltaRPMs scans a graph and for each build node in the graph and tries to replace it with a cached node instead.
+// to satisfy it. Delta nodes will be saved to the cache directory set for the cloner.
+//   - realDependencyGraph: The graph to use to find the packages we need to build. Should have any caching operations already
+//     performed on it. Will be updated with the paths to the delta RPMs we download.
+//   - dependencyGraphDeltaCopy: A copy of the graph we will use to try to optimize the build nodes. This graph should be
+//     optimized to only contain the nodes we need to build.
+//   - cloner: The cloner to use to download the RPMs
+func downloadAllAvailableDeltaRPMs(realDependencyGraph, dependencyGraphDeltaCopy *pkggraph.PkgGraph, cloner *rpmrepocloner.RpmRepoCloner) (err error) {
+	timestamp.StartEvent("downloading delta nodes", nil)
+	defer timestamp.StopEvent(nil)
+
+	// First scan the copy of the graph we tried to optimize for all the SRPMs we need to build. We will use this list to
+	// match against all the nodes in the full graph.
+	srpmPaths := make(map[string]bool)
+	for _, n := range dependencyGraphDeltaCopy.AllBuildNodes() {
+		srpmPaths[n.SrpmPath] = true
+	}
+
+	// For each build node, try to update it to a delta node with a downloaded RPM backing it.
+	logger.Log.Debugf("Resolving build nodes")
+	buildNodes := realDependencyGraph.AllBuildNodes()
+	for i, n := range buildNodes {
+		// If this node isn't part of the optimized graph, skip it.
+		if _, ok := srpmPaths[n.SrpmPath]; !ok {
+			logger.Log.Debugf("Skipping non-optimized delta build node %s", n)
+			continue
+		}
+
+		logger.Log.Debugf("Resolving build node %s", n)
+		err = downloadSingleDeltaRPM(realDependencyGraph, n, cloner)
+		if err != nil {
+			return fmt.Errorf("failed to download delta RPM for build node %s:\n%w", n, err)
+		}
+		if n.State == pkggraph.StateDelta {
+			logger.Log.Infof("Delta Progress %d%%: delta RPM found for '%s-%s'.", (i*100)/len(buildNodes), n.VersionedPkg.Name, n.VersionedPkg.Version)
+		} else {
+			logger.Log.Infof("Delta Progress %d%%: skipped getting delta RPM for '%s' at '%s'.", (i*100)/len(buildNodes), n.VersionedPkg.Name, n.RpmPath)
+		}
+	}
+
+	return
+}
+
+// downloadSingleDeltaRPM attempts to download a single delta RPM for a build node. If the delta RPM is available
+// it will be downloaded and the build node will be updated to point to the new RPM. The associated run node will
+// also be updated to point to the new RPM since the scheduler uses the run node to find the RPM to install. If a
+// delta RPM is not available, the build node will be left alone an no error will be returned.
+//   - realDependencyGraph: The graph to update
+//   - buildNode: The build node to update. This node should be from the real graph as we will be updating it directly.
+//     to find the actual build node in the graph.
+//   - cloner: The cloner to use to download the RPMs
+func downloadSingleDeltaRPM(realDependencyGraph *pkggraph.PkgGraph, buildNode *pkggraph.PkgNode, cloner *rpmrepocloner.RpmRepoCloner) (err error) {
+	const downloadDependencies = false
+	var lookup *pkggraph.LookupNode
+
+	// Replace all '/' with '_' in the package name to get a valid timestamp name
+	// e.g. "bin/ls" -> "bin_ls"
+	tsName := strings.ReplaceAll(buildNode.VersionedPkg.Name, "/", "_")
+	timestamp.StartEvent(fmt.Sprintf("downloading delta node %s", tsName), nil)
+	defer timestamp.StopEvent(nil)
+
+	lookup, err = realDependencyGraph.FindExactPkgNodeFromPkg(buildNode.VersionedPkg)
+	if err != nil {
+		err = fmt.Errorf("can't find build node '%s' in graph:\n%w", buildNode, err)
+		return err
+	}
+	if lookup == nil || lookup.RunNode == nil {
+		err = fmt.Errorf("can't find run lookup '%v' in graph", lookup)
+		return err
+	}
+
+	runNode := lookup.RunNode
+
+	// Get the final output path for the build node if we don't convert it to a delta node
+	originalRpmPath := buildNode.RpmPath
+	foundFinalRPM, err := file.PathExists(originalRpmPath)
+	if err != nil {
+		return fmt.Errorf("can't check if final RPM '%s' exists:\n%w", originalRpmPath, err)
+	}
+
+	// Only download dependencies for delta RPMs if we don't already have the RPM in the out/RPMS folder
+	if foundFinalRPM {
+		return
+	}
+	// We have the expected rpm path, take the base name and strip .rpm off to get a name we can pass to tdnf
+	// to download the delta RPM
+	// e.g. "/home/user/repo/out/RPMS/x86_64/pkg-1.0-1.cm2.x86_64.rpm" -> "pkg-1.0-1.cm2.x86_64"
+	fullyQualifiedRpmName := filepath.Base(originalRpmPath)
+	fullyQualifiedRpmName = strings.TrimSuffix(fullyQualifiedRpmName, ".rpm")
+
+	// Convert the name back into the expected path in the RPM cache. This is where the cloner is expected to put
+	// the RPM when it downloads it.
+	cachedRPMPath := rpmPackageToRPMPath(fullyQualifiedRpmName, cloner.CloneDirectory())
+	foundCacheRPM, err := file.PathExists(cachedRPMPath)
+	if err != nil {
+		return fmt.Errorf("can't check if cached RPM '%s' exists:\n%w", cachedRPMPath, err)
+	}
+
+	// We will likely try to download the delta RPM multiple times across different nodes, so only do it if we don't
+	// already have it in the cache.
+	if !foundCacheRPM {
+		// Avoid any processing since we know the exact RPM we want to download
+		_, err = cloner.CloneRawPackageNames(downloadDependencies, fullyQualifiedRpmName)
+		if err != nil {
+			logger.Log.Warnf("Can't find delta RPM to download for %s: %s (local copy may be newer than published version)", fullyQualifiedRpmName, err)
+			return nil
+		}
+	} else {
+		logger.Log.Debugf("Found pre-cached delta RPM for %s, skipping download", fullyQualifiedRpmName)
+	}
+
+	foundCacheRPM, err = file.PathExists(cachedRPMPath)
+	if err != nil {
+		return fmt.Errorf("can't check if cached RPM '%s' exists:\n%w", cachedRPMPath, err)
+	}
+	if foundCacheRPM {
+		buildNode.State = pkggraph.StateDelta
+		runNode.State = pkggraph.StateDelta
+
+		// Update the build and run nodes to point to the new RPM in the cache
+		runNode.RpmPath = cachedRPMPath
+		buildNode.RpmPath = cachedRPMPath
+
+		logger.Log.Debugf("Converted delta build node is now: '%s'", buildNode)
+		logger.Log.Debugf("Converted delta run node is now: '%s'", runNode)
+	} else {
+		logger.Log.Warnf("Delta download for '%s' did not generate the correct delta RPM: '%s'", buildNode, cachedRPMPath)
+		return nil
+	}
+
+	return
+}
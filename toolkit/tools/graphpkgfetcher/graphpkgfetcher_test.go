@@ -0,0 +1,375 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pausabletimeout"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+func TestShouldPairInputAndOutputGraphs(t *testing.T) {
+	pairs, err := graphFilePairs("a.dot", "a-out.dot", []string{"b.dot", "c.dot"}, []string{"b-out.dot", "c-out.dot"})
+	assert.NoError(t, err)
+	assert.Equal(t, []graphFilePair{
+		{input: "a.dot", output: "a-out.dot"},
+		{input: "b.dot", output: "b-out.dot"},
+		{input: "c.dot", output: "c-out.dot"},
+	}, pairs)
+
+	_, err = graphFilePairs("", "", []string{"b.dot", "c.dot"}, []string{"b-out.dot"})
+	assert.Error(t, err)
+
+	_, err = graphFilePairs("a.dot", "", nil, nil)
+	assert.Error(t, err)
+
+	_, err = graphFilePairs("", "", nil, nil)
+	assert.Error(t, err)
+}
+
+func TestShouldDownloadWithoutWritingOutputGraph(t *testing.T) {
+	graphDir := t.TempDir()
+	inputFile := filepath.Join(graphDir, "graph.dot")
+
+	_, err := downloadOnlyGraphFiles(inputFile, filepath.Join(graphDir, "out.dot"), nil, nil)
+	assert.Error(t, err)
+
+	graphFiles, err := downloadOnlyGraphFiles(inputFile, "", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []graphFilePair{{input: inputFile}}, graphFiles)
+
+	g := pkggraph.NewPkgGraph()
+	_, err = g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "zlib"})
+	assert.NoError(t, err)
+
+	graphCopies, err := downloadOnlyGraphs([]*pkggraph.PkgGraph{g})
+	assert.NoError(t, err)
+
+	cloner := &fakeCloner{providers: []string{"zlib-1.2.13-1.cm2.x86_64"}}
+	for _, n := range graphCopies[0].AllRunNodes() {
+		_, err = resolveSingleNode(context.Background(), cloner, n, newFetchedPackageSet(), newTestResolveOptions("/cache"))
+		assert.NoError(t, err)
+		assert.Equal(t, pkggraph.StateCached, n.State)
+	}
+	assert.Equal(t, []string{"zlib-1.2.13-1.cm2.x86_64"}, cloner.cloned)
+
+	for _, n := range g.AllRunNodes() {
+		assert.Equal(t, pkggraph.StateUnresolved, n.State)
+	}
+
+	assert.NoError(t, writeOutputGraphs(graphFiles, []*pkggraph.PkgGraph{g}))
+	writtenFiles, err := os.ReadDir(graphDir)
+	assert.NoError(t, err)
+	assert.Empty(t, writtenFiles)
+}
+
+// fakeCloner is the configurable cloner used by the tests. By default it provides every capability "<name>[.so]" with
+// the package "<name>-1.0-1.cm2.x86_64" and clones every package successfully. It records its lookups and clones.
+type fakeCloner struct {
+	// providers, if set, provide every capability.
+	providers []string
+	// available, if set, lists the only capabilities with a provider.
+	available map[string]bool
+	// missing capabilities have no provider.
+	missing map[string]bool
+	// lookupErr fails every lookup.
+	lookupErr error
+	// lookupDelay delays the lookups of the capabilities in 'slow', or of all capabilities if 'slow' is nil.
+	lookupDelay time.Duration
+	slow        map[string]bool
+	// serialized lookups wait for each other, like the ones made through a sharedCloner.
+	serialized bool
+	// packagesByRepo is returned by WhatProvidesByRepo.
+	packagesByRepo map[string][]string
+	// cloneFailures is the number of clones failing with 'cloneErr' before the clones succeed.
+	cloneFailures int
+	cloneErr      error
+	// prebuilt packages are cloned from local repos.
+	prebuilt map[string]bool
+	// sizes are the sizes of the cloned packages.
+	sizes map[string]int64
+	// deps are the packages cloned along with a package if the dependencies are cloned too.
+	deps map[string][]string
+	// repos are the repo IDs the packages are cloned from, "fake-repo" if not set.
+	repos map[string]string
+	// outDir, if set, receives the RPM of every cloned package.
+	outDir string
+
+	lock           sync.Mutex
+	lookupLock     sync.Mutex
+	lookups        map[string]int
+	cloneCalls     int
+	cloned         []string
+	clonedPackages map[string]rpmrepocloner.ClonedPackage
+}
+
+func (f *fakeCloner) WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	f.lock.Lock()
+	if f.lookups == nil {
+		f.lookups = make(map[string]int)
+	}
+	f.lookups[pkgVer.Name]++
+	f.lock.Unlock()
+
+	if f.serialized {
+		pausabletimeout.Lock(ctx, &f.lookupLock)
+		defer f.lookupLock.Unlock()
+	}
+
+	if f.lookupDelay > 0 && (f.slow == nil || f.slow[pkgVer.Name]) {
+		time.Sleep(f.lookupDelay)
+	}
+
+	switch {
+	case f.lookupErr != nil:
+		return nil, f.lookupErr
+	case f.missing[pkgVer.Name], f.available != nil && !f.available[pkgVer.Name]:
+		return nil, fmt.Errorf("%w: could not resolve %s", rpmrepocloner.ErrPackageNotFound, pkgVer.Name)
+	case f.providers != nil:
+		return f.providers, nil
+	}
+	return []string{fmt.Sprintf("%s-1.0-1.cm2.x86_64", strings.TrimSuffix(pkgVer.Name, ".so"))}, nil
+}
+
+func (f *fakeCloner) WhatProvidesByRepo(ctx context.Context, pkgVer *pkgjson.PackageVer) (packagesByRepo map[string][]string, err error) {
+	if f.packagesByRepo == nil {
+		return map[string][]string{}, nil
+	}
+	return f.packagesByRepo, nil
+}
+
+func (f *fakeCloner) PrioritizeCandidates(ctx context.Context, pkgVer *pkgjson.PackageVer, candidates []string) (prioritizedCandidates []string, err error) {
+	return candidates, nil
+}
+
+func (f *fakeCloner) CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.cloneCalls++
+	if f.cloneCalls <= f.cloneFailures {
+		return false, nil, f.cloneErr
+	}
+
+	if f.clonedPackages == nil {
+		f.clonedPackages = make(map[string]rpmrepocloner.ClonedPackage)
+	}
+
+	rpmPackages := []string{}
+	allPackagesPrebuilt = true
+	for _, pkgVer := range packagesToClone {
+		allPackagesPrebuilt = allPackagesPrebuilt && f.prebuilt[pkgVer.Name]
+		f.cloned = append(f.cloned, pkgVer.Name)
+		rpmPackages = append(rpmPackages, pkgVer.Name)
+		if cloneDeps {
+			rpmPackages = append(rpmPackages, f.deps[pkgVer.Name]...)
+		}
+	}
+
+	clonedPackages = make(map[string]string)
+	for _, rpmPackage := range rpmPackages {
+		rpmFile := rpmPackage + ".rpm"
+		clonedPackages[rpmFile] = "fake-repo"
+		if repoID, found := f.repos[rpmPackage]; found {
+			clonedPackages[rpmFile] = repoID
+		}
+		f.clonedPackages[rpmFile] = rpmrepocloner.ClonedPackage{Size: f.sizes[rpmPackage], Prebuilt: f.prebuilt[rpmPackage]}
+
+		if f.outDir != "" {
+			err = os.WriteFile(rpmPackageToRPMPath(rpmPackage, f.outDir), []byte(rpmPackage), 0644)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (f *fakeCloner) ClonedPackages() map[string]rpmrepocloner.ClonedPackage {
+	return f.clonedPackages
+}
+
+// newTestResolveOptions returns the options of a run cloning the dependencies into 'outDir' without any policy.
+func newTestResolveOptions(outDir string) *resolveOptions {
+	return &resolveOptions{cloneDeps: true, outDir: outDir}
+}
+
+func resolveWithWorkers(t *testing.T, workers int) (packages *fetchedPackageSet) {
+	nodes := []*pkggraph.PkgNode{}
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("pkg%d", i%25)
+		if i >= 25 {
+			name += ".so"
+		}
+		nodes = append(nodes, &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: name}, State: pkggraph.StateUnresolved})
+	}
+
+	cloner := &fakeCloner{}
+	packages = newFetchedPackageSet()
+	resolve := func(n *pkggraph.PkgNode) error {
+		_, err := resolveSingleNode(context.Background(), cloner, n, packages, newTestResolveOptions("/cache"))
+		return err
+	}
+
+	handledNodes := 0
+	startedNodes := resolveNodesConcurrently(context.Background(), nodes, workers, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		assert.NoError(t, resolveErr)
+		assert.Equal(t, pkggraph.StateCached, n.State)
+		handledNodes++
+		return true
+	})
+	assert.Equal(t, len(nodes), startedNodes)
+	assert.Equal(t, len(nodes), handledNodes)
+	return
+}
+
+func TestShouldStopResolvingOnceTimedOut(t *testing.T) {
+	const lookupDelay = 200 * time.Millisecond
+
+	nodes := []*pkggraph.PkgNode{}
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: fmt.Sprintf("pkg%d", i)}, State: pkggraph.StateUnresolved})
+	}
+
+	ctx, cancel := fetchContext(50 * time.Millisecond)
+	defer cancel()
+
+	cloner := &fakeCloner{lookupDelay: lookupDelay}
+	packages := newFetchedPackageSet()
+	resolve := func(n *pkggraph.PkgNode) error {
+		_, err := resolveSingleNode(ctx, cloner, n, packages, newTestResolveOptions("/cache"))
+		return err
+	}
+
+	start := time.Now()
+	resolveErrors := []error{}
+	startedNodes := resolveNodesConcurrently(ctx, nodes, 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		resolveErrors = append(resolveErrors, resolveErr)
+		return true
+	})
+
+	// The lookup in flight when the deadline hit finishes, but nothing is cloned and no other node is started.
+	assert.Less(t, time.Since(start), 2*lookupDelay)
+	assert.Equal(t, 1, startedNodes)
+	assert.Len(t, resolveErrors, 1)
+	assert.ErrorIs(t, resolveErrors[0], context.DeadlineExceeded)
+	assert.Empty(t, packages.fetched)
+	for _, n := range nodes {
+		assert.Equal(t, pkggraph.StateUnresolved, n.State)
+	}
+}
+
+func TestShouldWritePartialGraphWhenInterrupted(t *testing.T) {
+	g := pkggraph.NewPkgGraph()
+	nodes := []*pkggraph.PkgNode{}
+	for _, name := range []string{"bash", "glibc", "zlib"} {
+		node, err := g.AddPkgNode(&pkgjson.PackageVer{Name: name}, pkggraph.StateUnresolved, pkggraph.TypeRemoteRun, pkggraph.NoSRPMPath, pkggraph.NoRPMPath, pkggraph.NoSpecPath, pkggraph.NoSourceDir, pkggraph.NoArchitecture, pkggraph.NoSourceRepo)
+		assert.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cloner := &fakeCloner{}
+	packages := newFetchedPackageSet()
+	resolve := func(n *pkggraph.PkgNode) error {
+		_, err := resolveSingleNode(ctx, cloner, n, packages, newTestResolveOptions("/cache"))
+		return err
+	}
+
+	// Interrupted once the first node is resolved.
+	startedNodes := resolveNodesConcurrently(ctx, nodes, 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		assert.NoError(t, resolveErr)
+		cancel()
+		return true
+	})
+	assert.Equal(t, 1, startedNodes)
+
+	fetchErr := fmt.Errorf("stopped resolving the graph:\n%w", ctx.Err())
+	graphFiles := []graphFilePair{{input: "input.dot", output: filepath.Join(t.TempDir(), "output.dot")}}
+	assert.True(t, writePartialProgress(fetchErr, graphFiles, []*pkggraph.PkgGraph{g}))
+
+	writtenGraph, err := pkggraph.ReadDOTGraphFile(graphFiles[0].output)
+	assert.NoError(t, err)
+	states := make(map[string]pkggraph.NodeState)
+	for _, n := range writtenGraph.AllRunNodes() {
+		states[n.VersionedPkg.Name] = n.State
+	}
+	assert.Equal(t, map[string]pkggraph.NodeState{
+		"bash":  pkggraph.StateCached,
+		"glibc": pkggraph.StateUnresolved,
+		"zlib":  pkggraph.StateUnresolved,
+	}, states)
+
+	assert.False(t, writePartialProgress(fmt.Errorf("failed to clone"), graphFiles, []*pkggraph.PkgGraph{g}))
+}
+
+func TestShouldCancelFetchOnSignal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stop := cancelOnSignal(cancel)
+	defer stop()
+
+	assert.NoError(t, unix.Kill(os.Getpid(), unix.SIGTERM))
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "the fetch was not cancelled by SIGTERM")
+	}
+}
+
+func TestShouldFailValidationOfMissingRPMs(t *testing.T) {
+	cacheDir := t.TempDir()
+	zlibRPM := filepath.Join(cacheDir, "zlib-1.2.13-1.cm2.x86_64.rpm")
+	assert.NoError(t, os.WriteFile(zlibRPM, []byte{}, 0644))
+
+	g := pkggraph.NewPkgGraph()
+	zlibNode, err := g.AddPkgNode(&pkgjson.PackageVer{Name: "zlib"}, pkggraph.StateCached, pkggraph.TypeRemoteRun, pkggraph.NoSRPMPath, zlibRPM, pkggraph.NoSpecPath, pkggraph.NoSourceDir, pkggraph.NoArchitecture, pkggraph.NoSourceRepo)
+	assert.NoError(t, err)
+	assert.NoError(t, validateRpmPaths([]*pkggraph.PkgGraph{g}, []string{"graph.dot"}))
+
+	zlibNode.RpmPath = filepath.Join(cacheDir, "zlib-1.2.12-1.cm2.x86_64.rpm")
+	err = validateRpmPaths([]*pkggraph.PkgGraph{g}, []string{"graph.dot"})
+	assert.EqualError(t, err, "1 resolved node(s) point to missing RPMs")
+}
+
+func TestShouldValidatePathsOfHostProvidedNodes(t *testing.T) {
+	options := newTestResolveOptions(t.TempDir())
+	options.hostProvidedCapabilities = map[string]*pkgjson.PackageVer{"/bin/sh": {Name: "/bin/sh"}}
+
+	g := pkggraph.NewPkgGraph()
+	shNode, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "/bin/sh"})
+	assert.NoError(t, err)
+	resolution, err := resolveSingleNode(context.Background(), &fakeCloner{}, shNode, newFetchedPackageSet(), options)
+	assert.NoError(t, err)
+	assert.True(t, resolution.hostProvided)
+	assert.NoError(t, validateRpmPaths([]*pkggraph.PkgGraph{g}, []string{"graph.dot"}))
+
+	// Host-provided nodes stay valid in the graphs written for the next run.
+	graphFile := filepath.Join(t.TempDir(), "graph.dot")
+	assert.NoError(t, pkggraph.WriteDOTGraphFile(g, graphFile))
+	writtenGraph, err := pkggraph.ReadDOTGraphFile(graphFile)
+	assert.NoError(t, err)
+	assert.NoError(t, validateRpmPaths([]*pkggraph.PkgGraph{writtenGraph}, []string{graphFile}))
+}
@@ -0,0 +1,279 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+
+	"gonum.org/v1/gonum/graph/topo"
+)
+
+// onlyNodes holds the friendly names of the nodes from '--only-nodes-file'. All nodes may be resolved if it is nil.
+var onlyNodes map[string]bool
+
+// errFoundUnresolvedNode stops the scan of hasUnresolvedNodes at the first unresolved node.
+var errFoundUnresolvedNode = errors.New("found an unresolved node")
+
+// unresolvedNodeEntry describes a node about to be resolved in the '--unresolved-list-file'.
+type unresolvedNodeEntry struct {
+	Graph      string `json:"Graph"` // Input graph file holding the node
+	Node       string `json:"Node"`  // Friendly name of the node
+	Name       string `json:"Name"`
+	Condition  string `json:"Condition"`
+	Version    string `json:"Version"`
+	SCondition string `json:"SCondition,omitempty"` // Second condition of double-conditional nodes
+	SVersion   string `json:"SVersion,omitempty"`
+	Implicit   bool   `json:"Implicit"`
+}
+
+// warnAboutDuplicateProviders logs every capability provided by more than one local package, since which one satisfies
+// it is not deterministic.
+func warnAboutDuplicateProviders(dependencyGraph *pkggraph.PkgGraph, graphFile string) {
+	duplicates := dependencyGraph.DuplicateProviders()
+
+	capabilities := make([]string, 0, len(duplicates))
+	for capability := range duplicates {
+		capabilities = append(capabilities, capability)
+	}
+	sort.Strings(capabilities)
+
+	for _, capability := range capabilities {
+		providerRPMs := []string{}
+		for _, provider := range duplicates[capability] {
+			providerRPMs = append(providerRPMs, fmt.Sprintf("'%s' (%s)", filepath.Base(provider.RpmPath), provider.VersionedPkg))
+		}
+		logger.Log.Warnf("Capability '%s' in '%s' is provided by several packages: %s", capability, graphFile, strings.Join(providerRPMs, ", "))
+	}
+}
+
+// hasUnresolvedNodes scans through the graph to see if there is anything to do for '--target-arch'.
+// The scan stops at the first such node.
+func hasUnresolvedNodes(graph *pkggraph.PkgGraph) bool {
+	err := graph.EachRunNode(func(n *pkggraph.PkgNode) error {
+		if isNodeToResolve(n) {
+			return errFoundUnresolvedNode
+		}
+		return nil
+	})
+	return errors.Is(err, errFoundUnresolvedNode)
+}
+
+// findUnresolvedNodes returns the unresolved nodes matching '--target-arch' and listed in '--only-nodes-file'.
+func findUnresolvedNodes(runNodes []*pkggraph.PkgNode) (unreslovedNodes []*pkggraph.PkgNode) {
+	for _, n := range runNodes {
+		if isNodeToResolve(n) {
+			unreslovedNodes = append(unreslovedNodes, n)
+		}
+	}
+	return
+}
+
+// isNodeToResolve checks if the node is unresolved, matches '--target-arch', and is listed in '--only-nodes-file'.
+func isNodeToResolve(n *pkggraph.PkgNode) bool {
+	if onlyNodes != nil && !onlyNodes[n.FriendlyName()] {
+		return false
+	}
+	return n.State == pkggraph.StateUnresolved && matchesTargetArch(n, *targetArch)
+}
+
+// matchesTargetArch checks if the node should be resolved for 'targetArch'. Any node matches an empty 'targetArch'.
+func matchesTargetArch(node *pkggraph.PkgNode, targetArch string) bool {
+	const noarch = "noarch"
+
+	if targetArch == "" {
+		return true
+	}
+
+	arch := nodeArchitecture(node)
+	return arch == "" || arch == noarch || arch == targetArch
+}
+
+// nodeArchitecture returns the architecture of the node, taken from its RPM path if the node itself does not record one.
+// Returns an empty string if the architecture is unknown.
+func nodeArchitecture(node *pkggraph.PkgNode) string {
+	if node.Architecture != "" && node.Architecture != pkggraph.NoArchitecture {
+		return node.Architecture
+	}
+
+	if node.RpmPath == "" || node.RpmPath == pkggraph.NoRPMPath {
+		return ""
+	}
+
+	// RPM files are named "<name>-<version>-<release>.<arch>.rpm".
+	rpmName := strings.TrimSuffix(filepath.Base(node.RpmPath), ".rpm")
+	archSeparator := strings.LastIndex(rpmName, ".")
+	if archSeparator < 0 {
+		return ""
+	}
+	return rpmName[archSeparator+1:]
+}
+
+// nodesToResolve returns the unresolved nodes of the graph, limited to the ones matching '--select-labels' if set.
+func nodesToResolve(dependencyGraph *pkggraph.PkgGraph) (unresolvedNodes []*pkggraph.PkgNode, err error) {
+	unresolvedNodes = findUnresolvedNodes(dependencyGraph.AllRunNodes())
+	if strings.TrimSpace(*selectLabels) != "" {
+		var selector *pkggraph.LabelSelector
+		selector, err = pkggraph.ParseLabelSelector(*selectLabels)
+		if err != nil {
+			return
+		}
+		unresolvedNodes = selectNodesByLabels(unresolvedNodes, selector)
+	}
+	return
+}
+
+// writeUnresolvedList saves the nodes of all graphs which are about to be resolved into 'listFile'.
+func writeUnresolvedList(listFile string, dependencyGraphs []*pkggraph.PkgGraph, inputGraphFiles []string) (err error) {
+	entries := []unresolvedNodeEntry{}
+	for i, dependencyGraph := range dependencyGraphs {
+		var unresolvedNodes []*pkggraph.PkgNode
+		unresolvedNodes, err = nodesToResolve(dependencyGraph)
+		if err != nil {
+			return
+		}
+
+		for _, n := range unresolvedNodes {
+			entries = append(entries, unresolvedNodeEntry{
+				Graph:      inputGraphFiles[i],
+				Node:       n.FriendlyName(),
+				Name:       n.VersionedPkg.Name,
+				Condition:  n.VersionedPkg.Condition,
+				Version:    n.VersionedPkg.Version,
+				SCondition: n.VersionedPkg.SCondition,
+				SVersion:   n.VersionedPkg.SVersion,
+				Implicit:   n.Implicit,
+			})
+		}
+	}
+
+	logger.Log.Infof("Writing the %d node(s) to resolve to '%s'.", len(entries), listFile)
+	err = jsonutils.WriteJSONFile(listFile, entries)
+	if err != nil {
+		return fmt.Errorf("failed to write the unresolved nodes to '%s':\n%w", listFile, err)
+	}
+	return
+}
+
+// reportDryRun logs the capabilities of all nodes a real fetch would try to resolve. Mapping them to exact RPMs
+// requires querying the repos, so no cloner is created and the graphs are left untouched.
+func reportDryRun(dependencyGraphs []*pkggraph.PkgGraph, inputGraphFiles []string, tryDownloadDeltaRPMs bool) (nodeCount int, err error) {
+	for i, dependencyGraph := range dependencyGraphs {
+		var unresolvedNodes []*pkggraph.PkgNode
+		unresolvedNodes, err = nodesToResolve(dependencyGraph)
+		if err != nil {
+			return
+		}
+
+		for _, n := range unresolvedNodes {
+			logger.Log.Infof("Dry run: would resolve '%s' (%s).", n.VersionedPkg, inputGraphFiles[i])
+		}
+		nodeCount += len(unresolvedNodes)
+	}
+
+	logger.Log.Infof("Dry run: would try to resolve %d node(s).", nodeCount)
+	logger.Log.Warn("Dry run: exact RPMs cannot be determined without querying the repos, only the requested capabilities are listed.")
+	if tryDownloadDeltaRPMs {
+		logger.Log.Warn("Dry run: delta RPMs which would be downloaded cannot be determined without querying the repos.")
+	}
+	return
+}
+
+// selectNodesByLabels returns the nodes whose annotations match the selector. The other nodes are left unresolved.
+func selectNodesByLabels(nodes []*pkggraph.PkgNode, selector *pkggraph.LabelSelector) (selectedNodes []*pkggraph.PkgNode) {
+	for _, n := range nodes {
+		if selector.Matches(n) {
+			selectedNodes = append(selectedNodes, n)
+		}
+	}
+
+	logger.Log.Infof("Label selector (%s) selected %d of %d unresolved node(s).", selector, len(selectedNodes), len(nodes))
+	return
+}
+
+// orderNodesToResolve returns the order to resolve 'nodes' in. Deterministic runs sort the nodes by their friendly names,
+// the graph's own order may differ between runs. If 'byDependencies' is set, dependencies are resolved before their
+// dependants, keeping the name order between independent nodes.
+func orderNodesToResolve(dependencyGraph *pkggraph.PkgGraph, nodes []*pkggraph.PkgNode, deterministic, byDependencies bool) (orderedNodes []*pkggraph.PkgNode) {
+	orderedNodes = nodes
+	if deterministic {
+		orderedNodes = make([]*pkggraph.PkgNode, len(nodes))
+		copy(orderedNodes, nodes)
+		sort.SliceStable(orderedNodes, func(i, j int) bool {
+			return orderedNodes[i].FriendlyName() < orderedNodes[j].FriendlyName()
+		})
+	}
+
+	if byDependencies {
+		orderedNodes = orderByDependencies(dependencyGraph, orderedNodes)
+	}
+	return
+}
+
+// orderByDependencies returns the nodes sorted so every node comes after the nodes it depends on.
+// Members of dependency cycles are kept together at the position of their cycle.
+func orderByDependencies(dependencyGraph *pkggraph.PkgGraph, nodes []*pkggraph.PkgNode) (orderedNodes []*pkggraph.PkgNode) {
+	// Edges point from a dependant to its dependency, so the topological order must be reversed.
+	sorted, err := topo.Sort(dependencyGraph)
+	cycles, _ := err.(topo.Unorderable)
+
+	position := make(map[int64]int)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if sorted[i] != nil {
+			position[sorted[i].ID()] = len(position)
+			continue
+		}
+
+		// Cycles are listed in the same order as their nil markers.
+		cycle := cycles[len(cycles)-1]
+		cycles = cycles[:len(cycles)-1]
+		cyclePosition := len(position)
+		for _, cycleNode := range cycle {
+			position[cycleNode.ID()] = cyclePosition
+		}
+	}
+
+	orderedNodes = make([]*pkggraph.PkgNode, len(nodes))
+	copy(orderedNodes, nodes)
+	sort.SliceStable(orderedNodes, func(i, j int) bool {
+		return position[orderedNodes[i].ID()] < position[orderedNodes[j].ID()]
+	})
+	return
+}
+
+// readOnlyNodes reads the friendly names of the nodes to resolve. Names matching no run node of the graphs are
+// warned about, since the orchestrator's view of the graph may be outdated.
+func readOnlyNodes(path string, dependencyGraphs []*pkggraph.PkgGraph) (nodeNames map[string]bool, err error) {
+	nodeNames, err = readListFile(path)
+	if err != nil {
+		return
+	}
+
+	knownNodes := make(map[string]bool)
+	for _, dependencyGraph := range dependencyGraphs {
+		for _, n := range dependencyGraph.AllRunNodes() {
+			knownNodes[n.FriendlyName()] = true
+		}
+	}
+
+	unknownNodes := []string{}
+	for name := range nodeNames {
+		if !knownNodes[name] {
+			unknownNodes = append(unknownNodes, name)
+		}
+	}
+	sort.Strings(unknownNodes)
+
+	for _, name := range unknownNodes {
+		logger.Log.Warnf("Node '%s' from '%s' is not in any graph.", name, path)
+	}
+	return
+}
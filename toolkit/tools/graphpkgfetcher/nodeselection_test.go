@@ -0,0 +1,227 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldOrderNodesAfterTheirDependencies(t *testing.T) {
+	g := pkggraph.NewPkgGraph()
+	addNode := func(name string) *pkggraph.PkgNode {
+		node, err := g.AddPkgNode(&pkgjson.PackageVer{Name: name}, pkggraph.StateUnresolved, pkggraph.TypeRemoteRun, pkggraph.NoSRPMPath, pkggraph.NoRPMPath, pkggraph.NoSpecPath, pkggraph.NoSourceDir, pkggraph.NoArchitecture, pkggraph.NoSourceRepo)
+		assert.NoError(t, err)
+		return node
+	}
+
+	app := addNode("app")
+	lib := addNode("lib")
+	cycleA := addNode("cycle-a")
+	cycleB := addNode("cycle-b")
+	base := addNode("base")
+
+	// Edges point from a dependant to its dependency.
+	assert.NoError(t, g.AddEdge(app, lib))
+	assert.NoError(t, g.AddEdge(lib, cycleA))
+	assert.NoError(t, g.AddEdge(cycleA, cycleB))
+	assert.NoError(t, g.AddEdge(cycleB, cycleA))
+	assert.NoError(t, g.AddEdge(cycleB, base))
+
+	ordered := orderByDependencies(g, []*pkggraph.PkgNode{app, cycleB, lib, base, cycleA})
+	assert.Equal(t, []*pkggraph.PkgNode{base, cycleB, cycleA, lib, app}, ordered)
+}
+
+func TestShouldNotConstructClonerInDryRun(t *testing.T) {
+	oldDryRun, oldTmpDir, oldOutDir, oldWorkerTar := *dryRun, *tmpDir, *outDir, *workertar
+	defer func() {
+		*dryRun, *tmpDir, *outDir, *workertar = oldDryRun, oldTmpDir, oldOutDir, oldWorkerTar
+	}()
+
+	// Any attempt to create the worker environment fails with these paths.
+	notADir := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, os.WriteFile(notADir, []byte{}, 0644))
+	*dryRun, *tmpDir, *outDir, *workertar = true, notADir, notADir, filepath.Join(t.TempDir(), "missing.tar.gz")
+
+	g := pkggraph.NewPkgGraph()
+	for _, name := range []string{"zlib", "gcc"} {
+		_, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+		assert.NoError(t, err)
+	}
+
+	nodeCount, err := reportDryRun([]*pkggraph.PkgGraph{g}, []string{"graph.dot"}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, nodeCount)
+
+	err = fetchPackages(context.Background(), []*pkggraph.PkgGraph{g}, []string{"graph.dot"}, true, true, nil, nil)
+	assert.NoError(t, err)
+	for _, n := range g.AllRunNodes() {
+		assert.Equal(t, pkggraph.StateUnresolved, n.State)
+		assert.Equal(t, pkggraph.NoRPMPath, n.RpmPath)
+	}
+}
+
+func TestShouldListOnlyUnresolvedNodes(t *testing.T) {
+	g := pkggraph.NewPkgGraph()
+	_, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "zlib", Condition: ">=", Version: "1.2.13"})
+	assert.NoError(t, err)
+	implicitNode, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "/bin/sh"})
+	assert.NoError(t, err)
+	implicitNode.Implicit = true
+	resolvedNode, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "gcc"})
+	assert.NoError(t, err)
+	resolvedNode.State = pkggraph.StateCached
+
+	listFile := filepath.Join(t.TempDir(), "unresolved.json")
+	assert.NoError(t, writeUnresolvedList(listFile, []*pkggraph.PkgGraph{g}, []string{"graph.dot"}))
+
+	var entries []unresolvedNodeEntry
+	assert.NoError(t, jsonutils.ReadJSONFile(listFile, &entries))
+	assert.ElementsMatch(t, []unresolvedNodeEntry{
+		{Graph: "graph.dot", Node: "zlib--REMOTE<Unresolved>", Name: "zlib", Condition: ">=", Version: "1.2.13"},
+		{Graph: "graph.dot", Node: "/bin/sh--REMOTE<Unresolved>", Name: "/bin/sh", Implicit: true},
+	}, entries)
+}
+
+func TestShouldResolveNodesInDeterministicOrder(t *testing.T) {
+	resolveAndReport := func(names []string) (outcomes []nodeOutcome) {
+		g := pkggraph.NewPkgGraph()
+		for _, name := range names {
+			_, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+			assert.NoError(t, err)
+		}
+
+		unresolvedNodes, err := nodesToResolve(g)
+		assert.NoError(t, err)
+		unresolvedNodes = orderNodesToResolve(g, unresolvedNodes, true, false)
+
+		// 'missing' fails, so failures are ordered too.
+		cloner := &fakeCloner{missing: map[string]bool{"missing": true}}
+		packages := newFetchedPackageSet()
+		resolve := func(n *pkggraph.PkgNode) error {
+			_, err := resolveSingleNode(context.Background(), cloner, n, packages, newTestResolveOptions("/cache"))
+			return err
+		}
+
+		report := &fetchReport{}
+		resolveNodesConcurrently(context.Background(), unresolvedNodes, 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+			report.record(n, 0, resolveErr)
+			return true
+		})
+		return report.outcomes
+	}
+
+	firstRun := resolveAndReport([]string{"zlib", "missing", "bash", "gcc"})
+	secondRun := resolveAndReport([]string{"gcc", "bash", "zlib", "missing"})
+	assert.Equal(t, firstRun, secondRun)
+
+	nodeNames := []string{}
+	for _, outcome := range firstRun {
+		nodeNames = append(nodeNames, outcome.Node)
+	}
+	assert.Equal(t, []string{"bash--REMOTE<Cached>", "gcc--REMOTE<Cached>", "missing--REMOTE<Unresolved>", "zlib--REMOTE<Cached>"}, nodeNames)
+}
+
+func TestShouldOnlyResolveNodesOfTargetArch(t *testing.T) {
+	oldTargetArch := *targetArch
+	defer func() {
+		*targetArch = oldTargetArch
+	}()
+
+	g := pkggraph.NewPkgGraph()
+	addNode := func(name, rpmPath, arch string) {
+		_, err := g.AddPkgNode(&pkgjson.PackageVer{Name: name}, pkggraph.StateUnresolved, pkggraph.TypeRemoteRun, pkggraph.NoSRPMPath, rpmPath, pkggraph.NoSpecPath, pkggraph.NoSourceDir, arch, pkggraph.NoSourceRepo)
+		assert.NoError(t, err)
+	}
+	addNode("zlib", pkggraph.NoRPMPath, "x86_64")
+	addNode("glibc", pkggraph.NoRPMPath, "aarch64")
+	addNode("bash", "/rpms/aarch64/bash-5.1.8-1.cm2.aarch64.rpm", pkggraph.NoArchitecture)
+	addNode("ca-certificates", "/rpms/noarch/ca-certificates-2.0.0-1.cm2.noarch.rpm", pkggraph.NoArchitecture)
+	addNode("gcc", pkggraph.NoRPMPath, pkggraph.NoArchitecture)
+
+	*targetArch = "x86_64"
+	unresolvedNodes, err := nodesToResolve(g)
+	assert.NoError(t, err)
+
+	packages := newFetchedPackageSet()
+	for _, n := range unresolvedNodes {
+		_, err = resolveSingleNode(context.Background(), &fakeCloner{}, n, packages, newTestResolveOptions("/cache"))
+		assert.NoError(t, err)
+	}
+
+	states := make(map[string]pkggraph.NodeState)
+	for _, n := range g.AllRunNodes() {
+		states[n.VersionedPkg.Name] = n.State
+	}
+	assert.Equal(t, map[string]pkggraph.NodeState{
+		"zlib":            pkggraph.StateCached,
+		"glibc":           pkggraph.StateUnresolved,
+		"bash":            pkggraph.StateUnresolved,
+		"ca-certificates": pkggraph.StateCached,
+		"gcc":             pkggraph.StateCached,
+	}, states)
+
+	// Only nodes of other architectures are left.
+	assert.False(t, hasUnresolvedNodes(g))
+	*targetArch = "aarch64"
+	assert.True(t, hasUnresolvedNodes(g))
+}
+
+func TestShouldOnlyResolveListedNodes(t *testing.T) {
+	oldOnlyNodes := onlyNodes
+	defer func() {
+		onlyNodes = oldOnlyNodes
+	}()
+
+	g := pkggraph.NewPkgGraph()
+	nodes := make(map[string]*pkggraph.PkgNode)
+	for _, name := range []string{"bash", "glibc", "zlib"} {
+		node, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+		assert.NoError(t, err)
+		nodes[name] = node
+	}
+
+	onlyNodesFile := filepath.Join(t.TempDir(), "only-nodes.txt")
+	contents := fmt.Sprintf("%s\n%s\nmissing--REMOTE<Unresolved>\n", nodes["bash"].FriendlyName(), nodes["zlib"].FriendlyName())
+	assert.NoError(t, os.WriteFile(onlyNodesFile, []byte(contents), 0644))
+
+	hook := logtest.NewLocal(logger.Log)
+	defer hook.Reset()
+
+	var err error
+	onlyNodes, err = readOnlyNodes(onlyNodesFile, []*pkggraph.PkgGraph{g})
+	assert.NoError(t, err)
+
+	missingWarned := false
+	for _, entry := range hook.AllEntries() {
+		missingWarned = missingWarned || (entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "'missing--REMOTE<Unresolved>'"))
+	}
+	assert.True(t, missingWarned)
+
+	unresolvedNodes, err := nodesToResolve(g)
+	assert.NoError(t, err)
+
+	packages := newFetchedPackageSet()
+	for _, n := range unresolvedNodes {
+		_, err = resolveSingleNode(context.Background(), &fakeCloner{}, n, packages, newTestResolveOptions("/cache"))
+		assert.NoError(t, err)
+	}
+
+	assert.Equal(t, pkggraph.StateCached, nodes["bash"].State)
+	assert.Equal(t, pkggraph.StateUnresolved, nodes["glibc"].State)
+	assert.Equal(t, pkggraph.StateCached, nodes["zlib"].State)
+	assert.False(t, hasUnresolvedNodes(g))
+}
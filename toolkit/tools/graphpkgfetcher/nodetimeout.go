@@ -0,0 +1,70 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pausabletimeout"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+)
+
+// errNodeTimedOut marks nodes whose resolution ran past '--per-node-timeout' or their 'resolve-timeout' annotation.
+// Only that node fails, the fetch goes on.
+var errNodeTimedOut = errors.New("node resolution timed out")
+
+// nodeResolutionContext derives the context used to resolve a single node. The node's 'resolve-timeout' annotation,
+// if present and valid, takes precedence over 'defaultTimeout'. A non-positive timeout means no deadline.
+func nodeResolutionContext(ctx context.Context, node *pkggraph.PkgNode, defaultTimeout time.Duration) (nodeCtx context.Context, cancel context.CancelFunc) {
+	timeout := defaultTimeout
+	if timeoutOverride, found := node.Annotation(pkggraph.AnnotationResolveTimeout); found {
+		parsedTimeout, err := time.ParseDuration(timeoutOverride)
+		if err == nil {
+			logger.Log.Debugf("Using a resolution timeout of %s for '%s' from its annotation.", parsedTimeout, node.FriendlyName())
+			timeout = parsedTimeout
+		} else {
+			logger.Log.Warnf("Ignoring invalid '%s' annotation (%s) on '%s': %s", pkggraph.AnnotationResolveTimeout, timeoutOverride, node.FriendlyName(), err)
+		}
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return pausabletimeout.WithTimeout(ctx, timeout)
+}
+
+// nodeTimeoutError marks 'resolveErr' with errNodeTimedOut if the node's own deadline expired while the fetch's
+// context 'ctx' is still running. Cloner calls can't be interrupted, so a node only fails once the call in flight
+// when its deadline hits returns.
+func nodeTimeoutError(ctx, nodeCtx context.Context, resolveErr error) error {
+	if resolveErr == nil || ctx.Err() != nil || !errors.Is(nodeCtx.Err(), context.DeadlineExceeded) {
+		return resolveErr
+	}
+
+	deadline, _ := nodeCtx.Deadline()
+	return &nodeTimedOutError{deadline: deadline, err: resolveErr}
+}
+
+// nodeTimedOutError wraps the error of a node which ran past its own deadline. It matches errNodeTimedOut
+// and unwraps to the error the node's resolution stopped with.
+type nodeTimedOutError struct {
+	deadline time.Time
+	err      error
+}
+
+func (e *nodeTimedOutError) Error() string {
+	return fmt.Sprintf("%s (deadline %s):\n%s", errNodeTimedOut, e.deadline.Format(time.RFC3339), e.err)
+}
+
+func (e *nodeTimedOutError) Unwrap() error {
+	return e.err
+}
+
+func (e *nodeTimedOutError) Is(target error) bool {
+	return target == errNodeTimedOut
+}
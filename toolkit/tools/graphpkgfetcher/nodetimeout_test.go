@@ -0,0 +1,118 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldOnlyFailNodesExceedingPerNodeTimeout(t *testing.T) {
+	const (
+		lookupDelay    = 200 * time.Millisecond
+		perNodeTimeout = 50 * time.Millisecond
+	)
+
+	g := pkggraph.NewPkgGraph()
+	nodes := []*pkggraph.PkgNode{}
+	for _, name := range []string{"zlib", "huge-pkg", "bash"} {
+		n, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+		assert.NoError(t, err)
+		nodes = append(nodes, n)
+	}
+
+	ctx, cancel := fetchContext(0)
+	defer cancel()
+
+	cloner := &fakeCloner{lookupDelay: lookupDelay, slow: map[string]bool{"huge-pkg": true}}
+	packages := newFetchedPackageSet()
+	resolve := func(n *pkggraph.PkgNode) error {
+		nodeCtx, cancelNode := nodeResolutionContext(ctx, n, perNodeTimeout)
+		defer cancelNode()
+		_, err := resolveSingleNode(nodeCtx, cloner, n, packages, newTestResolveOptions("/cache"))
+		return nodeTimeoutError(ctx, nodeCtx, err)
+	}
+
+	report := &fetchReport{}
+	startedNodes := resolveNodesConcurrently(ctx, nodes, 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		report.record(n, 0, resolveErr)
+		return true
+	})
+
+	assert.Equal(t, len(nodes), startedNodes)
+	assert.Len(t, report.outcomes, len(nodes))
+	for _, outcome := range report.outcomes {
+		if outcome.Node == nodes[1].FriendlyName() {
+			assert.True(t, outcome.TimedOut)
+			assert.Contains(t, outcome.Error, errNodeTimedOut.Error())
+		} else {
+			assert.False(t, outcome.TimedOut, outcome.Node)
+			assert.Empty(t, outcome.Error, outcome.Node)
+		}
+	}
+	assert.Equal(t, pkggraph.StateUnresolved, nodes[1].State)
+	assert.Equal(t, pkggraph.StateCached, nodes[0].State)
+	assert.Equal(t, pkggraph.StateCached, nodes[2].State)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestShouldNotChargeNodesForWaitingOnTheCloner(t *testing.T) {
+	const (
+		nodeCount      = 4
+		lookupDelay    = 100 * time.Millisecond
+		perNodeTimeout = 250 * time.Millisecond
+	)
+
+	nodes := []*pkggraph.PkgNode{}
+	for i := 0; i < nodeCount; i++ {
+		nodes = append(nodes, &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: fmt.Sprintf("pkg%d", i)}, State: pkggraph.StateUnresolved})
+	}
+
+	ctx, cancel := fetchContext(0)
+	defer cancel()
+
+	// The lookups take longer than the timeout once they queued up behind each other.
+	cloner := &fakeCloner{lookupDelay: lookupDelay, serialized: true}
+	packages := newFetchedPackageSet()
+	resolve := func(n *pkggraph.PkgNode) error {
+		nodeCtx, cancelNode := nodeResolutionContext(ctx, n, perNodeTimeout)
+		defer cancelNode()
+		_, err := resolveSingleNode(nodeCtx, cloner, n, packages, newTestResolveOptions("/cache"))
+		return nodeTimeoutError(ctx, nodeCtx, err)
+	}
+
+	start := time.Now()
+	resolveNodesConcurrently(ctx, nodes, nodeCount, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		assert.NoError(t, resolveErr, n.FriendlyName())
+		return true
+	})
+
+	assert.GreaterOrEqual(t, time.Since(start), nodeCount*lookupDelay)
+	for _, n := range nodes {
+		assert.Equal(t, pkggraph.StateCached, n.State, n.FriendlyName())
+	}
+}
+
+func TestShouldNotLabelFetchTimeoutsAsNodeTimeouts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	nodeCtx, cancelNode := context.WithTimeout(ctx, time.Nanosecond)
+	defer cancelNode()
+	<-nodeCtx.Done()
+
+	resolveErr := fmt.Errorf("stopped resolving:\n%w", nodeCtx.Err())
+	timeoutErr := nodeTimeoutError(ctx, nodeCtx, resolveErr)
+	assert.ErrorIs(t, timeoutErr, errNodeTimedOut)
+	assert.ErrorIs(t, timeoutErr, context.DeadlineExceeded)
+	assert.Contains(t, timeoutErr.Error(), resolveErr.Error())
+	assert.NoError(t, nodeTimeoutError(ctx, nodeCtx, nil))
+
+	cancel()
+	assert.Equal(t, resolveErr, nodeTimeoutError(ctx, nodeCtx, resolveErr))
+}
@@ -0,0 +1,419 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/exe"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repoutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
+)
+
+// incrementalRepoUpdateBatchSize is the number of resolved nodes after which '--incremental-repo-updates' updates the repo metadata.
+const incrementalRepoUpdateBatchSize = 50
+
+// repoTagFileName is the name of the sidecar file describing the fetch which produced the output repo.
+const repoTagFileName = "repotag.json"
+
+// redactedArgument replaces the secrets in the arguments recorded by the repo tag.
+const redactedArgument = "REDACTED"
+
+// redactedArgumentFlags are the flags whose values are never recorded by the repo tag.
+var redactedArgumentFlags = map[string]bool{
+	"oci-username": true,
+}
+
+// urlCredentialsRegex matches the user information of URLs, like the credentials of '--https-proxy' or of a
+// '--repo-url' base URL, up to the '@'.
+var urlCredentialsRegex = regexp.MustCompile(`([[:alpha:]][[:alnum:]+.-]*://)[^/@\s]+@`)
+
+// repoTagMetadata describes the fetch which produced the output repo.
+type repoTagMetadata struct {
+	InputGraph            string            `json:"InputGraph"`
+	InputGraphSHA256      string            `json:"InputGraphSHA256"`
+	AdditionalInputGraphs map[string]string `json:"AdditionalInputGraphs,omitempty"` // Path -> SHA256 of every other input graph
+	ToolkitVersion        string            `json:"ToolkitVersion"`
+	Timestamp             string            `json:"Timestamp"`
+	Arguments             []string          `json:"Arguments"` // Without any credentials, see redactArguments
+}
+
+// convertRetryDelay is the delay before the first retry of a failed repo conversion, doubling with each attempt.
+var convertRetryDelay = 5 * time.Second
+
+// repoConverter turns the cloned RPMs into a repo.
+type repoConverter interface {
+	ConvertDownloadedPackagesIntoRepo() error
+}
+
+// kickstartPackageNames returns the sorted, unique package names of all run nodes which resolved to an RPM.
+func kickstartPackageNames(dependencyGraphs ...*pkggraph.PkgGraph) (packageNames []string) {
+	names := make(map[string]bool)
+	for _, dependencyGraph := range dependencyGraphs {
+		for _, n := range dependencyGraph.AllRunNodes() {
+			if n.State == pkggraph.StateUnresolved || n.RpmPath == "" || n.RpmPath == pkggraph.NoRPMPath {
+				continue
+			}
+			names[packageNameFromRPM(filepath.Base(n.RpmPath))] = true
+		}
+	}
+
+	packageNames = sliceutils.SetToSlice(names)
+	sort.Strings(packageNames)
+	return
+}
+
+// writeKickstartPackages writes the resolved package names as a Kickstart '%packages' section.
+// The graph has no notion of package groups, so only plain package names are written.
+func writeKickstartPackages(dependencyGraphs []*pkggraph.PkgGraph, outputFile string) (err error) {
+	const (
+		packagesSectionStart = "%packages"
+		packagesSectionEnd   = "%end"
+	)
+
+	packageNames := kickstartPackageNames(dependencyGraphs...)
+
+	lines := append([]string{packagesSectionStart}, packageNames...)
+	lines = append(lines, packagesSectionEnd)
+	err = file.WriteLines(lines, outputFile)
+	if err != nil {
+		return fmt.Errorf("failed to write '%s':\n%w", outputFile, err)
+	}
+
+	logger.Log.Infof("Wrote %d package(s) to the Kickstart package list '%s'.", len(packageNames), outputFile)
+	return
+}
+
+// savePartialRepo creates the output repo and summary from the packages cloned before the fetch was stopped, so they
+// can be reused by a rerun. Failures are only logged, the fetch already failed.
+func savePartialRepo(cloner *rpmrepocloner.RpmRepoCloner) {
+	err := convertIntoRepo(cloner, cloner.CloneDirectory(), *convertRetries)
+	if err != nil {
+		logger.Log.Errorf("Failed to convert the partially downloaded RPMs into a repo: %s", err)
+		return
+	}
+
+	if strings.TrimSpace(*outputSummaryFile) != "" {
+		err = repoutils.SaveClonedRepoContentsInFormat(cloner, *outputSummaryFile, *summaryFormat, *checksumAlgo)
+		if err != nil {
+			logger.Log.Errorf("Failed to save the partially cloned repo contents: %s", err)
+		}
+	}
+}
+
+// convertIntoRepo converts the RPMs in 'cloneDir' into a repo, retrying failed conversions up to 'retries' times.
+// A conversion failing because of malformed RPMs would fail again, so it is not retried.
+func convertIntoRepo(converter repoConverter, cloneDir string, retries int) (err error) {
+	delay := convertRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = converter.ConvertDownloadedPackagesIntoRepo()
+		if err == nil || attempt > retries {
+			return
+		}
+
+		malformedRPMs := findMalformedRPMs(cloneDir)
+		if len(malformedRPMs) != 0 {
+			return fmt.Errorf("not retrying the repo conversion, found malformed RPMs (%s):\n%w", strings.Join(malformedRPMs, ", "), err)
+		}
+
+		logger.Log.Warnf("Attempt %d/%d to convert the RPMs into a repo failed, retrying in %s. Error: %s", attempt, retries+1, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// findMalformedRPMs returns the names of the RPMs in 'cloneDir' whose headers can't be read.
+func findMalformedRPMs(cloneDir string) (malformedRPMs []string) {
+	rpmPaths, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil {
+		logger.Log.Warnf("Failed to list the RPMs in '%s': %s", cloneDir, err)
+		return
+	}
+
+	for _, rpmPath := range rpmPaths {
+		_, err = rpm.ReadPackageHeader(rpmPath)
+		if err != nil {
+			logger.Log.Warnf("Malformed RPM '%s': %s", rpmPath, err)
+			malformedRPMs = append(malformedRPMs, filepath.Base(rpmPath))
+		}
+	}
+	return
+}
+
+// listCachedRPMs returns the paths of the RPMs already present in the cache before fetching.
+func listCachedRPMs(cloneDir string) (cachedRPMs map[string]bool, err error) {
+	rpmPaths, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	cachedRPMs = sliceutils.SliceToSet(rpmPaths)
+	return
+}
+
+// cachedRPMChecksums returns the checksums of the cached RPMs as recorded in the metadata of the repo created by the
+// previous fetch, so they don't have to be hashed before fetching. RPMs missing from the metadata, or recorded with an
+// unsupported algorithm, are hashed instead.
+func cachedRPMChecksums(cloneDir string, cachedRPMs map[string]bool) (checksums map[string]string, err error) {
+	var recordedChecksums map[string]string
+	isRepo, err := file.PathExists(filepath.Join(cloneDir, rpmrepocloner.RepoMetadataFile))
+	if err != nil {
+		return
+	}
+	if isRepo {
+		repo, repoErr := rpmrepocloner.ReadLocalRepo(cloneDir)
+		if repoErr == nil {
+			recordedChecksums = repo.RPMChecksums()
+		} else {
+			logger.Log.Warnf("Failed to read the checksums of the cached packages from the repo metadata, hashing them instead:\n%s", repoErr)
+		}
+	}
+
+	hashedRPMs := 0
+	checksums = make(map[string]string, len(cachedRPMs))
+	for rpmPath := range cachedRPMs {
+		if checksum, found := recordedChecksums[rpmPath]; found && isSupportedChecksum(checksum) {
+			checksums[rpmPath] = checksum
+			continue
+		}
+
+		checksums[rpmPath], err = repoutils.GenerateChecksum(rpmPath, repoutils.ChecksumAlgorithmSHA256)
+		if err != nil {
+			return
+		}
+		hashedRPMs++
+	}
+
+	logger.Log.Debugf("Recorded the checksums of %d cached package(s), %d of them from the repo metadata.", len(checksums), len(checksums)-hashedRPMs)
+	return
+}
+
+// isSupportedChecksum returns true if the algorithm of an "<algorithm>:<hash>" checksum is one of the ChecksumAlgorithms.
+func isSupportedChecksum(checksum string) bool {
+	algorithm, _, _ := strings.Cut(checksum, ":")
+	return sliceutils.Contains(repoutils.ChecksumAlgorithms, algorithm, sliceutils.StringMatch)
+}
+
+// findMutatedPackages returns the names of the RPMs which are still in the cache under the same file name (NEVRA)
+// but whose contents no longer match the checksums recorded by cachedRPMChecksums.
+func findMutatedPackages(checksums map[string]string) (mutatedPackages []string, err error) {
+	for rpmPath, oldChecksum := range checksums {
+		exists, err := file.PathExists(rpmPath)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+
+		algorithm, _, _ := strings.Cut(oldChecksum, ":")
+		newChecksum, err := repoutils.GenerateChecksum(rpmPath, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if newChecksum != oldChecksum {
+			mutatedPackages = append(mutatedPackages, filepath.Base(rpmPath))
+		}
+	}
+
+	sort.Strings(mutatedPackages)
+	return
+}
+
+// checkCacheImmutability fails if any package was re-fetched under an unchanged NEVRA but with different contents.
+// Such packages were rebuilt without a version bump or tampered with.
+func checkCacheImmutability(cloneDir string, cachedChecksums map[string]string) (err error) {
+	timestamp.StartEvent("check cache immutability", nil)
+	defer timestamp.StopEvent(nil)
+
+	mutatedPackages, err := findMutatedPackages(cachedChecksums)
+	if err != nil {
+		return fmt.Errorf("failed to verify the checksums of the cached packages in '%s':\n%w", cloneDir, err)
+	}
+
+	if len(mutatedPackages) == 0 {
+		return
+	}
+
+	for _, mutatedPackage := range mutatedPackages {
+		logger.Log.Warnf("!!! '%s' was republished with the same NEVRA but different contents !!!", mutatedPackage)
+	}
+	return fmt.Errorf("%d cached package(s) changed contents without a version change", len(mutatedPackages))
+}
+
+// isRepoUpToDate checks if the clone directory already is a repo whose metadata indexes exactly the RPMs in the directory,
+// with unchanged contents, so creating the repo again can be skipped.
+// RPMs restored from a summary, downloaded, left behind by an interrupted run, re-fetched with different contents,
+// or removed since the metadata was created all require a new repo.
+func isRepoUpToDate(cloneDir string) (upToDate bool, err error) {
+	isRepo, err := file.PathExists(filepath.Join(cloneDir, rpmrepocloner.RepoMetadataFile))
+	if err != nil || !isRepo {
+		return
+	}
+
+	repo, err := rpmrepocloner.ReadLocalRepo(cloneDir)
+	if err != nil {
+		logger.Log.Warnf("Failed to read the metadata of the repo in '%s', it will be recreated:\n%s", cloneDir, err)
+		return false, nil
+	}
+	indexedChecksums := repo.RPMChecksums()
+
+	rpmPaths, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil || len(rpmPaths) != len(indexedChecksums) {
+		return
+	}
+	for _, rpmPath := range rpmPaths {
+		indexedChecksum, found := indexedChecksums[rpmPath]
+		if !found || !isSupportedChecksum(indexedChecksum) {
+			logger.Log.Debugf("'%s' is not indexed by the repo metadata.", rpmPath)
+			return false, nil
+		}
+
+		algorithm, _, _ := strings.Cut(indexedChecksum, ":")
+		checksum, err := repoutils.GenerateChecksum(rpmPath, algorithm)
+		if err != nil {
+			return false, err
+		}
+		if checksum != indexedChecksum {
+			logger.Log.Debugf("'%s' changed since the repo metadata was created.", rpmPath)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// writeRepoTag writes a sidecar file into the repo directory recording how the repo was produced.
+func writeRepoTag(repoDir string, inputGraphFiles []string) (err error) {
+	tag := repoTagMetadata{
+		ToolkitVersion: exe.ToolkitVersion,
+		Timestamp:      time.Now().UTC().Format(time.RFC3339),
+		Arguments:      redactArguments(os.Args[1:]),
+	}
+
+	for i, inputGraphFile := range inputGraphFiles {
+		graphHash, err := file.GenerateSHA256(inputGraphFile)
+		if err != nil {
+			return fmt.Errorf("failed to hash input graph '%s':\n%w", inputGraphFile, err)
+		}
+
+		if i == 0 {
+			tag.InputGraph = inputGraphFile
+			tag.InputGraphSHA256 = graphHash
+			continue
+		}
+
+		if tag.AdditionalInputGraphs == nil {
+			tag.AdditionalInputGraphs = make(map[string]string)
+		}
+		tag.AdditionalInputGraphs[inputGraphFile] = graphHash
+	}
+
+	tagPath := filepath.Join(repoDir, repoTagFileName)
+	logger.Log.Infof("Tagging output repo with fetch metadata (%s)", tagPath)
+	return jsonutils.WriteJSONFile(tagPath, tag)
+}
+
+// redactArguments returns a copy of the command line arguments without the values of redactedArgumentFlags and
+// without any credentials embedded in URLs.
+func redactArguments(args []string) (redacted []string) {
+	redacted = make([]string, 0, len(args))
+	redactNext := false
+	for _, arg := range args {
+		switch {
+		case redactNext:
+			arg = redactedArgument
+			redactNext = false
+		case strings.HasPrefix(arg, "--"):
+			flagName, _, hasValue := strings.Cut(strings.TrimPrefix(arg, "--"), "=")
+			if redactedArgumentFlags[flagName] {
+				if hasValue {
+					arg = fmt.Sprintf("--%s=%s", flagName, redactedArgument)
+				} else {
+					redactNext = true
+				}
+			}
+		}
+
+		redacted = append(redacted, urlCredentialsRegex.ReplaceAllString(arg, "${1}"+redactedArgument+"@"))
+	}
+	return
+}
+
+// updateRepoMetadata publishes the packages cloned so far as a repo, making them available to consumers
+// before the whole graph is resolved. Failures are not fatal, the repo is updated again once cloning finishes.
+func updateRepoMetadata(cloner *rpmrepocloner.RpmRepoCloner, newlyResolvedNodes int) {
+	logger.Log.Infof("Updating the repo metadata after resolving %d more node(s).", newlyResolvedNodes)
+	err := cloner.ConvertDownloadedPackagesIntoRepo()
+	if err != nil {
+		logger.Log.Warnf("Failed to incrementally update the repo metadata: %s", err)
+	}
+}
+
+// pruneOrphanedRPMs deletes the RPMs in 'cloneDir' which are neither the RPM of any node in the graphs nor in
+// 'clonedRPMs', the packages cloned by this run including the dependencies pulled in with them. With 'listOnly'
+// the orphans are only logged. Returns the number of bytes reclaimed, or which would be reclaimed.
+func pruneOrphanedRPMs(dependencyGraphs []*pkggraph.PkgGraph, cloneDir string, clonedRPMs map[string]rpmrepocloner.ClonedPackage, listOnly bool) (reclaimedBytes int64, err error) {
+	referencedRPMs := make(map[string]bool)
+	for _, dependencyGraph := range dependencyGraphs {
+		for _, n := range dependencyGraph.AllNodes() {
+			if n.RpmPath == "" || n.RpmPath == pkggraph.NoRPMPath {
+				continue
+			}
+			referencedRPMs[filepath.Base(n.RpmPath)] = true
+		}
+	}
+
+	rpmPaths, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	orphanCount := 0
+	for _, rpmPath := range rpmPaths {
+		rpmFile := filepath.Base(rpmPath)
+		if _, cloned := clonedRPMs[rpmFile]; cloned || referencedRPMs[rpmFile] {
+			continue
+		}
+
+		var rpmInfo os.FileInfo
+		rpmInfo, err = os.Stat(rpmPath)
+		if err != nil {
+			return
+		}
+
+		orphanCount++
+		reclaimedBytes += rpmInfo.Size()
+		if listOnly {
+			logger.Log.Infof("Dry run: would prune orphaned RPM '%s' (%s).", rpmFile, formatBytes(rpmInfo.Size()))
+			continue
+		}
+
+		logger.Log.Infof("Pruning orphaned RPM '%s' (%s).", rpmFile, formatBytes(rpmInfo.Size()))
+		err = os.Remove(rpmPath)
+		if err != nil {
+			return reclaimedBytes, fmt.Errorf("failed to remove orphaned RPM '%s':\n%w", rpmPath, err)
+		}
+	}
+
+	if listOnly {
+		logger.Log.Infof("Dry run: would prune %d orphaned RPM(s), reclaiming %s.", orphanCount, formatBytes(reclaimedBytes))
+	} else {
+		logger.Log.Infof("Pruned %d orphaned RPM(s), reclaimed %s.", orphanCount, formatBytes(reclaimedBytes))
+	}
+	return
+}
@@ -0,0 +1,197 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
+)
+
+const (
+	rpmPackageNameIndex    = 1
+	rpmPackageVersionIndex = 2
+)
+
+// rpmPackageNameRegex splits a fully qualified package "<name>-<version>-<release>.<arch>" to extract its name
+// and its "<version>-<release>".
+var rpmPackageNameRegex = regexp.MustCompile(`^(.+)-([^-]+-[^-]+)\.[^.]+$`)
+
+// packageNameFromRPM extracts the package name from a fully qualified package (e.g. "pkg-debuginfo-1.0-1.cm2.x86_64"),
+// optionally ending with ".rpm". Returns the input unchanged if it is not in the expected format.
+func packageNameFromRPM(rpmPackage string) string {
+	matches := rpmPackageNameRegex.FindStringSubmatch(strings.TrimSuffix(rpmPackage, ".rpm"))
+	if matches == nil {
+		return rpmPackage
+	}
+	return matches[rpmPackageNameIndex]
+}
+
+// distinctPackageNames returns the sorted names of the packages in 'rpmPackages', ignoring their versions.
+func distinctPackageNames(rpmPackages []string) (names []string) {
+	uniqueNames := make(map[string]bool)
+	for _, rpmPackage := range rpmPackages {
+		uniqueNames[packageNameFromRPM(rpmPackage)] = true
+	}
+
+	names = sliceutils.SetToSlice(uniqueNames)
+	sort.Strings(names)
+	return
+}
+
+// lowestVersionPackage returns the fully qualified package with the lowest "<version>-<release>".
+// Packages with equal versions are ordered by name.
+func lowestVersionPackage(rpmPackages []string) (lowestPackage string) {
+	sortedPackages := make([]string, len(rpmPackages))
+	copy(sortedPackages, rpmPackages)
+	sort.Strings(sortedPackages)
+	sort.SliceStable(sortedPackages, func(i, j int) bool {
+		return rpm.CompareVersions(packageVersionFromRPM(sortedPackages[i]), packageVersionFromRPM(sortedPackages[j])) < 0
+	})
+
+	return sortedPackages[0]
+}
+
+// highestVersionPackage returns the fully qualified package with the highest "<version>-<release>".
+// Packages with equal versions are ordered by name.
+func highestVersionPackage(rpmPackages []string) (highestPackage string) {
+	return sortByVersionDescending(rpmPackages)[0]
+}
+
+// sortByVersionDescending returns a copy of the fully qualified packages, sorted from the highest to the lowest
+// "<version>-<release>". Packages with equal versions are ordered by name, so the result does not depend on the input order.
+func sortByVersionDescending(rpmPackages []string) (sortedPackages []string) {
+	sortedPackages = make([]string, len(rpmPackages))
+	copy(sortedPackages, rpmPackages)
+	sort.Strings(sortedPackages)
+	sort.SliceStable(sortedPackages, func(i, j int) bool {
+		return rpm.CompareVersions(packageVersionFromRPM(sortedPackages[i]), packageVersionFromRPM(sortedPackages[j])) > 0
+	})
+
+	return
+}
+
+// packageVersionFromRPM extracts the "<version>-<release>" from a fully qualified package, optionally ending with ".rpm".
+// Returns an empty string if it is not in the expected format.
+func packageVersionFromRPM(rpmPackage string) string {
+	matches := rpmPackageNameRegex.FindStringSubmatch(strings.TrimSuffix(rpmPackage, ".rpm"))
+	if matches == nil {
+		return ""
+	}
+	return matches[rpmPackageVersionIndex]
+}
+
+func hasExcludedSuffix(packageName string, excludedSuffixes []string) bool {
+	for _, suffix := range excludedSuffixes {
+		if suffix != "" && strings.HasSuffix(packageName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterExcludedSubpackages removes all fully qualified packages whose name ends with one of the excluded suffixes.
+func filterExcludedSubpackages(rpmPackages, excludedSuffixes []string) (filteredPackages []string) {
+	for _, rpmPackage := range rpmPackages {
+		if hasExcludedSuffix(packageNameFromRPM(rpmPackage), excludedSuffixes) {
+			logger.Log.Debugf("Ignoring excluded subpackage '%s'.", rpmPackage)
+			continue
+		}
+		filteredPackages = append(filteredPackages, rpmPackage)
+	}
+	return
+}
+
+// matchesPackage returns true if 'pattern' is the fully qualified package (e.g. "openssl-1.1.1k-9.cm2.x86_64") or
+// a prefix of it ending at a NEVRA component boundary ('-' or '.') which covers at least the whole package name.
+// E.g. "openssl" and "openssl-1.1.1k" match the package above, while "openssl-li" or "openss" do not.
+func matchesPackage(rpmPackage, pattern string) bool {
+	if pattern == "" || !strings.HasPrefix(rpmPackage, pattern) {
+		return false
+	}
+	if len(pattern) < len(packageNameFromRPM(rpmPackage)) {
+		return false
+	}
+	return len(pattern) == len(rpmPackage) || strings.ContainsRune("-.", rune(rpmPackage[len(pattern)]))
+}
+
+// filterExcludedPackages removes all fully qualified packages matching one of the excluded packages.
+func filterExcludedPackages(rpmPackages []string, excludedPackages map[string]bool) (filteredPackages []string) {
+	if len(excludedPackages) == 0 {
+		return rpmPackages
+	}
+
+	for _, rpmPackage := range rpmPackages {
+		if isExcludedPackage(rpmPackage, excludedPackages) {
+			logger.Log.Debugf("Ignoring excluded package '%s'.", rpmPackage)
+			continue
+		}
+		filteredPackages = append(filteredPackages, rpmPackage)
+	}
+	return
+}
+
+// isExcludedPackage returns true if the fully qualified package matches one of the excluded packages.
+func isExcludedPackage(rpmPackage string, excludedPackages map[string]bool) bool {
+	for excludedPackage := range excludedPackages {
+		if matchesPackage(rpmPackage, excludedPackage) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedPackagesIn returns the sorted RPM files among a node's 'clonedPackages' matching one of the excluded packages.
+func excludedPackagesIn(clonedPackages map[string]string, excludedPackages map[string]bool) (excludedRPMs []string) {
+	for rpmFile := range clonedPackages {
+		if isExcludedPackage(strings.TrimSuffix(rpmFile, ".rpm"), excludedPackages) {
+			excludedRPMs = append(excludedRPMs, rpmFile)
+		}
+	}
+
+	sort.Strings(excludedRPMs)
+	return
+}
+
+// removeExcludedSubpackages deletes all RPMs from the clone directory whose package name ends with one of the
+// excluded suffixes. RPMs used by a node of the graph, or matching a package a node requires by name, are kept.
+func removeExcludedSubpackages(dependencyGraphs []*pkggraph.PkgGraph, cloneDir string, excludedSuffixes []string) (err error) {
+	requiredRPMs := make(map[string]bool)
+	requiredPackages := make(map[string]bool)
+	for _, dependencyGraph := range dependencyGraphs {
+		for _, n := range dependencyGraph.AllRunNodes() {
+			requiredRPMs[filepath.Base(n.RpmPath)] = true
+			requiredPackages[n.VersionedPkg.Name] = true
+		}
+	}
+
+	clonedRPMs, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	for _, rpmPath := range clonedRPMs {
+		rpmFile := filepath.Base(rpmPath)
+		packageName := packageNameFromRPM(rpmFile)
+		if !hasExcludedSuffix(packageName, excludedSuffixes) || requiredRPMs[rpmFile] || requiredPackages[packageName] {
+			continue
+		}
+
+		logger.Log.Debugf("Removing excluded subpackage '%s' from the cache.", rpmFile)
+		err = os.Remove(rpmPath)
+		if err != nil {
+			return fmt.Errorf("failed to remove excluded subpackage '%s':\n%w", rpmPath, err)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldPickLowestVersionPackage(t *testing.T) {
+	candidates := []string{
+		"openssl-1.1.1k-10.cm2.x86_64",
+		"openssl-1.1.1k-9.cm2.x86_64",
+		"openssl-3.0.8-1.cm2.x86_64",
+		"libressl-1.1.1k-9.cm2.x86_64",
+	}
+
+	assert.Equal(t, "libressl-1.1.1k-9.cm2.x86_64", lowestVersionPackage(candidates))
+	assert.Equal(t, "1.1.1k-10.cm2", packageVersionFromRPM("openssl-1.1.1k-10.cm2.x86_64.rpm"))
+}
+
+func TestShouldPickHighestVersionPackage(t *testing.T) {
+	candidates := []string{
+		"openssl-3.0.8-1.cm2.x86_64",
+		"openssl-3.0.8~rc1-1.cm2.x86_64",
+		"openssl-1.1.1k-10.cm2.x86_64",
+		"libressl-3.0.8-1.cm2.x86_64",
+	}
+
+	assert.Equal(t, "libressl-3.0.8-1.cm2.x86_64", highestVersionPackage(candidates))
+}
+
+func TestShouldMatchPackagesByNEVRAPrefix(t *testing.T) {
+	const rpmPackage = "openssl-1.1.1k-9.cm2.x86_64"
+
+	for _, pattern := range []string{"openssl", "openssl-1.1.1k", "openssl-1.1.1k-9", "openssl-1.1.1k-9.cm2", rpmPackage} {
+		assert.True(t, matchesPackage(rpmPackage, pattern), pattern)
+	}
+	for _, pattern := range []string{"", "openss", "openssl-1.1.1", "openssl-1.1.1k-", "openssl-libs"} {
+		assert.False(t, matchesPackage(rpmPackage, pattern), pattern)
+	}
+	assert.False(t, matchesPackage("openssl-libs-1.1.1k-9.cm2.x86_64", "openssl"))
+}
+
+func TestShouldPickNewestReleaseRegardlessOfOrder(t *testing.T) {
+	candidates := []string{
+		"zlib-1.2.13-9.cm2.x86_64",
+		"zlib-1.2.13-10.cm2.x86_64",
+		"zlib-1.2.13-2.cm2.x86_64",
+	}
+	expected := []string{"zlib-1.2.13-10.cm2.x86_64", "zlib-1.2.13-9.cm2.x86_64", "zlib-1.2.13-2.cm2.x86_64"}
+
+	orderings := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+	for _, ordering := range orderings {
+		shuffled := []string{}
+		for _, i := range ordering {
+			shuffled = append(shuffled, candidates[i])
+		}
+
+		assert.Equal(t, expected, sortByVersionDescending(shuffled), "order %v", ordering)
+		assert.Equal(t, expected[0], highestVersionPackage(shuffled), "order %v", ordering)
+	}
+}
+
+func TestShouldOnlyRemoveUnrequiredExcludedSubpackages(t *testing.T) {
+	cloneDir := t.TempDir()
+	for _, rpmName := range []string{"zlib-1.2.13-1.cm2.x86_64.rpm", "zlib-debuginfo-1.2.13-1.cm2.x86_64.rpm", "glibc-debuginfo-2.35-3.cm2.x86_64.rpm", "gtk3-docs-3.24.28-1.cm2.noarch.rpm"} {
+		err := os.WriteFile(filepath.Join(cloneDir, rpmName), []byte(rpmName), 0644)
+		assert.NoError(t, err)
+	}
+
+	// 'glibc-debuginfo' is explicitly required, so it is kept despite its suffix.
+	g := pkggraph.NewPkgGraph()
+	_, err := g.AddPkgNode(&pkgjson.PackageVer{Name: "zlib"}, pkggraph.StateCached, pkggraph.TypeRemoteRun, pkggraph.NoSRPMPath, filepath.Join(cloneDir, "zlib-1.2.13-1.cm2.x86_64.rpm"), pkggraph.NoSpecPath, pkggraph.NoSourceDir, pkggraph.NoArchitecture, pkggraph.NoSourceRepo)
+	assert.NoError(t, err)
+	_, err = g.AddPkgNode(&pkgjson.PackageVer{Name: "glibc-debuginfo"}, pkggraph.StateUnresolved, pkggraph.TypeRemoteRun, pkggraph.NoSRPMPath, pkggraph.NoRPMPath, pkggraph.NoSpecPath, pkggraph.NoSourceDir, pkggraph.NoArchitecture, pkggraph.NoSourceRepo)
+	assert.NoError(t, err)
+
+	err = removeExcludedSubpackages([]*pkggraph.PkgGraph{g}, cloneDir, []string{"-debuginfo", "", "-docs"})
+	assert.NoError(t, err)
+
+	remainingRPMs, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(cloneDir, "zlib-1.2.13-1.cm2.x86_64.rpm"),
+		filepath.Join(cloneDir, "glibc-debuginfo-2.35-3.cm2.x86_64.rpm"),
+	}, remainingRPMs)
+}
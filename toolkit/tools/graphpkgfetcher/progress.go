@@ -0,0 +1,464 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/eventstream"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/tracing"
+)
+
+// nodeLogFileNameRegex matches characters which are replaced when turning a node's name into a log file name.
+var nodeLogFileNameRegex = regexp.MustCompile(`[^[:alnum:]._+-]+`)
+
+// nodeOutcome records how a single unresolved node was resolved.
+type nodeOutcome struct {
+	Node       string `json:"-"`
+	State      string `json:"State"`
+	Package    string `json:"Package"`
+	Prebuilt   bool   `json:"Prebuilt"`
+	Candidates int    `json:"Candidates"`       // Packages providing the node which were considered
+	Mirror     string `json:"Mirror,omitempty"` // Base URL of the mirror the package was cloned from, if its repo has mirrors
+	TimedOut   bool   `json:"TimedOut,omitempty"`
+	Error      string `json:"Error"`
+}
+
+// downloadSummary sums up the RPMs cloned while resolving the graphs.
+type downloadSummary struct {
+	DownloadedPackages int   `json:"DownloadedPackages"`
+	DownloadedBytes    int64 `json:"DownloadedBytes"`
+	CacheHits          int   `json:"CacheHits"` // Packages copied from the local toolchain or built packages
+	CacheHitBytes      int64 `json:"CacheHitBytes"`
+}
+
+// fetchReport collects the outcomes of all unresolved nodes. A nil report records nothing.
+type fetchReport struct {
+	outcomes  []nodeOutcome
+	downloads *downloadSummary
+}
+
+// fetchReportContents is the layout of the '--report-file'.
+type fetchReportContents struct {
+	Nodes     map[string]nodeOutcome `json:"Nodes"` // Keyed by the nodes' friendly names
+	Downloads *downloadSummary       `json:"Downloads,omitempty"`
+}
+
+// resolutionEvent is streamed over '--progress-socket' for every processed node.
+type resolutionEvent struct {
+	Time      string `json:"Time"`
+	Node      string `json:"Node"`
+	Event     string `json:"Event"` // One of the resolutionEvent* constants
+	RPM       string `json:"RPM,omitempty"`
+	Error     string `json:"Error,omitempty"`
+	Processed int    `json:"Processed"` // Nodes processed so far, including this one
+	Total     int    `json:"Total"`
+}
+
+const (
+	resolutionEventResolved     = "resolved"
+	resolutionEventHostProvided = "host-provided"
+	resolutionEventFailed       = "failed"
+)
+
+// providerRepos records every repo offering a provider for a resolved node.
+type providerRepos struct {
+	Node                string              `json:"Node"`
+	ChosenRPM           string              `json:"ChosenRPM"`
+	ProvidersByRepo     map[string][]string `json:"ProvidersByRepo"`
+	OverlappingPackages []string            `json:"OverlappingPackages"` // Packages offered by more than one repo
+}
+
+// progressReporter periodically logs how many of the nodes to resolve were processed.
+type progressReporter struct {
+	total      int
+	processed  int
+	failed     int
+	interval   time.Duration
+	nodeStep   int
+	lastReport time.Time
+	now        func() time.Time
+}
+
+// newProgressReporter creates a reporter for 'total' nodes logging at most every 'interval'.
+// Graphs with at least 100 nodes are also reported every 10% of nodes. Smaller ones are only reported by time,
+// so they don't log a line for almost every node.
+// A non-positive interval disables the reporter.
+func newProgressReporter(total int, interval time.Duration) (reporter *progressReporter) {
+	const (
+		progressMinNodesForStep = 100
+		progressStepsCount      = 10
+	)
+
+	reporter = &progressReporter{
+		total:    total,
+		interval: interval,
+		now:      time.Now,
+	}
+	if total >= progressMinNodesForStep {
+		reporter.nodeStep = total / progressStepsCount
+	}
+	reporter.lastReport = reporter.now()
+
+	return
+}
+
+func (p *progressReporter) enabled() bool {
+	return p.interval > 0
+}
+
+// record counts a processed node and logs the progress if the interval elapsed or another step of nodes was reached.
+func (p *progressReporter) record(failed bool) {
+	if !p.enabled() {
+		return
+	}
+
+	p.processed++
+	if failed {
+		p.failed++
+	}
+
+	now := p.now()
+	stepReached := p.nodeStep > 0 && p.processed%p.nodeStep == 0
+	if !stepReached && now.Sub(p.lastReport) < p.interval {
+		return
+	}
+
+	p.lastReport = now
+	logger.Log.Infof("Resolved %d/%d nodes (%d%%), %d failure(s) so far.", p.processed, p.total, (p.processed*100)/p.total, p.failed)
+}
+
+// dependencyCounter checks how many RPMs each node's resolution needed.
+type dependencyCounter struct {
+	limit int
+}
+
+// newDependencyCounter creates a counter allowing 'limit' RPMs per node. A non-positive limit disables the counter.
+func newDependencyCounter(limit int) *dependencyCounter {
+	return &dependencyCounter{limit: limit}
+}
+
+func (c *dependencyCounter) enabled() bool {
+	return c.limit > 0
+}
+
+func (c *dependencyCounter) exceeded(pulledPackages []string) bool {
+	return c.enabled() && len(pulledPackages) > c.limit
+}
+
+// pulledPackages returns the sorted names of the RPMs a node's clones needed, as listed by TDNF.
+// Packages cloned earlier for other nodes are still listed, so the result doesn't depend on the order of resolution.
+func (c *dependencyCounter) pulledPackages(clonedPackages map[string]string) (pulledPackages []string) {
+	if !c.enabled() {
+		return
+	}
+
+	for rpmFile := range clonedPackages {
+		pulledPackages = append(pulledPackages, rpmFile)
+	}
+
+	sort.Strings(pulledPackages)
+	return
+}
+
+// reportExcessiveDependencies logs a node whose resolution pulled in more packages than allowed.
+func reportExcessiveDependencies(node *pkggraph.PkgNode, pulledPackages []string, limit int, isError bool) {
+	message := fmt.Sprintf("'%s' pulled in %d package(s), more than the limit of %d: %s",
+		node.VersionedPkg.Name, len(pulledPackages), limit, strings.Join(pulledPackages, ", "))
+	if isError {
+		logger.Log.Error(message)
+	} else {
+		logger.Log.Warn(message)
+	}
+}
+
+// failureLimit counts the nodes which failed to resolve against an optional limit.
+type failureLimit struct {
+	limit  int
+	failed int
+}
+
+// newFailureLimit creates a limit tolerating 'limit' failed nodes. A non-positive limit disables it.
+func newFailureLimit(limit int) *failureLimit {
+	return &failureLimit{limit: limit}
+}
+
+func (f *failureLimit) enabled() bool {
+	return f.limit > 0
+}
+
+func (f *failureLimit) exceeded() bool {
+	return f.enabled() && f.failed > f.limit
+}
+
+// record counts a processed node, logging once the limit is exceeded.
+func (f *failureLimit) record(failed bool) {
+	if !failed {
+		return
+	}
+
+	f.failed++
+	if f.enabled() && f.failed == f.limit+1 {
+		logger.Log.Errorf("%d node(s) failed to resolve, more than the '--max-failures' limit of %d. Not starting any more nodes.", f.failed, f.limit)
+	}
+}
+
+// byteBudget tracks the bytes downloaded into the clone directory against an optional limit.
+type byteBudget struct {
+	limit    int64
+	used     int64
+	cloneDir string
+	counted  map[string]bool
+}
+
+// newByteBudget creates a budget of 'limit' bytes for the RPMs downloaded into 'cloneDir'. A non-positive limit disables the budget.
+func newByteBudget(limit int64, cloneDir string) *byteBudget {
+	return &byteBudget{
+		limit:    limit,
+		cloneDir: cloneDir,
+		counted:  make(map[string]bool),
+	}
+}
+
+func (b *byteBudget) enabled() bool {
+	return b.limit > 0
+}
+
+func (b *byteBudget) exhausted() bool {
+	return b.enabled() && b.used >= b.limit
+}
+
+// charge counts the sizes of the RPMs a node's clones needed against the budget, each RPM only once.
+// 'downloads' are the RPMs the cloner added to the clone directory. Prebuilt ones were copied from local repos
+// and missing ones were already in the clone directory, neither counts. RPMs from '--oci-repo' are always downloaded.
+func (b *byteBudget) charge(clonedPackages map[string]string, downloads map[string]rpmrepocloner.ClonedPackage) {
+	if !b.enabled() {
+		return
+	}
+
+	for rpmFile, repoID := range clonedPackages {
+		if b.counted[rpmFile] {
+			continue
+		}
+		b.counted[rpmFile] = true
+
+		if repoID == ociRepoID {
+			rpmPath := filepath.Join(b.cloneDir, rpmFile)
+			rpmInfo, err := os.Stat(rpmPath)
+			if err != nil {
+				logger.Log.Warnf("Failed to get the size of '%s': %s", rpmPath, err)
+				continue
+			}
+			b.used += rpmInfo.Size()
+			continue
+		}
+
+		if download, found := downloads[rpmFile]; found && !download.Prebuilt {
+			b.used += download.Size
+		}
+	}
+}
+
+// findProviderRepos queries all enabled repos for the providers of a resolved node. Failures are not fatal since
+// the node is already resolved, the entry is simply left without any providers.
+func findProviderRepos(cloner *rpmrepocloner.RpmRepoCloner, node *pkggraph.PkgNode) (entry *providerRepos) {
+	entry = &providerRepos{
+		Node:      node.FriendlyName(),
+		ChosenRPM: filepath.Base(node.RpmPath),
+	}
+
+	providersByRepo, err := cloner.WhatProvidesByRepo(node.VersionedPkg)
+	if err != nil {
+		logger.Log.Warnf("Failed to find all repos providing '%v': %s", node.VersionedPkg, err)
+		return
+	}
+	entry.ProvidersByRepo = providersByRepo
+
+	reposPerPackage := make(map[string]map[string]bool)
+	for repoID, rpmPackages := range providersByRepo {
+		for _, rpmPackage := range rpmPackages {
+			packageName := packageNameFromRPM(rpmPackage)
+			if reposPerPackage[packageName] == nil {
+				reposPerPackage[packageName] = make(map[string]bool)
+			}
+			reposPerPackage[packageName][repoID] = true
+		}
+	}
+
+	for packageName, repos := range reposPerPackage {
+		if len(repos) > 1 {
+			entry.OverlappingPackages = append(entry.OverlappingPackages, packageName)
+		}
+	}
+	sort.Strings(entry.OverlappingPackages)
+
+	if len(entry.OverlappingPackages) > 0 {
+		logger.Log.Infof("Packages providing '%s' are offered by more than one repo: %v", node.VersionedPkg.Name, entry.OverlappingPackages)
+	}
+
+	return
+}
+
+// startNodeLog copies all debug logs into a separate file for the node under 'logDir', if set.
+// The returned function must be called once the node's resolution is done.
+func startNodeLog(logDir string, node *pkggraph.PkgNode) (stop func()) {
+	const nodeLogLevel = "debug"
+
+	stop = func() {}
+	if strings.TrimSpace(logDir) == "" {
+		return
+	}
+
+	logFileName := nodeLogFileNameRegex.ReplaceAllString(node.FriendlyName(), "_") + ".log"
+	stop, err := logger.StartFileLog(filepath.Join(logDir, logFileName), nodeLogLevel)
+	if err != nil {
+		logger.Log.Warnf("Failed to create a separate log for node '%s':\n%s", node.FriendlyName(), err)
+		stop = func() {}
+	}
+
+	return
+}
+
+// publishResolutionEvent streams the outcome of a node's resolution to the progress socket's clients.
+func publishResolutionEvent(progress *eventstream.Stream, node *pkggraph.PkgNode, processed, total int, hostProvided bool, resolveErr error) {
+	event := resolutionEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Node:      node.FriendlyName(),
+		Event:     resolutionEventResolved,
+		Processed: processed,
+		Total:     total,
+	}
+
+	switch {
+	case resolveErr != nil:
+		event.Event = resolutionEventFailed
+		event.Error = resolveErr.Error()
+	case hostProvided:
+		event.Event = resolutionEventHostProvided
+	default:
+		event.RPM = filepath.Base(node.RpmPath)
+	}
+
+	progress.Publish(event)
+}
+
+// endResolutionSpan records the outcome of resolving a node on its span and ends it.
+func endResolutionSpan(span *tracing.Span, node *pkggraph.PkgNode, resolveErr error) {
+	if span == nil {
+		return
+	}
+
+	span.SetAttribute("node", node.FriendlyName())
+	span.SetAttribute("repo", node.SourceRepo)
+	span.SetAttribute("success", resolveErr == nil)
+
+	var bytes int64
+	if resolveErr == nil {
+		rpmInfo, err := os.Stat(node.RpmPath)
+		if err == nil {
+			bytes = rpmInfo.Size()
+		}
+	} else {
+		span.SetAttribute("error", resolveErr.Error())
+	}
+	span.SetAttribute("bytes", bytes)
+
+	span.End()
+}
+
+// record adds the outcome of a node's resolution to the report.
+func (r *fetchReport) record(node *pkggraph.PkgNode, candidates int, resolveErr error) {
+	if r == nil {
+		return
+	}
+
+	outcome := nodeOutcome{
+		Node:       node.FriendlyName(),
+		State:      node.State.String(),
+		Prebuilt:   node.Type == pkggraph.TypePreBuilt,
+		Candidates: candidates,
+	}
+	if node.RpmPath != "" && node.RpmPath != pkggraph.NoRPMPath {
+		outcome.Package = filepath.Base(node.RpmPath)
+	}
+	if resolveErr != nil {
+		outcome.TimedOut = errors.Is(resolveErr, errNodeTimedOut)
+		outcome.Error = resolveErr.Error()
+	}
+	r.outcomes = append(r.outcomes, outcome)
+}
+
+// addMirrors records the mirror each node's package was cloned from, keyed by the packages' RPM file names.
+func (r *fetchReport) addMirrors(packageMirrors map[string]string) {
+	for i := range r.outcomes {
+		r.outcomes[i].Mirror = packageMirrors[r.outcomes[i].Package]
+	}
+}
+
+func (r *fetchReport) setDownloads(summary downloadSummary) {
+	if r == nil {
+		return
+	}
+	r.downloads = &summary
+}
+
+// write saves the recorded outcomes and the download summary into 'reportFile'.
+func (r *fetchReport) write(reportFile string) (err error) {
+	contents := fetchReportContents{
+		Nodes:     make(map[string]nodeOutcome, len(r.outcomes)),
+		Downloads: r.downloads,
+	}
+	for _, outcome := range r.outcomes {
+		contents.Nodes[outcome.Node] = outcome
+	}
+
+	err = jsonutils.WriteJSONFile(reportFile, contents)
+	if err != nil {
+		return fmt.Errorf("failed to write the fetch report to '%s':\n%w", reportFile, err)
+	}
+	return
+}
+
+// summarizeDownloads sums up the sizes of the cloned RPMs, separating the downloaded ones from the local cache hits.
+func summarizeDownloads(clonedPackages map[string]rpmrepocloner.ClonedPackage) (summary downloadSummary) {
+	for _, clonedPackage := range clonedPackages {
+		if clonedPackage.Prebuilt {
+			summary.CacheHits++
+			summary.CacheHitBytes += clonedPackage.Size
+		} else {
+			summary.DownloadedPackages++
+			summary.DownloadedBytes += clonedPackage.Size
+		}
+	}
+	return
+}
+
+// formatBytes returns a human-readable size using binary units, e.g. "3.7 GiB".
+func formatBytes(bytes int64) string {
+	const unit = 1024
+
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	value := float64(bytes) / unit
+	prefixes := "KMGTPE"
+	prefixIndex := 0
+	for value >= unit && prefixIndex < len(prefixes)-1 {
+		value /= unit
+		prefixIndex++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, prefixes[prefixIndex])
+}
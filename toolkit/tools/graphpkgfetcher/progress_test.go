@@ -0,0 +1,272 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldCountPackagesPulledInPerNode(t *testing.T) {
+	counter := newDependencyCounter(2)
+
+	pulledPackages := counter.pulledPackages(map[string]string{
+		"glibc-2.35-3.cm2.x86_64.rpm": "base",
+		"bash-5.1.8-2.cm2.x86_64.rpm": "base",
+	})
+	assert.Equal(t, []string{"bash-5.1.8-2.cm2.x86_64.rpm", "glibc-2.35-3.cm2.x86_64.rpm"}, pulledPackages)
+	assert.False(t, counter.exceeded(pulledPackages))
+
+	pulledPackages = counter.pulledPackages(map[string]string{
+		"zlib-1.2.13-1.cm2.x86_64.rpm":  "base",
+		"gtk3-3.24.28-1.cm2.x86_64.rpm": "extras",
+		"mesa-22.0.2-1.cm2.x86_64.rpm":  "extras",
+	})
+	assert.Equal(t, []string{"gtk3-3.24.28-1.cm2.x86_64.rpm", "mesa-22.0.2-1.cm2.x86_64.rpm", "zlib-1.2.13-1.cm2.x86_64.rpm"}, pulledPackages)
+	assert.True(t, counter.exceeded(pulledPackages))
+
+	disabledCounter := newDependencyCounter(0)
+	assert.Empty(t, disabledCounter.pulledPackages(map[string]string{"zlib-1.2.13-1.cm2.x86_64.rpm": "base"}))
+}
+
+func TestShouldSumUpDownloadedBytes(t *testing.T) {
+	const mib = 1024 * 1024
+
+	cloner := &fakeCloner{
+		sizes: map[string]int64{
+			"zlib-1.0-1.cm2.x86_64":    2 * mib,
+			"gcc-1.0-1.cm2.x86_64":     40 * mib,
+			"openssl-1.0-1.cm2.x86_64": 5 * mib,
+			"glibc-1.0-1.cm2.x86_64":   9 * mib,
+		},
+		prebuilt: map[string]bool{"glibc-1.0-1.cm2.x86_64": true},
+	}
+
+	packages := newFetchedPackageSet()
+	for _, name := range []string{"zlib", "gcc", "openssl", "glibc", "zlib"} {
+		node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: name}, State: pkggraph.StateUnresolved}
+		_, err := resolveSingleNode(context.Background(), cloner, node, packages, newTestResolveOptions("/cache"))
+		assert.NoError(t, err)
+	}
+
+	summary := summarizeDownloads(cloner.ClonedPackages())
+	assert.Equal(t, downloadSummary{DownloadedPackages: 3, DownloadedBytes: 47 * mib, CacheHits: 1, CacheHitBytes: 9 * mib}, summary)
+	assert.Equal(t, "47.0 MiB", formatBytes(summary.DownloadedBytes))
+}
+
+func TestShouldChargeDownloadBudgetOncePerDownloadedRPM(t *testing.T) {
+	const mib = 1024 * 1024
+
+	cloner := &fakeCloner{
+		sizes: map[string]int64{
+			"zlib-1.0-1.cm2.x86_64":    2 * mib,
+			"gcc-1.0-1.cm2.x86_64":     40 * mib,
+			"openssl-1.0-1.cm2.x86_64": 10 * mib,
+			"glibc-1.0-1.cm2.x86_64":   9 * mib,
+		},
+		prebuilt: map[string]bool{"glibc-1.0-1.cm2.x86_64": true},
+		deps:     map[string][]string{"gcc-1.0-1.cm2.x86_64": {"glibc-1.0-1.cm2.x86_64", "zlib-1.0-1.cm2.x86_64"}},
+	}
+	budget := newByteBudget(50*mib, t.TempDir())
+	packages := newFetchedPackageSet()
+
+	resolveAndCharge := func(name string) {
+		node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: name}, State: pkggraph.StateUnresolved}
+		resolution, err := resolveSingleNode(context.Background(), cloner, node, packages, newTestResolveOptions("/cache"))
+		assert.NoError(t, err)
+		budget.charge(resolution.clonedPackages, cloner.ClonedPackages())
+	}
+
+	// The prebuilt 'glibc' dependency doesn't count and 'zlib' is counted only once.
+	resolveAndCharge("gcc")
+	assert.Equal(t, int64(42*mib), budget.used)
+	resolveAndCharge("zlib")
+	resolveAndCharge("glibc")
+	assert.Equal(t, int64(42*mib), budget.used)
+	assert.False(t, budget.exhausted())
+
+	resolveAndCharge("openssl")
+	assert.Equal(t, int64(52*mib), budget.used)
+	assert.True(t, budget.exhausted())
+}
+
+func TestShouldOnlyChargeDownloadBudgetForRPMsDownloadedByRun(t *testing.T) {
+	cloneDir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(cloneDir, "internal-tool-2.0.0-1.cm2.x86_64.rpm"), make([]byte, 100), 0644))
+
+	budget := newByteBudget(1000, cloneDir)
+	budget.charge(map[string]string{
+		"bash-5.1.8-2.cm2.x86_64.rpm":          "base",
+		"glibc-2.35-3.cm2.x86_64.rpm":          "toolchain-repo",
+		"zlib-1.2.13-1.cm2.x86_64.rpm":         "base",
+		"internal-tool-2.0.0-1.cm2.x86_64.rpm": ociRepoID,
+		"local-tool-1.0.0-1.cm2.x86_64.rpm":    localRepoID,
+	}, map[string]rpmrepocloner.ClonedPackage{
+		"bash-5.1.8-2.cm2.x86_64.rpm": {Size: 300},
+		"glibc-2.35-3.cm2.x86_64.rpm": {Size: 400, Prebuilt: true},
+	})
+
+	// 'zlib' was already in the clone directory and 'local-tool' was copied from '--local-repo-dir'.
+	assert.Equal(t, int64(400), budget.used)
+
+	disabledBudget := newByteBudget(0, cloneDir)
+	disabledBudget.charge(map[string]string{"bash-5.1.8-2.cm2.x86_64.rpm": "base"}, map[string]rpmrepocloner.ClonedPackage{"bash-5.1.8-2.cm2.x86_64.rpm": {Size: 300}})
+	assert.Zero(t, disabledBudget.used)
+	assert.False(t, disabledBudget.exhausted())
+}
+
+func TestShouldFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "3.7 GiB", formatBytes(3973069570))
+}
+
+func TestShouldPeriodicallyLogResolutionProgress(t *testing.T) {
+	progressLines := func(hook *logtest.Hook) (lines []string) {
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, "Resolved ") {
+				lines = append(lines, entry.Message)
+			}
+		}
+		return
+	}
+
+	hook := logtest.NewLocal(logger.Log)
+	defer hook.Reset()
+
+	// Without time passing, large graphs are reported every 10% of nodes.
+	clock := time.Unix(0, 0)
+	reporter := newProgressReporter(200, time.Minute)
+	reporter.now = func() time.Time { return clock }
+	for i := 0; i < 200; i++ {
+		reporter.record(i%4 == 0)
+	}
+	lines := progressLines(hook)
+	assert.Len(t, lines, 10)
+	assert.Equal(t, "Resolved 20/200 nodes (10%), 5 failure(s) so far.", lines[0])
+	assert.Equal(t, "Resolved 200/200 nodes (100%), 50 failure(s) so far.", lines[9])
+
+	// Small graphs are only reported once the interval elapses.
+	hook.Reset()
+	reporter = newProgressReporter(6, time.Minute)
+	reporter.now = func() time.Time { return clock }
+	reporter.lastReport = clock
+	for i := 0; i < 6; i++ {
+		clock = clock.Add(30 * time.Second)
+		reporter.record(false)
+	}
+	assert.Equal(t, []string{
+		"Resolved 2/6 nodes (33%), 0 failure(s) so far.",
+		"Resolved 4/6 nodes (66%), 0 failure(s) so far.",
+		"Resolved 6/6 nodes (100%), 0 failure(s) so far.",
+	}, progressLines(hook))
+
+	// A zero interval disables the reporter.
+	hook.Reset()
+	reporter = newProgressReporter(200, 0)
+	for i := 0; i < 200; i++ {
+		reporter.record(true)
+	}
+	assert.Empty(t, progressLines(hook))
+}
+
+func TestShouldAbortOnceFailureLimitIsExceeded(t *testing.T) {
+	nodes := []*pkggraph.PkgNode{}
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: fmt.Sprintf("pkg%d", i)}, State: pkggraph.StateUnresolved})
+	}
+
+	cloner := &fakeCloner{available: map[string]bool{}}
+	resolve := func(n *pkggraph.PkgNode) error {
+		_, err := resolveSingleNode(context.Background(), cloner, n, newFetchedPackageSet(), newTestResolveOptions("/cache"))
+		return err
+	}
+
+	failures := newFailureLimit(2)
+	startedNodes := resolveNodesConcurrently(context.Background(), nodes, 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		failures.record(resolveErr != nil)
+		return !failures.exceeded()
+	})
+
+	// Two failures are tolerated, the third one aborts the run.
+	assert.Equal(t, 3, startedNodes)
+	assert.Equal(t, 3, failures.failed)
+	assert.True(t, failures.exceeded())
+
+	// Without a limit any number of failures is tolerated.
+	unlimited := newFailureLimit(0)
+	startedNodes = resolveNodesConcurrently(context.Background(), nodes, 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		unlimited.record(resolveErr != nil)
+		return !unlimited.exceeded()
+	})
+	assert.Equal(t, len(nodes), startedNodes)
+	assert.False(t, unlimited.exceeded())
+}
+
+func TestShouldNotStartNodeLogWithoutLogDir(t *testing.T) {
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "zlib"}, Type: pkggraph.TypeRemoteRun}
+	stop := startNodeLog(" ", node)
+	assert.NotNil(t, stop)
+	stop()
+}
+
+func TestShouldRouteLogsToTheirNodesLog(t *testing.T) {
+	g := pkggraph.NewPkgGraph()
+	nodes := []*pkggraph.PkgNode{}
+	for _, name := range []string{"zlib", "glibc"} {
+		node, err := g.AddPkgNode(&pkgjson.PackageVer{Name: name}, pkggraph.StateUnresolved, pkggraph.TypeRemoteRun, pkggraph.NoSRPMPath, pkggraph.NoRPMPath, pkggraph.NoSpecPath, pkggraph.NoSourceDir, pkggraph.NoArchitecture, pkggraph.NoSourceRepo)
+		assert.NoError(t, err)
+		nodes = append(nodes, node)
+	}
+
+	logDir := t.TempDir()
+	cloner := &fakeCloner{}
+	packages := newFetchedPackageSet()
+	stopNodeLogs := make(map[*pkggraph.PkgNode]func())
+	resolve := func(n *pkggraph.PkgNode) error {
+		stopNodeLogs[n] = startNodeLog(logDir, n)
+		_, err := resolveSingleNode(context.Background(), cloner, n, packages, newTestResolveOptions("/cache"))
+		return err
+	}
+
+	// A single worker, so each node's log is stopped before the next node starts.
+	resolveNodesConcurrently(context.Background(), nodes, 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		assert.NoError(t, resolveErr)
+		stopNodeLogs[n]()
+		return true
+	})
+	logger.Log.Debugf("Searching for a package which supplies: %s", "bash")
+
+	for _, name := range []string{"zlib", "glibc"} {
+		nodeLogs, err := filepath.Glob(filepath.Join(logDir, name+"-*.log"))
+		assert.NoError(t, err)
+		if !assert.Len(t, nodeLogs, 1) {
+			continue
+		}
+		assert.NotContains(t, filepath.Base(nodeLogs[0]), "<", "unsafe characters should be replaced in the file name")
+
+		contents, err := os.ReadFile(nodeLogs[0])
+		assert.NoError(t, err)
+		for _, otherName := range []string{"zlib", "glibc", "bash"} {
+			searchLine := "Searching for a package which supplies: " + otherName
+			if otherName == name {
+				assert.Contains(t, string(contents), searchLine)
+			} else {
+				assert.NotContains(t, string(contents), searchLine)
+			}
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+)
+
+// clonerRecording holds the cloner calls of a run, recorded with '--record-file' or replayed with '--replay-file'.
+// A nil recording neither records nor replays.
+type clonerRecording struct {
+	lock     sync.Mutex
+	replay   bool
+	contents clonerRecordingContents
+}
+
+// clonerRecordingContents is the format of the '--record-file' and '--replay-file'.
+type clonerRecordingContents struct {
+	WhatProvides         map[string]recordedLookup `json:"WhatProvides"`         // PackageVer query -> its providers
+	WhatProvidesByRepo   map[string]recordedLookup `json:"WhatProvidesByRepo"`   // PackageVer query -> its providers by repo ID
+	PrioritizeCandidates map[string]recordedLookup `json:"PrioritizeCandidates"` // "<PackageVer query>: <candidates>" -> ordered candidates
+	Clone                map[string]recordedClone  `json:"Clone"`                // Space separated package names -> outcome of their clone
+}
+
+// recordedLookup is the outcome of a recorded package lookup.
+type recordedLookup struct {
+	Packages       []string            `json:"Packages,omitempty"`
+	PackagesByRepo map[string][]string `json:"PackagesByRepo,omitempty"`
+	Error          string              `json:"Error,omitempty"`
+	NotFound       bool                `json:"NotFound,omitempty"` // The error means no repo has the package
+}
+
+// recordedClone is the outcome of a recorded clone.
+type recordedClone struct {
+	Prebuilt bool              `json:"Prebuilt"`
+	Packages map[string]string `json:"Packages,omitempty"` // RPM file -> ID of the repo it was cloned from
+	Error    string            `json:"Error,omitempty"`
+	NotFound bool              `json:"NotFound,omitempty"` // The error means no repo has the package
+}
+
+// recordingCloner records the outcome of every call into a clonerRecording.
+type recordingCloner struct {
+	nodeCloner
+	recording *clonerRecording
+}
+
+// replayingCloner answers every call from a clonerRecording, without accessing any repos.
+type replayingCloner struct {
+	recording *clonerRecording
+}
+
+// newClonerRecording returns a recording to fill for 'recordFile' or the one read from 'replayFile'.
+// Returns nil if neither is set.
+func newClonerRecording(recordFile, replayFile string) (recording *clonerRecording, err error) {
+	switch {
+	case replayFile != "":
+		recording = &clonerRecording{replay: true}
+		err = jsonutils.ReadJSONFile(replayFile, &recording.contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the recorded cloner calls from '%s':\n%w", replayFile, err)
+		}
+		logger.Log.Infof("Replaying the package lookups and clones recorded in '%s'.", replayFile)
+	case strings.TrimSpace(recordFile) != "":
+		recording = &clonerRecording{}
+	default:
+		return
+	}
+
+	contents := &recording.contents
+	if contents.WhatProvides == nil {
+		contents.WhatProvides = make(map[string]recordedLookup)
+	}
+	if contents.WhatProvidesByRepo == nil {
+		contents.WhatProvidesByRepo = make(map[string]recordedLookup)
+	}
+	if contents.PrioritizeCandidates == nil {
+		contents.PrioritizeCandidates = make(map[string]recordedLookup)
+	}
+	if contents.Clone == nil {
+		contents.Clone = make(map[string]recordedClone)
+	}
+	return
+}
+
+func (r *clonerRecording) replaying() bool {
+	return r != nil && r.replay
+}
+
+// wrap returns a cloner recording the calls made to 'cloner', or replacing it when replaying.
+func (r *clonerRecording) wrap(cloner nodeCloner) nodeCloner {
+	switch {
+	case r == nil:
+		return cloner
+	case r.replay:
+		return &replayingCloner{recording: r}
+	default:
+		return &recordingCloner{nodeCloner: cloner, recording: r}
+	}
+}
+
+func (r *clonerRecording) write(recordFile string) (err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err = jsonutils.WriteJSONFile(recordFile, &r.contents)
+	if err != nil {
+		return fmt.Errorf("failed to write the recorded cloner calls to '%s':\n%w", recordFile, err)
+	}
+	return
+}
+
+// prioritizeCandidatesKey identifies a PrioritizeCandidates call in the recording.
+func prioritizeCandidatesKey(pkgVer *pkgjson.PackageVer, candidates []string) string {
+	return fmt.Sprintf("%s: %s", pkgVer, strings.Join(candidates, " "))
+}
+
+// cloneKey identifies a Clone call in the recording.
+func cloneKey(packagesToClone []*pkgjson.PackageVer) string {
+	names := []string{}
+	for _, packageToClone := range packagesToClone {
+		names = append(names, packageToClone.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+// newRecordedLookup records the outcome of a lookup.
+func newRecordedLookup(packageNames []string, packagesByRepo map[string][]string, err error) (lookup recordedLookup) {
+	lookup = recordedLookup{Packages: packageNames, PackagesByRepo: packagesByRepo}
+	if err != nil {
+		lookup.Error = err.Error()
+		lookup.NotFound = errors.Is(err, rpmrepocloner.ErrPackageNotFound)
+	}
+	return
+}
+
+// recordedError recreates a recorded error, keeping whether it means no repo has the package.
+func recordedError(message string, notFound bool) error {
+	switch {
+	case message == "":
+		return nil
+	case notFound:
+		return fmt.Errorf("%w: %s", rpmrepocloner.ErrPackageNotFound, strings.TrimPrefix(message, rpmrepocloner.ErrPackageNotFound.Error()+": "))
+	default:
+		return errors.New(message)
+	}
+}
+
+func (c *recordingCloner) WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	packageNames, err = c.nodeCloner.WhatProvides(ctx, pkgVer)
+
+	c.recording.lock.Lock()
+	defer c.recording.lock.Unlock()
+	c.recording.contents.WhatProvides[pkgVer.String()] = newRecordedLookup(packageNames, nil, err)
+	return
+}
+
+func (c *recordingCloner) WhatProvidesByRepo(ctx context.Context, pkgVer *pkgjson.PackageVer) (packagesByRepo map[string][]string, err error) {
+	packagesByRepo, err = c.nodeCloner.WhatProvidesByRepo(ctx, pkgVer)
+
+	c.recording.lock.Lock()
+	defer c.recording.lock.Unlock()
+	c.recording.contents.WhatProvidesByRepo[pkgVer.String()] = newRecordedLookup(nil, packagesByRepo, err)
+	return
+}
+
+func (c *recordingCloner) PrioritizeCandidates(ctx context.Context, pkgVer *pkgjson.PackageVer, candidates []string) (prioritizedCandidates []string, err error) {
+	prioritizedCandidates, err = c.nodeCloner.PrioritizeCandidates(ctx, pkgVer, candidates)
+
+	c.recording.lock.Lock()
+	defer c.recording.lock.Unlock()
+	c.recording.contents.PrioritizeCandidates[prioritizeCandidatesKey(pkgVer, candidates)] = newRecordedLookup(prioritizedCandidates, nil, err)
+	return
+}
+
+func (c *recordingCloner) CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	allPackagesPrebuilt, clonedPackages, err = c.nodeCloner.CloneAndListPackages(ctx, cloneDeps, packagesToClone...)
+
+	clone := recordedClone{Prebuilt: allPackagesPrebuilt, Packages: clonedPackages}
+	if err != nil {
+		clone.Error = err.Error()
+		clone.NotFound = errors.Is(err, rpmrepocloner.ErrPackageNotFound)
+	}
+
+	c.recording.lock.Lock()
+	defer c.recording.lock.Unlock()
+	c.recording.contents.Clone[cloneKey(packagesToClone)] = clone
+	return
+}
+
+func (c *replayingCloner) WhatProvides(ctx context.Context, pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	lookup, found := c.recording.contents.WhatProvides[pkgVer.String()]
+	if !found {
+		return nil, fmt.Errorf("the lookup of '%v' is not in the recording", pkgVer)
+	}
+	return append([]string(nil), lookup.Packages...), recordedError(lookup.Error, lookup.NotFound)
+}
+
+func (c *replayingCloner) WhatProvidesByRepo(ctx context.Context, pkgVer *pkgjson.PackageVer) (packagesByRepo map[string][]string, err error) {
+	lookup, found := c.recording.contents.WhatProvidesByRepo[pkgVer.String()]
+	if !found {
+		return nil, fmt.Errorf("the lookup of '%v' by repo is not in the recording", pkgVer)
+	}
+	return lookup.PackagesByRepo, recordedError(lookup.Error, lookup.NotFound)
+}
+
+func (c *replayingCloner) PrioritizeCandidates(ctx context.Context, pkgVer *pkgjson.PackageVer, candidates []string) (prioritizedCandidates []string, err error) {
+	lookup, found := c.recording.contents.PrioritizeCandidates[prioritizeCandidatesKey(pkgVer, candidates)]
+	if !found {
+		return nil, fmt.Errorf("the ordering of the candidates for '%v' is not in the recording", pkgVer)
+	}
+	return append([]string(nil), lookup.Packages...), recordedError(lookup.Error, lookup.NotFound)
+}
+
+func (c *replayingCloner) CloneAndListPackages(ctx context.Context, cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
+	clone, found := c.recording.contents.Clone[cloneKey(packagesToClone)]
+	if !found {
+		return false, nil, fmt.Errorf("the clone of '%s' is not in the recording", cloneKey(packagesToClone))
+	}
+	return clone.Prebuilt, clone.Packages, recordedError(clone.Error, clone.NotFound)
+}
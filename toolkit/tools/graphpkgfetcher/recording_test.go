@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldReplayRecordedRunWithSameGraphStates(t *testing.T) {
+	resolveGraph := func(cloner nodeCloner) (states map[string]string) {
+		g := pkggraph.NewPkgGraph()
+		for _, name := range []string{"bash", "glibc", "gcc", "zlib"} {
+			_, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+			assert.NoError(t, err)
+		}
+
+		packages := newFetchedPackageSet()
+		resolve := func(n *pkggraph.PkgNode) error {
+			_, err := resolveSingleNode(context.Background(), cloner, n, packages, newTestResolveOptions("/cache"))
+			return err
+		}
+		resolveNodesConcurrently(context.Background(), g.AllRunNodes(), 1, resolve, func(*pkggraph.PkgNode, error) bool {
+			return true
+		})
+
+		states = make(map[string]string)
+		for _, n := range g.AllRunNodes() {
+			states[n.VersionedPkg.Name] = fmt.Sprintf("%s %s", n.State, n.RpmPath)
+		}
+		return
+	}
+
+	recordFile := filepath.Join(t.TempDir(), "recording.json")
+	recording, err := newClonerRecording(recordFile, "")
+	assert.NoError(t, err)
+	recordedStates := resolveGraph(recording.wrap(&fakeCloner{available: map[string]bool{"bash": true, "glibc": true, "zlib": true}}))
+	assert.NoError(t, recording.write(recordFile))
+	assert.Equal(t, "Cached /cache/bash-1.0-1.cm2.x86_64.rpm", recordedStates["bash"])
+	assert.Contains(t, recordedStates["gcc"], "Unresolved")
+
+	replay, err := newClonerRecording("", recordFile)
+	assert.NoError(t, err)
+	assert.True(t, replay.replaying())
+	assert.Equal(t, recordedStates, resolveGraph(replay.wrap(nil)))
+
+	// Calls missing from the recording fail instead of reaching any repo.
+	_, err = replay.wrap(nil).WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "openssl"})
+	assert.ErrorContains(t, err, "is not in the recording")
+	_, err = replay.wrap(nil).WhatProvides(context.Background(), &pkgjson.PackageVer{Name: "gcc"})
+	assert.ErrorIs(t, err, rpmrepocloner.ErrPackageNotFound)
+}
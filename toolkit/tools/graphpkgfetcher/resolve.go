@@ -0,0 +1,1060 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/eventstream"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repoutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/tracing"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/scheduler/schedulerutils"
+)
+
+// Supported values of '--resolution-strategy'.
+const (
+	resolutionStrategyHighest = "highest"
+	resolutionStrategyMinimum = "minimum"
+)
+
+// errNotAvailableOffline marks nodes which would need a download with '--offline', which fail the fetch even in best-effort mode.
+var errNotAvailableOffline = errors.New("not available offline")
+
+// errAmbiguousProvides marks nodes provided by several packages with '--strict-provides', which fail the fetch even in best-effort mode.
+var errAmbiguousProvides = errors.New("ambiguous provides")
+
+// errTooManyFailures marks fetches aborted by '--max-failures', whose partially resolved graphs are still written.
+var errTooManyFailures = errors.New("too many failed nodes")
+
+// prebuiltDecision records the inputs and outcome of the prebuilt check of a resolved node.
+type prebuiltDecision struct {
+	Node               string `json:"Node"`
+	RPM                string `json:"RPM"`
+	ClonedAsPrebuilt   bool   `json:"ClonedAsPrebuilt"`   // The last clone for the node only used local repos
+	KnownPrebuilt      bool   `json:"KnownPrebuilt"`      // An earlier clone marked the node's RPM path as prebuilt
+	IsToolchainPackage bool   `json:"IsToolchainPackage"` // The node's RPM is in the toolchain manifest
+	ChecksumMismatch   bool   `json:"ChecksumMismatch"`   // The node's RPM does not match its checksum from the toolchain manifest
+	MarkedPrebuilt     bool   `json:"MarkedPrebuilt"`
+}
+
+// toolchainRPMs holds the RPMs created by the toolchain and the SHA-256 checksums the manifest lists for them.
+// A nil manifest contains no RPMs.
+type toolchainRPMs struct {
+	packages  []string
+	checksums map[string]string
+}
+
+// resolveOptions holds the policy applied to every node of a run. Nil or empty fields impose no restriction.
+type resolveOptions struct {
+	// cloneDeps also clones the dependencies of the chosen packages.
+	cloneDeps bool
+	// outDir is the directory the cloned RPMs end up in.
+	outDir string
+	// toolchain holds the RPMs which may be marked as prebuilt.
+	toolchain *toolchainRPMs
+	// hostProvidedCapabilities are satisfied by the build environment and need no RPM, keyed by their names.
+	// Their version is only set if '--host-provided-file' lists it.
+	hostProvidedCapabilities map[string]*pkgjson.PackageVer
+	// pins are the versions from '--version-pins-file'.
+	pins versionPins
+	// excludedPackages are never cloned.
+	excludedPackages map[string]bool
+	// policy restricts packages to the repos from '--repo-policy-file'.
+	policy repoPolicy
+	// localBuiltVersions holds the highest "<version>-<release>" of each package built into '--rpm-dir'.
+	// Candidates older than the locally built package are never chosen.
+	localBuiltVersions map[string]string
+	// lock holds the packages the nodes are locked to by '--lock-file-in'.
+	lock packageLock
+	// lockedDependencies are all packages the nodes' clones may pull in with '--lock-file-in'.
+	// Nil if there is no lock file or it doesn't list them.
+	lockedDependencies map[string]bool
+	// trace records the prebuilt decisions for '--prebuilt-trace-file'.
+	trace *prebuiltTrace
+	// localRpmsDir is '--rpm-dir', holding the locally built RPMs.
+	localRpmsDir string
+	// tmpDir holds the temporary files of choosing between competing candidates.
+	tmpDir string
+	// resolutionStrategy is '--resolution-strategy', one of the resolutionStrategy* values.
+	resolutionStrategy string
+	// cloneRetries and cloneRetryDelay are '--clone-retries' and '--clone-retry-delay', used by retryCloneOperation.
+	cloneRetries    int
+	cloneRetryDelay time.Duration
+	// offline reports nodes which would need a download as not available, see '--offline'.
+	offline bool
+	// failFastOnImplicit reports unresolvable implicit nodes like any other node.
+	failFastOnImplicit bool
+	// excludedSubpackageSuffixes are the name suffixes from '--exclude-subpackage-suffix'.
+	excludedSubpackageSuffixes []string
+	// strictProvides rejects capabilities provided by more than one distinct package name.
+	strictProvides bool
+	// minSignatureAlgo is the weakest signature hash accepted for downloaded RPMs, empty to accept any.
+	minSignatureAlgo string
+	// warnOnWeakSignatures only warns about the RPMs rejected by minSignatureAlgo.
+	warnOnWeakSignatures bool
+	// requireSignature verifies the RPM chosen for each node against the keys in gpgKeyring.
+	requireSignature bool
+	gpgKeyring       string
+}
+
+// prebuiltTrace collects the prebuilt decisions of all resolved nodes. A nil trace records nothing.
+type prebuiltTrace struct {
+	lock      sync.Mutex
+	Decisions []prebuiltDecision `json:"Decisions"`
+}
+
+// fetchedPackageSet tracks the packages cloned while resolving a graph, shared by all resolution workers.
+type fetchedPackageSet struct {
+	lock     sync.Mutex
+	fetched  map[string]bool
+	prebuilt map[string]bool
+	cloned   map[string]map[string]string // Fetched package -> RPM files its clone needed -> their repo IDs
+	// hashAlgorithms caches the signature hash algorithms read by signatureHashAlgorithm, keyed by the RPMs' paths.
+	hashAlgorithms map[string]string
+}
+
+// nodeResolution is what resolving a single node produced besides the node's RPM path.
+type nodeResolution struct {
+	candidates     int
+	clonedPackages map[string]string // RPM files needed by the node's candidates -> their repo IDs
+	hostProvided   bool              // The node needs no RPM, see hostProvides
+}
+
+// resolveNodesConcurrently resolves the nodes in order using up to 'workers' goroutines. 'handleResult' is called on
+// the calling goroutine for each node once its resolution finished. After 'handleResult' returns false no more nodes
+// are started, but the ones already being resolved are still handled. The same applies once 'ctx' is done.
+// Returns the number of started nodes.
+func resolveNodesConcurrently(ctx context.Context, nodes []*pkggraph.PkgNode, workers int, resolve func(*pkggraph.PkgNode) error, handleResult func(node *pkggraph.PkgNode, resolveErr error) (keepGoing bool)) (startedNodes int) {
+	type nodeResult struct {
+		node *pkggraph.PkgNode
+		err  error
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	pendingNodes := make(chan *pkggraph.PkgNode)
+	results := make(chan nodeResult)
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for n := range pendingNodes {
+				results <- nodeResult{node: n, err: resolve(n)}
+			}
+		}()
+	}
+
+	keepGoing := true
+	inFlight := 0
+	for {
+		keepGoing = keepGoing && ctx.Err() == nil
+		canStartNode := keepGoing && startedNodes < len(nodes)
+		if inFlight == 0 && !canStartNode {
+			break
+		}
+
+		// A nil channel blocks forever, disabling the send case once no more nodes should be started.
+		var nextPendingNodes chan *pkggraph.PkgNode
+		var nextNode *pkggraph.PkgNode
+		if canStartNode {
+			nextPendingNodes = pendingNodes
+			nextNode = nodes[startedNodes]
+		}
+
+		select {
+		case nextPendingNodes <- nextNode:
+			startedNodes++
+			inFlight++
+		case result := <-results:
+			inFlight--
+			keepGoing = handleResult(result.node, result.err) && keepGoing
+		}
+	}
+
+	close(pendingNodes)
+	waitGroup.Wait()
+	return
+}
+
+// newResolveOptions reads the policy applied to every node of the run from the command line and the files it names.
+func newResolveOptions() (options *resolveOptions, err error) {
+	options = &resolveOptions{
+		cloneDeps:                  true,
+		outDir:                     *outDir,
+		toolchain:                  &toolchainRPMs{},
+		localRpmsDir:               *existingRpmDir,
+		tmpDir:                     *tmpDir,
+		resolutionStrategy:         *resolutionStrategy,
+		cloneRetries:               *cloneRetries,
+		cloneRetryDelay:            *cloneRetryDelay,
+		offline:                    *offline,
+		failFastOnImplicit:         *failFastOnImplicit,
+		excludedSubpackageSuffixes: *excludedSubpackageSuffixes,
+		strictProvides:             *strictProvides,
+		minSignatureAlgo:           *minSignatureAlgo,
+		warnOnWeakSignatures:       *warnOnWeakSignatures,
+		requireSignature:           *requireSignature,
+		gpgKeyring:                 *gpgKeyring,
+	}
+
+	options.toolchain.packages, options.toolchain.checksums, err = schedulerutils.ReadReservedFilesChecksums(*toolchainManifest...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read toolchain manifest files (%s):\n%w", strings.Join(*toolchainManifest, ", "), err)
+	}
+
+	options.hostProvidedCapabilities, err = readHostProvidedFile(*hostProvidedFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host-provided capabilities from '%s':\n%w", *hostProvidedFile, err)
+	}
+
+	options.pins, err = readVersionPins(*versionPinsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version pins from '%s':\n%w", *versionPinsFile, err)
+	}
+
+	options.policy, err = readRepoPolicy(*repoPolicyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the repo policy from '%s':\n%w", *repoPolicyFile, err)
+	}
+
+	options.excludedPackages, err = readListFile(*excludedPackagesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read excluded packages from '%s':\n%w", *excludedPackagesFile, err)
+	}
+	for _, excludedPackage := range *excludedPackages {
+		options.excludedPackages[strings.TrimSpace(excludedPackage)] = true
+	}
+
+	options.localBuiltVersions, err = readLocalBuiltVersions(options.localRpmsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the versions of the RPMs in '%s':\n%w", options.localRpmsDir, err)
+	}
+
+	options.lock, options.lockedDependencies, err = readLockFile(*lockFileIn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the lock file '%s':\n%w", *lockFileIn, err)
+	}
+
+	if strings.TrimSpace(*prebuiltTraceFile) != "" {
+		options.trace = &prebuiltTrace{Decisions: []prebuiltDecision{}}
+	}
+
+	return
+}
+
+// resolveGraphs resolves the unresolved nodes of all graphs one after another using the same cloner and 'options'.
+func resolveGraphs(ctx context.Context, dependencyGraphs []*pkggraph.PkgGraph, inputGraphFiles []string, inputSummaryFile string, options *resolveOptions, cloner *rpmrepocloner.RpmRepoCloner, workers int, stopOnFailure bool, tracer *tracing.Tracer, parentSpan *tracing.Span, progress *eventstream.Stream) (err error) {
+	if strings.TrimSpace(inputSummaryFile) != "" {
+		// If an input summary file was provided, simply restore the cache using the file.
+		err = repoutils.RestoreClonedRepoContentsWithValidation(cloner, inputSummaryFile, !*skipChecksumValidation)
+		if err != nil {
+			return fmt.Errorf("failed to restore external packages cache from '%s':\n%w", inputSummaryFile, err)
+		}
+
+		previousEnabledRepos := cloner.GetEnabledRepos()
+		cloner.SetEnabledRepos(rpmrepocloner.RepoFlagToolchain | rpmrepocloner.RepoFlagDownloadedCache)
+		defer cloner.SetEnabledRepos(previousEnabledRepos)
+	}
+
+	// The report is written even if resolving a graph fails, so the failures are captured.
+	var report *fetchReport
+	if strings.TrimSpace(*fetchReportFile) != "" {
+		report = &fetchReport{}
+		defer func() {
+			report.addMirrors(cloner.PackageMirrors())
+			reportErr := report.write(*fetchReportFile)
+			if reportErr == nil {
+				return
+			}
+			if err == nil {
+				err = reportErr
+			} else {
+				logger.Log.Warnf("%s", reportErr)
+			}
+		}()
+	}
+
+	// Runs before the report is written, so the summary is part of it.
+	defer func() {
+		summary := summarizeDownloads(cloner.ClonedPackages())
+		logger.Log.Infof("Downloaded %d package(s) totalling %s, copied %d package(s) (%s) from the local toolchain and built packages.",
+			summary.DownloadedPackages, formatBytes(summary.DownloadedBytes), summary.CacheHits, formatBytes(summary.CacheHitBytes))
+		report.setDownloads(summary)
+	}()
+
+	// Failures are counted across all graphs.
+	failures := newFailureLimit(*maxFailures)
+
+	// Like the report, the recording is written even if resolving a graph fails.
+	recording, err := newClonerRecording(*recordFile, *replayFile)
+	if err != nil {
+		return
+	}
+	if recording != nil && !recording.replay {
+		defer func() {
+			recordErr := recording.write(*recordFile)
+			if recordErr == nil {
+				return
+			}
+			if err == nil {
+				err = recordErr
+			} else {
+				logger.Log.Warnf("%s", recordErr)
+			}
+		}()
+	}
+
+	lookups := newProvidesCache()
+	defer func() {
+		lookupCount, hits := lookups.stats()
+		logger.Log.Debugf("Served %d of %d package lookup(s) from the lookup cache.", hits, lookupCount)
+	}()
+
+	allProviderRepos := []*providerRepos{}
+	for i, dependencyGraph := range dependencyGraphs {
+		if len(dependencyGraphs) > 1 {
+			logger.Log.Infof("Resolving graph (%d/%d) '%s'.", i+1, len(dependencyGraphs), inputGraphFiles[i])
+		}
+
+		graphProviderRepos, err := resolveGraphNodes(ctx, dependencyGraph, options, cloner, lookups, failures, recording, workers, stopOnFailure, report, tracer, parentSpan, progress)
+		if err != nil {
+			return fmt.Errorf("failed to resolve graph '%s':\n%w", inputGraphFiles[i], err)
+		}
+		allProviderRepos = append(allProviderRepos, graphProviderRepos...)
+	}
+
+	// Concurrent workers record these in the order the nodes finish.
+	if *deterministic {
+		sort.SliceStable(allProviderRepos, func(i, j int) bool {
+			return allProviderRepos[i].Node < allProviderRepos[j].Node
+		})
+		if options.trace != nil {
+			sort.SliceStable(options.trace.Decisions, func(i, j int) bool {
+				return options.trace.Decisions[i].Node < options.trace.Decisions[j].Node
+			})
+		}
+	}
+
+	if strings.TrimSpace(*providerReposFile) != "" {
+		err = jsonutils.WriteJSONFile(*providerReposFile, allProviderRepos)
+		if err != nil {
+			return fmt.Errorf("failed to write provider repos to '%s':\n%w", *providerReposFile, err)
+		}
+	}
+
+	if options.trace != nil {
+		err = jsonutils.WriteJSONFile(*prebuiltTraceFile, options.trace)
+		if err != nil {
+			return fmt.Errorf("failed to write the prebuilt trace to '%s':\n%w", *prebuiltTraceFile, err)
+		}
+	}
+
+	return
+}
+
+// resolveGraphNodes scans a graph and for each unresolved node in the graph clones the RPMs needed
+// to satisfy it, resolving up to 'workers' nodes at once. Each node's resolution is recorded as a child span of 'parentSpan'.
+// Once 'ctx' is done no more nodes are started and an error is returned, regardless of 'stopOnFailure'.
+// If '--provider-repos-file' is set, the repos offering each resolved node are returned.
+// Package lookups are served from 'lookups' if an earlier node already made them. Once 'failures' is exceeded no more
+// nodes are started and an error wrapping errTooManyFailures is returned. The nodes' cloner calls are recorded into or
+// replayed from 'recording'. Every node is resolved with 'options'.
+func resolveGraphNodes(ctx context.Context, dependencyGraph *pkggraph.PkgGraph, options *resolveOptions, cloner *rpmrepocloner.RpmRepoCloner, lookups *providesCache, failures *failureLimit, recording *clonerRecording, workers int, stopOnFailure bool, report *fetchReport, tracer *tracing.Tracer, parentSpan *tracing.Span, progress *eventstream.Stream) (allProviderRepos []*providerRepos, err error) {
+	timestamp.StartEvent("Clone packages", nil)
+	defer timestamp.StopEvent(nil)
+
+	// Cache an RPM for each unresolved node in the graph.
+	cachingSucceeded := true
+	packages := newFetchedPackageSet()
+	sharedCloner := &sharedCloner{cloner: cloner}
+	var remoteCloner nodeCloner = &cachingCloner{nodeCloner: sharedCloner, cache: lookups}
+	// Replayed runs must not reach the registry either.
+	if !recording.replaying() {
+		remoteCloner, err = newOCIRepoCloner(remoteCloner, *ociRepo, *ociUsername, *ociPasswordEnv, *outDir)
+		if err != nil {
+			return
+		}
+	}
+	localCloner, err := newLocalRepoCloner(remoteCloner, *localRepoDir, *outDir)
+	if err != nil {
+		return
+	}
+	cachedCloner := recording.wrap(newPostCloneHookCloner(localCloner, *postCloneHook, *postCloneHookFatal, *outDir))
+	unresolvedNodes, err := nodesToResolve(dependencyGraph)
+	if err != nil {
+		return
+	}
+	unresolvedNodesCount := len(unresolvedNodes)
+	resolvedSinceRepoUpdate := 0
+	unresolvedNodes = orderNodesToResolve(dependencyGraph, unresolvedNodes, *deterministic, *incrementalRepoUpdates)
+
+	recordProviderRepos := strings.TrimSpace(*providerReposFile) != ""
+
+	retiredPackages, err := readListFile(*retiredPackagesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retired packages from '%s':\n%w", *retiredPackagesFile, err)
+	}
+
+	// Replayed lookups must not reach the repos.
+	if !recording.replaying() {
+		lookups.prefill(cloner, unresolvedNodes, options.hostProvidedCapabilities)
+	}
+
+	retiredPackagesFound := false
+	untrustedRPMsFound := false
+	weakSignaturesFound := false
+	ambiguousProvidesFound := false
+	lockedPackagesUnavailable := false
+	offlineUnresolvableNodes := 0
+	var implicitErr error
+
+	if *requireSignature && strings.TrimSpace(*gpgKeyring) == "" {
+		return nil, fmt.Errorf("'--require-signature' needs a '--gpg-keyring'")
+	}
+
+	budget := newByteBudget(int64(*downloadBudget), cloner.CloneDirectory())
+	depsCounter := newDependencyCounter(*maxDepsPerNode)
+	excessiveDepsFound := false
+
+	// Per-node logs attribute everything logged during a node's resolution to that node.
+	if workers > 1 && strings.TrimSpace(*perNodeLogDir) != "" {
+		logger.Log.Warnf("'--per-node-log-dir' needs nodes to be resolved one at a time, ignoring '--download-workers=%d'.", workers)
+		workers = 1
+	}
+
+	// Only the resolution itself runs on the workers, all bookkeeping below happens on this goroutine.
+	stopNodeLogs := make(map[*pkggraph.PkgNode]func())
+	nodeResolutions := make(map[*pkggraph.PkgNode]nodeResolution)
+	workerStateLock := sync.Mutex{}
+	resolveNode := func(n *pkggraph.PkgNode) (resolveErr error) {
+		stopNodeLog := startNodeLog(*perNodeLogDir, n)
+		workerStateLock.Lock()
+		stopNodeLogs[n] = stopNodeLog
+		workerStateLock.Unlock()
+
+		nodeSpan := tracer.StartSpan("resolveSingleNode", parentSpan)
+		nodeCtx, cancelNode := nodeResolutionContext(ctx, n, *perNodeTimeout)
+		defer cancelNode()
+		resolution, resolveErr := resolveSingleNode(nodeCtx, cachedCloner, n, packages, options)
+		resolveErr = nodeTimeoutError(ctx, nodeCtx, resolveErr)
+		workerStateLock.Lock()
+		nodeResolutions[n] = resolution
+		workerStateLock.Unlock()
+		endResolutionSpan(nodeSpan, n, resolveErr)
+		return
+	}
+
+	processedNodes := 0
+	overallProgress := newProgressReporter(unresolvedNodesCount, *progressInterval)
+	handleResolvedNode := func(n *pkggraph.PkgNode, resolveErr error) (keepGoing bool) {
+		workerStateLock.Lock()
+		stopNodeLog := stopNodeLogs[n]
+		delete(stopNodeLogs, n)
+		resolution := nodeResolutions[n]
+		delete(nodeResolutions, n)
+		workerStateLock.Unlock()
+		defer stopNodeLog()
+
+		processedNodes++
+		progressHeader := fmt.Sprintf("Cache progress %d%%", (processedNodes*100)/unresolvedNodesCount)
+		if budget.enabled() {
+			sharedCloner.use(func(cloner *rpmrepocloner.RpmRepoCloner) {
+				budget.charge(resolution.clonedPackages, cloner.ClonedPackages())
+			})
+		}
+		pulledPackages := depsCounter.pulledPackages(resolution.clonedPackages)
+		publishResolutionEvent(progress, n, processedNodes, unresolvedNodesCount, resolution.hostProvided, resolveErr)
+		report.record(n, resolution.candidates, resolveErr)
+		overallProgress.record(resolveErr != nil)
+		failures.record(resolveErr != nil)
+
+		switch {
+		case resolveErr == nil && resolution.hostProvided:
+			logger.Log.Infof("%s: '%s' is provided by the host.", progressHeader, n.VersionedPkg.Name)
+		case resolveErr == nil:
+			logger.Log.Infof("%s: choosing '%s' to provide '%s'.", progressHeader, filepath.Base(n.RpmPath), n.VersionedPkg.Name)
+			if retiredRPMs := retiredPackagesIn(resolution.clonedPackages, retiredPackages); len(retiredRPMs) > 0 {
+				retiredPackagesFound = true
+				reportRetiredPackages(dependencyGraph, n, retiredRPMs, *failOnRetiredPackages)
+				if *failOnRetiredPackages {
+					sharedCloner.use(func(cloner *rpmrepocloner.RpmRepoCloner) {
+						removeRejectedRPMs(options.outDir, retiredRPMs)
+					})
+				}
+			}
+			if depsCounter.exceeded(pulledPackages) {
+				excessiveDepsFound = true
+				reportExcessiveDependencies(n, pulledPackages, depsCounter.limit, *failOnMaxDeps)
+			}
+			if recordProviderRepos {
+				sharedCloner.use(func(cloner *rpmrepocloner.RpmRepoCloner) {
+					allProviderRepos = append(allProviderRepos, findProviderRepos(cloner, n))
+				})
+			}
+			resolvedSinceRepoUpdate++
+			if *incrementalRepoUpdates && resolvedSinceRepoUpdate >= incrementalRepoUpdateBatchSize {
+				sharedCloner.use(func(cloner *rpmrepocloner.RpmRepoCloner) {
+					updateRepoMetadata(cloner, resolvedSinceRepoUpdate)
+				})
+				resolvedSinceRepoUpdate = 0
+			}
+		default:
+			// Failing to clone a dependency should not halt a build.
+			// The build should continue and attempt best effort to build as many packages as possible.
+			logger.Log.Warnf("%s: failed to resolve graph node '%s':\n%s", progressHeader, n, resolveErr)
+			cachingSucceeded = false
+			untrustedRPMsFound = untrustedRPMsFound || errors.Is(resolveErr, errUntrustedRPM)
+			weakSignaturesFound = weakSignaturesFound || errors.Is(resolveErr, errWeakSignature)
+			ambiguousProvidesFound = ambiguousProvidesFound || errors.Is(resolveErr, errAmbiguousProvides)
+			lockedPackagesUnavailable = lockedPackagesUnavailable || errors.Is(resolveErr, errLockedPackageUnavailable)
+			// Implicit nodes may still be built later on.
+			if errors.Is(resolveErr, errNotAvailableOffline) && !n.Implicit {
+				offlineUnresolvableNodes++
+			}
+			errorMessage := strings.Builder{}
+			errorMessage.WriteString(fmt.Sprintf("Failed to resolve all nodes in the graph while resolving '%s'\n", n))
+			errorMessage.WriteString("Nodes which have this as a dependency:\n")
+			for _, dependant := range dependencyGraph.Dependents(n) {
+				errorMessage.WriteString(fmt.Sprintf("\t'%s' depends on '%s'\n", dependant, n))
+			}
+			logger.Log.Debugf(errorMessage.String())
+
+			if fatalErr := implicitResolutionError(n, resolveErr, *failFastOnImplicit); fatalErr != nil {
+				logger.Log.Errorf("%s", fatalErr)
+				if implicitErr == nil {
+					implicitErr = fatalErr
+				}
+			}
+		}
+
+		// Nodes already being resolved by other workers still finish once the budget or failure limit is reached.
+		return !budget.exhausted() && implicitErr == nil && !failures.exceeded()
+	}
+
+	timestamp.StartEvent("clone graph", nil)
+	startedNodes := resolveNodesConcurrently(ctx, unresolvedNodes, workers, resolveNode, handleResolvedNode)
+	timestamp.StopEvent(nil) // clone graph
+
+	if ctx.Err() != nil {
+		for _, n := range unresolvedNodes[startedNodes:] {
+			report.record(n, 0, fmt.Errorf("fetch stopped:\n%w", ctx.Err()))
+		}
+		return nil, fmt.Errorf("stopped resolving the graph with %d of %d node(s) processed:\n%w", processedNodes, unresolvedNodesCount, ctx.Err())
+	}
+
+	if failures.exceeded() {
+		for _, n := range unresolvedNodes[startedNodes:] {
+			report.record(n, 0, fmt.Errorf("failure limit reached"))
+		}
+		return nil, fmt.Errorf("stopped resolving the graph with %d of %d node(s) processed after %d node(s) failed:\n%w", processedNodes, unresolvedNodesCount, failures.failed, errTooManyFailures)
+	}
+
+	if startedNodes < unresolvedNodesCount {
+		logger.Log.Warnf("Download budget of %d bytes reached (%d bytes downloaded), leaving %d node(s) unresolved.", budget.limit, budget.used, unresolvedNodesCount-startedNodes)
+		for _, n := range unresolvedNodes[startedNodes:] {
+			report.record(n, 0, fmt.Errorf("download budget reached"))
+		}
+		if !*downloadBudgetAsSuccess {
+			cachingSucceeded = false
+		}
+	}
+
+	if *globalCompetingResolution {
+		err = resolveCompetingPackagesGlobally(dependencyGraph, packages.fetched, *outDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve competing packages globally:\n%w", err)
+		}
+	}
+
+	if implicitErr != nil {
+		return nil, implicitErr
+	}
+
+	if retiredPackagesFound && *failOnRetiredPackages {
+		return nil, fmt.Errorf("nodes resolved to retired packages")
+	}
+
+	if untrustedRPMsFound {
+		return nil, fmt.Errorf("nodes resolved to RPMs failing signature verification")
+	}
+
+	if weakSignaturesFound {
+		return nil, fmt.Errorf("nodes pulled in RPMs with a signature weaker than '--min-signature-algo'")
+	}
+
+	if ambiguousProvidesFound {
+		return nil, fmt.Errorf("capabilities provided by more than one package with '--strict-provides'")
+	}
+
+	if lockedPackagesUnavailable {
+		return nil, fmt.Errorf("nodes locked to packages which are no longer available with '--lock-file-in'")
+	}
+
+	if offlineUnresolvableNodes > 0 {
+		return nil, fmt.Errorf("%d node(s) can't be resolved from the local RPMs with '--offline'", offlineUnresolvableNodes)
+	}
+
+	if excessiveDepsFound && *failOnMaxDeps {
+		return nil, fmt.Errorf("nodes pulled in more than %d package(s)", depsCounter.limit)
+	}
+
+	if stopOnFailure && !cachingSucceeded {
+		return nil, fmt.Errorf("failed to cache unresolved nodes")
+	}
+	return
+}
+
+// implicitResolutionError returns the error stopping the fetch if 'n' is an implicit node which failed to resolve
+// while 'failFast' is set. Otherwise the failure is handled like any other node's.
+func implicitResolutionError(n *pkggraph.PkgNode, resolveErr error, failFast bool) error {
+	if !failFast || !n.Implicit || resolveErr == nil {
+		return nil
+	}
+	return fmt.Errorf("failed to resolve implicit node '%s' with '--fail-fast-on-implicit':\n%w", n.FriendlyName(), resolveErr)
+}
+
+// resolveSingleNode caches the RPM for a single node.
+// It will modify fetchedPackages on a successful package clone and returns the number of candidate packages considered.
+// The context is checked between cloner operations, an expired context fails the node's resolution.
+func resolveSingleNode(ctx context.Context, cloner nodeCloner, node *pkggraph.PkgNode, packages *fetchedPackageSet, options *resolveOptions) (resolution nodeResolution, err error) {
+	// Capabilities supplied by the build environment itself need no RPM.
+	if hostProvides(options.hostProvidedCapabilities, node.VersionedPkg) {
+		logger.Log.Debugf("Node %s is provided by the host, marking it as satisfied", node.FriendlyName())
+		node.State = pkggraph.StateUpToDate
+		node.RpmPath = pkggraph.NoRPMPath
+		node.SetAnnotation(pkggraph.AnnotationHostProvided, "true")
+		resolution.hostProvided = true
+		return
+	}
+
+	logger.Log.Debugf("Adding node %s to the cache", node.FriendlyName())
+
+	logger.Log.Debugf("Searching for a package which supplies: %s", node.VersionedPkg.Name)
+	// Resolve nodes to exact package names so they can be referenced in the graph.
+	var resolvedPackages []string
+	err = retryCloneOperation(ctx, options, fmt.Sprintf("lookup of '%v'", node.VersionedPkg), func() (opErr error) {
+		resolvedPackages, opErr = cloner.WhatProvides(ctx, node.VersionedPkg)
+		return
+	})
+	if err != nil {
+		if options.offline && errors.Is(err, rpmrepocloner.ErrPackageNotFound) {
+			err = fmt.Errorf("%w: '%v' is not provided by any local RPM and can't be downloaded with '--offline'", errNotAvailableOffline, node.VersionedPkg)
+		}
+
+		msg := fmt.Sprintf("Failed to resolve (%s) to a package. Error: %s", node.VersionedPkg, err)
+		// It is not an error if an implicit node could not be resolved as it may become available later in the build.
+		// If it does not become available scheduler will print an error at the end of the build.
+		if (node.Implicit && !options.failFastOnImplicit) || node.State == pkggraph.StateDelta {
+			logger.Log.Debug(msg)
+		} else {
+			logger.Log.Warn(msg)
+		}
+		return
+	}
+
+	if len(resolvedPackages) == 0 {
+		return resolution, fmt.Errorf("failed to find any packages providing '%v'", node.VersionedPkg)
+	}
+
+	if ctx.Err() != nil {
+		return resolution, fmt.Errorf("stopped resolving '%v':\n%w", node.VersionedPkg, ctx.Err())
+	}
+
+	if !hasExcludedSuffix(node.VersionedPkg.Name, options.excludedSubpackageSuffixes) {
+		resolvedPackages = filterExcludedSubpackages(resolvedPackages, options.excludedSubpackageSuffixes)
+		if len(resolvedPackages) == 0 {
+			return resolution, fmt.Errorf("all packages providing '%v' are excluded subpackages", node.VersionedPkg)
+		}
+	}
+
+	resolvedPackages = filterExcludedPackages(resolvedPackages, options.excludedPackages)
+	if len(resolvedPackages) == 0 {
+		return resolution, fmt.Errorf("all packages providing '%v' are excluded from cloning", node.VersionedPkg)
+	}
+
+	resolvedPackages, err = applyRepoPolicy(ctx, cloner, node.VersionedPkg, resolvedPackages, options.policy)
+	if err != nil {
+		return resolution, fmt.Errorf("failed to resolve '%v' with the repo policy:\n%w", node.VersionedPkg, err)
+	}
+
+	resolvedPackages, err = rejectDowngrades(resolvedPackages, options.localBuiltVersions)
+	if err != nil {
+		return resolution, fmt.Errorf("failed to resolve '%v' without downgrading a locally built package:\n%w", node.VersionedPkg, err)
+	}
+
+	resolvedPackages, err = applyVersionPins(resolvedPackages, options.pins)
+	if err != nil {
+		return resolution, fmt.Errorf("failed to resolve '%v' with the version pins:\n%w", node.VersionedPkg, err)
+	}
+
+	resolvedPackages, err = applyPackageLock(node.VersionedPkg, resolvedPackages, options.lock)
+	if err != nil {
+		return resolution, fmt.Errorf("failed to resolve '%v' with the lock file:\n%w", node.VersionedPkg, err)
+	}
+
+	if options.strictProvides {
+		if providerNames := distinctPackageNames(resolvedPackages); len(providerNames) > 1 {
+			return resolution, fmt.Errorf("%w: '%v' is provided by several packages (%s)", errAmbiguousProvides, node.VersionedPkg, strings.Join(providerNames, ", "))
+		}
+	}
+
+	resolvedPackages, err = cloner.PrioritizeCandidates(ctx, node.VersionedPkg, resolvedPackages)
+	if err != nil {
+		return resolution, fmt.Errorf("failed to order the packages providing '%v' by repo priority:\n%w", node.VersionedPkg, err)
+	}
+	resolution.candidates = len(resolvedPackages)
+
+	preBuilt := false
+	for _, resolvedPackage := range resolvedPackages {
+		if !packages.isFetched(resolvedPackage) {
+			if ctx.Err() != nil {
+				err = fmt.Errorf("stopped resolving '%v' before cloning '%s':\n%w", node.VersionedPkg, resolvedPackage, ctx.Err())
+				return
+			}
+
+			desiredPackage := &pkgjson.PackageVer{
+				Name: resolvedPackage,
+			}
+
+			var clonedPackages map[string]string
+
+			err = retryCloneOperation(ctx, options, fmt.Sprintf("clone of '%s'", resolvedPackage), func() (opErr error) {
+				preBuilt, clonedPackages, opErr = cloner.CloneAndListPackages(ctx, options.cloneDeps, desiredPackage)
+				return
+			})
+			if err != nil {
+				err = fmt.Errorf("failed to clone '%s' from RPM repo:\n%w", resolvedPackage, err)
+				return
+			}
+			packages.markFetched(resolvedPackage, preBuilt, clonedPackages)
+
+			logger.Log.Debugf("Fetched '%s' as potential candidate (is pre-built: %v).", resolvedPackage, preBuilt)
+		}
+	}
+
+	resolution.clonedPackages = packages.clonedPackages(resolvedPackages)
+	err = rejectPulledInPackages(node, resolution.clonedPackages, options)
+	if err != nil {
+		return
+	}
+
+	if options.minSignatureAlgo != "" {
+		err = rejectWeaklySignedPackages(node, resolution.clonedPackages, packages, options)
+		if err != nil {
+			return
+		}
+	}
+
+	err = assignRPMPath(node, options, resolvedPackages)
+	if err != nil {
+		err = fmt.Errorf("failed to find an RPM to provide '%s':\n%w", node.VersionedPkg.Name, err)
+		return
+	}
+
+	if options.requireSignature {
+		err = verifyNodeSignature(node, packages, options.gpgKeyring)
+		if err != nil {
+			return
+		}
+	}
+
+	// If a package is  available locally, and it is part of the toolchain, mark it as a prebuilt so the scheduler knows it can use it
+	// immediately (especially for dynamic generator created capabilities)
+	packages.lock.Lock()
+	decision := decidePrebuilt(node, preBuilt, packages.prebuilt, options.toolchain)
+	if decision.MarkedPrebuilt {
+		packages.prebuilt[node.RpmPath] = true
+	}
+	packages.lock.Unlock()
+
+	options.trace.record(decision)
+	if decision.MarkedPrebuilt {
+		logger.Log.Debugf("Using a prebuilt toolchain package to resolve this dependency")
+		node.State = pkggraph.StateUpToDate
+		node.Type = pkggraph.TypePreBuilt
+	} else {
+		node.State = pkggraph.StateCached
+	}
+
+	return
+}
+
+// retryCloneOperation runs a cloner operation, retrying it up to the options' cloneRetries times with an exponential
+// backoff capped at their cloneRetryDelay. Packages missing from all repos and expired contexts are not retried.
+func retryCloneOperation(ctx context.Context, options *resolveOptions, description string, operation func() error) (err error) {
+	const initialDelay = time.Second
+
+	delay := initialDelay
+	if delay > options.cloneRetryDelay {
+		delay = options.cloneRetryDelay
+	}
+
+	totalAttempts := options.cloneRetries + 1
+	for attempt := 1; ; attempt++ {
+		err = operation()
+		if err == nil || attempt >= totalAttempts || errors.Is(err, rpmrepocloner.ErrPackageNotFound) {
+			return
+		}
+
+		logger.Log.Warnf("Attempt %d/%d of the %s failed, retrying in %s. Error: %s", attempt, totalAttempts, description, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > options.cloneRetryDelay {
+			delay = options.cloneRetryDelay
+		}
+	}
+}
+
+// rejectPulledInPackages fails a node whose clones pulled in RPMs which must not be cloned. TDNF resolves the
+// dependencies of the clones without knowing about the excluded packages, the version pins or the lock file, which were
+// only applied to the node's candidates. The rejected RPMs are removed from the clone directory.
+func rejectPulledInPackages(node *pkggraph.PkgNode, clonedPackages map[string]string, options *resolveOptions) (err error) {
+	if excludedRPMs := excludedPackagesIn(clonedPackages, options.excludedPackages); len(excludedRPMs) > 0 {
+		removeRejectedRPMs(options.outDir, excludedRPMs)
+		return fmt.Errorf("cloning '%v' pulled in the excluded package(s) '%s'", node.VersionedPkg, strings.Join(excludedRPMs, "', '"))
+	}
+
+	if unpinnedRPMs := unpinnedPackagesIn(clonedPackages, options.pins); len(unpinnedRPMs) > 0 {
+		removeRejectedRPMs(options.outDir, unpinnedRPMs)
+		return fmt.Errorf("cloning '%v' pulled in package(s) not matching their version pins '%s'", node.VersionedPkg, strings.Join(unpinnedRPMs, "', '"))
+	}
+
+	if unlockedRPMs := unlockedPackagesIn(clonedPackages, options.lockedDependencies); len(unlockedRPMs) > 0 {
+		removeRejectedRPMs(options.outDir, unlockedRPMs)
+		return fmt.Errorf("%w: cloning '%v' pulled in package(s) missing from the lock file '%s'", errLockedPackageUnavailable, node.VersionedPkg, strings.Join(unlockedRPMs, "', '"))
+	}
+
+	return
+}
+
+// decidePrebuilt evaluates whether a resolved node can be treated as a prebuilt toolchain package, keeping each input
+// of the decision so it can be traced. A toolchain RPM not matching its checksum from the manifest is not prebuilt.
+func decidePrebuilt(node *pkggraph.PkgNode, clonedAsPrebuilt bool, prebuiltPackages map[string]bool, toolchain *toolchainRPMs) (decision prebuiltDecision) {
+	decision = prebuiltDecision{
+		Node:               node.FriendlyName(),
+		RPM:                filepath.Base(node.RpmPath),
+		ClonedAsPrebuilt:   clonedAsPrebuilt,
+		KnownPrebuilt:      prebuiltPackages[node.RpmPath],
+		IsToolchainPackage: toolchain.contains(node.RpmPath),
+	}
+	decision.MarkedPrebuilt = (decision.ClonedAsPrebuilt || decision.KnownPrebuilt) && decision.IsToolchainPackage
+
+	if decision.MarkedPrebuilt {
+		checksumErr := toolchain.verifyChecksum(node.RpmPath)
+		if checksumErr != nil {
+			logger.Log.Warnf("Not using '%s' as a prebuilt toolchain package: %s", decision.RPM, checksumErr)
+			decision.ChecksumMismatch = true
+			decision.MarkedPrebuilt = false
+		}
+	}
+
+	logger.Log.Tracef("Prebuilt check for '%s' (%s): cloned as prebuilt=%v, known prebuilt=%v, toolchain package=%v, checksum mismatch=%v -> prebuilt=%v",
+		decision.Node, decision.RPM, decision.ClonedAsPrebuilt, decision.KnownPrebuilt, decision.IsToolchainPackage, decision.ChecksumMismatch, decision.MarkedPrebuilt)
+	return
+}
+
+// contains checks if the RPM is created by the toolchain.
+func (m *toolchainRPMs) contains(rpmPath string) bool {
+	if m == nil {
+		return false
+	}
+	return isToolchainPackage(rpmPath, m.packages)
+}
+
+// verifyChecksum checks the RPM on disk matches its checksum from the manifest. RPMs listed without a checksum are
+// not checked.
+func (m *toolchainRPMs) verifyChecksum(rpmPath string) (err error) {
+	if m == nil {
+		return
+	}
+
+	expectedChecksum, found := m.checksums[filepath.Base(rpmPath)]
+	if !found {
+		return
+	}
+
+	checksum, err := file.GenerateSHA256(rpmPath)
+	if err != nil {
+		return fmt.Errorf("failed to compute the checksum of '%s':\n%w", rpmPath, err)
+	}
+
+	if checksum != expectedChecksum {
+		return fmt.Errorf("checksum of '%s' (%s) does not match the toolchain manifest (%s)", rpmPath, checksum, expectedChecksum)
+	}
+	return
+}
+
+// record adds a decision to the trace.
+func (t *prebuiltTrace) record(decision prebuiltDecision) {
+	if t == nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Decisions = append(t.Decisions, decision)
+}
+
+func newFetchedPackageSet() *fetchedPackageSet {
+	return &fetchedPackageSet{
+		fetched:  make(map[string]bool),
+		prebuilt: make(map[string]bool),
+		cloned:   make(map[string]map[string]string),
+
+		hashAlgorithms: make(map[string]string),
+	}
+}
+
+func (p *fetchedPackageSet) isFetched(rpmPackage string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.fetched[rpmPackage]
+}
+
+// isPrebuilt returns true if the package was cloned using only local repos.
+func (p *fetchedPackageSet) isPrebuilt(rpmPackage string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.prebuilt[rpmPackage]
+}
+
+func (p *fetchedPackageSet) markFetched(rpmPackage string, prebuilt bool, clonedPackages map[string]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fetched[rpmPackage] = true
+	p.prebuilt[rpmPackage] = prebuilt
+	p.cloned[rpmPackage] = clonedPackages
+}
+
+// signatureHashAlgorithm returns the hash algorithm of the signature of 'rpmPath', empty if it is unsigned. Each RPM
+// is only read once, as nodes sharing dependencies check the same RPMs.
+func (p *fetchedPackageSet) signatureHashAlgorithm(rpmPath string) (hashAlgorithm string, err error) {
+	p.lock.Lock()
+	hashAlgorithm, found := p.hashAlgorithms[rpmPath]
+	p.lock.Unlock()
+	if found {
+		return
+	}
+
+	hashAlgorithm, err = rpm.SignatureHashAlgorithm(rpmPath)
+	if err != nil {
+		return
+	}
+
+	p.lock.Lock()
+	p.hashAlgorithms[rpmPath] = hashAlgorithm
+	p.lock.Unlock()
+	return
+}
+
+// clonedPackages returns the RPM files the clones of the fetched 'rpmPackages' needed, mapped to their repo IDs.
+func (p *fetchedPackageSet) clonedPackages(rpmPackages []string) (clonedPackages map[string]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	clonedPackages = make(map[string]string)
+	for _, rpmPackage := range rpmPackages {
+		for rpmFile, repoID := range p.cloned[rpmPackage] {
+			clonedPackages[rpmFile] = repoID
+		}
+	}
+	return
+}
+
+func assignRPMPath(node *pkggraph.PkgNode, options *resolveOptions, resolvedPackages []string) (err error) {
+	outDir := options.outDir
+
+	rpmPaths := []string{}
+	for _, resolvedPackage := range resolvedPackages {
+		rpmPaths = append(rpmPaths, rpmPackageToRPMPath(resolvedPackage, outDir))
+	}
+
+	chosenRPMPath := rpmPaths[0]
+	if len(rpmPaths) > 1 && options.resolutionStrategy == resolutionStrategyMinimum {
+		lowestPackage := lowestVersionPackage(resolvedPackages)
+		logger.Log.Debugf("Found %d candidates. Picking the lowest version '%s'.", len(rpmPaths), lowestPackage)
+		chosenRPMPath = rpmPackageToRPMPath(lowestPackage, outDir)
+	} else if len(rpmPaths) > 1 {
+		var resolvedRPMs []string
+		logger.Log.Debugf("Found %d candidates. Resolving.", len(rpmPaths))
+
+		resolvedRPMs, err = rpm.ResolveCompetingPackages(options.tmpDir, rpmPaths...)
+		if err != nil {
+			logger.Log.Errorf("Failed while trying to pick an RPM providing '%s' from the following RPMs: %v", node.VersionedPkg.Name, rpmPaths)
+			return
+		}
+
+		resolvedRPMsCount := len(resolvedRPMs)
+		if resolvedRPMsCount == 0 {
+			logger.Log.Errorf("Failed while trying to pick an RPM providing '%s'. No RPM can be installed from the following: %v", node.VersionedPkg.Name, rpmPaths)
+			return
+		}
+
+		chosenPackage := resolvedRPMs[0]
+		if resolvedRPMsCount > 1 {
+			sortedPackages := sortByVersionDescending(resolvedRPMs)
+			chosenPackage = sortedPackages[0]
+			logger.Log.Warnf("Found %d installable candidates to provide '%s'. Picking the highest version '%s', rejecting: %v. Pin the desired version with '--version-pins-file' to silence this warning.",
+				resolvedRPMsCount, node.VersionedPkg.Name, chosenPackage, sortedPackages[1:])
+		}
+
+		chosenRPMPath = rpmPackageToRPMPath(chosenPackage, outDir)
+	}
+
+	node.RpmPath = chosenRPMPath
+
+	return
+}
+
+func rpmPackageToRPMPath(rpmPackage, outDir string) string {
+	// Construct the rpm path of the cloned package.
+	rpmName := fmt.Sprintf("%s.rpm", rpmPackage)
+	return filepath.Join(outDir, rpmName)
+}
+
+// isToolchainPackage returns true if the RPM at 'rpmPath' is one of the toolchain RPMs. Names differing only in their
+// formatting, e.g. an explicit epoch or a missing '.rpm' extension, still match.
+func isToolchainPackage(rpmPath string, toolchainRPMs []string) bool {
+	base := filepath.Base(rpmPath)
+	for _, t := range toolchainRPMs {
+		if t == base {
+			return true
+		}
+	}
+
+	rpmInfo, err := rpm.ParseNEVRA(base)
+	if err != nil {
+		return false
+	}
+	for _, t := range toolchainRPMs {
+		toolchainInfo, err := rpm.ParseNEVRA(t)
+		if err == nil && rpmInfo.SameNEVRA(toolchainInfo) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,435 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/scheduler/schedulerutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldNotDowngradeLocallyBuiltPackages(t *testing.T) {
+	rpmDir := t.TempDir()
+	for _, rpmFile := range []string{"x86_64/zlib-1.2.13-1.cm2.x86_64.rpm", "x86_64/zlib-1.2.13-2.cm2.x86_64.rpm", "noarch/tzdata-2023c-1.cm2.noarch.rpm"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(rpmDir, filepath.Dir(rpmFile)), os.ModePerm))
+		assert.NoError(t, os.WriteFile(filepath.Join(rpmDir, rpmFile), []byte{}, 0644))
+	}
+
+	versions, err := readLocalBuiltVersions(rpmDir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"zlib": "1.2.13-2.cm2", "tzdata": "2023c-1.cm2"}, versions)
+
+	options := newTestResolveOptions("/cache")
+	options.localBuiltVersions = versions
+
+	tests := []struct {
+		name      string
+		candidate string
+		chosen    bool
+	}{
+		{name: "older", candidate: "zlib-1.2.13-1.cm2.x86_64", chosen: false},
+		{name: "equal", candidate: "zlib-1.2.13-2.cm2.x86_64", chosen: true},
+		{name: "newer", candidate: "zlib-1.3-1.cm2.x86_64", chosen: true},
+	}
+	for _, test := range tests {
+		node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "zlib"}, State: pkggraph.StateUnresolved, RpmPath: pkggraph.NoRPMPath}
+		cloner := &fakeCloner{providers: []string{test.candidate}}
+
+		_, err = resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+		if test.chosen {
+			assert.NoError(t, err, test.name)
+			assert.Equal(t, rpmPackageToRPMPath(test.candidate, "/cache"), node.RpmPath, test.name)
+		} else {
+			assert.Error(t, err, test.name)
+			assert.Empty(t, cloner.cloned, test.name)
+			assert.Equal(t, pkggraph.NoRPMPath, node.RpmPath, test.name)
+		}
+	}
+
+	keptCandidates, err := rejectDowngrades([]string{"zlib-1.2.13-1.cm2.x86_64", "zlib-1.3-1.cm2.x86_64", "gcc-12.2.0-1.cm2.x86_64"}, versions)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"zlib-1.3-1.cm2.x86_64", "gcc-12.2.0-1.cm2.x86_64"}, keptCandidates)
+}
+
+func TestShouldMatchToolchainPackagesByNEVRA(t *testing.T) {
+	toolchainPackages := []string{"zlib-1.2.13-1.cm2.x86_64.rpm", "gcc-12.2.0-1.cm2.x86_64", "perl-1:5.34.1-489.cm2.x86_64.rpm"}
+
+	assert.True(t, isToolchainPackage("/out/zlib-1.2.13-1.cm2.x86_64.rpm", toolchainPackages))
+	assert.True(t, isToolchainPackage("/out/zlib-1:1.2.13-1.cm2.x86_64.rpm", toolchainPackages))
+	assert.True(t, isToolchainPackage("/out/gcc-12.2.0-1.cm2.x86_64.rpm", toolchainPackages))
+	assert.True(t, isToolchainPackage("/out/perl-5.34.1-489.cm2.x86_64.rpm", toolchainPackages))
+
+	assert.False(t, isToolchainPackage("/out/perl-2:5.34.1-489.cm2.x86_64.rpm", toolchainPackages))
+	assert.False(t, isToolchainPackage("/out/zlib-1.2.13-2.cm2.x86_64.rpm", toolchainPackages))
+	assert.False(t, isToolchainPackage("/out/zlib-devel-1.2.13-1.cm2.x86_64.rpm", toolchainPackages))
+	assert.False(t, isToolchainPackage("/out/zlib.rpm", toolchainPackages))
+}
+
+func TestShouldTracePrebuiltDecisionInputs(t *testing.T) {
+	const rpmPath = "/cache/gcc-12.2.0-1.cm2.x86_64.rpm"
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "gcc"}, RpmPath: rpmPath}
+	toolchain := &toolchainRPMs{packages: []string{"gcc-12.2.0-1.cm2.x86_64.rpm"}}
+
+	decision := decidePrebuilt(node, true, map[string]bool{}, toolchain)
+	assert.True(t, decision.ClonedAsPrebuilt)
+	assert.True(t, decision.IsToolchainPackage)
+	assert.True(t, decision.MarkedPrebuilt)
+
+	decision = decidePrebuilt(node, false, map[string]bool{rpmPath: true}, toolchain)
+	assert.True(t, decision.KnownPrebuilt)
+	assert.True(t, decision.MarkedPrebuilt)
+
+	decision = decidePrebuilt(node, true, map[string]bool{}, &toolchainRPMs{})
+	assert.False(t, decision.IsToolchainPackage)
+	assert.False(t, decision.MarkedPrebuilt)
+
+	trace := &prebuiltTrace{}
+	trace.record(decision)
+	assert.Equal(t, []prebuiltDecision{decision}, trace.Decisions)
+
+	var disabledTrace *prebuiltTrace
+	disabledTrace.record(decision)
+}
+
+func TestShouldListPackagesClonedForNodeRegardlessOfOrder(t *testing.T) {
+	cloner := &fakeCloner{deps: map[string][]string{
+		"gtk3-1.0-1.cm2.x86_64": {"glibc-1.0-1.cm2.x86_64", "mesa-1.0-1.cm2.x86_64"},
+		"mesa-1.0-1.cm2.x86_64": {"glibc-1.0-1.cm2.x86_64"},
+	}}
+	packages := newFetchedPackageSet()
+
+	resolve := func(name string) map[string]string {
+		node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: name}, State: pkggraph.StateUnresolved}
+		resolution, err := resolveSingleNode(context.Background(), cloner, node, packages, newTestResolveOptions("/cache"))
+		assert.NoError(t, err)
+		return resolution.clonedPackages
+	}
+
+	// 'gtk3' already cloned 'mesa', whose resolution still lists everything it needs.
+	assert.Len(t, resolve("gtk3"), 3)
+	assert.Equal(t, map[string]string{"mesa-1.0-1.cm2.x86_64.rpm": "fake-repo", "glibc-1.0-1.cm2.x86_64.rpm": "fake-repo"}, resolve("mesa"))
+
+	// Nodes resolved to an already fetched package list the packages of its clone.
+	assert.Len(t, resolve("gtk3"), 3)
+	assert.Equal(t, 2, cloner.cloneCalls)
+}
+
+func TestShouldFetchSamePackagesWithWorkers(t *testing.T) {
+	serialPackages := resolveWithWorkers(t, 1)
+	assert.Len(t, serialPackages.fetched, 25)
+
+	concurrentPackages := resolveWithWorkers(t, 8)
+	assert.Equal(t, serialPackages.fetched, concurrentPackages.fetched)
+	assert.Equal(t, serialPackages.prebuilt, concurrentPackages.prebuilt)
+}
+
+func TestShouldStopStartingNodesWhenHandlerStops(t *testing.T) {
+	nodes := []*pkggraph.PkgNode{}
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, &pkggraph.PkgNode{})
+	}
+
+	handledNodes := 0
+	startedNodes := resolveNodesConcurrently(context.Background(), nodes, 1, func(*pkggraph.PkgNode) error { return nil }, func(*pkggraph.PkgNode, error) bool {
+		handledNodes++
+		return handledNodes < 3
+	})
+	assert.Equal(t, 3, startedNodes)
+	assert.Equal(t, 3, handledNodes)
+}
+
+func TestShouldRetryTransientCloneFailures(t *testing.T) {
+	options := newTestResolveOptions("/cache")
+	options.cloneRetries, options.cloneRetryDelay = 3, time.Millisecond
+
+	cloner := &fakeCloner{cloneFailures: 2, cloneErr: fmt.Errorf("connection reset by peer")}
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "zlib"}, State: pkggraph.StateUnresolved}
+
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, cloner.cloneCalls)
+	assert.Equal(t, pkggraph.StateCached, node.State)
+}
+
+func TestShouldNotRetryMissingPackages(t *testing.T) {
+	options := newTestResolveOptions("/cache")
+	options.cloneRetries, options.cloneRetryDelay = 3, time.Millisecond
+
+	cloner := &fakeCloner{cloneFailures: 2, cloneErr: fmt.Errorf("%w: No package zlib available", rpmrepocloner.ErrPackageNotFound)}
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "zlib"}, State: pkggraph.StateUnresolved}
+
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+	assert.ErrorIs(t, err, rpmrepocloner.ErrPackageNotFound)
+	assert.Equal(t, 1, cloner.cloneCalls)
+	assert.Equal(t, pkggraph.StateUnresolved, node.State)
+}
+
+func TestShouldReportMixedNodeOutcomes(t *testing.T) {
+	report := &fetchReport{}
+	resolveAndRecord := func(cloner nodeCloner, name string) (node *pkggraph.PkgNode) {
+		node = &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: name}, State: pkggraph.StateUnresolved, Type: pkggraph.TypeRemoteRun, RpmPath: pkggraph.NoRPMPath}
+		resolution, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), newTestResolveOptions("/cache"))
+		report.record(node, resolution.candidates, err)
+		return
+	}
+
+	resolvedNode := resolveAndRecord(&fakeCloner{}, "zlib")
+	failedNode := resolveAndRecord(&fakeCloner{cloneFailures: 1, cloneErr: fmt.Errorf("%w: No package gcc available", rpmrepocloner.ErrPackageNotFound)}, "gcc")
+
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	assert.NoError(t, report.write(reportFile))
+
+	contents := fetchReportContents{}
+	assert.NoError(t, jsonutils.ReadJSONFile(reportFile, &contents))
+	outcomes := contents.Nodes
+	assert.Len(t, outcomes, 2)
+	assert.Nil(t, contents.Downloads)
+
+	resolved := outcomes[resolvedNode.FriendlyName()]
+	assert.Equal(t, "Cached", resolved.State)
+	assert.Equal(t, "zlib-1.0-1.cm2.x86_64.rpm", resolved.Package)
+	assert.False(t, resolved.Prebuilt)
+	assert.Equal(t, 1, resolved.Candidates)
+	assert.Empty(t, resolved.Error)
+
+	failed := outcomes[failedNode.FriendlyName()]
+	assert.Equal(t, "Unresolved", failed.State)
+	assert.Empty(t, failed.Package)
+	assert.Equal(t, 1, failed.Candidates)
+	assert.Contains(t, failed.Error, "No package gcc available")
+}
+
+func TestShouldFailNodeWithOnlyExcludedProvider(t *testing.T) {
+	cloner := &fakeCloner{providers: []string{"openssl-1.1.1k-9.cm2.x86_64"}}
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "openssl"}, State: pkggraph.StateUnresolved}
+	excluded := map[string]bool{"openssl": true}
+
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: "/cache", excludedPackages: excluded})
+	assert.ErrorContains(t, err, "excluded")
+	assert.Empty(t, cloner.cloned)
+	assert.Equal(t, pkggraph.StateUnresolved, node.State)
+}
+
+func TestShouldSkipExcludedProvider(t *testing.T) {
+	cloner := &fakeCloner{providers: []string{"openssl-1.1.1k-9.cm2.x86_64", "libressl-3.0-1.cm2.x86_64"}}
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "libcrypto.so"}, State: pkggraph.StateUnresolved}
+	excluded := map[string]bool{"openssl-1.1.1k": true}
+
+	resolution, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: "/cache", excludedPackages: excluded})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, resolution.candidates)
+	assert.Equal(t, []string{"libressl-3.0-1.cm2.x86_64"}, cloner.cloned)
+	assert.Equal(t, "/cache/libressl-3.0-1.cm2.x86_64.rpm", node.RpmPath)
+	assert.Equal(t, pkggraph.StateCached, node.State)
+}
+
+func TestShouldFailNodePullingInExcludedDependency(t *testing.T) {
+	outDir := t.TempDir()
+	cloner := &fakeCloner{
+		deps:   map[string][]string{"curl-1.0-1.cm2.x86_64": {"openssl-1.1.1k-9.cm2.x86_64", "zlib-1.0-1.cm2.x86_64"}},
+		outDir: outDir,
+	}
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "curl"}, State: pkggraph.StateUnresolved}
+	excluded := map[string]bool{"openssl": true}
+
+	_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: outDir, excludedPackages: excluded})
+	assert.ErrorContains(t, err, "pulled in the excluded package(s) 'openssl-1.1.1k-9.cm2.x86_64.rpm'")
+	assert.Equal(t, pkggraph.StateUnresolved, node.State)
+	assert.NoFileExists(t, filepath.Join(outDir, "openssl-1.1.1k-9.cm2.x86_64.rpm"))
+	assert.FileExists(t, filepath.Join(outDir, "zlib-1.0-1.cm2.x86_64.rpm"))
+}
+
+func TestShouldOnlyRejectDistinctProvidersWhenStrict(t *testing.T) {
+	tests := []struct {
+		name      string
+		providers []string
+		ambiguous bool
+	}{
+		{"single provider", []string{"openssl-1.1.1k-9.cm2.x86_64"}, false},
+		{"versions of one package", []string{"openssl-1.1.1k-9.cm2.x86_64", "openssl-1.1.1k-10.cm2.x86_64"}, false},
+		{"different packages", []string{"openssl-1.1.1k-9.cm2.x86_64", "libressl-3.0-1.cm2.x86_64"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cloner := &fakeCloner{providers: test.providers}
+			node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "libcrypto.so"}, State: pkggraph.StateUnresolved}
+			options := newTestResolveOptions("/cache")
+			options.strictProvides = true
+
+			_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), options)
+			if test.ambiguous {
+				assert.ErrorIs(t, err, errAmbiguousProvides)
+				assert.ErrorContains(t, err, "libressl, openssl")
+				assert.Empty(t, cloner.cloned)
+				assert.Equal(t, pkggraph.StateUnresolved, node.State)
+			} else {
+				// Picking one of several versions needs the 'rpm' tool, so only check that the strict mode lets them through.
+				assert.NotErrorIs(t, err, errAmbiguousProvides)
+				assert.Equal(t, test.providers, cloner.cloned)
+			}
+		})
+	}
+}
+
+func TestShouldOnlyFailFastOnUnresolvableImplicitNodeWhenRequested(t *testing.T) {
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "/usr/bin/missing"}, State: pkggraph.StateUnresolved, Implicit: true}
+
+	_, resolveErr := resolveSingleNode(context.Background(), &fakeCloner{available: map[string]bool{}}, node, newFetchedPackageSet(), newTestResolveOptions("/cache"))
+	assert.ErrorIs(t, resolveErr, rpmrepocloner.ErrPackageNotFound)
+	assert.Equal(t, pkggraph.StateUnresolved, node.State)
+
+	assert.NoError(t, implicitResolutionError(node, resolveErr, false))
+
+	err := implicitResolutionError(node, resolveErr, true)
+	assert.ErrorContains(t, err, "failed to resolve implicit node")
+	assert.ErrorIs(t, err, rpmrepocloner.ErrPackageNotFound)
+
+	explicitNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "missing"}, State: pkggraph.StateUnresolved}
+	assert.NoError(t, implicitResolutionError(explicitNode, resolveErr, true))
+}
+
+func TestShouldResolveLocallySatisfiableGraphOffline(t *testing.T) {
+	options := newTestResolveOptions("/cache")
+	options.offline = true
+
+	g := pkggraph.NewPkgGraph()
+	for _, name := range []string{"bash", "glibc", "zlib"} {
+		_, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+		assert.NoError(t, err)
+	}
+
+	cloner := &fakeCloner{available: map[string]bool{"bash": true, "glibc": true, "zlib": true}}
+	packages := newFetchedPackageSet()
+	resolve := func(n *pkggraph.PkgNode) error {
+		_, err := resolveSingleNode(context.Background(), cloner, n, packages, options)
+		return err
+	}
+
+	startedNodes := resolveNodesConcurrently(context.Background(), g.AllRunNodes(), 1, resolve, func(n *pkggraph.PkgNode, resolveErr error) bool {
+		assert.NoError(t, resolveErr)
+		return true
+	})
+	assert.Equal(t, 3, startedNodes)
+	for _, n := range g.AllRunNodes() {
+		assert.Equal(t, pkggraph.StateCached, n.State)
+	}
+
+	missingNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "gcc"}, State: pkggraph.StateUnresolved}
+	_, err := resolveSingleNode(context.Background(), cloner, missingNode, packages, options)
+	assert.ErrorIs(t, err, errNotAvailableOffline)
+	assert.ErrorContains(t, err, "can't be downloaded with '--offline'")
+	assert.Equal(t, pkggraph.StateUnresolved, missingNode.State)
+}
+
+func TestShouldOnlyUsePrebuiltToolchainRPMMatchingChecksum(t *testing.T) {
+	const (
+		matchingRPM   = "gcc-12.2.0-1.cm2.x86_64.rpm"
+		corruptedRPM  = "glibc-2.35-3.cm2.x86_64.rpm"
+		uncheckedRPM  = "zlib-1.2.13-1.cm2.x86_64.rpm"
+		unexpectedSum = "0000000000000000000000000000000000000000000000000000000000000000"
+	)
+
+	cacheDir := t.TempDir()
+	for _, rpmName := range []string{matchingRPM, corruptedRPM, uncheckedRPM} {
+		assert.NoError(t, os.WriteFile(filepath.Join(cacheDir, rpmName), []byte(rpmName), 0644))
+	}
+	matchingSum, err := file.GenerateSHA256(filepath.Join(cacheDir, matchingRPM))
+	assert.NoError(t, err)
+
+	// Checksum and filename-only entries may be mixed.
+	manifestPath := filepath.Join(t.TempDir(), "toolchain_x86_64.txt")
+	manifest := fmt.Sprintf("%s  /toolchain/RPMS/x86_64/%s\n%s *%s\n%s\n", matchingSum, matchingRPM, unexpectedSum, corruptedRPM, uncheckedRPM)
+	assert.NoError(t, os.WriteFile(manifestPath, []byte(manifest), 0644))
+
+	toolchain := &toolchainRPMs{}
+	toolchain.packages, toolchain.checksums, err = schedulerutils.ReadReservedFilesChecksums(manifestPath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{matchingRPM, corruptedRPM, uncheckedRPM}, toolchain.packages)
+	assert.Equal(t, map[string]string{matchingRPM: matchingSum, corruptedRPM: unexpectedSum}, toolchain.checksums)
+
+	plainPackages, err := schedulerutils.ReadReservedFilesList(manifestPath)
+	assert.NoError(t, err)
+	assert.Equal(t, toolchain.packages, plainPackages)
+
+	resolve := func(rpmName string) (node *pkggraph.PkgNode) {
+		packageName := strings.TrimSuffix(rpmName, ".rpm")
+		node = &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: packageName}, State: pkggraph.StateUnresolved, Type: pkggraph.TypeRemoteRun, RpmPath: pkggraph.NoRPMPath}
+		cloner := &fakeCloner{providers: []string{packageName}, prebuilt: map[string]bool{packageName: true}}
+		_, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), &resolveOptions{cloneDeps: true, outDir: cacheDir, toolchain: toolchain})
+		assert.NoError(t, err)
+		return
+	}
+
+	matchingNode := resolve(matchingRPM)
+	assert.Equal(t, pkggraph.StateUpToDate, matchingNode.State)
+	assert.Equal(t, pkggraph.TypePreBuilt, matchingNode.Type)
+
+	corruptedNode := resolve(corruptedRPM)
+	assert.Equal(t, pkggraph.StateCached, corruptedNode.State)
+	assert.Equal(t, pkggraph.TypeRemoteRun, corruptedNode.Type)
+
+	uncheckedNode := resolve(uncheckedRPM)
+	assert.Equal(t, pkggraph.StateUpToDate, uncheckedNode.State)
+	assert.Equal(t, pkggraph.TypePreBuilt, uncheckedNode.Type)
+
+	decision := decidePrebuilt(corruptedNode, true, map[string]bool{}, toolchain)
+	assert.True(t, decision.IsToolchainPackage)
+	assert.True(t, decision.ChecksumMismatch)
+	assert.False(t, decision.MarkedPrebuilt)
+}
+
+func TestShouldMergeToolchainManifests(t *testing.T) {
+	const (
+		compilerSum = "1111111111111111111111111111111111111111111111111111111111111111"
+		otherSum    = "2222222222222222222222222222222222222222222222222222222222222222"
+	)
+
+	manifestDir := t.TempDir()
+	writeManifest := func(name, contents string) (path string) {
+		path = filepath.Join(manifestDir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+		return
+	}
+
+	// Both components ship glibc, each also has packages of its own.
+	compilerManifest := writeManifest("compiler.txt", fmt.Sprintf("%s  gcc-12.2.0-1.cm2.x86_64.rpm\nglibc-2.35-3.cm2.x86_64.rpm\n", compilerSum))
+	coreManifest := writeManifest("core.txt", "/toolchain/RPMS/x86_64/glibc-2.35-3.cm2.x86_64.rpm\nzlib-1.2.13-1.cm2.x86_64.rpm\n")
+
+	toolchain := &toolchainRPMs{}
+	var err error
+	toolchain.packages, toolchain.checksums, err = schedulerutils.ReadReservedFilesChecksums(compilerManifest, coreManifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"gcc-12.2.0-1.cm2.x86_64.rpm", "glibc-2.35-3.cm2.x86_64.rpm", "zlib-1.2.13-1.cm2.x86_64.rpm"}, toolchain.packages)
+	assert.Equal(t, map[string]string{"gcc-12.2.0-1.cm2.x86_64.rpm": compilerSum}, toolchain.checksums)
+
+	assert.True(t, toolchain.contains("/cache/gcc-12.2.0-1.cm2.x86_64.rpm"))
+	assert.True(t, toolchain.contains("/cache/glibc-2.35-3.cm2.x86_64.rpm"))
+	assert.True(t, toolchain.contains("/cache/zlib-1.2.13-1.cm2.x86_64.rpm"))
+	assert.False(t, toolchain.contains("/cache/bash-5.1.8-1.cm2.x86_64.rpm"))
+
+	// A single manifest reads the same as before.
+	singlePackages, err := schedulerutils.ReadReservedFilesList(coreManifest)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"glibc-2.35-3.cm2.x86_64.rpm", "zlib-1.2.13-1.cm2.x86_64.rpm"}, singlePackages)
+
+	noPackages, err := schedulerutils.ReadReservedFilesList("")
+	assert.NoError(t, err)
+	assert.Empty(t, noPackages)
+
+	conflictingManifest := writeManifest("conflicting.txt", fmt.Sprintf("%s  gcc-12.2.0-1.cm2.x86_64.rpm\n", otherSum))
+	_, _, err = schedulerutils.ReadReservedFilesChecksums(compilerManifest, conflictingManifest)
+	assert.Error(t, err)
+}
@@ -0,0 +1,479 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/shell"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
+)
+
+// signatureHashAlgorithms lists the supported signature hash algorithms from the weakest to the strongest.
+var signatureHashAlgorithms = []string{"MD5", "SHA1", "SHA224", "SHA256", "SHA384", "SHA512"}
+
+// licenseReport aggregates the licenses of all fetched packages.
+type licenseReport struct {
+	Licenses   map[string][]string `json:"Licenses"`   // License header value -> RPMs using it
+	Disallowed map[string]string   `json:"Disallowed"` // RPM -> license header value not covered by the allowlist
+}
+
+// licenseSeparatorRegex splits compound license expressions (e.g. "GPLv2+ and (MIT or BSD)") into single licenses.
+var licenseSeparatorRegex = regexp.MustCompile(`(?i)\s+(?:and|or)\s+|[()]`)
+
+// errUntrustedRPM marks nodes whose RPM failed '--require-signature', which fail the fetch even in best-effort mode.
+var errUntrustedRPM = errors.New("RPM signature verification failed")
+
+// errWeakSignature marks nodes whose clones pulled in RPMs rejected by '--min-signature-algo', which fail the fetch even in best-effort mode.
+var errWeakSignature = errors.New("RPM signature too weak")
+
+// closureGap is a requirement of a fetched RPM which no fetched RPM or resolved node provides.
+type closureGap struct {
+	rpmFile     string
+	requirement string
+}
+
+// checkClosure reads the requirements of every RPM in the clone directory and fails if any of them is neither provided
+// by another fetched RPM nor by a resolved run node of the graphs, e.g. because a clone missed a dependency.
+func checkClosure(dependencyGraphs []*pkggraph.PkgGraph, cloneDir string) (err error) {
+	timestamp.StartEvent("check closure", nil)
+	defer timestamp.StopEvent(nil)
+
+	rpmPaths, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	fetchedPackages := make(map[string]*rpm.PackageInfo, len(rpmPaths))
+	for _, rpmPath := range rpmPaths {
+		fetchedPackages[filepath.Base(rpmPath)], err = rpm.ReadPackageHeader(rpmPath)
+		if err != nil {
+			return fmt.Errorf("failed to read the requirements of '%s':\n%w", rpmPath, err)
+		}
+	}
+
+	gaps, err := findClosureGaps(fetchedPackages, resolvedGraphProviders(dependencyGraphs))
+	if err != nil {
+		return
+	}
+
+	if len(gaps) == 0 {
+		logger.Log.Infof("All requirements of the %d fetched RPM(s) are satisfied.", len(fetchedPackages))
+		return
+	}
+
+	for _, gap := range gaps {
+		logger.Log.Errorf("'%s' required by '%s' is not provided by any fetched RPM or resolved node.", gap.requirement, gap.rpmFile)
+	}
+	return fmt.Errorf("%d requirement(s) of the fetched RPMs are not satisfied", len(gaps))
+}
+
+// resolvedGraphProviders returns the capabilities of all run nodes which were resolved or will be built locally.
+func resolvedGraphProviders(dependencyGraphs []*pkggraph.PkgGraph) (providers []*pkgjson.PackageVer) {
+	for _, dependencyGraph := range dependencyGraphs {
+		for _, n := range dependencyGraph.AllNodes() {
+			isRunNode := n.Type == pkggraph.TypeLocalRun || n.Type == pkggraph.TypeRemoteRun || n.Type == pkggraph.TypePreBuilt
+			if isRunNode && n.State != pkggraph.StateUnresolved {
+				providers = append(providers, n.VersionedPkg)
+			}
+		}
+	}
+	return
+}
+
+// findClosureGaps returns the requirements of the fetched packages, keyed by their RPM file names, which neither one
+// of the fetched packages nor one of 'providers' satisfies, ordered by RPM file. File requirements are not checked, as
+// the packages' provides do not list their files, and neither are the 'rpmlib()' capabilities provided by RPM itself.
+// Requirements and provides which aren't a single capability with an optional version, e.g. rich dependencies,
+// are skipped.
+func findClosureGaps(fetchedPackages map[string]*rpm.PackageInfo, providers []*pkgjson.PackageVer) (gaps []closureGap, err error) {
+	providedIntervals := make(map[string][]pkgjson.PackageVerInterval)
+	addProvider := func(provider *pkgjson.PackageVer) (err error) {
+		interval, err := provider.Interval()
+		if err != nil {
+			return
+		}
+		providedIntervals[provider.Name] = append(providedIntervals[provider.Name], interval)
+		return
+	}
+
+	for _, provider := range providers {
+		err = addProvider(provider)
+		if err != nil {
+			return
+		}
+	}
+
+	rpmFiles := make([]string, 0, len(fetchedPackages))
+	for rpmFile, info := range fetchedPackages {
+		rpmFiles = append(rpmFiles, rpmFile)
+		for _, provide := range info.Provides {
+			provider, parseErr := pkgjson.PackageStringToPackageVer(provide)
+			if parseErr != nil {
+				logger.Log.Debugf("Ignoring provide '%s' of '%s': %s", provide, rpmFile, parseErr)
+				continue
+			}
+
+			err = addProvider(provider)
+			if err != nil {
+				return nil, fmt.Errorf("invalid provide '%s' of '%s':\n%w", provide, rpmFile, err)
+			}
+		}
+	}
+	sort.Strings(rpmFiles)
+
+	for _, rpmFile := range rpmFiles {
+		for _, requirement := range fetchedPackages[rpmFile].Requires {
+			if strings.HasPrefix(requirement, "/") || strings.HasPrefix(requirement, "rpmlib(") {
+				continue
+			}
+
+			required, parseErr := pkgjson.PackageStringToPackageVer(requirement)
+			if parseErr != nil {
+				logger.Log.Debugf("Not checking requirement '%s' of '%s': %s", requirement, rpmFile, parseErr)
+				continue
+			}
+
+			var requiredInterval pkgjson.PackageVerInterval
+			requiredInterval, err = required.Interval()
+			if err != nil {
+				return nil, fmt.Errorf("invalid requirement '%s' of '%s':\n%w", requirement, rpmFile, err)
+			}
+
+			satisfied := false
+			for _, providedInterval := range providedIntervals[required.Name] {
+				if providedInterval.Satisfies(&requiredInterval) {
+					satisfied = true
+					break
+				}
+			}
+			if !satisfied {
+				gaps = append(gaps, closureGap{rpmFile: rpmFile, requirement: requirement})
+			}
+		}
+	}
+
+	return
+}
+
+// checkLicenses reports the license of every RPM in 'cloneDir' into 'reportFile', if set. If 'allowlistFile' is set,
+// fails if any RPM's license expression names a license missing from the allowlist.
+func checkLicenses(cloneDir, reportFile, allowlistFile string) (err error) {
+	const licenseTag = "LICENSE"
+
+	timestamp.StartEvent("check licenses", nil)
+	defer timestamp.StopEvent(nil)
+
+	allowlist, err := readListFile(allowlistFile)
+	if err != nil {
+		return fmt.Errorf("failed to read license allowlist '%s':\n%w", allowlistFile, err)
+	}
+
+	rpmPaths, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	report := &licenseReport{
+		Licenses:   make(map[string][]string),
+		Disallowed: make(map[string]string),
+	}
+
+	for _, rpmPath := range rpmPaths {
+		rpmName := filepath.Base(rpmPath)
+
+		license, err := rpm.QueryHeader(rpmPath, licenseTag)
+		if err != nil {
+			return fmt.Errorf("failed to query the license of '%s':\n%w", rpmPath, err)
+		}
+
+		report.Licenses[license] = append(report.Licenses[license], rpmName)
+		if allowlistFile != "" && !isLicenseAllowed(license, allowlist) {
+			logger.Log.Warnf("'%s' uses a license not on the allowlist: %s", rpmName, license)
+			report.Disallowed[rpmName] = license
+		}
+	}
+
+	if strings.TrimSpace(reportFile) != "" {
+		err = jsonutils.WriteJSONFile(reportFile, report)
+		if err != nil {
+			return fmt.Errorf("failed to write license report to '%s':\n%w", reportFile, err)
+		}
+	}
+
+	if len(report.Disallowed) > 0 {
+		err = fmt.Errorf("found %d RPM(s) with licenses not on the allowlist", len(report.Disallowed))
+	}
+
+	return
+}
+
+// isLicenseAllowed checks if every license named by a license expression is on the allowlist.
+// An expression matching an allowlist entry as a whole is allowed as well.
+func isLicenseAllowed(license string, allowlist map[string]bool) bool {
+	if allowlist[strings.TrimSpace(license)] {
+		return true
+	}
+
+	for _, singleLicense := range licenseSeparatorRegex.Split(license, -1) {
+		singleLicense = strings.TrimSpace(singleLicense)
+		if singleLicense != "" && !allowlist[singleLicense] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// signatureHashStrength ranks a signature hash algorithm, higher is stronger. Unknown algorithms rank lowest.
+func signatureHashStrength(hashAlgorithm string) int {
+	for i, knownAlgorithm := range signatureHashAlgorithms {
+		if strings.EqualFold(knownAlgorithm, hashAlgorithm) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// readSignedBaseline verifies the detached GPG signature of the baseline manifest and reads its NEVRAs.
+func readSignedBaseline(manifestPath, signaturePath string) (baseline map[string]bool, err error) {
+	if strings.TrimSpace(signaturePath) == "" {
+		return nil, fmt.Errorf("the baseline manifest must be signed, '--baseline-signature' is required")
+	}
+
+	_, stderr, err := shell.Execute("gpg", "--verify", signaturePath, manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify signature '%s' of baseline manifest '%s':\n%s\n%w", signaturePath, manifestPath, stderr, err)
+	}
+	logger.Log.Infof("Verified the signature of baseline manifest '%s'.", manifestPath)
+
+	baseline, err = readListFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline manifest '%s':\n%w", manifestPath, err)
+	}
+
+	// Accept both plain NEVRAs and RPM file names.
+	for nevra := range baseline {
+		if strings.HasSuffix(nevra, ".rpm") {
+			delete(baseline, nevra)
+			baseline[strings.TrimSuffix(nevra, ".rpm")] = true
+		}
+	}
+
+	return
+}
+
+// verifyAgainstBaseline compares the NEVRAs of all RPMs in 'rpmsDir' against the baseline, failing on any
+// added, removed, or changed package.
+func verifyAgainstBaseline(rpmsDir string, baseline map[string]bool) (err error) {
+	rpmPaths, err := filepath.Glob(filepath.Join(rpmsDir, "*.rpm"))
+	if err != nil {
+		return
+	}
+
+	resolved := make(map[string]bool, len(rpmPaths))
+	for _, rpmPath := range rpmPaths {
+		resolved[strings.TrimSuffix(filepath.Base(rpmPath), ".rpm")] = true
+	}
+
+	drift := baselineDrift(resolved, baseline)
+	if len(drift) > 0 {
+		err = fmt.Errorf("%d difference(s):\n%s", len(drift), strings.Join(drift, "\n"))
+	}
+
+	return
+}
+
+// baselineDrift describes every difference between the resolved and baseline NEVRAs. A package with the same
+// name and architecture but a different version in both sets is reported as a single change.
+func baselineDrift(resolved, baseline map[string]bool) (drift []string) {
+	nameArch := func(nevra string) string {
+		return fmt.Sprintf("%s.%s", packageNameFromRPM(nevra), nevra[strings.LastIndex(nevra, ".")+1:])
+	}
+
+	removed := make(map[string]string)
+	for nevra := range baseline {
+		if !resolved[nevra] {
+			removed[nameArch(nevra)] = nevra
+		}
+	}
+
+	for nevra := range resolved {
+		if baseline[nevra] {
+			continue
+		}
+
+		key := nameArch(nevra)
+		if baselineNEVRA, found := removed[key]; found {
+			drift = append(drift, fmt.Sprintf("changed: '%s' -> '%s'", baselineNEVRA, nevra))
+			delete(removed, key)
+		} else {
+			drift = append(drift, fmt.Sprintf("added: '%s'", nevra))
+		}
+	}
+
+	for _, nevra := range removed {
+		drift = append(drift, fmt.Sprintf("removed: '%s'", nevra))
+	}
+
+	sort.Strings(drift)
+	return
+}
+
+// retiredPackagesIn returns the sorted RPM files among a node's 'clonedPackages' whose package is retired.
+func retiredPackagesIn(clonedPackages map[string]string, retiredPackages map[string]bool) (retiredRPMs []string) {
+	for rpmFile := range clonedPackages {
+		if retiredPackages[packageNameFromRPM(rpmFile)] {
+			retiredRPMs = append(retiredRPMs, rpmFile)
+		}
+	}
+
+	sort.Strings(retiredRPMs)
+	return
+}
+
+// removeRejectedRPMs deletes RPMs pulled in by a node's clones which must not stay in 'cloneDir'.
+func removeRejectedRPMs(cloneDir string, rpmFiles []string) {
+	for _, rpmFile := range rpmFiles {
+		rpmPath := filepath.Join(cloneDir, rpmFile)
+		logger.Log.Debugf("Removing rejected RPM '%s' from the cache.", rpmFile)
+		err := os.Remove(rpmPath)
+		if err != nil && !os.IsNotExist(err) {
+			logger.Log.Warnf("Failed to remove rejected RPM '%s': %s", rpmPath, err)
+		}
+	}
+}
+
+// reportRetiredPackages logs the chain of dependants which caused a node to pull in retired packages, either as its
+// own RPM or as one of its dependencies.
+func reportRetiredPackages(dependencyGraph *pkggraph.PkgGraph, node *pkggraph.PkgNode, retiredRPMs []string, isError bool) {
+	message := fmt.Sprintf("'%s' pulled in the retired package(s) '%s', required by: %s",
+		node.VersionedPkg.Name, strings.Join(retiredRPMs, "', '"), strings.Join(dependantChain(dependencyGraph, node), " <- "))
+	if isError {
+		logger.Log.Error(message)
+	} else {
+		logger.Log.Warn(message)
+	}
+}
+
+// dependantChain follows the first dependant of each node, starting from 'node', until reaching a node nothing
+// depends on. It returns the friendly names of all visited dependants.
+func dependantChain(dependencyGraph *pkggraph.PkgGraph, node *pkggraph.PkgNode) (chain []string) {
+	visited := map[int64]bool{node.ID(): true}
+	current := node
+	for {
+		dependants := dependencyGraph.Dependents(current)
+		if len(dependants) == 0 {
+			break
+		}
+
+		// Prefer a dependant we have not seen yet to avoid looping in cycles.
+		var next *pkggraph.PkgNode
+		for _, dependant := range dependants {
+			if !visited[dependant.ID()] {
+				next = dependant
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		visited[next.ID()] = true
+		chain = append(chain, next.FriendlyName())
+		current = next
+	}
+
+	return
+}
+
+// rejectWeaklySignedPackages fails a node whose clones pulled in RPMs which are unsigned or signed with a weaker hash
+// algorithm than the options' minSignatureAlgo. The rejected RPMs are removed from the clone directory. With
+// warnOnWeakSignatures, they are only reported.
+func rejectWeaklySignedPackages(node *pkggraph.PkgNode, clonedPackages map[string]string, packages *fetchedPackageSet, options *resolveOptions) (err error) {
+	weakRPMs, err := weaklySignedPackagesIn(clonedPackages, packages, options.outDir, options.localRpmsDir, options.minSignatureAlgo, options.toolchain)
+	if err != nil || len(weakRPMs) == 0 {
+		return
+	}
+
+	if options.warnOnWeakSignatures {
+		logger.Log.Warnf("Cloning '%v' pulled in RPM(s) with a signature weaker than '%s': '%s'", node.VersionedPkg, options.minSignatureAlgo, strings.Join(weakRPMs, "', '"))
+		return
+	}
+
+	removeRejectedRPMs(options.outDir, weakRPMs)
+	return fmt.Errorf("%w: cloning '%v' pulled in RPM(s) with a signature weaker than '%s': '%s'", errWeakSignature, node.VersionedPkg, options.minSignatureAlgo, strings.Join(weakRPMs, "', '"))
+}
+
+// weaklySignedPackagesIn returns the sorted RPM files of 'clonedPackages' which are unsigned or signed with a weaker hash
+// algorithm than 'minAlgorithm'. Toolchain RPMs and the locally built RPMs from 'localRpmsDir' are never signed, so they
+// are skipped, as are RPMs another node already removed from 'cloneDir'.
+func weaklySignedPackagesIn(clonedPackages map[string]string, packages *fetchedPackageSet, cloneDir, localRpmsDir, minAlgorithm string, toolchain *toolchainRPMs) (weakRPMs []string, err error) {
+	minStrength := signatureHashStrength(minAlgorithm)
+	for rpmFile := range clonedPackages {
+		rpmPath := filepath.Join(cloneDir, rpmFile)
+		if toolchain.contains(rpmPath) {
+			continue
+		}
+
+		// Local RPMs are stored in per-architecture sub-directories.
+		localCopies, err := filepath.Glob(filepath.Join(localRpmsDir, "*", rpmFile))
+		if err != nil {
+			return nil, err
+		}
+		if len(localCopies) > 0 {
+			continue
+		}
+
+		hashAlgorithm, err := packages.signatureHashAlgorithm(rpmPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the signature of '%s':\n%w", rpmFile, err)
+		}
+
+		if signatureHashStrength(hashAlgorithm) < minStrength {
+			weakRPMs = append(weakRPMs, rpmFile)
+		}
+	}
+
+	sort.Strings(weakRPMs)
+	return
+}
+
+// verifyNodeSignature checks the signature of the RPM chosen for a node. RPMs cloned only from local repos, e.g. the
+// toolchain or local builds, are not signed and are skipped. An RPM failing the check is removed from the cache and
+// the node is left unresolved.
+func verifyNodeSignature(node *pkggraph.PkgNode, packages *fetchedPackageSet, keyringFile string) (err error) {
+	chosenPackage := strings.TrimSuffix(filepath.Base(node.RpmPath), ".rpm")
+	if packages.isPrebuilt(chosenPackage) {
+		logger.Log.Debugf("Not verifying the signature of local package '%s'.", chosenPackage)
+		return
+	}
+
+	verifyErr := rpm.VerifySignature(node.RpmPath, keyringFile)
+	if verifyErr == nil {
+		return
+	}
+
+	err = fmt.Errorf("%w for '%s':\n%s", errUntrustedRPM, filepath.Base(node.RpmPath), verifyErr)
+	removeErr := os.Remove(node.RpmPath)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		logger.Log.Warnf("Failed to remove untrusted RPM '%s': %s", node.RpmPath, removeErr)
+	}
+	node.RpmPath = pkggraph.NoRPMPath
+	return
+}
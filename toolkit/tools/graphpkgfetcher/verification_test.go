@@ -0,0 +1,213 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkggraph"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldReportBaselineDrift(t *testing.T) {
+	baseline := map[string]bool{
+		"gcc-12.2.0-1.cm2.x86_64":     true,
+		"glibc-2.35-3.cm2.x86_64":     true,
+		"zlib-1.2.13-1.cm2.x86_64":    true,
+		"bash-5.1.8-2.cm2.x86_64":     true,
+		"bash-5.1.8-2.cm2.aarch64":    true,
+		"expat-2.5.0-1.cm2.noarch":    true,
+		"openssl-1.1.1k-1.cm2.x86_64": true,
+	}
+	resolved := map[string]bool{
+		"gcc-12.2.0-1.cm2.x86_64":     true,
+		"glibc-2.35-4.cm2.x86_64":     true,
+		"bash-5.1.8-2.cm2.x86_64":     true,
+		"bash-5.1.8-2.cm2.aarch64":    true,
+		"expat-2.5.0-1.cm2.noarch":    true,
+		"openssl-1.1.1k-1.cm2.x86_64": true,
+		"curl-7.88.1-1.cm2.x86_64":    true,
+	}
+
+	drift := baselineDrift(resolved, baseline)
+	assert.Equal(t, []string{
+		"added: 'curl-7.88.1-1.cm2.x86_64'",
+		"changed: 'glibc-2.35-3.cm2.x86_64' -> 'glibc-2.35-4.cm2.x86_64'",
+		"removed: 'zlib-1.2.13-1.cm2.x86_64'",
+	}, drift)
+
+	assert.Empty(t, baselineDrift(baseline, baseline))
+}
+
+func TestShouldAllowOnlyAllowlistedLicenses(t *testing.T) {
+	allowlist := map[string]bool{
+		"MIT":     true,
+		"GPLv2+":  true,
+		"BSD":     true,
+		"ASL 2.0": true,
+	}
+
+	assert.True(t, isLicenseAllowed("MIT", allowlist))
+	assert.True(t, isLicenseAllowed("ASL 2.0", allowlist))
+	assert.True(t, isLicenseAllowed("GPLv2+ and (MIT or BSD)", allowlist))
+	assert.False(t, isLicenseAllowed("GPLv3", allowlist))
+	assert.False(t, isLicenseAllowed("MIT AND GPLv3", allowlist))
+}
+
+func TestShouldFindRetiredPackagesPulledInAsDependencies(t *testing.T) {
+	retiredPackages := map[string]bool{"python2": true, "python2-libs": true}
+	cloner := &fakeCloner{deps: map[string][]string{
+		"gdb-1.0-1.cm2.x86_64": {"python2-libs-1.0-1.cm2.x86_64", "zlib-1.0-1.cm2.x86_64"},
+	}}
+
+	node := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "gdb"}, State: pkggraph.StateUnresolved}
+	resolution, err := resolveSingleNode(context.Background(), cloner, node, newFetchedPackageSet(), newTestResolveOptions("/cache"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"python2-libs-1.0-1.cm2.x86_64.rpm"}, retiredPackagesIn(resolution.clonedPackages, retiredPackages))
+
+	assert.Equal(t, []string{"python2-2.7.18-1.cm2.x86_64.rpm"}, retiredPackagesIn(map[string]string{
+		"python2-2.7.18-1.cm2.x86_64.rpm":  "base",
+		"python3-3.9.14-1.cm2.x86_64.rpm":  "base",
+		"python2x-2.7.18-1.cm2.x86_64.rpm": "base",
+	}, retiredPackages))
+	assert.Empty(t, retiredPackagesIn(map[string]string{"zlib-1.2.13-1.cm2.x86_64.rpm": "base"}, retiredPackages))
+}
+
+func TestShouldRemoveRejectedRPMs(t *testing.T) {
+	cloneDir := t.TempDir()
+	for _, rpmFile := range []string{"gdb-1.0-1.cm2.x86_64.rpm", "python2-libs-1.0-1.cm2.x86_64.rpm"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(cloneDir, rpmFile), []byte(rpmFile), 0644))
+	}
+
+	// RPMs already removed for an earlier node are skipped.
+	removeRejectedRPMs(cloneDir, []string{"python2-libs-1.0-1.cm2.x86_64.rpm", "python2-1.0-1.cm2.x86_64.rpm"})
+
+	remainingRPMs, err := filepath.Glob(filepath.Join(cloneDir, "*.rpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(cloneDir, "gdb-1.0-1.cm2.x86_64.rpm")}, remainingRPMs)
+}
+
+func TestShouldLeaveNodeWithUntrustedRPMUnresolved(t *testing.T) {
+	const fixturesDir = "../internal/rpm/testdata/signatures"
+
+	cacheDir := t.TempDir()
+	for _, rpmPackage := range []string{"signed-1.0-1.cm2.x86_64", "tampered-1.0-1.cm2.x86_64"} {
+		rpmContents, err := os.ReadFile(filepath.Join(fixturesDir, rpmPackage+".rpm"))
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(filepath.Join(cacheDir, rpmPackage+".rpm"), rpmContents, 0644))
+	}
+
+	options := newTestResolveOptions(cacheDir)
+	options.requireSignature, options.gpgKeyring = true, filepath.Join(fixturesDir, "trusted-keyring.gpg")
+
+	signedNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "signed"}, State: pkggraph.StateUnresolved, RpmPath: pkggraph.NoRPMPath}
+	_, err := resolveSingleNode(context.Background(), &fakeCloner{providers: []string{"signed-1.0-1.cm2.x86_64"}}, signedNode, newFetchedPackageSet(), options)
+	assert.NoError(t, err)
+	assert.Equal(t, pkggraph.StateCached, signedNode.State)
+
+	tamperedNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "tampered"}, State: pkggraph.StateUnresolved, RpmPath: pkggraph.NoRPMPath}
+	_, err = resolveSingleNode(context.Background(), &fakeCloner{providers: []string{"tampered-1.0-1.cm2.x86_64"}}, tamperedNode, newFetchedPackageSet(), options)
+	assert.ErrorIs(t, err, errUntrustedRPM)
+	assert.Equal(t, pkggraph.StateUnresolved, tamperedNode.State)
+	assert.Equal(t, pkggraph.NoRPMPath, tamperedNode.RpmPath)
+	assert.NoFileExists(t, filepath.Join(cacheDir, "tampered-1.0-1.cm2.x86_64.rpm"))
+}
+
+func TestShouldOnlyFailNodesPullingInWeaklySignedRPMs(t *testing.T) {
+	const fixturesDir = "../internal/rpm/testdata/signatures"
+
+	// "bash" pulls in an unsigned dependency, the other RPMs are signed with SHA512.
+	cacheDir := t.TempDir()
+	rpmFixtures := map[string]string{
+		"zlib-1.0-1.cm2.x86_64":       "signed-1.0-1.cm2.x86_64.rpm",
+		"bash-1.0-1.cm2.x86_64":       "signed-1.0-1.cm2.x86_64.rpm",
+		"legacy-lib-1.0-1.cm2.x86_64": "unsigned-1.0-1.cm2.x86_64.rpm",
+	}
+	for rpmPackage, fixture := range rpmFixtures {
+		rpmContents, err := os.ReadFile(filepath.Join(fixturesDir, fixture))
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(rpmPackageToRPMPath(rpmPackage, cacheDir), rpmContents, 0644))
+	}
+
+	cloner := &fakeCloner{deps: map[string][]string{"bash-1.0-1.cm2.x86_64": {"legacy-lib-1.0-1.cm2.x86_64"}}}
+	packages := newFetchedPackageSet()
+	options := newTestResolveOptions(cacheDir)
+	options.minSignatureAlgo = "SHA256"
+
+	zlibNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "zlib"}, State: pkggraph.StateUnresolved, RpmPath: pkggraph.NoRPMPath}
+	_, err := resolveSingleNode(context.Background(), cloner, zlibNode, packages, options)
+	assert.NoError(t, err)
+	assert.Equal(t, pkggraph.StateCached, zlibNode.State)
+
+	bashNode := &pkggraph.PkgNode{VersionedPkg: &pkgjson.PackageVer{Name: "bash"}, State: pkggraph.StateUnresolved, RpmPath: pkggraph.NoRPMPath}
+	_, err = resolveSingleNode(context.Background(), cloner, bashNode, packages, options)
+	assert.ErrorIs(t, err, errWeakSignature)
+	assert.ErrorContains(t, err, "legacy-lib-1.0-1.cm2.x86_64.rpm")
+	assert.Equal(t, pkggraph.StateUnresolved, bashNode.State)
+	assert.NoFileExists(t, rpmPackageToRPMPath("legacy-lib-1.0-1.cm2.x86_64", cacheDir))
+	assert.FileExists(t, rpmPackageToRPMPath("zlib-1.0-1.cm2.x86_64", cacheDir))
+}
+
+func TestShouldNotCheckSignaturesOfLocalRPMs(t *testing.T) {
+	const fixturesDir = "../internal/rpm/testdata/signatures"
+
+	cacheDir := t.TempDir()
+	localRpmsDir := t.TempDir()
+	unsignedRPM, err := os.ReadFile(filepath.Join(fixturesDir, "unsigned-1.0-1.cm2.x86_64.rpm"))
+	assert.NoError(t, err)
+	for _, rpmFile := range []string{"gcc-12.2.0-1.cm2.x86_64.rpm", "local-1.0-1.cm2.x86_64.rpm", "remote-1.0-1.cm2.x86_64.rpm"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(cacheDir, rpmFile), unsignedRPM, 0644))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(localRpmsDir, "x86_64"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(localRpmsDir, "x86_64", "local-1.0-1.cm2.x86_64.rpm"), unsignedRPM, 0644))
+
+	clonedPackages := map[string]string{
+		"gcc-12.2.0-1.cm2.x86_64.rpm":  "toolchain-repo",
+		"local-1.0-1.cm2.x86_64.rpm":   "local-repo",
+		"remote-1.0-1.cm2.x86_64.rpm":  "fake-repo",
+		"removed-1.0-1.cm2.x86_64.rpm": "fake-repo",
+	}
+	toolchain := &toolchainRPMs{packages: []string{"gcc-12.2.0-1.cm2.x86_64.rpm"}}
+
+	weakRPMs, err := weaklySignedPackagesIn(clonedPackages, newFetchedPackageSet(), cacheDir, localRpmsDir, "SHA256", toolchain)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"remote-1.0-1.cm2.x86_64.rpm"}, weakRPMs)
+}
+
+func TestShouldReportIncompleteClosure(t *testing.T) {
+	const fixture = "../internal/rpm/testdata/headers/header-1.0-1.cm2.x86_64.rpm"
+
+	cloneDir := t.TempDir()
+	rpmContents, err := os.ReadFile(fixture)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(cloneDir, filepath.Base(fixture)), rpmContents, 0644))
+
+	g := pkggraph.NewPkgGraph()
+	headerNode, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "header"})
+	assert.NoError(t, err)
+	headerNode.State = pkggraph.StateCached
+	headerNode.RpmPath = filepath.Join(cloneDir, filepath.Base(fixture))
+
+	// Nothing provides the RPM's 'glibc >= 2.35' requirement, 'rpmlib()' requirements are provided by RPM.
+	err = checkClosure([]*pkggraph.PkgGraph{g}, cloneDir)
+	assert.Error(t, err)
+
+	gaps, err := findClosureGaps(map[string]*rpm.PackageInfo{"header-1.0-1.cm2.x86_64.rpm": {Requires: []string{"glibc >= 2.35", "/bin/sh"}}}, []*pkgjson.PackageVer{{Name: "glibc", Condition: "=", Version: "2.34-1.cm2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []closureGap{{rpmFile: "header-1.0-1.cm2.x86_64.rpm", requirement: "glibc >= 2.35"}}, gaps)
+
+	// Unresolved nodes provide nothing.
+	glibcNode, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "glibc", Condition: "=", Version: "2.35-1.cm2"})
+	assert.NoError(t, err)
+	assert.Error(t, checkClosure([]*pkggraph.PkgGraph{g}, cloneDir))
+
+	glibcNode.State = pkggraph.StateUpToDate
+	glibcNode.Type = pkggraph.TypePreBuilt
+	assert.NoError(t, checkClosure([]*pkggraph.PkgGraph{g}, cloneDir))
+}
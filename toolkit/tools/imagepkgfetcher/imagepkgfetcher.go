@@ -41,6 +41,7 @@ var (
 
 	tlsClientCert = app.Flag("tls-cert", "TLS client certificate to use when downloading files.").String()
 	tlsClientKey  = app.Flag("tls-key", "TLS client key to use when downloading files.").String()
+	caBundle      = app.Flag("ca-bundle", "Additional CA certificates to trust when verifying the server certificates of HTTPS repos.").String()
 
 	externalOnly = app.Flag("external-only", "Only clone packages not provided locally.").Bool()
 	inputGraph   = app.Flag("package-graph", "Path to the graph file to read, only needed if external-only is set.").ExistingFile()
@@ -48,6 +49,8 @@ var (
 	inputSummaryFile  = app.Flag("input-summary-file", "Path to a file with the summary of packages cloned to be restored").String()
 	outputSummaryFile = app.Flag("output-summary-file", "Path to save the summary of packages cloned").String()
 
+	skipChecksumValidation = app.Flag("skip-checksum-validation", "Do not validate the restored RPMs against the checksums recorded in the input summary file.").Bool()
+
 	logFile       = exe.LogFileFlag(app)
 	logLevel      = exe.LogLevelFlag(app)
 	profFlags     = exe.SetupProfileFlags(app)
@@ -75,7 +78,8 @@ func main() {
 
 	timestamp.StartEvent("initialize and configure cloner", nil)
 
-	cloner, err := rpmrepocloner.ConstructCloner(*outDir, *tmpDir, *workertar, *existingRpmDir, *existingToolchainRpmDir, *tlsClientCert, *tlsClientKey, *repoFiles)
+	const expandRepoTemplates = false
+	cloner, err := rpmrepocloner.ConstructCloner(*outDir, *tmpDir, *workertar, *existingRpmDir, *existingToolchainRpmDir, *tlsClientCert, *tlsClientKey, *caBundle, *repoFiles, expandRepoTemplates, "", 0, nil)
 	if err != nil {
 		logger.Log.Panicf("Failed to initialize RPM repo cloner. Error: %s", err)
 	}
@@ -99,7 +103,7 @@ func main() {
 		timestamp.StartEvent("restore packages", nil)
 
 		// If an input summary file was provided, simply restore the cache using the file.
-		err = repoutils.RestoreClonedRepoContents(cloner, *inputSummaryFile)
+		err = repoutils.RestoreClonedRepoContentsWithValidation(cloner, *inputSummaryFile, !*skipChecksumValidation)
 
 		timestamp.StopEvent(nil) // restore packages
 	} else {
@@ -0,0 +1,175 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Streams newline delimited JSON (NDJSON) events to clients of a Unix domain socket.
+//
+// All methods are safe to call on a nil *Stream, in which case they do nothing. This allows tools to
+// unconditionally publish events and only pay for streaming when a socket is configured:
+//
+//	stream, _ := eventstream.Listen(socketPath)  // stream is nil if socketPath is empty
+//	stream.Publish(event)                         // sent to all connected clients
+//	stream.Close()
+//
+// Clients connecting after events were published first receive all earlier events, so they always see the
+// full progress of the run.
+
+package eventstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+)
+
+const (
+	socketNetwork = "unix"
+	writeTimeout  = 5 * time.Second
+)
+
+// Stream broadcasts events to all clients connected to its socket.
+type Stream struct {
+	socketPath string
+	listener   net.Listener
+
+	lock    sync.Mutex
+	history [][]byte
+	clients map[net.Conn]bool
+	closed  bool
+}
+
+// Listen creates a Unix domain socket at 'socketPath' and starts accepting clients. An existing file at 'socketPath',
+// e.g. a stale socket from an earlier run, is replaced. If 'socketPath' is empty, a nil stream is returned which
+// turns all calls into no-ops.
+func Listen(socketPath string) (s *Stream, err error) {
+	socketPath = strings.TrimSpace(socketPath)
+	if socketPath == "" {
+		return
+	}
+
+	err = os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		err = fmt.Errorf("failed to remove existing file at socket path '%s':\n%w", socketPath, err)
+		return
+	}
+
+	listener, err := net.Listen(socketNetwork, socketPath)
+	if err != nil {
+		err = fmt.Errorf("failed to listen on socket '%s':\n%w", socketPath, err)
+		return
+	}
+
+	s = &Stream{
+		socketPath: socketPath,
+		listener:   listener,
+		clients:    make(map[net.Conn]bool),
+	}
+	go s.acceptClients()
+
+	logger.Log.Debugf("Streaming events over socket (%s)", socketPath)
+	return
+}
+
+// Publish encodes the event as a single JSON line and sends it to all connected clients.
+// Clients which cannot receive the event are disconnected.
+func (s *Stream) Publish(event interface{}) {
+	if s == nil {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		logger.Log.Warnf("Failed to encode event for socket (%s): %s", s.socketPath, err)
+		return
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.history = append(s.history, line)
+	for client := range s.clients {
+		err = writeLine(client, line)
+		if err != nil {
+			logger.Log.Debugf("Disconnecting event stream client: %s", err)
+			client.Close()
+			delete(s.clients, client)
+		}
+	}
+}
+
+// Close disconnects all clients and removes the socket.
+func (s *Stream) Close() (err error) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+
+	for client := range s.clients {
+		client.Close()
+	}
+	s.clients = nil
+
+	// Closing a Unix listener also removes its socket file.
+	return s.listener.Close()
+}
+
+// acceptClients replays all earlier events to each new client before adding it to the broadcast list.
+func (s *Stream) acceptClients() {
+	for {
+		client, err := s.listener.Accept()
+		if err != nil {
+			// The listener was closed.
+			return
+		}
+
+		s.addClient(client)
+	}
+}
+
+func (s *Stream) addClient(client net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		client.Close()
+		return
+	}
+
+	for _, line := range s.history {
+		err := writeLine(client, line)
+		if err != nil {
+			logger.Log.Debugf("Failed to send earlier events to a new client: %s", err)
+			client.Close()
+			return
+		}
+	}
+
+	s.clients[client] = true
+}
+
+func writeLine(client net.Conn, line []byte) (err error) {
+	err = client.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		return
+	}
+
+	_, err = client.Write(line)
+	return
+}
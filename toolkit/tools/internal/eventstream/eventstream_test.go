@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package eventstream
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+type testEvent struct {
+	Node  string `json:"Node"`
+	Event string `json:"Event"`
+}
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+func readEvent(t *testing.T, reader *bufio.Reader) (event testEvent) {
+	line, err := reader.ReadBytes('\n')
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(line, &event))
+	return
+}
+
+func TestShouldReturnNilStreamForEmptySocketPath(t *testing.T) {
+	stream, err := Listen("")
+	assert.NoError(t, err)
+	assert.Nil(t, stream)
+
+	// All calls on a nil stream must be safe no-ops.
+	stream.Publish(testEvent{Node: "gcc", Event: "resolved"})
+	assert.NoError(t, stream.Close())
+}
+
+func TestShouldReplayEarlierEventsToLateClients(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "progress.sock")
+	stream, err := Listen(socketPath)
+	assert.NoError(t, err)
+	defer stream.Close()
+
+	stream.Publish(testEvent{Node: "gcc", Event: "resolved"})
+
+	client, err := net.Dial(socketNetwork, socketPath)
+	assert.NoError(t, err)
+	defer client.Close()
+	assert.NoError(t, client.SetReadDeadline(time.Now().Add(10*time.Second)))
+	reader := bufio.NewReader(client)
+
+	assert.Equal(t, testEvent{Node: "gcc", Event: "resolved"}, readEvent(t, reader))
+
+	stream.Publish(testEvent{Node: "zlib", Event: "failed"})
+	assert.Equal(t, testEvent{Node: "zlib", Event: "failed"}, readEvent(t, reader))
+}
+
+func TestShouldReplaceStaleSocketFile(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "progress.sock")
+	assert.NoError(t, os.WriteFile(socketPath, []byte("stale"), 0644))
+
+	stream, err := Listen(socketPath)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Close())
+
+	_, err = os.Stat(socketPath)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -15,41 +15,64 @@ import (
 // ToolkitVersion specifies the version of the toolkit and the reported version of all tools in it.
 var ToolkitVersion = ""
 
+// FlagRegistrar is anything flags can be registered with, such as a *kingpin.Application or one of its
+// commands (*kingpin.CmdClause).
+type FlagRegistrar interface {
+	Flag(name, help string) *kingpin.FlagClause
+}
+
 // InputFlag registers an input flag for k with documentation doc and returns the passed value
-func InputFlag(k *kingpin.Application, doc string) *string {
+func InputFlag(k FlagRegistrar, doc string) *string {
 	return k.Flag("input", doc).Required().ExistingFile()
 }
 
 // InputStringFlag registers an input flag for k with documentation doc and returns the passed value
-func InputStringFlag(k *kingpin.Application, doc string) *string {
+func InputStringFlag(k FlagRegistrar, doc string) *string {
 	return k.Flag("input", doc).Required().String()
 }
 
+// OptionalInputStringFlag registers an input flag for k with documentation doc and returns the passed value.
+// Use it when another flag can replace the input, and enforce that one of them is passed with a validator.
+func OptionalInputStringFlag(k FlagRegistrar, doc string) *string {
+	return k.Flag("input", doc).String()
+}
+
 // InputDirFlag registers an input flag for k with documentation doc and returns the passed value
-func InputDirFlag(k *kingpin.Application, doc string) *string {
+func InputDirFlag(k FlagRegistrar, doc string) *string {
 	return k.Flag("dir", doc).Required().ExistingDir()
 }
 
 // OutputFlag registers an output flag for k with documentation doc and returns the passed value
-func OutputFlag(k *kingpin.Application, doc string) *string {
+func OutputFlag(k FlagRegistrar, doc string) *string {
 	return k.Flag("output", doc).Required().String()
 }
 
+// OptionalOutputFlag registers an output flag for k with documentation doc and returns the passed value.
+// Use it when the output is only needed with some of the other flags, and enforce that with a validator.
+func OptionalOutputFlag(k FlagRegistrar, doc string) *string {
+	return k.Flag("output", doc).String()
+}
+
 // OutputDirFlag registers an output flag for k with documentation doc and returns the passed value
-func OutputDirFlag(k *kingpin.Application, doc string) *string {
+func OutputDirFlag(k FlagRegistrar, doc string) *string {
 	return k.Flag("output-dir", doc).Required().String()
 }
 
 // LogFileFlag registers a log file flag for k and returns the passed value
-func LogFileFlag(k *kingpin.Application) *string {
+func LogFileFlag(k FlagRegistrar) *string {
 	return k.Flag(logger.FileFlag, logger.FileFlagHelp).String()
 }
 
 // LogLevelFlag registers a log level flag for k and returns the passed value
-func LogLevelFlag(k *kingpin.Application) *string {
+func LogLevelFlag(k FlagRegistrar) *string {
 	return k.Flag(logger.LevelsFlag, logger.LevelsHelp).PlaceHolder(logger.LevelsPlaceholder).Enum(logger.Levels()...)
 }
 
+// LogFormatFlag registers a log format flag for k and returns the passed value
+func LogFormatFlag(k FlagRegistrar) *string {
+	return k.Flag(logger.FormatFlag, logger.FormatFlagHelp).PlaceHolder(logger.FormatsPlaceholder).Default(logger.TextFormat).Enum(logger.Formats()...)
+}
+
 // PlaceHolderize takes a list of available inputs and returns a corresponding placeholder
 func PlaceHolderize(thing []string) string {
 	return fmt.Sprintf("(%s)", strings.Join(thing, "|"))
@@ -76,7 +99,7 @@ type ProfileFlags struct {
 	TraceFile     *string
 }
 
-func SetupProfileFlags(k *kingpin.Application) *ProfileFlags {
+func SetupProfileFlags(k FlagRegistrar) *ProfileFlags {
 	p := &ProfileFlags{}
 	p.EnableCpuProf = k.Flag("enable-cpu-prof", "Enable CPU pprof data collection.").Bool()
 	p.EnableMemProf = k.Flag("enable-mem-prof", "Enable Memory pprof data collection.").Bool()
@@ -7,6 +7,7 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -211,6 +212,26 @@ func GenerateSHA256(path string) (hash string, err error) {
 	return
 }
 
+// GenerateSHA512 calculates a sha512 of a file
+func GenerateSHA512(path string) (hash string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	sha512Generator := sha512.New()
+	_, err = io.Copy(sha512Generator, file)
+	if err != nil {
+		return
+	}
+
+	rawHash := sha512Generator.Sum(nil)
+	hash = hex.EncodeToString(rawHash)
+
+	return
+}
+
 // DirExists returns true if the directory exists,
 // false otherwise.
 func DirExists(path string) (exists bool, err error) {
@@ -7,6 +7,7 @@ package logger
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -25,8 +26,14 @@ var (
 	stderrHook *writerHook
 	fileHook   *writerHook
 
+	// Format of the entries written by all hooks, including those created later
+	format = TextFormat
+
 	// Valid log levels
 	levelsArray = []string{"panic", "fatal", "error", "warn", "info", "debug", "trace"}
+
+	// Valid log formats
+	formatsArray = []string{TextFormat, JSONFormat}
 )
 
 const (
@@ -45,6 +52,21 @@ const (
 	// FileFlagHelp is the suggested help message for the logfile flag
 	FileFlagHelp = "Path to the image's log file."
 
+	// FormatsPlaceholder are all valid log formats separated by '|' character.
+	FormatsPlaceholder = "(text|json)"
+
+	// FormatFlag is the suggested name of the flag for the log format
+	FormatFlag = "log-format"
+
+	// FormatFlagHelp is the suggested help message for the log format flag
+	FormatFlagHelp = "The format of the log entries. 'json' writes each entry as a JSON object on its own line."
+
+	// TextFormat writes the log entries as human readable text.
+	TextFormat = "text"
+
+	// JSONFormat writes each log entry as a JSON object with its level, timestamp, message, and fields.
+	JSONFormat = "json"
+
 	defaultLogFileLevel   = logrus.DebugLevel
 	defaultStderrLogLevel = logrus.InfoLevel
 	parentCallerLevel     = 1
@@ -96,22 +118,22 @@ func SetStderrLogLevel(level string) (err error) {
 
 // InitBestEffort runs InitStderrLog always, and InitLogFile if path is not empty
 func InitBestEffort(path string, level string) {
-	if level == "" {
-		level = defaultStderrLogLevel.String()
-	}
-
 	_, callerFilePath, _, ok := runtime.Caller(parentCallerLevel)
 	if !ok {
 		log.Panic("Failed to get caller info.")
 	}
 
-	initStderrLogInternal(callerFilePath)
+	initBestEffortInternal(callerFilePath, path, level, TextFormat)
+}
 
-	if path != "" {
-		PanicOnError(initLogFile(path), "Failed while setting log file (%s).", path)
+// InitBestEffortWithFormat is InitBestEffort, writing the log entries in 'logFormat' instead of text
+func InitBestEffortWithFormat(path, level, logFormat string) {
+	_, callerFilePath, _, ok := runtime.Caller(parentCallerLevel)
+	if !ok {
+		log.Panic("Failed to get caller info.")
 	}
 
-	PanicOnError(SetStderrLogLevel(level), "Failed while setting log level.")
+	initBestEffortInternal(callerFilePath, path, level, logFormat)
 }
 
 // Levels returns list of strings representing valid log levels.
@@ -119,6 +141,11 @@ func Levels() []string {
 	return levelsArray
 }
 
+// Formats returns list of strings representing valid log formats.
+func Formats() []string {
+	return formatsArray
+}
+
 // PanicOnError logs the error and any message strings and then panics
 func PanicOnError(err interface{}, args ...interface{}) {
 	if err != nil {
@@ -169,6 +196,56 @@ func StreamOutput(pipe io.Reader, logFunction func(...interface{}), wg *sync.Wai
 	wg.Done()
 }
 
+// StartFileLog starts copying all log entries up to 'level' into a new file at 'filePath',
+// in addition to any other configured outputs. Call 'stop' to stop copying and close the file.
+func StartFileLog(filePath, level string) (stop func(), err error) {
+	const (
+		noToolName = ""
+		useColors  = false
+	)
+
+	logLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return
+	}
+
+	err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return
+	}
+
+	hook := newWriterHook(file, logLevel, useColors, noToolName)
+	Log.AddHook(hook)
+
+	// Otherwise the hook will not receive any entries more verbose than the other outputs.
+	previousLevel := Log.GetLevel()
+	if logLevel > previousLevel {
+		Log.SetLevel(logLevel)
+	}
+
+	stop = func() {
+		remainingHooks := make(logrus.LevelHooks)
+		for hookLevel, levelHooks := range Log.Hooks {
+			for _, levelHook := range levelHooks {
+				if levelHook != hook {
+					remainingHooks[hookLevel] = append(remainingHooks[hookLevel], levelHook)
+				}
+			}
+		}
+
+		Log.ReplaceHooks(remainingHooks)
+		Log.SetLevel(previousLevel)
+		file.Close()
+	}
+
+	return
+}
+
 // ReplaceStderrWriter replaces the stderr writer and returns the old one
 func ReplaceStderrWriter(newOut io.Writer) (oldOut io.Writer) {
 	return stderrHook.ReplaceWriter(newOut)
@@ -179,9 +256,25 @@ func ReplaceStderrFormatter(newFormatter logrus.Formatter) (oldFormatter logrus.
 	return stderrHook.ReplaceFormatter(newFormatter)
 }
 
+func initBestEffortInternal(callerFilePath, path, level, logFormat string) {
+	if level == "" {
+		level = defaultStderrLogLevel.String()
+	}
+
+	initStderrLogInternal(callerFilePath)
+	PanicOnError(setFormat(logFormat), "Failed while setting log format.")
+
+	if path != "" {
+		PanicOnError(initLogFile(path), "Failed while setting log file (%s).", path)
+	}
+
+	PanicOnError(SetStderrLogLevel(level), "Failed while setting log level.")
+}
+
 func initStderrLogInternal(callerFilePath string) {
 	const useColors = true
 
+	format = TextFormat
 	Log = logrus.New()
 	Log.ReportCaller = true
 
@@ -194,6 +287,22 @@ func initStderrLogInternal(callerFilePath string) {
 	Log.SetOutput(io.Discard)
 }
 
+// setFormat switches the stderr and file outputs, and any outputs created afterwards, to 'logFormat'
+func setFormat(logFormat string) (err error) {
+	if logFormat != TextFormat && logFormat != JSONFormat {
+		return fmt.Errorf("invalid log format (%s), expected one of: %s", logFormat, strings.Join(formatsArray, ", "))
+	}
+
+	format = logFormat
+	for _, hook := range []*writerHook{stderrHook, fileHook} {
+		if hook != nil {
+			hook.ReplaceFormatter(newFormatter(hook.useColors, hook.toolName))
+		}
+	}
+
+	return
+}
+
 func setHookLogLevel(hook *writerHook, level string) (err error) {
 	logLevel, err := logrus.ParseLevel(level)
 	if err != nil {
@@ -0,0 +1,131 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldWriteJSONLogLines(t *testing.T) {
+	InitStderrLog()
+	defer InitStderrLog()
+
+	output := &bytes.Buffer{}
+	ReplaceStderrWriter(output)
+
+	err := setFormat(JSONFormat)
+	assert.NoError(t, err)
+
+	Log.Infof("Resolving (%d) nodes.", 3)
+	Log.WithField("node", "zlib").Warnf("Failed to resolve.")
+	Log.Debugf("Not written at the default level.")
+
+	lines := 0
+	for scanner := bufio.NewScanner(output); scanner.Scan(); lines++ {
+		var entry map[string]interface{}
+
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		assert.NoError(t, err, "line (%s) is not a JSON object", scanner.Text())
+		assert.Contains(t, entry, "level")
+		assert.Contains(t, entry, "timestamp")
+		assert.Contains(t, entry, "message")
+		assert.Equal(t, "log_test", entry["tool"])
+
+		if entry["level"] == "warning" {
+			assert.Equal(t, "Failed to resolve.", entry["message"])
+			assert.Equal(t, "zlib", entry["node"])
+		} else {
+			assert.Equal(t, "Resolving (3) nodes.", entry["message"])
+		}
+	}
+	assert.Equal(t, 2, lines)
+}
+
+func TestShouldApplyJSONFormatToLaterFileLogs(t *testing.T) {
+	InitStderrLog()
+	defer InitStderrLog()
+	ReplaceStderrWriter(&bytes.Buffer{})
+
+	err := setFormat(JSONFormat)
+	assert.NoError(t, err)
+
+	filePath := filepath.Join(t.TempDir(), "node.log")
+	stop, err := StartFileLog(filePath, logrus.DebugLevel.String())
+	assert.NoError(t, err)
+	Log.Debugf("Written to the file.")
+	stop()
+
+	contents, err := os.ReadFile(filePath)
+	assert.NoError(t, err)
+
+	var entry map[string]interface{}
+	err = json.Unmarshal(contents, &entry)
+	assert.NoError(t, err)
+	assert.Equal(t, "Written to the file.", entry["message"])
+}
+
+func TestShouldCopyVerboseEntriesOnlyToFileLog(t *testing.T) {
+	InitStderrLog()
+	defer InitStderrLog()
+
+	stderr := &bytes.Buffer{}
+	ReplaceStderrWriter(stderr)
+	stderrLevel := Log.GetLevel()
+
+	filePath := filepath.Join(t.TempDir(), "logs", "node.log")
+	stop, err := StartFileLog(filePath, logrus.DebugLevel.String())
+	assert.NoError(t, err)
+
+	Log.Debugf("Debug entry.")
+	Log.Infof("Info entry.")
+	stop()
+	Log.Infof("After stop.")
+
+	assert.Equal(t, stderrLevel, Log.GetLevel())
+	assert.NotContains(t, stderr.String(), "Debug entry.")
+	assert.Contains(t, stderr.String(), "Info entry.")
+	assert.Contains(t, stderr.String(), "After stop.")
+
+	contents, err := os.ReadFile(filePath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "Debug entry.")
+	assert.Contains(t, string(contents), "Info entry.")
+	assert.NotContains(t, string(contents), "After stop.")
+}
+
+func TestShouldRejectUnknownFileLogLevel(t *testing.T) {
+	InitStderrLog()
+	defer InitStderrLog()
+
+	_, err := StartFileLog(filepath.Join(t.TempDir(), "node.log"), "loud")
+	assert.Error(t, err)
+}
+
+func TestShouldDefaultToTextLogs(t *testing.T) {
+	InitStderrLog()
+	defer InitStderrLog()
+
+	output := &bytes.Buffer{}
+	ReplaceStderrWriter(output)
+
+	Log.Infof("Plain text.")
+	assert.False(t, json.Valid(output.Bytes()))
+	assert.Contains(t, output.String(), "Plain text.")
+}
+
+func TestShouldRejectUnknownLogFormat(t *testing.T) {
+	InitStderrLog()
+	defer InitStderrLog()
+
+	err := setFormat("xml")
+	assert.Error(t, err)
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,10 +19,27 @@ type writerHook struct {
 	level     logrus.Level
 	writer    io.Writer
 	formatter logrus.Formatter
+	useColors bool
+	toolName  string
 }
 
 // newWriterHook returns new writerHook
 func newWriterHook(writer io.Writer, level logrus.Level, useColors bool, toolName string) *writerHook {
+	return &writerHook{
+		level:     level,
+		writer:    writer,
+		formatter: newFormatter(useColors, toolName),
+		useColors: useColors,
+		toolName:  toolName,
+	}
+}
+
+// newFormatter returns a formatter for the current log format
+func newFormatter(useColors bool, toolName string) logrus.Formatter {
+	if format == JSONFormat {
+		return newJSONFormatter(toolName)
+	}
+
 	formatter := &logrus.TextFormatter{
 		ForceColors: useColors,
 		CallerPrettyfier: func(frame *runtime.Frame) (function string, file string) {
@@ -42,10 +60,22 @@ func newWriterHook(writer io.Writer, level logrus.Level, useColors bool, toolNam
 		}
 	}
 
-	return &writerHook{
-		level:     level,
-		writer:    writer,
-		formatter: formatter,
+	return formatter
+}
+
+// newJSONFormatter returns a formatter writing each entry as a JSON object on its own line.
+// The tool name replaces the caller information, the same as for the text formatter.
+func newJSONFormatter(toolName string) logrus.Formatter {
+	return &logrus.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+		FieldMap: logrus.FieldMap{
+			logrus.FieldKeyTime: "timestamp",
+			logrus.FieldKeyMsg:  "message",
+			logrus.FieldKeyFile: "tool",
+		},
+		CallerPrettyfier: func(frame *runtime.Frame) (function string, file string) {
+			return "", toolName
+		},
 	}
 }
 
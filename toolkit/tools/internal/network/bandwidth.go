@@ -0,0 +1,99 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package network
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter limits the combined throughput of all readers wrapped by it with a token bucket, allowing bursts of
+// at most one second worth of bytes. A nil limiter does not limit anything.
+type BandwidthLimiter struct {
+	lock           sync.Mutex
+	bytesPerSecond int64
+	tokens         float64
+	lastRefill     time.Time
+}
+
+// limitedReader reads through a BandwidthLimiter.
+type limitedReader struct {
+	reader  io.Reader
+	limiter *BandwidthLimiter
+}
+
+// downloadLimiter is shared by all downloads of this package, see SetMaxDownloadBandwidth.
+var (
+	downloadLimiterLock sync.Mutex
+	downloadLimiter     *BandwidthLimiter
+)
+
+// NewBandwidthLimiter creates a limiter allowing 'bytesPerSecond' on average. Returns nil, no limit, if 'bytesPerSecond'
+// is not positive.
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &BandwidthLimiter{
+		bytesPerSecond: bytesPerSecond,
+		lastRefill:     time.Now(),
+	}
+}
+
+// SetMaxDownloadBandwidth limits the combined throughput of all downloads made by DownloadFile and
+// DownloadFileResumable, including concurrent ones, to 'bytesPerSecond'. Zero or less removes the limit.
+func SetMaxDownloadBandwidth(bytesPerSecond int64) {
+	downloadLimiterLock.Lock()
+	defer downloadLimiterLock.Unlock()
+	downloadLimiter = NewBandwidthLimiter(bytesPerSecond)
+}
+
+// Reader wraps 'reader' so reading from it draws from the limiter's budget. Returns 'reader' itself for a nil limiter.
+func (l *BandwidthLimiter) Reader(reader io.Reader) io.Reader {
+	if l == nil {
+		return reader
+	}
+	return &limitedReader{reader: reader, limiter: l}
+}
+
+// wait takes 'n' bytes from the bucket and blocks until the bucket would have held them.
+// Concurrent callers each wait for their own share, so their combined throughput stays within the limit.
+func (l *BandwidthLimiter) wait(n int) {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.lastRefill).Seconds() * float64(l.bytesPerSecond)
+	if l.tokens > float64(l.bytesPerSecond) {
+		l.tokens = float64(l.bytesPerSecond)
+	}
+	l.lastRefill = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.lock.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / float64(l.bytesPerSecond) * float64(time.Second)))
+	}
+}
+
+// Read reads at most one second worth of bytes at a time, so a single read never exceeds the burst of the limiter.
+func (r *limitedReader) Read(p []byte) (n int, err error) {
+	if int64(len(p)) > r.limiter.bytesPerSecond {
+		p = p[:r.limiter.bytesPerSecond]
+	}
+
+	n, err = r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return
+}
+
+// currentDownloadLimiter returns the limiter shared by all downloads, nil if they are not limited.
+func currentDownloadLimiter() *BandwidthLimiter {
+	downloadLimiterLock.Lock()
+	defer downloadLimiterLock.Unlock()
+	return downloadLimiter
+}
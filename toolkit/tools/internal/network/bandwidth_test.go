@@ -0,0 +1,64 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package network
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldThrottleReaderToBandwidth(t *testing.T) {
+	const (
+		bytesPerSecond = 100 * 1024
+		payloadSize    = 150 * 1024
+	)
+
+	limiter := NewBandwidthLimiter(bytesPerSecond)
+	payload := bytes.Repeat([]byte{'x'}, payloadSize)
+
+	start := time.Now()
+	received, err := io.ReadAll(limiter.Reader(bytes.NewReader(payload)))
+	assert.NoError(t, err)
+	assert.Equal(t, payload, received)
+
+	expectedFloor := time.Duration(float64(payloadSize) / bytesPerSecond * float64(time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), expectedFloor)
+}
+
+func TestShouldShareBandwidthBetweenReaders(t *testing.T) {
+	const (
+		bytesPerSecond = 100 * 1024
+		payloadSize    = 50 * 1024
+		readers        = 3
+	)
+
+	limiter := NewBandwidthLimiter(bytesPerSecond)
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			received, err := io.ReadAll(limiter.Reader(bytes.NewReader(make([]byte, payloadSize))))
+			assert.NoError(t, err)
+			assert.Len(t, received, payloadSize)
+		}()
+	}
+	wg.Wait()
+
+	expectedFloor := time.Duration(float64(readers*payloadSize) / bytesPerSecond * float64(time.Second))
+	assert.GreaterOrEqual(t, time.Since(start), expectedFloor)
+}
+
+func TestShouldNotThrottleWithoutLimit(t *testing.T) {
+	reader := bytes.NewReader([]byte("payload"))
+	assert.Nil(t, NewBandwidthLimiter(0))
+	assert.Equal(t, io.Reader(reader), NewBandwidthLimiter(0).Reader(reader))
+}
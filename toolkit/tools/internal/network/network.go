@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -50,31 +52,207 @@ func DownloadFile(url, dst string, caCerts *x509.CertPool, tlsCerts []tls.Certif
 		dstFile.Close()
 	}()
 
-	tlsConfig := &tls.Config{
-		RootCAs:      caCerts,
-		Certificates: tlsCerts,
+	client := newHTTPClient(caCerts, tlsCerts)
+	response, err := client.Get(url)
+	if err != nil {
+		return
 	}
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	transport.TLSClientConfig = tlsConfig
-	client := &http.Client{
-		Transport: transport,
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid response: %v", response.StatusCode)
 	}
 
-	response, err := client.Get(url)
+	_, err = io.Copy(dstFile, currentDownloadLimiter().Reader(response.Body))
+
+	return
+}
+
+// DownloadFileResumable downloads `url` into `dst` like DownloadFile, but keeps an interrupted download in a `.part` file
+// under `partDir`, next to the ETag or Last-Modified date the server reported for it. The next call for the same `dst`
+// resumes it with an HTTP range request conditioned on that validator with `If-Range`, so the server sends the whole file
+// again if it changed in the meantime or does not support ranges. Partial downloads without a validator are restarted.
+// The complete file is checked against the size announced by the server and renamed into `dst`, which is atomic if
+// `partDir` is on the same filesystem. `caCerts` may be nil.
+func DownloadFileResumable(url, dst, partDir string, caCerts *x509.CertPool, tlsCerts []tls.Certificate) (err error) {
+	const (
+		partFileExtension      = ".part"
+		validatorFileExtension = ".validator"
+	)
+
+	partPath := filepath.Join(partDir, filepath.Base(dst)+partFileExtension)
+	validatorPath := partPath + validatorFileExtension
+
+	offset, validator, err := readPartialDownload(partPath, validatorPath)
+	if err != nil {
+		return
+	}
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return
+	}
+	if offset > 0 {
+		logger.Log.Debugf("Resuming (%s) -> (%s) from byte %d", url, dst, offset)
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		request.Header.Set("If-Range", validator)
+	} else {
+		logger.Log.Debugf("Downloading (%s) -> (%s)", url, dst)
+	}
+
+	client := newHTTPClient(caCerts, tlsCerts)
+	response, err := client.Do(request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
+	// Drops the partial download, so the next attempt starts from scratch.
+	discardPartialDownload := func() {
+		for _, path := range []string{partPath, validatorPath} {
+			cleanupErr := file.RemoveFileIfExists(path)
+			if cleanupErr != nil {
+				logger.Log.Errorf("Failed to remove stale partial download file '%s': %s", path, cleanupErr)
+			}
+		}
+	}
+
+	var expectedSize int64
+	openFlags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case response.StatusCode == http.StatusPartialContent && offset > 0 && strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		openFlags |= os.O_APPEND
+		expectedSize = contentRangeSize(response.Header.Get("Content-Range"))
+	case response.StatusCode == http.StatusOK:
+		if offset > 0 {
+			logger.Log.Debugf("Server of (%s) sent the whole file instead of a range, restarting the download", url)
+		}
+		openFlags |= os.O_TRUNC
+		expectedSize = response.ContentLength
+	case response.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial download does not match the file on the server anymore, the next attempt starts from scratch.
+		discardPartialDownload()
+		return fmt.Errorf("invalid response: %v", response.StatusCode)
+	default:
 		return fmt.Errorf("invalid response: %v", response.StatusCode)
 	}
 
-	_, err = io.Copy(dstFile, response.Body)
+	err = os.MkdirAll(partDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	if response.StatusCode == http.StatusOK {
+		err = writePartialDownloadValidator(validatorPath, response.Header)
+		if err != nil {
+			return
+		}
+	}
+
+	partFile, err := os.OpenFile(partPath, openFlags, 0644)
+	if err != nil {
+		return
+	}
+
+	// An interrupted transfer leaves the received bytes in the partial download file for the next attempt.
+	_, err = io.Copy(partFile, currentDownloadLimiter().Reader(response.Body))
+	closeErr := partFile.Close()
+	if err != nil {
+		return
+	}
+	if closeErr != nil {
+		return closeErr
+	}
 
+	partInfo, err := os.Stat(partPath)
+	if err != nil {
+		return
+	}
+	if expectedSize >= 0 && partInfo.Size() != expectedSize {
+		discardPartialDownload()
+		return fmt.Errorf("downloaded %d bytes of (%s), but the server announced %d bytes", partInfo.Size(), url, expectedSize)
+	}
+
+	err = os.Rename(partPath, dst)
+	if err != nil {
+		logger.Log.Debugf("Failed to rename (%s) -> (%s), moving it instead: %s", partPath, dst, err)
+		err = file.Move(partPath, dst)
+		if err != nil {
+			return
+		}
+	}
+
+	err = file.RemoveFileIfExists(validatorPath)
 	return
 }
 
+// readPartialDownload returns the size of a previous partial download and the validator it was downloaded with.
+// Returns a zero offset if there is no partial download, or if it has no validator to safely resume it with.
+func readPartialDownload(partPath, validatorPath string) (offset int64, validator string, err error) {
+	partInfo, err := os.Stat(partPath)
+	if os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return
+	}
+
+	validatorContents, err := os.ReadFile(validatorPath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	validator = strings.TrimSpace(string(validatorContents))
+	if validator == "" {
+		logger.Log.Debugf("Partial download '%s' has no ETag or Last-Modified date to resume it with, restarting it", partPath)
+		return 0, "", nil
+	}
+
+	return partInfo.Size(), validator, nil
+}
+
+// writePartialDownloadValidator records the strong ETag, or else the Last-Modified date, of a download starting from
+// scratch, so it can be resumed with If-Range. Weak ETags can't be used with If-Range. Removes any stale validator if
+// the server sent neither.
+func writePartialDownloadValidator(validatorPath string, header http.Header) (err error) {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+
+	if validator == "" {
+		return file.RemoveFileIfExists(validatorPath)
+	}
+	return os.WriteFile(validatorPath, []byte(validator), 0644)
+}
+
+// contentRangeSize returns the complete size of the file from a "bytes <first>-<last>/<size>" Content-Range header,
+// or -1 if the server did not report it.
+func contentRangeSize(contentRange string) (size int64) {
+	_, sizeField, found := strings.Cut(contentRange, "/")
+	if !found {
+		return -1
+	}
+
+	size, err := strconv.ParseInt(sizeField, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return
+}
+
+// newHTTPClient creates a client trusting `caCerts` and presenting `tlsCerts`. `caCerts` may be nil.
+func newHTTPClient(caCerts *x509.CertPool, tlsCerts []tls.Certificate) *http.Client {
+	tlsConfig := &tls.Config{
+		RootCAs:      caCerts,
+		Certificates: tlsCerts,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+	}
+}
+
 // CheckNetworkAccess checks whether the installer environment has network access
 // This function is only executed within the ISO installation environment for kickstart-like unattended installation
 func CheckNetworkAccess() (err error, hasNetworkAccess bool) {
@@ -0,0 +1,197 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// testDownloadServer serves 'content' with the 'etag' validator, but drops the connection halfway through the first
+// full download. Ranged requests are only honoured if 'supportsRanges' is set and their If-Range matches 'etag',
+// otherwise the whole content is served again.
+type testDownloadServer struct {
+	*httptest.Server
+
+	content        []byte
+	etag           string
+	supportsRanges bool
+	interrupted    bool
+	rangeRequests  []string
+}
+
+func newInterruptingServer(t *testing.T, content []byte, supportsRanges bool) (server *testDownloadServer, rangeRequests *[]string) {
+	server = &testDownloadServer{
+		content:        content,
+		etag:           `"v1"`,
+		supportsRanges: supportsRanges,
+	}
+
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rangeHeader := req.Header.Get("Range")
+		server.rangeRequests = append(server.rangeRequests, rangeHeader)
+
+		if server.etag != "" {
+			w.Header().Set("ETag", server.etag)
+		}
+
+		if rangeHeader != "" && server.supportsRanges && req.Header.Get("If-Range") == server.etag {
+			var offset int
+			_, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &offset)
+			if !assert.NoError(t, err) {
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(server.content)-1, len(server.content)))
+			w.Header().Set("Content-Length", strconv.Itoa(len(server.content)-offset))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(server.content[offset:])
+			return
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(server.content)))
+		w.WriteHeader(http.StatusOK)
+		if server.interrupted {
+			w.Write(server.content)
+			return
+		}
+
+		server.interrupted = true
+		w.Write(server.content[:len(server.content)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &server.rangeRequests
+}
+
+func TestShouldResumeInterruptedDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	server, rangeRequests := newInterruptingServer(t, content, true)
+
+	partDir := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "large.rpm")
+	url := server.URL + "/large.rpm"
+
+	err := DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.Error(t, err)
+	assert.NoFileExists(t, dst)
+
+	partContent, err := os.ReadFile(filepath.Join(partDir, "large.rpm.part"))
+	assert.NoError(t, err)
+	assert.Equal(t, content[:len(content)/2], partContent)
+
+	err = DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(content)/2)}, *rangeRequests)
+
+	downloaded, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.NoFileExists(t, filepath.Join(partDir, "large.rpm.part"))
+}
+
+func TestShouldRestartDownloadWithoutRangeSupport(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	server, _ := newInterruptingServer(t, content, false)
+
+	partDir := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "large.rpm")
+	url := server.URL + "/large.rpm"
+
+	err := DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.Error(t, err)
+
+	err = DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.NoError(t, err)
+
+	downloaded, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+}
+
+func TestShouldRestartDownloadChangedOnServer(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	server, rangeRequests := newInterruptingServer(t, content, true)
+
+	partDir := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "large.rpm")
+	url := server.URL + "/large.rpm"
+
+	err := DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.Error(t, err)
+
+	// Republished under the same name, the range of the old file must not be appended.
+	server.content = bytes.Repeat([]byte("fedcba9876543210"), 4096)
+	server.etag = `"v2"`
+
+	err = DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(content)/2)}, *rangeRequests)
+
+	downloaded, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, server.content, downloaded)
+	assert.NoFileExists(t, filepath.Join(partDir, "large.rpm.part.validator"))
+}
+
+func TestShouldNotResumeDownloadWithoutValidator(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	server, rangeRequests := newInterruptingServer(t, content, true)
+	server.etag = ""
+
+	partDir := t.TempDir()
+	dst := filepath.Join(t.TempDir(), "large.rpm")
+	url := server.URL + "/large.rpm"
+
+	err := DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.Error(t, err)
+	assert.FileExists(t, filepath.Join(partDir, "large.rpm.part"))
+
+	err = DownloadFileResumable(url, dst, partDir, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", ""}, *rangeRequests)
+
+	downloaded, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+}
+
+func TestShouldRejectDownloadOfUnexpectedSize(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 8-%d/%d", len(content)-1, 2*len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[8:])
+	}))
+	t.Cleanup(server.Close)
+
+	partDir := t.TempDir()
+	partPath := filepath.Join(partDir, "small.rpm.part")
+	assert.NoError(t, os.WriteFile(partPath, content[:8], 0644))
+	assert.NoError(t, os.WriteFile(partPath+".validator", []byte(`"v1"`), 0644))
+
+	dst := filepath.Join(t.TempDir(), "small.rpm")
+	err := DownloadFileResumable(server.URL+"/small.rpm", dst, partDir, nil, nil)
+	assert.Error(t, err)
+	assert.NoFileExists(t, dst)
+	assert.NoFileExists(t, partPath)
+}
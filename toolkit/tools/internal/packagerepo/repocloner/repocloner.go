@@ -16,10 +16,12 @@ type RepoContents struct {
 
 // RepoPackage represents a package in a repo.
 type RepoPackage struct {
-	Name         string `json:"Name"`         // Name of the package
-	Version      string `json:"Version"`      // Version number of the package
-	Architecture string `json:"Architecture"` // Architecture of the package
-	Distribution string `json:"Distribution"` // Distribution tag of the package
+	Name         string `json:"Name"`               // Name of the package
+	Version      string `json:"Version"`            // Version number of the package
+	Architecture string `json:"Architecture"`       // Architecture of the package
+	Distribution string `json:"Distribution"`       // Distribution tag of the package
+	Repo         string `json:"-"`                  // ID of the repo the package was listed from, not part of the flat summary
+	Checksum     string `json:"Checksum,omitempty"` // "<algorithm>:<hash>" checksum of the package's RPM, missing from older summaries
 }
 
 // RepoCloner is an interface for a package repository cloner.
@@ -0,0 +1,296 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/versioncompare"
+)
+
+// RepoMetadataFile is the index of a repo's metadata, relative to the repo's root directory.
+const RepoMetadataFile = "repodata/repomd.xml"
+
+// LocalRepo is a createrepo-generated repository directory, resolved directly from its metadata
+// instead of being defined in a repo file inside the cloner's chroot.
+type LocalRepo struct {
+	repoDir  string
+	packages map[string]localRepoPackage // Keyed by the package's "<name>-<version>-<release>.<arch>"
+}
+
+// localRepoPackage is a package listed in a local repo's primary metadata.
+type localRepoPackage struct {
+	Name     string           `xml:"name"`
+	Arch     string           `xml:"arch"`
+	Version  localRepoVersion `xml:"version"`
+	Checksum struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"checksum"`
+	Location struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+	Provides []localRepoEntry `xml:"format>provides>entry"`
+	Requires []localRepoEntry `xml:"format>requires>entry"`
+	Files    []string         `xml:"format>file"`
+}
+
+// localRepoVersion is the version of a package, or of one of its provides, in a local repo's primary metadata.
+type localRepoVersion struct {
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+// localRepoEntry is a capability provided or required by a package in a local repo's primary metadata.
+type localRepoEntry struct {
+	Name  string `xml:"name,attr"`
+	Flags string `xml:"flags,attr"`
+	Epoch string `xml:"epoch,attr"`
+	Ver   string `xml:"ver,attr"`
+	Rel   string `xml:"rel,attr"`
+}
+
+// localRepoMetadata is the index of a repo's metadata files, 'repodata/repomd.xml'.
+type localRepoMetadata struct {
+	Data []struct {
+		Type     string `xml:"type,attr"`
+		Location struct {
+			Href string `xml:"href,attr"`
+		} `xml:"location"`
+	} `xml:"data"`
+}
+
+// localRepoPrimary is the list of a repo's packages, the 'primary' metadata file.
+type localRepoPrimary struct {
+	Packages []localRepoPackage `xml:"package"`
+}
+
+// entryConditions translates the flags of the metadata's provides and requires into PackageVer conditions.
+var entryConditions = map[string]string{
+	"":   "",
+	"EQ": "=",
+	"LT": "<",
+	"LE": "<=",
+	"GT": ">",
+	"GE": ">=",
+}
+
+// ReadLocalRepo reads the packages of a createrepo-generated repository directory, which must contain 'repodata/repomd.xml'.
+func ReadLocalRepo(repoDir string) (repo *LocalRepo, err error) {
+	metadata := localRepoMetadata{}
+	err = readLocalRepoXML(filepath.Join(repoDir, RepoMetadataFile), &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the metadata of local repo '%s':\n%w", repoDir, err)
+	}
+
+	primaryHref := ""
+	for _, data := range metadata.Data {
+		if data.Type == "primary" {
+			primaryHref = data.Location.Href
+			break
+		}
+	}
+	if primaryHref == "" {
+		return nil, fmt.Errorf("local repo '%s' has no primary metadata in '%s'", repoDir, RepoMetadataFile)
+	}
+
+	primary := localRepoPrimary{}
+	err = readLocalRepoXML(filepath.Join(repoDir, primaryHref), &primary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the packages of local repo '%s':\n%w", repoDir, err)
+	}
+
+	repo = &LocalRepo{
+		repoDir:  repoDir,
+		packages: make(map[string]localRepoPackage, len(primary.Packages)),
+	}
+	for _, pkg := range primary.Packages {
+		repo.packages[pkg.fullName()] = pkg
+	}
+	logger.Log.Infof("Found %d package(s) in local repo '%s'.", len(repo.packages), repoDir)
+
+	return
+}
+
+// readLocalRepoXML decodes a metadata file, decompressing it first if it is gzipped.
+func readLocalRepoXML(path string, contents interface{}) (err error) {
+	xmlFile, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer xmlFile.Close()
+
+	var reader io.Reader = xmlFile
+	if strings.HasSuffix(path, ".gz") {
+		var gzipReader *gzip.Reader
+
+		gzipReader, err = gzip.NewReader(xmlFile)
+		if err != nil {
+			return fmt.Errorf("failed to decompress '%s':\n%w", path, err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	err = xml.NewDecoder(reader).Decode(contents)
+	if err != nil {
+		return fmt.Errorf("failed to parse '%s':\n%w", path, err)
+	}
+	return
+}
+
+// WhatProvides finds the packages of the repo which provide the requested PackageVer, highest version first.
+// Like the cloner's WhatProvides, the packages are named "<name>-<version>-<release>.<arch>".
+func (l *LocalRepo) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	queryInterval, err := pkgVer.Interval()
+	if err != nil {
+		return
+	}
+
+	for packageName, pkg := range l.packages {
+		var provided bool
+
+		provided, err = pkg.provides(pkgVer.Name, &queryInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid provides of '%s' in local repo '%s':\n%w", packageName, l.repoDir, err)
+		}
+		if provided {
+			packageNames = append(packageNames, packageName)
+		}
+	}
+
+	sort.Slice(packageNames, func(i, j int) bool {
+		iVersion := l.packages[packageNames[i]].Version.evr()
+		jVersion := l.packages[packageNames[j]].Version.evr()
+		if comparison := versioncompare.New(iVersion).Compare(versioncompare.New(jVersion)); comparison != 0 {
+			return comparison > 0
+		}
+		return packageNames[i] < packageNames[j]
+	})
+
+	if len(packageNames) == 0 {
+		err = fmt.Errorf("%w: could not resolve %s in local repo '%s'", ErrPackageNotFound, pkgVer.Name, l.repoDir)
+		return
+	}
+
+	logger.Log.Debugf("Translated '%s' to local repo package(s): %s", pkgVer.Name, strings.Join(packageNames, " "))
+	return
+}
+
+// Requires returns the capabilities required by one of the packages returned by WhatProvides.
+func (l *LocalRepo) Requires(packageName string) (requires []*pkgjson.PackageVer, err error) {
+	pkg, found := l.packages[packageName]
+	if !found {
+		return nil, fmt.Errorf("%w: '%s' is not in local repo '%s'", ErrPackageNotFound, packageName, l.repoDir)
+	}
+
+	for _, require := range pkg.Requires {
+		var requireVer *pkgjson.PackageVer
+
+		requireVer, err = require.packageVer()
+		if err != nil {
+			return nil, fmt.Errorf("invalid requires of '%s' in local repo '%s':\n%w", packageName, l.repoDir, err)
+		}
+		requires = append(requires, requireVer)
+	}
+	return
+}
+
+// RPMPath returns the path to the RPM file of one of the packages returned by WhatProvides.
+func (l *LocalRepo) RPMPath(packageName string) (rpmPath string, found bool) {
+	pkg, found := l.packages[packageName]
+	if !found {
+		return
+	}
+	return filepath.Join(l.repoDir, pkg.Location.Href), true
+}
+
+// RPMChecksums returns the checksum recorded in the repo's metadata for each of its RPMs, keyed by the RPM's path.
+// The checksums are prefixed with their algorithm, e.g. "sha256:<hash>". RPMs listed without a checksum are skipped.
+func (l *LocalRepo) RPMChecksums() (checksums map[string]string) {
+	checksums = make(map[string]string, len(l.packages))
+	for _, pkg := range l.packages {
+		checksum := strings.TrimSpace(pkg.Checksum.Value)
+		if pkg.Checksum.Type == "" || checksum == "" {
+			continue
+		}
+		checksums[filepath.Join(l.repoDir, pkg.Location.Href)] = fmt.Sprintf("%s:%s", pkg.Checksum.Type, checksum)
+	}
+	return
+}
+
+// fullName returns the package's "<name>-<version>-<release>.<arch>".
+func (p *localRepoPackage) fullName() string {
+	return fmt.Sprintf("%s-%s-%s.%s", p.Name, p.Version.Ver, p.Version.Rel, p.Arch)
+}
+
+// provides returns true if the package provides 'capability' in a version from 'queryInterval'.
+// Files have no version, they satisfy any requested version.
+func (p *localRepoPackage) provides(capability string, queryInterval *pkgjson.PackageVerInterval) (provided bool, err error) {
+	for _, file := range p.Files {
+		if file == capability {
+			return true, nil
+		}
+	}
+
+	for _, provide := range p.Provides {
+		if provide.Name != capability {
+			continue
+		}
+
+		var provideVer *pkgjson.PackageVer
+		provideVer, err = provide.packageVer()
+		if err != nil {
+			return
+		}
+
+		var provideInterval pkgjson.PackageVerInterval
+		provideInterval, err = provideVer.Interval()
+		if err != nil {
+			return
+		}
+		if provideInterval.Satisfies(queryInterval) {
+			return true, nil
+		}
+	}
+
+	return
+}
+
+// packageVer converts the entry into a PackageVer.
+func (e *localRepoEntry) packageVer() (pkgVer *pkgjson.PackageVer, err error) {
+	condition, known := entryConditions[e.Flags]
+	if !known {
+		return nil, fmt.Errorf("unknown flags '%s' of '%s'", e.Flags, e.Name)
+	}
+
+	pkgVer = &pkgjson.PackageVer{Name: e.Name}
+	if condition != "" {
+		pkgVer.Condition = condition
+		pkgVer.Version = localRepoVersion{Epoch: e.Epoch, Ver: e.Ver, Rel: e.Rel}.evr()
+	}
+	return
+}
+
+// evr returns the version as "[<epoch>:]<version>[-<release>]", omitting a zero epoch.
+func (v localRepoVersion) evr() (evr string) {
+	evr = v.Ver
+	if v.Rel != "" {
+		evr = fmt.Sprintf("%s-%s", evr, v.Rel)
+	}
+	if v.Epoch != "" && v.Epoch != "0" {
+		evr = fmt.Sprintf("%s:%s", v.Epoch, evr)
+	}
+	return
+}
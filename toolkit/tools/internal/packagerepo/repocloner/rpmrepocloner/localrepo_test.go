@@ -0,0 +1,118 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLocalRepoMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo" xmlns:rpm="http://linux.duke.edu/metadata/rpm">
+  <data type="primary">
+    <location href="repodata/0123abcd-primary.xml.gz"/>
+  </data>
+</repomd>
+`
+
+const testLocalRepoPrimaryMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="2">
+<package type="rpm">
+  <name>internal-tool</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.2.0" rel="1.cm2"/>
+  <checksum type="sha256" pkgid="YES">4e9b3c1f</checksum>
+  <location href="internal-tool-1.2.0-1.cm2.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="internal-tool" flags="EQ" epoch="0" ver="1.2.0" rel="1.cm2"/>
+      <rpm:entry name="libinternal.so.1()(64bit)"/>
+    </rpm:provides>
+    <rpm:requires>
+      <rpm:entry name="glibc" flags="GE" epoch="0" ver="2.35"/>
+      <rpm:entry name="/bin/sh" pre="1"/>
+    </rpm:requires>
+    <file>/usr/bin/internal-tool</file>
+  </format>
+</package>
+<package type="rpm">
+  <name>internal-tool</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="2.0.0" rel="1.cm2"/>
+  <location href="Packages/internal-tool-2.0.0-1.cm2.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="internal-tool" flags="EQ" epoch="0" ver="2.0.0" rel="1.cm2"/>
+    </rpm:provides>
+  </format>
+</package>
+</metadata>
+`
+
+func writeLocalRepo(t *testing.T) (repoDir string) {
+	repoDir = t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(repoDir, "repodata"), os.ModePerm))
+	assert.NoError(t, os.WriteFile(filepath.Join(repoDir, RepoMetadataFile), []byte(testLocalRepoMetadata), 0644))
+
+	primaryFile, err := os.Create(filepath.Join(repoDir, "repodata", "0123abcd-primary.xml.gz"))
+	assert.NoError(t, err)
+	defer primaryFile.Close()
+
+	gzipWriter := gzip.NewWriter(primaryFile)
+	_, err = gzipWriter.Write([]byte(testLocalRepoPrimaryMetadata))
+	assert.NoError(t, err)
+	assert.NoError(t, gzipWriter.Close())
+	return
+}
+
+func TestShouldResolveProvidesFromLocalRepo(t *testing.T) {
+	repoDir := writeLocalRepo(t)
+	repo, err := ReadLocalRepo(repoDir)
+	assert.NoError(t, err)
+
+	packageNames, err := repo.WhatProvides(&pkgjson.PackageVer{Name: "internal-tool"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"internal-tool-2.0.0-1.cm2.x86_64", "internal-tool-1.2.0-1.cm2.x86_64"}, packageNames)
+
+	packageNames, err = repo.WhatProvides(&pkgjson.PackageVer{Name: "internal-tool", Condition: "<", Version: "2.0.0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"internal-tool-1.2.0-1.cm2.x86_64"}, packageNames)
+
+	for _, capability := range []string{"libinternal.so.1()(64bit)", "/usr/bin/internal-tool"} {
+		packageNames, err = repo.WhatProvides(&pkgjson.PackageVer{Name: capability})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"internal-tool-1.2.0-1.cm2.x86_64"}, packageNames)
+	}
+
+	_, err = repo.WhatProvides(&pkgjson.PackageVer{Name: "internal-tool", Condition: ">", Version: "2.0.0-1.cm2"})
+	assert.ErrorIs(t, err, ErrPackageNotFound)
+
+	requires, err := repo.Requires("internal-tool-1.2.0-1.cm2.x86_64")
+	assert.NoError(t, err)
+	assert.Equal(t, []*pkgjson.PackageVer{{Name: "glibc", Condition: ">=", Version: "2.35"}, {Name: "/bin/sh"}}, requires)
+
+	rpmPath, found := repo.RPMPath("internal-tool-2.0.0-1.cm2.x86_64")
+	assert.True(t, found)
+	assert.Equal(t, filepath.Join(repoDir, "Packages", "internal-tool-2.0.0-1.cm2.x86_64.rpm"), rpmPath)
+}
+
+func TestShouldFailLocalRepoWithoutMetadata(t *testing.T) {
+	_, err := ReadLocalRepo(t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestShouldReadRPMChecksumsFromLocalRepo(t *testing.T) {
+	repoDir := writeLocalRepo(t)
+
+	repo, err := ReadLocalRepo(repoDir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		filepath.Join(repoDir, "internal-tool-1.2.0-1.cm2.x86_64.rpm"): "sha256:4e9b3c1f",
+	}, repo.RPMChecksums())
+}
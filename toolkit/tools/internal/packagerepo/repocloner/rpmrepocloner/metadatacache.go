@@ -0,0 +1,227 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// chrootTdnfCacheDir is where TDNF keeps the repos' metadata inside the chroot, in a sub-directory per repo ID.
+	chrootTdnfCacheDir = "/var/cache/tdnf"
+	// chrootMetadataCacheDir is where the metadata cache is mounted inside the chroot. Only the remote repos'
+	// sub-directories of chrootTdnfCacheDir link into it, the local repos' metadata is never shared between cloners.
+	chrootMetadataCacheDir = "/metadatacache"
+
+	metadataStampFile     = ".metadata-refreshed"
+	metadataLockExtension = ".lock"
+)
+
+// MetadataCache keeps TDNF's copy of the remote repos' metadata in a directory outside of the chroot, so cloners
+// constructed while the metadata is younger than MaxAge reuse it instead of downloading it again.
+type MetadataCache struct {
+	Dir          string        // Directory holding the cached metadata, shared by all cloners using the cache
+	MaxAge       time.Duration // How long after a refresh the metadata is reused
+	ForceRefresh bool          // Refresh the metadata before the cloner first uses it, even if it is still fresh
+}
+
+// metadataStamp records when the cached metadata was last refreshed, and for which repo definitions.
+type metadataStamp struct {
+	Refreshed time.Time `json:"Refreshed"`
+	ReposHash string    `json:"ReposHash"`
+}
+
+// RefreshMetadata downloads the metadata of all remote repos into the metadata cache, regardless of its age.
+// Cloners without a metadata cache refresh the metadata of all repos.
+func (r *RpmRepoCloner) RefreshMetadata() (err error) {
+	if r.metadataCache == nil || r.offline || r.rpmmdSnapshotDir != "" {
+		return r.chroot.Run(r.refreshPackagesCache)
+	}
+
+	const force = true
+	return r.loadCachedMetadata(force)
+}
+
+// ensureCachedMetadata loads the remote repos' metadata from the metadata cache before their first lookup or clone,
+// once the repo files carry their final proxies, mirrors, priorities and throttles. Does nothing without a metadata cache.
+func (r *RpmRepoCloner) ensureCachedMetadata() (err error) {
+	if r.metadataCache == nil {
+		return
+	}
+
+	return r.loadCachedMetadata(r.metadataCache.ForceRefresh)
+}
+
+// loadCachedMetadata links the remote repos' metadata to the metadata cache and refreshes it unless it is still fresh.
+// Once loaded, the metadata is only refreshed again if 'force' is set.
+func (r *RpmRepoCloner) loadCachedMetadata(force bool) (err error) {
+	r.metadataLock.Lock()
+	defer r.metadataLock.Unlock()
+
+	if r.metadataLoaded && !force {
+		return
+	}
+
+	knownRepoIDs, err := r.definedRepoIDs()
+	if err != nil {
+		return
+	}
+
+	remoteRepoIDs := []string{}
+	for repoID := range knownRepoIDs {
+		if !r.isLocalRepoID(repoID) {
+			remoteRepoIDs = append(remoteRepoIDs, repoID)
+		}
+	}
+
+	err = linkRepoMetadataDirs(filepath.Join(r.chroot.RootDir(), chrootTdnfCacheDir), chrootMetadataCacheDir, remoteRepoIDs)
+	if err != nil {
+		return fmt.Errorf("failed to link the repos' metadata to the metadata cache:\n%w", err)
+	}
+
+	err = r.chroot.Run(func() error {
+		return r.refreshCachedMetadata(force)
+	})
+	if err != nil {
+		return
+	}
+
+	r.metadataLoaded = true
+	return
+}
+
+// isCachedMetadataLoaded checks if the remote repos' metadata was already loaded from the metadata cache.
+func (r *RpmRepoCloner) isCachedMetadataLoaded() bool {
+	r.metadataLock.Lock()
+	defer r.metadataLock.Unlock()
+
+	return r.metadataLoaded
+}
+
+// linkRepoMetadataDirs replaces the metadata directory of each repo in 'repoIDs' under 'tdnfCacheDir' with a link to
+// its sub-directory of 'metadataCacheDir', keyed by the repo ID. The links are resolved inside the chroot.
+func linkRepoMetadataDirs(tdnfCacheDir, metadataCacheDir string, repoIDs []string) (err error) {
+	err = os.MkdirAll(tdnfCacheDir, os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	for _, repoID := range repoIDs {
+		repoMetadataDir := filepath.Join(tdnfCacheDir, repoID)
+		err = os.RemoveAll(repoMetadataDir)
+		if err != nil {
+			return
+		}
+
+		err = os.Symlink(filepath.Join(metadataCacheDir, repoID), repoMetadataDir)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// refreshCachedMetadata refreshes the metadata of the remote repos unless the metadata cache is still fresh.
+// Must be run inside the chroot.
+func (r *RpmRepoCloner) refreshCachedMetadata(force bool) (err error) {
+	reposHash, err := hashRepoDefinitions(chrootRepoDir)
+	if err != nil {
+		return fmt.Errorf("failed to hash the repo definitions:\n%w", err)
+	}
+
+	_, err = refreshMetadataIfStale(chrootMetadataCacheDir, reposHash, r.metadataCache.MaxAge, force, func() (err error) {
+		args, err := makecacheArgs()
+		if err != nil {
+			return
+		}
+		return r.refreshRemoteMetadata(args)
+	})
+	return
+}
+
+// refreshMetadataIfStale calls 'refresh' if 'force' is set, or if the metadata in 'cacheDir' was refreshed more than
+// 'maxAge' ago or for other repo definitions than the ones hashing to 'reposHash'. Other runs sharing the cache wait
+// for the check and refresh to finish.
+func refreshMetadataIfStale(cacheDir, reposHash string, maxAge time.Duration, force bool, refresh func() error) (refreshed bool, err error) {
+	stampPath := filepath.Join(cacheDir, metadataStampFile)
+
+	lock, err := os.OpenFile(stampPath+metadataLockExtension, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	defer lock.Close()
+
+	err = unix.Flock(int(lock.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock the metadata cache (%s):\n%w", cacheDir, err)
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+
+	if !force {
+		var stamp metadataStamp
+		stampErr := jsonutils.ReadJSONFile(stampPath, &stamp)
+		age := time.Since(stamp.Refreshed)
+		switch {
+		case stampErr != nil:
+			logger.Log.Debugf("No usable metadata cache stamp (%s): %s", stampPath, stampErr)
+		case stamp.ReposHash != reposHash:
+			logger.Log.Infof("The repo definitions changed since the cached repo metadata was refreshed.")
+		case age < maxAge:
+			logger.Log.Infof("Reusing the cached repo metadata refreshed %s ago.", age.Round(time.Second))
+			return
+		default:
+			logger.Log.Infof("The cached repo metadata expired %s ago.", (age - maxAge).Round(time.Second))
+		}
+	}
+
+	// A failed refresh may leave partial metadata behind, it must not be reused.
+	err = os.Remove(stampPath)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	logger.Log.Infof("Refreshing the cached repo metadata.")
+	err = refresh()
+	if err != nil {
+		return
+	}
+
+	err = jsonutils.WriteJSONFile(stampPath, metadataStamp{Refreshed: time.Now(), ReposHash: reposHash})
+	if err != nil {
+		return true, fmt.Errorf("failed to record the metadata refresh:\n%w", err)
+	}
+	return true, nil
+}
+
+// hashRepoDefinitions returns a hash of the names and contents of all repo files in 'repoDir'.
+func hashRepoDefinitions(repoDir string) (reposHash string, err error) {
+	repoFiles, err := filepath.Glob(filepath.Join(repoDir, "*.repo"))
+	if err != nil {
+		return
+	}
+
+	hash := sha256.New()
+	for _, repoFile := range repoFiles {
+		var contents []byte
+
+		contents, err = os.ReadFile(repoFile)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(hash, "%s\n%d\n", filepath.Base(repoFile), len(contents))
+		hash.Write(contents)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
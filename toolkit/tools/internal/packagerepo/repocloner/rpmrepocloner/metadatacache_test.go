@@ -0,0 +1,171 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/stretchr/testify/assert"
+)
+
+// newMetadataServer serves a repo's 'repomd.xml' and counts the requests made for it.
+func newMetadataServer(t *testing.T) (server *httptest.Server, requests *int32) {
+	requests = new(int32)
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Write([]byte("<repomd/>"))
+	}))
+	t.Cleanup(server.Close)
+	return
+}
+
+// downloadMetadata returns a refresh function downloading the metadata from 'server' into 'cacheDir'.
+func downloadMetadata(server *httptest.Server, cacheDir string) func() error {
+	return func() error {
+		resp, err := http.Get(server.URL + "/repodata/repomd.xml")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		return os.WriteFile(filepath.Join(cacheDir, "repomd.xml"), []byte(resp.Status), 0644)
+	}
+}
+
+func TestShouldReuseFreshMetadataCache(t *testing.T) {
+	const (
+		reposHash = "repos"
+		maxAge    = time.Hour
+	)
+
+	server, requests := newMetadataServer(t)
+	cacheDir := t.TempDir()
+
+	refreshed, err := refreshMetadataIfStale(cacheDir, reposHash, maxAge, false, downloadMetadata(server, cacheDir))
+	assert.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	refreshed, err = refreshMetadataIfStale(cacheDir, reposHash, maxAge, false, downloadMetadata(server, cacheDir))
+	assert.NoError(t, err)
+	assert.False(t, refreshed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestShouldRefreshExpiredMetadataCache(t *testing.T) {
+	const (
+		reposHash = "repos"
+		maxAge    = time.Hour
+	)
+
+	server, requests := newMetadataServer(t)
+	cacheDir := t.TempDir()
+
+	stampPath := filepath.Join(cacheDir, metadataStampFile)
+	err := jsonutils.WriteJSONFile(stampPath, metadataStamp{Refreshed: time.Now().Add(-2 * maxAge), ReposHash: reposHash})
+	assert.NoError(t, err)
+
+	refreshed, err := refreshMetadataIfStale(cacheDir, reposHash, maxAge, false, downloadMetadata(server, cacheDir))
+	assert.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	var stamp metadataStamp
+	err = jsonutils.ReadJSONFile(stampPath, &stamp)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), stamp.Refreshed, time.Minute)
+}
+
+func TestShouldRefreshMetadataCacheForNewReposOrWhenForced(t *testing.T) {
+	const maxAge = time.Hour
+
+	server, requests := newMetadataServer(t)
+	cacheDir := t.TempDir()
+
+	_, err := refreshMetadataIfStale(cacheDir, "repos", maxAge, false, downloadMetadata(server, cacheDir))
+	assert.NoError(t, err)
+
+	refreshed, err := refreshMetadataIfStale(cacheDir, "other repos", maxAge, false, downloadMetadata(server, cacheDir))
+	assert.NoError(t, err)
+	assert.True(t, refreshed)
+
+	refreshed, err = refreshMetadataIfStale(cacheDir, "other repos", maxAge, true, downloadMetadata(server, cacheDir))
+	assert.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, int32(3), atomic.LoadInt32(requests))
+}
+
+func TestShouldNotReuseMetadataCacheAfterFailedRefresh(t *testing.T) {
+	const (
+		reposHash = "repos"
+		maxAge    = time.Hour
+	)
+
+	server, requests := newMetadataServer(t)
+	cacheDir := t.TempDir()
+
+	_, err := refreshMetadataIfStale(cacheDir, reposHash, maxAge, true, func() error {
+		return os.ErrDeadlineExceeded
+	})
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	refreshed, err := refreshMetadataIfStale(cacheDir, reposHash, maxAge, false, downloadMetadata(server, cacheDir))
+	assert.NoError(t, err)
+	assert.True(t, refreshed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestShouldHashRepoDefinitions(t *testing.T) {
+	repoDir := t.TempDir()
+	repoFile := filepath.Join(repoDir, "mariner.repo")
+
+	err := os.WriteFile(repoFile, []byte("[mariner]\nbaseurl=https://example.com/a\n"), 0644)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(repoDir, "notes.txt"), []byte("ignored"), 0644)
+	assert.NoError(t, err)
+
+	hash, err := hashRepoDefinitions(repoDir)
+	assert.NoError(t, err)
+
+	err = os.Remove(filepath.Join(repoDir, "notes.txt"))
+	assert.NoError(t, err)
+	sameHash, err := hashRepoDefinitions(repoDir)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, sameHash)
+
+	err = os.WriteFile(repoFile, []byte("[mariner]\nbaseurl=https://example.com/b\n"), 0644)
+	assert.NoError(t, err)
+	changedHash, err := hashRepoDefinitions(repoDir)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, changedHash)
+}
+
+func TestShouldLinkOnlyRemoteReposMetadataToCache(t *testing.T) {
+	remoteRepoIDs := []string{"mariner-official-base", "extras"}
+	tdnfCacheDir := filepath.Join(t.TempDir(), "tdnf")
+
+	// Metadata TDNF downloaded before the repos were linked is replaced, the local repos' metadata is left alone.
+	err := os.MkdirAll(filepath.Join(tdnfCacheDir, remoteRepoIDs[0], "repodata"), os.ModePerm)
+	assert.NoError(t, err)
+	err = os.MkdirAll(filepath.Join(tdnfCacheDir, repoIDToolchain, "repodata"), os.ModePerm)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		err = linkRepoMetadataDirs(tdnfCacheDir, chrootMetadataCacheDir, remoteRepoIDs)
+		assert.NoError(t, err)
+
+		for _, repoID := range remoteRepoIDs {
+			target, err := os.Readlink(filepath.Join(tdnfCacheDir, repoID))
+			assert.NoError(t, err)
+			assert.Equal(t, filepath.Join(chrootMetadataCacheDir, repoID), target)
+		}
+		assert.DirExists(t, filepath.Join(tdnfCacheDir, repoIDToolchain, "repodata"))
+	}
+}
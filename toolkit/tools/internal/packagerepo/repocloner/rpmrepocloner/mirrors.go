@@ -0,0 +1,182 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/tdnf"
+)
+
+const (
+	mirrorProbeTimeout = 30 * time.Second
+	mirrorProbePath    = RepoMetadataFile
+)
+
+// Remote locations of repos in repo files.
+const (
+	repoOptionBaseURL    = "baseurl"
+	repoOptionMetalink   = "metalink"
+	repoOptionMirrorList = "mirrorlist"
+)
+
+// repoMirrors tracks the ordered mirror base URLs of remote repos, the mirror each repo currently uses,
+// and which mirror served each cloned package.
+type repoMirrors struct {
+	lock     sync.Mutex
+	client   *http.Client
+	mirrors  map[string][]string // Repo ID -> ordered mirror base URLs
+	active   map[string]int      // Repo ID -> index of the mirror in use
+	servedBy map[string]string   // RPM file name -> base URL of the mirror it was cloned from
+}
+
+func newRepoMirrors(mirrors map[string][]string) *repoMirrors {
+	return &repoMirrors{
+		client:   &http.Client{Timeout: mirrorProbeTimeout},
+		mirrors:  mirrors,
+		active:   make(map[string]int),
+		servedBy: make(map[string]string),
+	}
+}
+
+// mirrorProbeTransport returns the HTTP transport used to probe the mirrors, reaching them the way TDNF does:
+// through the configured proxies, with the cloner's TLS client certificate and trusted CAs.
+func (r *RpmRepoCloner) mirrorProbeTransport() (transport *http.Transport) {
+	if r.proxy != nil {
+		transport = r.proxy.transport()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	transport.TLSClientConfig = r.tlsConfig
+	return
+}
+
+// activeMirror returns the base URL the repo currently uses, "" if the repo has no mirrors.
+func (m *repoMirrors) activeMirror(repoID string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	mirrors := m.mirrors[repoID]
+	if len(mirrors) == 0 {
+		return ""
+	}
+	return mirrors[m.active[repoID]]
+}
+
+// activeMirrors returns the base URL each repo with mirrors currently uses.
+func (m *repoMirrors) activeMirrors() (baseURLs map[string]string) {
+	baseURLs = make(map[string]string)
+	for repoID := range m.mirrors {
+		baseURLs[repoID] = m.activeMirror(repoID)
+	}
+	return
+}
+
+// failover probes the mirror each repo currently uses and moves the repos with an unavailable mirror to the next
+// available one. Mirrors are only ever tried in order, so a repo never returns to a mirror it failed over from.
+// Returns the new base URL of each repo which switched mirrors.
+func (m *repoMirrors) failover() (switchedRepos map[string]string) {
+	switchedRepos = make(map[string]string)
+	for repoID, currentMirror := range m.activeMirrors() {
+		if m.isAvailable(currentMirror) {
+			continue
+		}
+
+		m.lock.Lock()
+		mirrors := m.mirrors[repoID]
+		nextIndex := m.active[repoID] + 1
+		m.lock.Unlock()
+
+		for ; nextIndex < len(mirrors); nextIndex++ {
+			if m.isAvailable(mirrors[nextIndex]) {
+				break
+			}
+		}
+
+		if nextIndex >= len(mirrors) {
+			logger.Log.Warnf("Mirror (%s) of repo (%s) is unavailable and there are no more mirrors to fail over to.", currentMirror, repoID)
+			continue
+		}
+
+		logger.Log.Warnf("Mirror (%s) of repo (%s) is unavailable, failing over to (%s).", currentMirror, repoID, mirrors[nextIndex])
+		m.lock.Lock()
+		m.active[repoID] = nextIndex
+		m.lock.Unlock()
+		switchedRepos[repoID] = mirrors[nextIndex]
+	}
+
+	return
+}
+
+// isAvailable checks if a mirror serves the repo's metadata.
+func (m *repoMirrors) isAvailable(baseURL string) bool {
+	probeURL := strings.TrimSuffix(expandRepoVariables(baseURL), "/") + "/" + mirrorProbePath
+
+	response, err := m.client.Get(probeURL)
+	if err != nil {
+		logger.Log.Debugf("Failed to reach mirror (%s): %s", probeURL, err)
+		return false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		logger.Log.Debugf("Mirror (%s) responded with: %s", probeURL, response.Status)
+		return false
+	}
+	return true
+}
+
+// recordServedPackages attributes the RPM files installed by 'tdnf install', each mapped to the ID of the repo TDNF
+// resolved it from, to the mirrors of their repos.
+func (m *repoMirrors) recordServedPackages(installedPackages map[string]string) {
+	for rpmFile, repoID := range installedPackages {
+		baseURL := m.activeMirror(repoID)
+		if baseURL == "" {
+			continue
+		}
+
+		m.lock.Lock()
+		m.servedBy[rpmFile] = baseURL
+		m.lock.Unlock()
+	}
+}
+
+// packageMirrors returns a copy of the mirror each package was cloned from.
+func (m *repoMirrors) packageMirrors() (servedBy map[string]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	servedBy = make(map[string]string, len(m.servedBy))
+	for rpmFile, baseURL := range m.servedBy {
+		servedBy[rpmFile] = baseURL
+	}
+	return
+}
+
+// expandRepoVariables replaces the '$basearch' and '$releasever' variables TDNF supports in repo URLs,
+// leaving any variable which can't be determined as is.
+func expandRepoVariables(repoURL string) string {
+	if basearch, err := rpm.GetRpmArch(runtime.GOARCH); err == nil {
+		repoURL = strings.ReplaceAll(repoURL, "$basearch", basearch)
+	}
+
+	if releaseverArg, err := tdnf.GetReleaseverCliArg(); err == nil {
+		releasever := releaseverArg[strings.Index(releaseverArg, "=")+1:]
+		repoURL = strings.ReplaceAll(repoURL, "$releasever", releasever)
+	}
+
+	return repoURL
+}
+
+// setRepoBaseURL points the repo with the given ID, defined in one of the repo files under 'repoDir', to 'baseURL'.
+// The repo's other remote locations (metalinks, mirror lists) are dropped, as TDNF would prefer them over the base URL.
+func setRepoBaseURL(repoDir, repoID, baseURL string) (err error) {
+	return setRepoOption(repoDir, repoID, repoOptionBaseURL, baseURL, repoOptionMetalink, repoOptionMirrorList)
+}
@@ -0,0 +1,208 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+// newMirrorServer serves a repo's metadata and packages, or fails every request with 'status' if it is not 200.
+func newMirrorServer(t *testing.T, status int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if req.URL.Path == "/"+mirrorProbePath || strings.HasSuffix(req.URL.Path, ".rpm") {
+			w.Write([]byte("content"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestShouldFailOverToNextAvailableMirror(t *testing.T) {
+	unavailableMirror := newMirrorServer(t, http.StatusServiceUnavailable)
+	availableMirror := newMirrorServer(t, http.StatusOK)
+
+	hook := logtest.NewLocal(logger.Log)
+	defer hook.Reset()
+
+	mirrors := newRepoMirrors(map[string][]string{"base": {unavailableMirror.URL, availableMirror.URL}})
+	switchedRepos := mirrors.failover()
+
+	assert.Equal(t, map[string]string{"base": availableMirror.URL}, switchedRepos)
+	assert.Equal(t, availableMirror.URL, mirrors.activeMirror("base"))
+
+	failoverLogged := false
+	for _, entry := range hook.AllEntries() {
+		failoverLogged = failoverLogged || (entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "failing over to ("+availableMirror.URL+")"))
+	}
+	assert.True(t, failoverLogged)
+
+	// Packages TDNF downloads afterwards are attributed to the mirror which served them.
+	response, err := http.Get(mirrors.activeMirror("base") + "/zlib-1.2.13-1.cm2.x86_64.rpm")
+	assert.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	mirrors.recordServedPackages(parseInstalledPackages(" zlib    x86_64    1.2.13-1.cm2    base    100.00k 102400\n"))
+	assert.Equal(t, map[string]string{"zlib-1.2.13-1.cm2.x86_64.rpm": availableMirror.URL}, mirrors.packageMirrors())
+}
+
+func TestShouldKeepAvailableMirror(t *testing.T) {
+	primaryMirror := newMirrorServer(t, http.StatusOK)
+	secondaryMirror := newMirrorServer(t, http.StatusOK)
+
+	mirrors := newRepoMirrors(map[string][]string{"base": {primaryMirror.URL, secondaryMirror.URL}})
+
+	assert.Empty(t, mirrors.failover())
+	assert.Equal(t, primaryMirror.URL, mirrors.activeMirror("base"))
+}
+
+func TestShouldNotFailOverWithoutAvailableMirrors(t *testing.T) {
+	primaryMirror := newMirrorServer(t, http.StatusServiceUnavailable)
+	secondaryMirror := newMirrorServer(t, http.StatusBadGateway)
+
+	mirrors := newRepoMirrors(map[string][]string{"base": {primaryMirror.URL, secondaryMirror.URL}})
+
+	assert.Empty(t, mirrors.failover())
+	assert.Equal(t, primaryMirror.URL, mirrors.activeMirror("base"))
+}
+
+func TestShouldIgnorePackagesFromReposWithoutMirrors(t *testing.T) {
+	mirrors := newRepoMirrors(map[string][]string{"base": {"https://mirror.example.com"}})
+
+	mirrors.recordServedPackages(parseInstalledPackages(" zlib    x86_64    1.2.13-1.cm2    toolchain-repo    100.00k 102400\n"))
+	assert.Empty(t, mirrors.packageMirrors())
+}
+
+// writeTLSClientIdentity writes a self-signed TLS client certificate and its key under 'dir'.
+func writeTLSClientIdentity(t *testing.T, dir string) (certPath, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "builder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certPath = filepath.Join(dir, "client.crt")
+	keyPath = filepath.Join(dir, "client.key")
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	assert.NoError(t, err)
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	assert.NoError(t, err)
+	return
+}
+
+func TestShouldProbeMirrorsWithClonersTLSConfig(t *testing.T) {
+	mirror := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	mirror.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	mirror.StartTLS()
+	t.Cleanup(mirror.Close)
+
+	dir := t.TempDir()
+	certPath, keyPath := writeTLSClientIdentity(t, dir)
+	caBundlePath := filepath.Join(dir, "ca-bundle.crt")
+	err := os.WriteFile(caBundlePath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mirror.Certificate().Raw}), 0644)
+	assert.NoError(t, err)
+
+	mirrors := newRepoMirrors(map[string][]string{"base": {mirror.URL}})
+	tlsSettings := []struct {
+		tlsCert, tlsKey, caBundle string
+		available                 bool
+	}{
+		{certPath, keyPath, "", false}, // The mirror's CA is not trusted.
+		{"", "", caBundlePath, false},  // No client certificate is presented.
+		{certPath, keyPath, caBundlePath, true},
+	}
+	for _, settings := range tlsSettings {
+		r := &RpmRepoCloner{}
+		r.tlsConfig, err = newClientTLSConfig(settings.tlsCert, settings.tlsKey, settings.caBundle)
+		assert.NoError(t, err)
+
+		mirrors.client.Transport = r.mirrorProbeTransport()
+		assert.Equal(t, settings.available, mirrors.isAvailable(mirror.URL))
+	}
+}
+
+func TestShouldReplaceRepoBaseURL(t *testing.T) {
+	const repoFileContents = `[base]
+name=Base
+metalink=https://mirrors.example.com/metalink?repo=base
+baseurl=https://primary.example.com/base/$basearch
+enabled=1
+
+[extras]
+name=Extras
+baseurl=https://primary.example.com/extras/$basearch
+enabled=1
+`
+
+	repoDir := t.TempDir()
+	repoFilePath := filepath.Join(repoDir, "allrepos.repo")
+	err := os.WriteFile(repoFilePath, []byte(repoFileContents), 0644)
+	assert.NoError(t, err)
+
+	err = setRepoBaseURL(repoDir, "base", "https://secondary.example.com/base/$basearch")
+	assert.NoError(t, err)
+
+	contents, err := os.ReadFile(repoFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, `[base]
+baseurl=https://secondary.example.com/base/$basearch
+name=Base
+enabled=1
+
+[extras]
+name=Extras
+baseurl=https://primary.example.com/extras/$basearch
+enabled=1
+`, string(contents))
+
+	err = setRepoBaseURL(repoDir, "missing", "https://secondary.example.com/missing")
+	assert.Error(t, err)
+}
+
+func TestShouldExpandBasearch(t *testing.T) {
+	expanded := expandRepoVariables("https://mirror.example.com/base/$basearch")
+	assert.NotContains(t, expanded, "$basearch")
+}
@@ -0,0 +1,424 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/rpm"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/versioncompare"
+)
+
+// OCIAnnotationNEVRA is the manifest annotation naming the RPM stored in an OCI artifact,
+// as "<name>-[<epoch>:]<version>-<release>.<arch>".
+const OCIAnnotationNEVRA = "com.microsoft.cbl-mariner.rpm.nevra"
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociDigestSHA256      = "sha256:"
+)
+
+// ociChallengeParamRegex matches the 'key="value"' parameters of a 'WWW-Authenticate' challenge.
+var ociChallengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// OCIRepo is a repository of an OCI registry holding RPMs as artifacts, one tag per RPM. The manifest of each artifact
+// names its RPM in the OCIAnnotationNEVRA annotation and stores the RPM file as its only layer.
+// Artifacts have no provides or requires besides their package name.
+type OCIRepo struct {
+	registryURL string // Scheme and host of the registry, e.g. "https://registry.example.com"
+	repository  string // Path of the repository inside the registry, e.g. "mariner/rpms"
+	username    string
+	password    string
+	client      *http.Client
+
+	lock     sync.Mutex
+	token    string                // Bearer token issued by the registry's token service, if it uses one
+	packages map[string]ociPackage // Keyed by the package's "<name>-<version>-<release>.<arch>"
+}
+
+// ociPackage is an RPM artifact found in the repository.
+type ociPackage struct {
+	name   string
+	evr    string // "[<epoch>:]<version>-<release>"
+	digest string // Digest of the layer holding the RPM file
+}
+
+// ociTagList is the response to listing a repository's tags.
+type ociTagList struct {
+	Tags []string `json:"tags"`
+}
+
+// ociManifest is the part of an OCI image manifest describing an RPM artifact.
+type ociManifest struct {
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"layers"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// ociToken is the response of a registry's token service.
+type ociToken struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// ReadOCIRepo lists the RPM artifacts of the OCI repository at 'repoURL' (e.g. "https://registry.example.com/mariner/rpms").
+// 'username' and 'password' are optional, they are used for basic authentication and to request tokens from registries
+// using a token service.
+func ReadOCIRepo(repoURL, username, password string) (repo *OCIRepo, err error) {
+	parsedURL, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCI repo URL (%s):\n%w", repoURL, err)
+	}
+	repository := strings.Trim(parsedURL.Path, "/")
+	if parsedURL.Scheme == "" || parsedURL.Host == "" || repository == "" {
+		return nil, fmt.Errorf("OCI repo URL (%s) must be in the form 'https://<registry>/<repository>'", repoURL)
+	}
+
+	repo = &OCIRepo{
+		registryURL: fmt.Sprintf("%s://%s", parsedURL.Scheme, parsedURL.Host),
+		repository:  repository,
+		username:    username,
+		password:    password,
+		client:      &http.Client{},
+		packages:    make(map[string]ociPackage),
+	}
+
+	tags, err := repo.listTags()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the tags of OCI repo (%s):\n%w", repoURL, err)
+	}
+
+	for _, tag := range tags {
+		err = repo.addArtifact(tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read artifact (%s) of OCI repo (%s):\n%w", tag, repoURL, err)
+		}
+	}
+	logger.Log.Infof("Found %d package(s) in OCI repo (%s).", len(repo.packages), repoURL)
+
+	return
+}
+
+// WhatProvides finds the artifacts whose package name is the requested PackageVer's name in a matching version,
+// highest version first. Like the cloner's WhatProvides, the packages are named "<name>-<version>-<release>.<arch>".
+func (o *OCIRepo) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	queryInterval, err := pkgVer.Interval()
+	if err != nil {
+		return
+	}
+
+	for packageName, pkg := range o.packages {
+		if pkg.name != pkgVer.Name {
+			continue
+		}
+
+		var packageInterval pkgjson.PackageVerInterval
+		packageInterval, err = (&pkgjson.PackageVer{Name: pkg.name, Condition: "=", Version: pkg.evr}).Interval()
+		if err != nil {
+			return nil, fmt.Errorf("invalid version of (%s) in OCI repo (%s):\n%w", packageName, o.repository, err)
+		}
+		if packageInterval.Satisfies(&queryInterval) {
+			packageNames = append(packageNames, packageName)
+		}
+	}
+
+	sort.Slice(packageNames, func(i, j int) bool {
+		iVersion := versioncompare.New(o.packages[packageNames[i]].evr)
+		jVersion := versioncompare.New(o.packages[packageNames[j]].evr)
+		if comparison := iVersion.Compare(jVersion); comparison != 0 {
+			return comparison > 0
+		}
+		return packageNames[i] < packageNames[j]
+	})
+
+	if len(packageNames) == 0 {
+		err = fmt.Errorf("%w: could not resolve %s in OCI repo (%s)", ErrPackageNotFound, pkgVer.Name, o.repository)
+		return
+	}
+
+	logger.Log.Debugf("Translated '%s' to OCI repo package(s): %s", pkgVer.Name, strings.Join(packageNames, " "))
+	return
+}
+
+// HasPackage returns true if 'packageName' is one of the packages returned by WhatProvides.
+func (o *OCIRepo) HasPackage(packageName string) bool {
+	_, found := o.packages[packageName]
+	return found
+}
+
+// Download stores the RPM of one of the packages returned by WhatProvides in 'destinationDir', verifying its digest.
+func (o *OCIRepo) Download(packageName, destinationDir string) (rpmPath string, err error) {
+	pkg, found := o.packages[packageName]
+	if !found {
+		return "", fmt.Errorf("%w: '%s' is not in OCI repo (%s)", ErrPackageNotFound, packageName, o.repository)
+	}
+
+	logger.Log.Debugf("Downloading (%s) from OCI repo (%s).", packageName, o.repository)
+	response, err := o.get(o.apiURL("blobs", pkg.digest), "")
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	tmpFile, err := os.CreateTemp(destinationDir, packageName+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), response.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to download (%s):\n%w", packageName, err)
+	}
+
+	digest := ociDigestSHA256 + hex.EncodeToString(hash.Sum(nil))
+	if digest != pkg.digest {
+		return "", fmt.Errorf("downloaded (%s) has digest (%s), expected (%s)", packageName, digest, pkg.digest)
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return
+	}
+
+	rpmPath = filepath.Join(destinationDir, packageName+".rpm")
+	err = os.Rename(tmpFile.Name(), rpmPath)
+	return
+}
+
+// listTags returns all tags of the repository, following the registry's pagination.
+func (o *OCIRepo) listTags() (tags []string, err error) {
+	nextURL := o.apiURL("tags", "list")
+	for nextURL != "" {
+		var (
+			response *http.Response
+			tagList  ociTagList
+		)
+
+		response, err = o.get(nextURL, "")
+		if err != nil {
+			return
+		}
+
+		err = json.NewDecoder(response.Body).Decode(&tagList)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the tag list:\n%w", err)
+		}
+		tags = append(tags, tagList.Tags...)
+
+		nextURL, err = o.nextPageURL(response.Header.Get("Link"))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// nextPageURL returns the absolute URL of a 'Link: <url>; rel="next"' header, empty if there is none.
+func (o *OCIRepo) nextPageURL(linkHeader string) (nextURL string, err error) {
+	if !strings.Contains(linkHeader, `rel="next"`) {
+		return
+	}
+
+	start, end := strings.Index(linkHeader, "<"), strings.Index(linkHeader, ">")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("invalid 'Link' header (%s)", linkHeader)
+	}
+
+	base, err := url.Parse(o.registryURL)
+	if err != nil {
+		return
+	}
+	next, err := url.Parse(linkHeader[start+1 : end])
+	if err != nil {
+		return
+	}
+	return base.ResolveReference(next).String(), nil
+}
+
+// addArtifact adds the package of the artifact tagged 'tag'. Artifacts without the NEVRA annotation are skipped.
+func (o *OCIRepo) addArtifact(tag string) (err error) {
+	response, err := o.get(o.apiURL("manifests", tag), ociManifestMediaType)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	manifest := ociManifest{}
+	err = json.NewDecoder(response.Body).Decode(&manifest)
+	if err != nil {
+		return fmt.Errorf("failed to parse the manifest:\n%w", err)
+	}
+
+	nevra := manifest.Annotations[OCIAnnotationNEVRA]
+	if nevra == "" {
+		logger.Log.Debugf("Skipping OCI artifact (%s), it has no '%s' annotation.", tag, OCIAnnotationNEVRA)
+		return
+	}
+
+	info, err := rpm.ParseNEVRA(nevra)
+	if err != nil {
+		return
+	}
+	if len(manifest.Layers) != 1 || !strings.HasPrefix(manifest.Layers[0].Digest, ociDigestSHA256) {
+		return fmt.Errorf("expected a single layer with a '%s' digest, found %d layer(s)", ociDigestSHA256, len(manifest.Layers))
+	}
+
+	evr := fmt.Sprintf("%s-%s", info.Version, info.Release)
+	if info.Epoch != "" {
+		evr = fmt.Sprintf("%s:%s", info.Epoch, evr)
+	}
+
+	o.packages[fmt.Sprintf("%s-%s-%s.%s", info.Name, info.Version, info.Release, info.Arch)] = ociPackage{
+		name:   info.Name,
+		evr:    evr,
+		digest: manifest.Layers[0].Digest,
+	}
+	return
+}
+
+// apiURL returns the URL of a registry API endpoint of the repository, e.g. "<registry>/v2/<repository>/tags/list".
+func (o *OCIRepo) apiURL(endpoint, reference string) string {
+	return fmt.Sprintf("%s/v2/%s/%s/%s", o.registryURL, o.repository, endpoint, reference)
+}
+
+// get sends an authenticated GET request. If the registry asks for a bearer token, one is requested from its token
+// service and the request is repeated. Fails unless the final response is '200 OK'.
+func (o *OCIRepo) get(requestURL, accept string) (response *http.Response, err error) {
+	response, err = o.send(requestURL, accept)
+	if err != nil {
+		return
+	}
+
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+		response.Body.Close()
+
+		err = o.requestToken(challenge)
+		if err != nil {
+			return nil, fmt.Errorf("failed to authenticate to (%s):\n%w", o.registryURL, err)
+		}
+
+		response, err = o.send(requestURL, accept)
+		if err != nil {
+			return
+		}
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("unexpected response to (%s): %s", requestURL, response.Status)
+	}
+	return
+}
+
+// send sends a GET request with the current token, or with basic authentication if there is none yet.
+func (o *OCIRepo) send(requestURL, accept string) (response *http.Response, err error) {
+	request, err := http.NewRequest(http.MethodGet, requestURL, nil)
+	if err != nil {
+		return
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+
+	o.lock.Lock()
+	token := o.token
+	o.lock.Unlock()
+
+	switch {
+	case token != "":
+		request.Header.Set("Authorization", "Bearer "+token)
+	case o.username != "":
+		request.SetBasicAuth(o.username, o.password)
+	}
+
+	return o.client.Do(request)
+}
+
+// requestToken answers a 'WWW-Authenticate: Bearer realm="...",service="...",scope="..."' challenge by requesting
+// a token from the realm.
+func (o *OCIRepo) requestToken(challenge string) (err error) {
+	const bearerPrefix = "bearer "
+
+	if !strings.HasPrefix(strings.ToLower(challenge), bearerPrefix) {
+		return fmt.Errorf("unsupported authentication challenge (%s)", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, match := range ociChallengeParamRegex.FindAllStringSubmatch(challenge[len(bearerPrefix):], -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return fmt.Errorf("authentication challenge (%s) has no realm", challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil {
+		return
+	}
+	query := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequest(http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return
+	}
+	if o.username != "" {
+		request.SetBasicAuth(o.username, o.password)
+	}
+
+	response, err := o.client.Do(request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("token service (%s) responded: %s", params["realm"], response.Status)
+	}
+
+	token := ociToken{}
+	err = json.NewDecoder(response.Body).Decode(&token)
+	if err != nil {
+		return fmt.Errorf("failed to parse the token:\n%w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("token service (%s) issued no token", params["realm"])
+	}
+
+	o.lock.Lock()
+	o.token = token.Token
+	o.lock.Unlock()
+	return
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+const testOCIToken = "test-token"
+
+// newTestOCIRegistry serves the artifacts, keyed by tag and holding an RPM's NEVRA and contents, from the repository
+// "mariner/rpms". Requests must use a bearer token issued for the 'builder' user.
+func newTestOCIRegistry(t *testing.T, artifacts map[string][2]string) (server *httptest.Server) {
+	const repoPrefix = "/v2/mariner/rpms/"
+
+	blobs := make(map[string]string)
+	manifests := make(map[string]string)
+	tags := []string{}
+	for tag, artifact := range artifacts {
+		hash := sha256.Sum256([]byte(artifact[1]))
+		digest := ociDigestSHA256 + hex.EncodeToString(hash[:])
+		blobs[digest] = artifact[1]
+
+		manifest, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     ociManifestMediaType,
+			"layers":        []map[string]string{{"mediaType": "application/x-rpm", "digest": digest}},
+			"annotations":   map[string]string{OCIAnnotationNEVRA: artifact[0]},
+		})
+		assert.NoError(t, err)
+		manifests[tag] = string(manifest)
+		tags = append(tags, tag)
+	}
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			username, password, _ := r.BasicAuth()
+			if username != "builder" || password != "secret" || r.URL.Query().Get("scope") != "repository:mariner/rpms:pull" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"token": %q}`, testOCIToken)
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer "+testOCIToken {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="test",scope="repository:mariner/rpms:pull"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, repoPrefix)
+		switch {
+		case path == "tags/list":
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": "mariner/rpms", "tags": tags})
+		case strings.HasPrefix(path, "manifests/") && manifests[strings.TrimPrefix(path, "manifests/")] != "":
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			fmt.Fprint(w, manifests[strings.TrimPrefix(path, "manifests/")])
+		case strings.HasPrefix(path, "blobs/") && blobs[strings.TrimPrefix(path, "blobs/")] != "":
+			fmt.Fprint(w, blobs[strings.TrimPrefix(path, "blobs/")])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return
+}
+
+func TestShouldResolveAndDownloadFromOCIRepo(t *testing.T) {
+	server := newTestOCIRegistry(t, map[string][2]string{
+		"internal-tool-1.2.0": {"internal-tool-1.2.0-1.cm2.x86_64", "old rpm"},
+		"internal-tool-2.0.0": {"internal-tool-1:2.0.0-1.cm2.x86_64", "new rpm"},
+	})
+
+	repo, err := ReadOCIRepo(server.URL+"/mariner/rpms", "builder", "secret")
+	assert.NoError(t, err)
+
+	packageNames, err := repo.WhatProvides(&pkgjson.PackageVer{Name: "internal-tool"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"internal-tool-2.0.0-1.cm2.x86_64", "internal-tool-1.2.0-1.cm2.x86_64"}, packageNames)
+
+	packageNames, err = repo.WhatProvides(&pkgjson.PackageVer{Name: "internal-tool", Condition: "<", Version: "1:0"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"internal-tool-1.2.0-1.cm2.x86_64"}, packageNames)
+
+	_, err = repo.WhatProvides(&pkgjson.PackageVer{Name: "other-tool"})
+	assert.ErrorIs(t, err, ErrPackageNotFound)
+
+	destinationDir := t.TempDir()
+	rpmPath, err := repo.Download("internal-tool-2.0.0-1.cm2.x86_64", destinationDir)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(destinationDir, "internal-tool-2.0.0-1.cm2.x86_64.rpm"), rpmPath)
+
+	contents, err := os.ReadFile(rpmPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "new rpm", string(contents))
+}
+
+func TestShouldFailOCIRepoWithWrongCredentials(t *testing.T) {
+	server := newTestOCIRegistry(t, map[string][2]string{})
+
+	_, err := ReadOCIRepo(server.URL+"/mariner/rpms", "builder", "wrong")
+	assert.Error(t, err)
+
+	_, err = ReadOCIRepo(server.URL, "builder", "secret")
+	assert.Error(t, err)
+}
@@ -0,0 +1,210 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+)
+
+// Options of repo files configuring the proxy TDNF downloads through.
+const (
+	repoOptionProxy         = "proxy"
+	repoOptionProxyUsername = "proxy_username"
+	repoOptionProxyPassword = "proxy_password"
+)
+
+// ProxyConfig describes the proxies the cloner reaches remote repos through.
+type ProxyConfig struct {
+	HTTPProxy  *url.URL // Proxy for 'http' repos, nil to connect directly. May hold the proxy's credentials.
+	HTTPSProxy *url.URL // Proxy for 'https' repos, nil to connect directly. May hold the proxy's credentials.
+	NoProxy    []string // Hosts reached directly. Entries also match their sub-domains, "*" matches all hosts.
+}
+
+// NewProxyConfig parses the proxy URLs and the comma separated list of hosts to reach directly.
+// Empty values fall back to the standard 'HTTP_PROXY', 'HTTPS_PROXY', and 'NO_PROXY' environment variables,
+// or their lowercase forms.
+func NewProxyConfig(httpProxy, httpsProxy, noProxy string) (config *ProxyConfig, err error) {
+	config = &ProxyConfig{}
+
+	config.HTTPProxy, err = parseProxyURL(valueOrEnv(httpProxy, "HTTP_PROXY"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP proxy:\n%w", err)
+	}
+
+	config.HTTPSProxy, err = parseProxyURL(valueOrEnv(httpsProxy, "HTTPS_PROXY"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTPS proxy:\n%w", err)
+	}
+
+	for _, host := range strings.Split(valueOrEnv(noProxy, "NO_PROXY"), ",") {
+		host = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if host != "" {
+			config.NoProxy = append(config.NoProxy, host)
+		}
+	}
+
+	return
+}
+
+// IsEnabled checks if any proxy is configured.
+func (c *ProxyConfig) IsEnabled() bool {
+	return c.HTTPProxy != nil || c.HTTPSProxy != nil
+}
+
+// proxyFor returns the proxy to reach 'target' through, nil to connect directly.
+func (c *ProxyConfig) proxyFor(target *url.URL) *url.URL {
+	if c.bypasses(target.Hostname()) {
+		return nil
+	}
+
+	switch target.Scheme {
+	case "http":
+		return c.HTTPProxy
+	case "https":
+		return c.HTTPSProxy
+	default:
+		return nil
+	}
+}
+
+// bypasses checks if 'host' is reached directly, without a proxy.
+func (c *ProxyConfig) bypasses(host string) bool {
+	host = strings.ToLower(host)
+	for _, noProxyHost := range c.NoProxy {
+		if noProxyHost == "*" || host == noProxyHost || strings.HasSuffix(host, "."+noProxyHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// transport returns an HTTP transport sending requests through the configured proxies.
+func (c *ProxyConfig) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(request *http.Request) (*url.URL, error) {
+		return c.proxyFor(request.URL), nil
+	}
+	return transport
+}
+
+// SetProxy makes the cloner reach remote repos through the proxies of 'config'. TDNF is configured through the
+// 'proxy' options of the repo files, so the repos must already be defined. Call it before SetRepoMirrors to also
+// probe the mirrors through the proxies.
+func (r *RpmRepoCloner) SetProxy(config *ProxyConfig) (err error) {
+	repoDir := filepath.Join(r.chroot.RootDir(), chrootRepoDir)
+	err = setRepoProxies(repoDir, config, r.isLocalRepoID)
+	if err != nil {
+		return
+	}
+
+	r.proxy = config
+	if r.mirrors != nil {
+		r.mirrors.client.Transport = r.mirrorProbeTransport()
+	}
+
+	return
+}
+
+// setRepoProxies sets the proxy options of each remote repo defined in the repo files under 'repoDir', based on the
+// scheme and host of its URL. Repos for which 'isLocalRepo' returns true are skipped.
+func setRepoProxies(repoDir string, config *ProxyConfig, isLocalRepo func(repoID string) bool) (err error) {
+	repoFiles, err := filepath.Glob(filepath.Join(repoDir, "*.repo"))
+	if err != nil {
+		return
+	}
+
+	for _, repoFilePath := range repoFiles {
+		var repoURLs map[string]*url.URL
+
+		repoURLs, err = readRepoFileURLs(repoFilePath)
+		if err != nil {
+			return
+		}
+
+		for repoID, repoURL := range repoURLs {
+			if repoURL == nil || isLocalRepo(repoID) {
+				continue
+			}
+
+			proxyURL := config.proxyFor(repoURL)
+			if proxyURL == nil {
+				continue
+			}
+
+			err = setRepoFileProxy(repoFilePath, repoID, proxyURL)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// setRepoFileProxy sets the proxy options of a repo defined in a repo file.
+// TDNF takes the proxy's credentials separately from its URL.
+func setRepoFileProxy(repoFilePath, repoID string, proxyURL *url.URL) (err error) {
+	proxyAddress := (&url.URL{Scheme: proxyURL.Scheme, Host: proxyURL.Host}).String()
+	logger.Log.Debugf("Reaching repo (%s) through proxy (%s).", repoID, proxyAddress)
+
+	_, err = setRepoFileOption(repoFilePath, repoID, repoOptionProxy, proxyAddress)
+	if err != nil || proxyURL.User == nil {
+		return
+	}
+
+	_, err = setRepoFileOption(repoFilePath, repoID, repoOptionProxyUsername, proxyURL.User.Username())
+	if err != nil {
+		return
+	}
+
+	password, _ := proxyURL.User.Password()
+	_, err = setRepoFileOption(repoFilePath, repoID, repoOptionProxyPassword, password)
+	return
+}
+
+// parseProxyURL parses a proxy URL, defaulting to the 'http' scheme when none is given. Returns nil for an empty URL.
+func parseProxyURL(rawURL string) (proxyURL *url.URL, err error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return nil, nil
+	}
+
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+
+	proxyURL, err = url.Parse(rawURL)
+	if err != nil {
+		// The parser's error repeats the whole URL, including any credentials.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("malformed proxy URL:\n%w", err)
+	}
+	if proxyURL.Hostname() == "" {
+		return nil, fmt.Errorf("proxy URL (%s) has no host", proxyURL.Redacted())
+	}
+
+	return
+}
+
+// valueOrEnv returns 'value', or the value of the environment variable 'name', or of its lowercase form, if empty.
+func valueOrEnv(value, name string) string {
+	if value != "" {
+		return value
+	}
+	if envValue := os.Getenv(name); envValue != "" {
+		return envValue
+	}
+	return os.Getenv(strings.ToLower(name))
+}
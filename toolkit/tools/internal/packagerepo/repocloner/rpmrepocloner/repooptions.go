@@ -0,0 +1,122 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/tdnf"
+)
+
+// Options of repo files set by the cloner.
+const (
+	repoOptionPriority = "priority"
+	repoOptionThrottle = "throttle"
+)
+
+// SetMaxDownloadBandwidth limits the download throughput from each remote repo to 'bytesPerSecond' by setting the
+// 'throttle' option of the repos. TDNF downloads one package at a time and the chroot runs a single TDNF at once,
+// so this also limits the combined throughput of all clones. Zero or less removes the limit.
+func (r *RpmRepoCloner) SetMaxDownloadBandwidth(bytesPerSecond int64) (err error) {
+	knownRepoIDs, err := r.definedRepoIDs()
+	if err != nil {
+		return
+	}
+
+	throttle := "0"
+	if bytesPerSecond > 0 {
+		throttle = strconv.FormatInt(bytesPerSecond, 10)
+	}
+
+	repoDir := filepath.Join(r.chroot.RootDir(), chrootRepoDir)
+	for repoID := range knownRepoIDs {
+		if r.isLocalRepoID(repoID) {
+			continue
+		}
+
+		logger.Log.Debugf("Limiting downloads from repo (%s) to %s bytes per second.", repoID, throttle)
+		err = setRepoOption(repoDir, repoID, repoOptionThrottle, throttle)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// setRepoOption sets an option of the repo with the given ID, defined in one of the repo files under 'repoDir'.
+// The repo's 'droppedOptions' are removed.
+func setRepoOption(repoDir, repoID, option, value string, droppedOptions ...string) (err error) {
+	repoFiles, err := filepath.Glob(filepath.Join(repoDir, "*.repo"))
+	if err != nil {
+		return
+	}
+
+	for _, repoFilePath := range repoFiles {
+		var found bool
+
+		found, err = setRepoFileOption(repoFilePath, repoID, option, value, droppedOptions...)
+		if err != nil || found {
+			return
+		}
+	}
+
+	return fmt.Errorf("no repo with ID (%s) under (%s)", repoID, repoDir)
+}
+
+// setRepoFileOption replaces an option of a repo in a single repo file, if it defines the repo,
+// and removes the repo's 'droppedOptions'.
+func setRepoFileOption(repoFilePath, repoID, option, value string, droppedOptions ...string) (found bool, err error) {
+	replacedOptions := []string{regexp.QuoteMeta(option)}
+	for _, droppedOption := range droppedOptions {
+		replacedOptions = append(replacedOptions, regexp.QuoteMeta(droppedOption))
+	}
+	optionRegex := regexp.MustCompile(fmt.Sprintf(`^\s*(?:%s)\s*=`, strings.Join(replacedOptions, "|")))
+
+	repoFile, err := os.Open(repoFilePath)
+	if err != nil {
+		return
+	}
+	defer repoFile.Close()
+
+	lines := []string{}
+	currentRepoID := ""
+	scanner := bufio.NewScanner(repoFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		idMatches := tdnf.RepoIDRegex.FindStringSubmatch(line)
+		if len(idMatches) > tdnf.RepoIDIndex {
+			currentRepoID = idMatches[tdnf.RepoIDIndex]
+			lines = append(lines, line)
+			if currentRepoID == repoID {
+				found = true
+				lines = append(lines, fmt.Sprintf("%s=%s", option, value))
+			}
+			continue
+		}
+
+		if currentRepoID == repoID && optionRegex.MatchString(line) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	err = scanner.Err()
+	if err != nil || !found {
+		return
+	}
+
+	repoFile.Close()
+	err = file.WriteLines(lines, repoFilePath)
+	return
+}
@@ -0,0 +1,61 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldReplaceRepoOption(t *testing.T) {
+	const repoFileContents = `[base]
+name=Base
+priority=50
+baseurl=https://primary.example.com/base/$basearch
+
+[extras]
+name=Extras
+priority=70
+`
+
+	repoDir := t.TempDir()
+	repoFilePath := filepath.Join(repoDir, "allrepos.repo")
+	err := os.WriteFile(repoFilePath, []byte(repoFileContents), 0644)
+	assert.NoError(t, err)
+
+	err = setRepoOption(repoDir, "base", repoOptionPriority, "10")
+	assert.NoError(t, err)
+
+	contents, err := os.ReadFile(repoFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, `[base]
+priority=10
+name=Base
+baseurl=https://primary.example.com/base/$basearch
+
+[extras]
+name=Extras
+priority=70
+`, string(contents))
+
+	err = setRepoOption(repoDir, "missing", repoOptionPriority, "10")
+	assert.Error(t, err)
+}
+
+func TestShouldAddMissingRepoOption(t *testing.T) {
+	repoDir := t.TempDir()
+	repoFilePath := filepath.Join(repoDir, "allrepos.repo")
+	err := os.WriteFile(repoFilePath, []byte("[base]\nname=Base\n\n[extras]\nname=Extras\n"), 0644)
+	assert.NoError(t, err)
+
+	err = setRepoOption(repoDir, "extras", repoOptionThrottle, "1048576")
+	assert.NoError(t, err)
+
+	contents, err := os.ReadFile(repoFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "[base]\nname=Base\n\n[extras]\nthrottle=1048576\nname=Extras\n", string(contents))
+}
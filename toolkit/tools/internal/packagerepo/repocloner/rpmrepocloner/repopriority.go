@@ -0,0 +1,154 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+)
+
+// DefaultRepoPriority is the priority TDNF gives to repos which do not set one.
+const DefaultRepoPriority = 50
+
+// SetRepoPriorities sets the priorities of some of the repos, keyed by repo ID. Like the 'priority' option of repo
+// files, a lower value means a higher priority. The priorities are written into the repo files, so TDNF downloads a
+// package offered by several repos from the one with the highest priority, and are used by PrioritizeCandidates.
+func (r *RpmRepoCloner) SetRepoPriorities(priorities map[string]int) (err error) {
+	knownRepoIDs, err := r.definedRepoIDs()
+	if err != nil {
+		return
+	}
+
+	for repoID := range priorities {
+		if !knownRepoIDs[repoID] {
+			return fmt.Errorf("a priority was given for an undefined repo (%s)", repoID)
+		}
+	}
+
+	repoDir := filepath.Join(r.chroot.RootDir(), chrootRepoDir)
+	for repoID, priority := range priorities {
+		logger.Log.Debugf("Using priority (%d) for repo (%s).", priority, repoID)
+		err = setRepoOption(repoDir, repoID, repoOptionPriority, strconv.Itoa(priority))
+		if err != nil {
+			return
+		}
+	}
+
+	r.repoPriorities = make(map[string]int, len(priorities))
+	for repoID, priority := range priorities {
+		r.repoPriorities[repoID] = priority
+	}
+	return
+}
+
+// UsePreviewRepoAsFallback gives the preview repo a lower priority than all other repos, so PrioritizeCandidates only
+// keeps its packages for nodes no other repo provides. The preview repo still has to be enabled with SetEnabledRepos.
+// Must be called after SetRepoPriorities, which replaces all priorities.
+func (r *RpmRepoCloner) UsePreviewRepoAsFallback() (err error) {
+	priority := fallbackRepoPriority(r.repoPriorities)
+
+	repoDir := filepath.Join(r.chroot.RootDir(), chrootRepoDir)
+	err = setRepoOption(repoDir, repoIDPreview, repoOptionPriority, strconv.Itoa(priority))
+	if err != nil {
+		return
+	}
+
+	logger.Log.Debugf("Using priority (%d) for the fallback preview repo (%s).", priority, repoIDPreview)
+	if r.repoPriorities == nil {
+		r.repoPriorities = make(map[string]int)
+	}
+	r.repoPriorities[repoIDPreview] = priority
+	return
+}
+
+// fallbackRepoPriority returns a priority lower than DefaultRepoPriority and all of 'priorities' except the preview
+// repo's own.
+func fallbackRepoPriority(priorities map[string]int) (priority int) {
+	lowestPriority := DefaultRepoPriority
+	for repoID, repoPriority := range priorities {
+		if repoID != repoIDPreview && repoPriority > lowestPriority {
+			lowestPriority = repoPriority
+		}
+	}
+	return lowestPriority + 1
+}
+
+// PrioritizeCandidates keeps only the candidates providing 'pkgVer' offered by the repo with the highest priority,
+// so versions from repos with a lower priority are never compared against them. Candidates offered only by the
+// local toolchain, built, or cache repos are always kept. The candidates are returned unchanged if no repo
+// priorities were set with SetRepoPriorities.
+func (r *RpmRepoCloner) PrioritizeCandidates(pkgVer *pkgjson.PackageVer, candidates []string) (prioritizedCandidates []string, err error) {
+	if len(r.repoPriorities) == 0 || len(candidates) < 2 {
+		return candidates, nil
+	}
+
+	packagesByRepo, err := r.WhatProvidesByRepo(pkgVer)
+	if err != nil {
+		return
+	}
+
+	prioritizedCandidates, sourceRepos := prioritizeCandidates(candidates, packagesByRepo, r.repoPriorities)
+	for _, candidate := range prioritizedCandidates {
+		if repoID, found := sourceRepos[candidate]; found {
+			logger.Log.Debugf("'%s' for '%s' is preferred from repo (%s).", candidate, pkgVer.Name, repoID)
+		}
+	}
+	return
+}
+
+// prioritizeCandidates finds the repo with the highest priority offering each candidate and keeps the candidates
+// offered by the repos with the highest priority of all, in their original order. Candidates missing from
+// 'packagesByRepo' come from local repos and take precedence over any remote one. Repos without a priority in
+// 'priorities' use DefaultRepoPriority, ties between repos are broken by repo ID.
+func prioritizeCandidates(candidates []string, packagesByRepo map[string][]string, priorities map[string]int) (prioritizedCandidates []string, sourceRepos map[string]string) {
+	repoIDs := make([]string, 0, len(packagesByRepo))
+	for repoID := range packagesByRepo {
+		repoIDs = append(repoIDs, repoID)
+	}
+	sort.Strings(repoIDs)
+
+	sourceRepos = make(map[string]string)
+	sourcePriorities := make(map[string]int)
+	for _, repoID := range repoIDs {
+		priority, found := priorities[repoID]
+		if !found {
+			priority = DefaultRepoPriority
+		}
+
+		for _, packageName := range packagesByRepo[repoID] {
+			if bestPriority, found := sourcePriorities[packageName]; found && bestPriority <= priority {
+				continue
+			}
+			sourcePriorities[packageName] = priority
+			sourceRepos[packageName] = repoID
+		}
+	}
+
+	candidatePriority := func(candidate string) int {
+		if priority, found := sourcePriorities[candidate]; found {
+			return priority
+		}
+		return math.MinInt
+	}
+
+	highestPriority := math.MaxInt
+	for _, candidate := range candidates {
+		if priority := candidatePriority(candidate); priority < highestPriority {
+			highestPriority = priority
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidatePriority(candidate) == highestPriority {
+			prioritizedCandidates = append(prioritizedCandidates, candidate)
+		}
+	}
+	return
+}
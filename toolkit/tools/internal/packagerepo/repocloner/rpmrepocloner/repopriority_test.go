@@ -0,0 +1,68 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldChooseCopyFromHigherPriorityRepo(t *testing.T) {
+	candidates := []string{"bash-5.2.15-1.cm2.x86_64", "bash-5.1.8-2.cm2.x86_64"}
+	packagesByRepo := map[string][]string{
+		"upstream": {"bash-5.2.15-1.cm2.x86_64", "bash-5.1.8-2.cm2.x86_64"},
+		"internal": {"bash-5.1.8-2.cm2.x86_64"},
+	}
+
+	prioritized, sourceRepos := prioritizeCandidates(candidates, packagesByRepo, map[string]int{"internal": 10})
+	assert.Equal(t, []string{"bash-5.1.8-2.cm2.x86_64"}, prioritized)
+	assert.Equal(t, "internal", sourceRepos["bash-5.1.8-2.cm2.x86_64"])
+
+	// Without priorities all repos are equal, the versions decide.
+	prioritized, sourceRepos = prioritizeCandidates(candidates, packagesByRepo, map[string]int{})
+	assert.Equal(t, candidates, prioritized)
+	assert.Equal(t, "internal", sourceRepos["bash-5.1.8-2.cm2.x86_64"])
+
+	// A lower priority for the internal repo leaves its copy to the upstream one.
+	_, sourceRepos = prioritizeCandidates(candidates, packagesByRepo, map[string]int{"internal": 90})
+	assert.Equal(t, "upstream", sourceRepos["bash-5.1.8-2.cm2.x86_64"])
+}
+
+func TestShouldAlwaysKeepLocalCandidates(t *testing.T) {
+	candidates := []string{"zlib-1.2.13-1.cm2.x86_64", "zlib-1.2.12-1.cm2.x86_64"}
+	packagesByRepo := map[string][]string{
+		"internal": {"zlib-1.2.12-1.cm2.x86_64"},
+	}
+
+	prioritized, _ := prioritizeCandidates(candidates, packagesByRepo, map[string]int{"internal": 1})
+	assert.Equal(t, []string{"zlib-1.2.13-1.cm2.x86_64"}, prioritized)
+}
+
+func TestShouldOnlyFallBackToPreviewRepo(t *testing.T) {
+	priorities := map[string]int{"internal": 10, "upstream": 90}
+	priorities[repoIDPreview] = fallbackRepoPriority(priorities)
+	assert.Equal(t, 91, priorities[repoIDPreview])
+
+	// The stable copy is chosen even though the preview one is newer.
+	candidates := []string{"cmake-3.27.2-1.cm2.x86_64", "cmake-3.21.4-3.cm2.x86_64"}
+	packagesByRepo := map[string][]string{
+		repoIDPreview: {"cmake-3.27.2-1.cm2.x86_64"},
+		"upstream":    {"cmake-3.21.4-3.cm2.x86_64"},
+	}
+	prioritized, sourceRepos := prioritizeCandidates(candidates, packagesByRepo, priorities)
+	assert.Equal(t, []string{"cmake-3.21.4-3.cm2.x86_64"}, prioritized)
+	assert.Equal(t, "upstream", sourceRepos["cmake-3.21.4-3.cm2.x86_64"])
+
+	// Packages only the preview repo provides are still used.
+	candidates = []string{"rust-1.72.0-1.cm2.x86_64"}
+	packagesByRepo = map[string][]string{
+		repoIDPreview: {"rust-1.72.0-1.cm2.x86_64"},
+	}
+	prioritized, sourceRepos = prioritizeCandidates(candidates, packagesByRepo, priorities)
+	assert.Equal(t, candidates, prioritized)
+	assert.Equal(t, repoIDPreview, sourceRepos["rust-1.72.0-1.cm2.x86_64"])
+
+	assert.Equal(t, DefaultRepoPriority+1, fallbackRepoPriority(nil))
+}
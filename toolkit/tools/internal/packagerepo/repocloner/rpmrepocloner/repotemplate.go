@@ -0,0 +1,66 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
+)
+
+// repoTemplateVariableRegex matches the '${NAME}' environment variable references of repo file templates.
+var repoTemplateVariableRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// tdnfRepoVariables are substituted by TDNF itself, so their references are left untouched.
+var tdnfRepoVariables = map[string]bool{
+	"arch":       true,
+	"basearch":   true,
+	"releasever": true,
+}
+
+// readRepoTemplate reads a repo file, replacing its '${NAME}' references with the values of the environment variables.
+// References without braces, like '$basearch', are left for TDNF.
+func readRepoTemplate(repoFilePath string) (contents string, err error) {
+	template, err := os.ReadFile(repoFilePath)
+	if err != nil {
+		return
+	}
+
+	contents, err = expandRepoTemplate(string(template), os.LookupEnv)
+	if err != nil {
+		err = fmt.Errorf("failed to expand repo file template (%s):\n%w", repoFilePath, err)
+	}
+	return
+}
+
+// expandRepoTemplate replaces the '${NAME}' references in 'template' with the values returned by 'lookupEnv'.
+// Referencing an undefined variable is an error, instead of silently expanding it to an empty string.
+func expandRepoTemplate(template string, lookupEnv func(string) (string, bool)) (contents string, err error) {
+	undefinedVariables := make(map[string]bool)
+	contents = repoTemplateVariableRegex.ReplaceAllStringFunc(template, func(reference string) string {
+		name := repoTemplateVariableRegex.FindStringSubmatch(reference)[1]
+		if tdnfRepoVariables[name] {
+			return reference
+		}
+
+		value, found := lookupEnv(name)
+		if !found {
+			undefinedVariables[name] = true
+			return reference
+		}
+		return value
+	})
+
+	if len(undefinedVariables) > 0 {
+		names := sliceutils.SetToSlice(undefinedVariables)
+		sort.Strings(names)
+		err = fmt.Errorf("undefined environment variable(s): %s", strings.Join(names, ", "))
+	}
+
+	return
+}
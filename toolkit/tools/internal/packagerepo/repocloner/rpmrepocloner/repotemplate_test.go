@@ -0,0 +1,74 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const templateRepoFile = `[regional-mirror]
+name=Regional mirror
+baseurl=${TEST_REPO_MIRROR}/base/$basearch
+gpgkey=file:///etc/pki/rpm-gpg/MICROSOFT-RPM-GPG-KEY ${releasever}
+enabled=1
+`
+
+func TestShouldExpandEnvironmentInRepoTemplate(t *testing.T) {
+	t.Setenv("TEST_REPO_MIRROR", "https://westus.mirror.example.com/cbl-mariner/2.0")
+
+	repoFilePath := filepath.Join(t.TempDir(), "regional.repo")
+	assert.NoError(t, os.WriteFile(repoFilePath, []byte(templateRepoFile), 0644))
+
+	allReposPath := filepath.Join(t.TempDir(), "allrepos.repo")
+	dstFile, err := os.Create(allReposPath)
+	assert.NoError(t, err)
+	defer dstFile.Close()
+
+	const expandTemplate = true
+	assert.NoError(t, appendRepoFile(repoFilePath, dstFile, expandTemplate))
+
+	repoConfig, err := os.ReadFile(allReposPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(repoConfig), "baseurl=https://westus.mirror.example.com/cbl-mariner/2.0/base/$basearch\n")
+	// TDNF's own variables are left for TDNF to substitute.
+	assert.Contains(t, string(repoConfig), "MICROSOFT-RPM-GPG-KEY ${releasever}\n")
+}
+
+func TestShouldFailRepoTemplateWithUndefinedVariables(t *testing.T) {
+	lookupEnv := func(name string) (string, bool) {
+		if name == "DEFINED" {
+			return "", true
+		}
+		return "", false
+	}
+
+	_, err := expandRepoTemplate("baseurl=${ZONE_MIRROR}/${DEFINED}/${REGION_MIRROR}/${ZONE_MIRROR}", lookupEnv)
+	assert.EqualError(t, err, "undefined environment variable(s): REGION_MIRROR, ZONE_MIRROR")
+
+	// Empty, but defined, variables are allowed.
+	contents, err := expandRepoTemplate("baseurl=https://mirror${DEFINED}.example.com", lookupEnv)
+	assert.NoError(t, err)
+	assert.Equal(t, "baseurl=https://mirror.example.com", contents)
+}
+
+func TestShouldKeepLiteralRepoFileWithoutTemplating(t *testing.T) {
+	repoFilePath := filepath.Join(t.TempDir(), "literal.repo")
+	assert.NoError(t, os.WriteFile(repoFilePath, []byte(templateRepoFile), 0644))
+
+	allReposPath := filepath.Join(t.TempDir(), "allrepos.repo")
+	dstFile, err := os.Create(allReposPath)
+	assert.NoError(t, err)
+	defer dstFile.Close()
+
+	const expandTemplate = false
+	assert.NoError(t, appendRepoFile(repoFilePath, dstFile, expandTemplate))
+
+	repoConfig, err := os.ReadFile(allReposPath)
+	assert.NoError(t, err)
+	assert.Equal(t, templateRepoFile+"\n", string(repoConfig))
+}
@@ -5,13 +5,19 @@ package rpmrepocloner
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/buildpipeline"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repomanager/rpmrepomanager"
@@ -22,6 +28,10 @@ import (
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
 )
 
+// ErrPackageNotFound is wrapped by the errors returned when none of the enabled repos offers a requested package.
+// Unlike other clone failures it is not transient, so callers should not retry it.
+var ErrPackageNotFound = errors.New("package not found")
+
 // RepoFlag* flags are used to denote which repos the cloner is allowed to use for its queries.
 const (
 	RepoFlagMarinerDefaults = uint64(1) << iota // External default Mariner repos pre-installed in the chroot.
@@ -31,6 +41,8 @@ const (
 	RepoFlagToolchain                           // Local repo with the toolchain packages.
 	RepoFlagUpstream                            // Separate flag to control the use of all upstream packages repositories.
 
+	// A compound flag enabling all local repositories, which need no network access.
+	RepoFlagLocal = RepoFlagToolchain | RepoFlagLocalBuilds | RepoFlagDownloadedCache
 	// A compound flag enabling all supported repositories.
 	RepoFlagAll = RepoFlagToolchain | RepoFlagLocalBuilds | RepoFlagDownloadedCache | RepoFlagPreview | RepoFlagMarinerDefaults | RepoFlagUpstream
 )
@@ -45,17 +57,50 @@ const (
 	repoIDCacheRegular   = "fetcher-cloned-repo"
 	repoIDPreview        = "mariner-preview"
 	repoIDToolchain      = "toolchain-repo"
+
+	chrootRpmmdSnapshotDir = "/rpmmdsnapshot"
+	repoIDSnapshotPrefix   = "rpmmd-snapshot-"
+
+	chrootRepoDir = "/etc/yum.repos.d/"
+
+	chrootCABundleFile = "/etc/pki/tls/certs/ca-bundle.crt"
+
+	chrootTLSClientCertFile = "/etc/tdnf/mariner_user.crt"
+	chrootTLSClientKeyFile  = "/etc/tdnf/mariner_user.key"
 )
 
+// ClonedPackage describes an RPM file added to the clone directory by the cloner.
+type ClonedPackage struct {
+	Size     int64  // Size of the RPM file in bytes
+	Prebuilt bool   // Copied from the local toolchain or built packages instead of being downloaded
+	Repo     string // ID of the repo TDNF cloned the RPM from, empty if unknown
+}
+
 // RpmRepoCloner represents an RPM repository cloner.
 type RpmRepoCloner struct {
-	chroot                *safechroot.Chroot
-	chrootCloneDir        string
-	defaultMarinerRepoIDs []string
-	mountedCloneDir       string
-	repoIDCache           string
-	reposArgsList         [][]string
-	reposFlags            uint64
+	batchProvides             batchProvidesBackend
+	chroot                    *safechroot.Chroot
+	clonedPackages            map[string]ClonedPackage
+	chrootCloneDir            string
+	defaultMarinerRepoIDs     []string
+	keepTmpDir                bool
+	maxMetadataRefreshPerHost int
+	metadataCache             *MetadataCache
+	metadataLoaded            bool       // The remote repos' metadata was loaded from the metadata cache
+	metadataLock              sync.Mutex // Guards loading the metadata from the metadata cache
+	mirrors                   *repoMirrors
+	mountedCloneDir           string
+	offline                   bool
+	proxy                     *ProxyConfig
+	repoIDCache               string
+	repoPriorities            map[string]int
+	reposArgsList             [][]string
+	reposFlags                uint64
+	rpmmdSnapshotDir          string
+	snapshotRepoIDs           []string
+	tlsConfig                 *tls.Config // TLS configuration matching the network files given to the chroot
+	tmpDir                    string
+	tmpDirLock                *os.File // Held while the chroot uses 'tmpDir', nil if the cloner does not own it
 }
 
 // ConstructCloner constructs a new RpmRepoCloner.
@@ -66,24 +111,65 @@ type RpmRepoCloner struct {
 //   - prebuiltRpmsDir is the directory with toolchain RPMs
 //   - tlsCert is the path to the TLS certificate, "" if not needed
 //   - tlsKey is the path to the TLS key, "" if not needed
+//   - caBundle is the path to additional CA certificates trusted when verifying HTTPS repos, "" if not needed
 //   - repoDefinitions is a list of repo files to use
-func ConstructCloner(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir, tlsCert, tlsKey string, repoDefinitions []string) (r *RpmRepoCloner, err error) {
+//   - expandRepoTemplates replaces '${VAR}' references in the repo files with the values of the environment variables
+//   - rpmmdSnapshotDir is a directory of captured repositories (each sub-directory holding RPMs and their 'repodata'),
+//     which will replace all remote repositories if set. "" if not needed
+//   - maxMetadataRefreshPerHost is the maximum number of repos refreshing their metadata from the same host at once,
+//     0 to refresh all repos with a single 'tdnf makecache' call
+//   - metadataCache keeps the remote repos' metadata between cloners, nil to always download it
+func ConstructCloner(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir, tlsCert, tlsKey, caBundle string, repoDefinitions []string, expandRepoTemplates bool, rpmmdSnapshotDir string, maxMetadataRefreshPerHost int, metadataCache *MetadataCache) (r *RpmRepoCloner, err error) {
 	timestamp.StartEvent("initialize and configure cloner", nil)
 	defer timestamp.StopEvent(nil) // initialize and configure cloner
 
-	r = &RpmRepoCloner{}
-	err = r.initialize(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir, repoDefinitions)
+	r = &RpmRepoCloner{
+		clonedPackages:            make(map[string]ClonedPackage),
+		maxMetadataRefreshPerHost: maxMetadataRefreshPerHost,
+		metadataCache:             metadataCache,
+	}
+	err = r.initialize(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir, repoDefinitions, expandRepoTemplates, rpmmdSnapshotDir)
 	if err != nil {
 		err = fmt.Errorf("failed to prep new rpm cloner:\n%w", err)
 	}
 
-	tlsKey, tlsCert = strings.TrimSpace(tlsKey), strings.TrimSpace(tlsCert)
-	err = r.addNetworkFiles(tlsCert, tlsKey)
+	tlsKey, tlsCert, caBundle = strings.TrimSpace(tlsKey), strings.TrimSpace(tlsCert), strings.TrimSpace(caBundle)
+	err = r.addNetworkFiles(tlsCert, tlsKey, caBundle)
 	if err != nil {
 		err = fmt.Errorf("failed to customize RPM repo cloner. Error:\n%w", err)
 		return
 	}
 
+	r.tlsConfig, err = newClientTLSConfig(tlsCert, tlsKey, caBundle)
+	if err != nil {
+		err = fmt.Errorf("failed to customize RPM repo cloner. Error:\n%w", err)
+		return
+	}
+
+	return
+}
+
+// ConstructLocalCloner constructs a new RpmRepoCloner which never accesses the network. Packages are only resolved
+// from the toolchain, built, and already downloaded RPMs, no remote repo is ever enabled or refreshed.
+//   - destinationDir is the directory to save RPMs
+//   - tmpDir is the directory to create a chroot
+//   - workerTar is the path to the worker tar used to seed the chroot
+//   - existingRpmsDir is the directory with prebuilt RPMs
+//   - prebuiltRpmsDir is the directory with toolchain RPMs
+func ConstructLocalCloner(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir string) (r *RpmRepoCloner, err error) {
+	timestamp.StartEvent("initialize and configure local cloner", nil)
+	defer timestamp.StopEvent(nil) // initialize and configure local cloner
+
+	r = &RpmRepoCloner{
+		clonedPackages: make(map[string]ClonedPackage),
+		offline:        true,
+	}
+	const expandRepoTemplates = false
+	err = r.initialize(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir, []string{}, expandRepoTemplates, "")
+	if err != nil {
+		err = fmt.Errorf("failed to prep new local rpm cloner:\n%w", err)
+	}
+
 	return
 }
 
@@ -94,7 +180,9 @@ func ConstructCloner(destinationDir, tmpDir, workerTar, existingRpmsDir, toolcha
 //   - existingRpmsDir is the directory with prebuilt RPMs
 //   - prebuiltRpmsDir is the directory with toolchain RPMs
 //   - repoDefinitions is a list of repo files to use when cloning RPMs
-func (r *RpmRepoCloner) initialize(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir string, repoDefinitions []string) (err error) {
+//   - expandRepoTemplates replaces '${VAR}' references in the repo files with the values of the environment variables
+//   - rpmmdSnapshotDir is an optional directory of captured repositories replacing all remote repositories
+func (r *RpmRepoCloner) initialize(destinationDir, tmpDir, workerTar, existingRpmsDir, toolchainRpmsDir string, repoDefinitions []string, expandRepoTemplates bool, rpmmdSnapshotDir string) (err error) {
 	const (
 		isExistingDir          = false
 		leaveChrootFilesOnDisk = false
@@ -124,6 +212,10 @@ func (r *RpmRepoCloner) initialize(destinationDir, tmpDir, workerTar, existingRp
 					logger.Log.Panicf("Unable to close chroot on failed initialization. Error: %s", closeErr)
 				}
 			}
+			releaseErr := r.releaseTmpDir()
+			if releaseErr != nil {
+				logger.Log.Warnf("Failed to release the tmp dir on failed initialization. Error: %s", releaseErr)
+			}
 		}
 	}()
 
@@ -134,6 +226,16 @@ func (r *RpmRepoCloner) initialize(destinationDir, tmpDir, workerTar, existingRp
 		return
 	}
 
+	// The chroot is created in 'tmpDir' itself, so no other run may use it at the same time.
+	// Docker based builds take their chroots from a pool instead.
+	if buildpipeline.IsRegularBuild() {
+		r.tmpDir = tmpDir
+		r.tmpDirLock, err = lockTmpDir(tmpDir)
+		if err != nil {
+			return
+		}
+	}
+
 	// Setup the chroot
 	logger.Log.Infof("Creating cloning environment to populate (%s)", destinationDir)
 	r.chroot = safechroot.NewChroot(tmpDir, isExistingDir)
@@ -159,6 +261,24 @@ func (r *RpmRepoCloner) initialize(destinationDir, tmpDir, workerTar, existingRp
 	extraMountPoints = append(extraMountPoints, toolchainRpmsOverlayMount)
 	overlayExtraDirs = append(overlayExtraDirs, toolchainRpmsOverlayExtraDirs...)
 
+	// Include the captured repositories snapshot, if any.
+	r.rpmmdSnapshotDir = strings.TrimSpace(rpmmdSnapshotDir)
+	if r.rpmmdSnapshotDir != "" {
+		extraMountPoints = append(extraMountPoints, safechroot.NewMountPoint(rpmmdSnapshotDir, chrootRpmmdSnapshotDir, bindFsType, safechroot.BindMountPointFlags, bindData))
+	}
+
+	// Remote repos' metadata is only cached if there are remote repos to begin with.
+	if r.metadataCache != nil && (r.offline || r.rpmmdSnapshotDir != "") {
+		r.metadataCache = nil
+	}
+	if r.metadataCache != nil {
+		err = os.MkdirAll(r.metadataCache.Dir, os.ModePerm)
+		if err != nil {
+			return fmt.Errorf("failed to create the metadata cache dir (%s):\n%w", r.metadataCache.Dir, err)
+		}
+		extraMountPoints = append(extraMountPoints, safechroot.NewMountPoint(r.metadataCache.Dir, chrootMetadataCacheDir, bindFsType, safechroot.BindMountPointFlags, bindData))
+	}
+
 	// Also request that /overlaywork is created before any chroot mounts happen so the overlay can
 	// be created successfully
 	err = r.chroot.Initialize(workerTar, overlayExtraDirs, extraMountPoints)
@@ -181,7 +301,7 @@ func (r *RpmRepoCloner) initialize(destinationDir, tmpDir, workerTar, existingRp
 	}
 
 	logger.Log.Info("Initializing repository configurations")
-	err = r.initializeRepoDefinitions(repoDefinitions)
+	err = r.initializeRepoDefinitions(repoDefinitions, expandRepoTemplates)
 	if err != nil {
 		return
 	}
@@ -195,34 +315,74 @@ func (r *RpmRepoCloner) initialize(destinationDir, tmpDir, workerTar, existingRp
 		r.repoIDCache = repoIDCacheRegular
 	}
 
+	if r.rpmmdSnapshotDir != "" {
+		err = r.initializeSnapshotRepoDefinitions(r.rpmmdSnapshotDir)
+		if err != nil {
+			return
+		}
+	}
+
 	r.SetEnabledRepos(repoFlagClonerDefault)
 
 	return
 }
 
 // addNetworkFiles adds files needed for networking capabilities into the cloner.
-// tlsClientCert and tlsClientKey are optional.
-func (r *RpmRepoCloner) addNetworkFiles(tlsClientCert, tlsClientKey string) (err error) {
+// tlsClientCert, tlsClientKey, and caBundle are optional.
+func (r *RpmRepoCloner) addNetworkFiles(tlsClientCert, tlsClientKey, caBundle string) (err error) {
 	files := []safechroot.FileToCopy{
 		{Src: "/etc/resolv.conf", Dest: "/etc/resolv.conf"},
 	}
 
 	if tlsClientCert != "" && tlsClientKey != "" {
 		tlsFiles := []safechroot.FileToCopy{
-			{Src: tlsClientCert, Dest: "/etc/tdnf/mariner_user.crt"},
-			{Src: tlsClientKey, Dest: "/etc/tdnf/mariner_user.key"},
+			{Src: tlsClientCert, Dest: chrootTLSClientCertFile},
+			{Src: tlsClientKey, Dest: chrootTLSClientKeyFile},
 		}
 
 		files = append(files, tlsFiles...)
 	}
 
 	err = r.chroot.AddFiles(files...)
+	if err != nil {
+		return
+	}
+
+	if caBundle != "" {
+		err = addTrustedCABundle(caBundle, filepath.Join(r.chroot.RootDir(), chrootCABundleFile))
+	}
+
+	return
+}
+
+// addTrustedCABundle appends the certificates from 'caBundle' to the system trust store at 'trustStorePath',
+// so HTTPS repos signed by a private CA can be verified without losing trust in the public CAs.
+func addTrustedCABundle(caBundle, trustStorePath string) (err error) {
+	certificates, err := os.ReadFile(caBundle)
+	if err != nil {
+		return fmt.Errorf("failed to read CA bundle (%s):\n%w", caBundle, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(trustStorePath), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	trustStore, err := os.OpenFile(trustStorePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer trustStore.Close()
+
+	logger.Log.Infof("Trusting CA certificates from (%s) inside the cloner.", caBundle)
+	// Guard against the existing trust store not ending with a new line.
+	_, err = trustStore.WriteString("\n" + string(certificates) + "\n")
 	return
 }
 
 // initializeRepoDefinitions will configure the chroot's repo files to match those
-// provided by the caller.
-func (r *RpmRepoCloner) initializeRepoDefinitions(repoDefinitions []string) (err error) {
+// provided by the caller. If 'expandTemplates' is set, environment variable references in them are expanded.
+func (r *RpmRepoCloner) initializeRepoDefinitions(repoDefinitions []string, expandTemplates bool) (err error) {
 	// ============== TDNF SPECIFIC IMPLEMENTATION ==============
 	// Unlike some other package managers, TDNF has no notion of repository priority.
 	// It reads the repo files using `readdir`, which should be assumed to be random ordering.
@@ -230,10 +390,7 @@ func (r *RpmRepoCloner) initializeRepoDefinitions(repoDefinitions []string) (err
 	// In order to simulate repository priority, concatenate all requested repofiles into a single file.
 	// TDNF will read the file top-down. It will then parse the results into a linked list, meaning
 	// the first repo entry in the file is the first to be checked.
-	const (
-		chrootRepoDir  = "/etc/yum.repos.d/"
-		chrootRepoFile = "allrepos.repo"
-	)
+	const chrootRepoFile = "allrepos.repo"
 
 	fullRepoDirPath := filepath.Join(r.chroot.RootDir(), chrootRepoDir)
 	fullRepoFilePath := filepath.Join(fullRepoDirPath, chrootRepoFile)
@@ -262,7 +419,7 @@ func (r *RpmRepoCloner) initializeRepoDefinitions(repoDefinitions []string) (err
 	// Append all repo files together into a single repo file.
 	// Assume the order of repoDefinitions indicates their relative priority.
 	for _, repoFilePath := range repoDefinitions {
-		err = appendRepoFile(repoFilePath, dstFile)
+		err = appendRepoFile(repoFilePath, dstFile, expandTemplates)
 		if err != nil {
 			return
 		}
@@ -278,7 +435,9 @@ func (r *RpmRepoCloner) initializeRepoDefinitions(repoDefinitions []string) (err
 		}
 		r.defaultMarinerRepoIDs = append(r.defaultMarinerRepoIDs, repoIDs...)
 
-		err = appendRepoFile(originalRepoFilePath, dstFile)
+		// The chroot's own repo files are never templates.
+		const expandChrootRepoTemplate = false
+		err = appendRepoFile(originalRepoFilePath, dstFile, expandChrootRepoTemplate)
 		if err != nil {
 			return err
 		}
@@ -291,18 +450,91 @@ func (r *RpmRepoCloner) initializeRepoDefinitions(repoDefinitions []string) (err
 	return
 }
 
-func appendRepoFile(repoFilePath string, dstFile *os.File) (err error) {
-	repoFile, err := os.Open(repoFilePath)
+// initializeSnapshotRepoDefinitions adds a local repository definition for each captured repository found in the snapshot
+// directory. Once defined, the snapshot repositories are the only remote repositories the cloner will use.
+func (r *RpmRepoCloner) initializeSnapshotRepoDefinitions(rpmmdSnapshotDir string) (err error) {
+	const chrootSnapshotRepoFile = "rpmmdsnapshot.repo"
+
+	repoIDs, repoDefinitions, err := snapshotRepoDefinitions(rpmmdSnapshotDir)
 	if err != nil {
 		return
 	}
-	defer repoFile.Close()
+	r.snapshotRepoIDs = repoIDs
 
-	_, err = io.Copy(dstFile, repoFile)
+	err = file.Write(repoDefinitions, filepath.Join(r.chroot.RootDir(), chrootRepoDir, chrootSnapshotRepoFile))
 	if err != nil {
 		return
 	}
 
+	return r.chroot.Run(r.refreshPackagesCache)
+}
+
+// snapshotRepoDefinitions returns the IDs and the repo file contents of the captured repositories found in the
+// snapshot directory. Sub-directories without repo metadata are skipped.
+func snapshotRepoDefinitions(rpmmdSnapshotDir string) (repoIDs []string, repoDefinitionsContents string, err error) {
+	snapshotEntries, err := os.ReadDir(rpmmdSnapshotDir)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read the rpmmd snapshot directory '%s':\n%w", rpmmdSnapshotDir, err)
+	}
+
+	repoDefinitions := strings.Builder{}
+	for _, entry := range snapshotEntries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		exists, err := file.PathExists(filepath.Join(rpmmdSnapshotDir, entry.Name(), RepoMetadataFile))
+		if err != nil {
+			return nil, "", err
+		}
+		if !exists {
+			logger.Log.Warnf("Skipping rpmmd snapshot directory '%s', it has no '%s'.", entry.Name(), RepoMetadataFile)
+			continue
+		}
+
+		repoID := repoIDSnapshotPrefix + entry.Name()
+		repoIDs = append(repoIDs, repoID)
+		logger.Log.Debugf("Found rpmmd snapshot repo: %s", repoID)
+
+		repoDefinitions.WriteString(fmt.Sprintf("[%s]\n", repoID))
+		repoDefinitions.WriteString(fmt.Sprintf("name=%s\n", repoID))
+		repoDefinitions.WriteString(fmt.Sprintf("baseurl=file://%s\n", filepath.Join(chrootRpmmdSnapshotDir, entry.Name())))
+		repoDefinitions.WriteString("enabled=1\ngpgcheck=0\nskip_if_unavailable=0\n\n")
+	}
+
+	if len(repoIDs) == 0 {
+		return nil, "", fmt.Errorf("no repositories found in the rpmmd snapshot directory '%s'", rpmmdSnapshotDir)
+	}
+
+	return repoIDs, repoDefinitions.String(), nil
+}
+
+func appendRepoFile(repoFilePath string, dstFile *os.File, expandTemplate bool) (err error) {
+	if expandTemplate {
+		var contents string
+		contents, err = readRepoTemplate(repoFilePath)
+		if err != nil {
+			return
+		}
+
+		_, err = dstFile.WriteString(contents)
+		if err != nil {
+			return
+		}
+	} else {
+		var repoFile *os.File
+		repoFile, err = os.Open(repoFilePath)
+		if err != nil {
+			return
+		}
+		defer repoFile.Close()
+
+		_, err = io.Copy(dstFile, repoFile)
+		if err != nil {
+			return
+		}
+	}
+
 	// Append a new line
 	_, err = dstFile.WriteString("\n")
 	return
@@ -331,12 +563,19 @@ func (r *RpmRepoCloner) initializeMountedChrootRepo(repoDir string) (err error)
 // It will automatically resolve packages that describe a provide or file from a package.
 // If all packages were pre-built, the cloner will set allPackagesPrebuilt = true.
 func (r *RpmRepoCloner) Clone(cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, err error) {
+	allPackagesPrebuilt, _, err = r.CloneAndListPackages(cloneDeps, packagesToClone...)
+	return
+}
+
+// CloneAndListPackages clones the packages like Clone and also returns the RPM files of all packages the clone needed,
+// including the dependencies already in the clone directory, each mapped to the ID of the repo it was resolved from.
+func (r *RpmRepoCloner) CloneAndListPackages(cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
 	packageNames := []string{}
 	for _, packageToClone := range packagesToClone {
 		logger.Log.Debugf("Cloning (%s).", packageToClone)
 		packageNames = append(packageNames, convertPackageVersionToTdnfArg(packageToClone))
 	}
-	return r.CloneRawPackageNames(cloneDeps, packageNames...)
+	return r.cloneRawPackageNames(cloneDeps, packageNames...)
 }
 
 // CloneRawPackageNames clones the provided package name exactly as specified.
@@ -344,6 +583,13 @@ func (r *RpmRepoCloner) Clone(cloneDeps bool, packagesToClone ...*pkgjson.Packag
 // This version of clone will not resolve provides or files from other packages beyond what tdnf is able to do itself.
 // If all packages were pre-built, the cloner will set allPackagesPrebuilt = true.
 func (r *RpmRepoCloner) CloneRawPackageNames(cloneDeps bool, rawPackageNames ...string) (allPackagesPrebuilt bool, err error) {
+	allPackagesPrebuilt, _, err = r.cloneRawPackageNames(cloneDeps, rawPackageNames...)
+	return
+}
+
+// cloneRawPackageNames clones the provided package names exactly as specified and lists the RPM files of all packages
+// the clone needed, each mapped to the ID of the repo it was resolved from.
+func (r *RpmRepoCloner) cloneRawPackageNames(cloneDeps bool, rawPackageNames ...string) (allPackagesPrebuilt bool, clonedPackages map[string]string, err error) {
 	timestamp.StartEvent("cloning packages", nil)
 	defer timestamp.StopEvent(nil)
 
@@ -361,19 +607,38 @@ func (r *RpmRepoCloner) CloneRawPackageNames(cloneDeps bool, rawPackageNames ...
 		r.chrootCloneDir,
 	}
 
+	err = r.ensureCachedMetadata()
+	if err != nil {
+		return
+	}
+
 	logger.Log.Debugf("Will clone in total %d items.", len(rawPackageNames))
 
 	allPackagesPrebuilt = true
+	clonedPackages = make(map[string]string)
 	for _, packageNameToClone := range rawPackageNames {
 		logger.Log.Debugf("Cloning raw name (%s).", packageNameToClone)
 
 		finalArgs := append(constantArgs, packageNameToClone)
-		err = r.chroot.Run(func() (chrootErr error) {
-			prebuilt, chrootErr := r.clonePackage(finalArgs)
-			if !prebuilt {
-				allPackagesPrebuilt = false
-			}
-			return
+		err = r.withMirrorFailover(func() error {
+			return r.chroot.Run(func() (chrootErr error) {
+				existingRPMs, chrootErr := filepath.Glob(filepath.Join(r.chrootCloneDir, "*.rpm"))
+				if chrootErr != nil {
+					return
+				}
+
+				prebuilt, installedPackages, chrootErr := r.clonePackage(finalArgs)
+				if !prebuilt {
+					allPackagesPrebuilt = false
+				}
+				if chrootErr == nil {
+					r.recordClonedPackages(existingRPMs, prebuilt, installedPackages)
+					for rpmFile, repoID := range installedPackages {
+						clonedPackages[rpmFile] = repoID
+					}
+				}
+				return
+			})
 		})
 
 		if err != nil {
@@ -384,6 +649,45 @@ func (r *RpmRepoCloner) CloneRawPackageNames(cloneDeps bool, rawPackageNames ...
 	return
 }
 
+// ClonedPackages returns the RPMs added to the clone directory by all clones so far, keyed by their file names.
+// RPMs already present in the clone directory before a clone are not included.
+func (r *RpmRepoCloner) ClonedPackages() (clonedPackages map[string]ClonedPackage) {
+	clonedPackages = make(map[string]ClonedPackage, len(r.clonedPackages))
+	for rpmFile, clonedPackage := range r.clonedPackages {
+		clonedPackages[rpmFile] = clonedPackage
+	}
+	return
+}
+
+// recordClonedPackages records the RPMs in the clone directory missing from 'existingRPMs', along with the repos
+// 'installedPackages' lists them from. Must be run inside the chroot.
+func (r *RpmRepoCloner) recordClonedPackages(existingRPMs []string, prebuilt bool, installedPackages map[string]string) {
+	existing := make(map[string]bool, len(existingRPMs))
+	for _, rpmPath := range existingRPMs {
+		existing[rpmPath] = true
+	}
+
+	rpmPaths, err := filepath.Glob(filepath.Join(r.chrootCloneDir, "*.rpm"))
+	if err != nil {
+		logger.Log.Warnf("Failed to list cloned RPMs in (%s): %s", r.chrootCloneDir, err)
+		return
+	}
+
+	for _, rpmPath := range rpmPaths {
+		if existing[rpmPath] {
+			continue
+		}
+
+		rpmInfo, err := os.Stat(rpmPath)
+		if err != nil {
+			logger.Log.Warnf("Failed to get the size of (%s): %s", rpmPath, err)
+			continue
+		}
+		rpmFile := filepath.Base(rpmPath)
+		r.clonedPackages[rpmFile] = ClonedPackage{Size: rpmInfo.Size(), Prebuilt: prebuilt, Repo: installedPackages[rpmFile]}
+	}
+}
+
 // WhatProvides attempts to find packages which provide the requested PackageVer.
 func (r *RpmRepoCloner) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
 	var (
@@ -395,6 +699,11 @@ func (r *RpmRepoCloner) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames [
 		return
 	}
 
+	err = r.ensureCachedMetadata()
+	if err != nil {
+		return
+	}
+
 	provideQuery := convertPackageVersionToTdnfArg(pkgVer)
 
 	baseArgs := []string{
@@ -407,27 +716,29 @@ func (r *RpmRepoCloner) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames [
 	for _, reposArgs := range r.reposArgsList {
 		logger.Log.Debugf("Using repos args: %v", reposArgs)
 
-		err = r.chroot.Run(func() (err error) {
-			completeArgs := append(baseArgs, reposArgs...)
+		err = r.withMirrorFailover(func() error {
+			return r.chroot.Run(func() (err error) {
+				completeArgs := append(baseArgs, reposArgs...)
 
-			stdout, stderr, err := shell.Execute("tdnf", completeArgs...)
-			logger.Log.Debugf("tdnf search for provide '%s':\n%s", pkgVer.Name, stdout)
+				stdout, stderr, err := shell.Execute("tdnf", completeArgs...)
+				logger.Log.Debugf("tdnf search for provide '%s':\n%s", pkgVer.Name, stdout)
 
-			if err != nil {
-				logger.Log.Debugf("Failed to lookup provide '%s', tdnf error: '%s'", pkgVer.Name, stderr)
-				return
-			}
+				if err != nil {
+					logger.Log.Debugf("Failed to lookup provide '%s', tdnf error: '%s'", pkgVer.Name, stderr)
+					return
+				}
 
-			// MUST keep order of packages printed by TDNF.
-			// TDNF will print the packages starting from the highest version, which allows us to work around an RPM bug:
-			// https://github.com/rpm-software-management/rpm/issues/2359
-			for _, matches := range tdnf.PackageLookupNameMatchRegex.FindAllStringSubmatch(stdout, -1) {
-				packageName := matches[tdnf.PackageNameIndex]
-				packageNames = append(packageNames, packageName)
-				logger.Log.Debugf("'%s' is available from package '%s'", pkgVer.Name, packageName)
-			}
+				// MUST keep order of packages printed by TDNF.
+				// TDNF will print the packages starting from the highest version, which allows us to work around an RPM bug:
+				// https://github.com/rpm-software-management/rpm/issues/2359
+				for _, matches := range tdnf.PackageLookupNameMatchRegex.FindAllStringSubmatch(stdout, -1) {
+					packageName := matches[tdnf.PackageNameIndex]
+					packageNames = append(packageNames, packageName)
+					logger.Log.Debugf("'%s' is available from package '%s'", pkgVer.Name, packageName)
+				}
 
-			return
+				return
+			})
 		})
 		if err != nil {
 			return
@@ -440,7 +751,7 @@ func (r *RpmRepoCloner) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames [
 	}
 
 	if len(packageNames) == 0 {
-		err = fmt.Errorf("could not resolve %s", pkgVer.Name)
+		err = fmt.Errorf("%w: could not resolve %s", ErrPackageNotFound, pkgVer.Name)
 		return
 	}
 
@@ -448,6 +759,173 @@ func (r *RpmRepoCloner) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames [
 	return
 }
 
+// WhatProvidesByRepo finds all packages which provide the requested PackageVer, grouped by the ID of the remote repo offering them.
+// Unlike WhatProvides, it does not stop at the first repo with a match and instead queries all enabled repos at once.
+// The local toolchain, built, and cache repos are not included in the results.
+func (r *RpmRepoCloner) WhatProvidesByRepo(pkgVer *pkgjson.PackageVer) (packagesByRepo map[string][]string, err error) {
+	if len(r.reposArgsList) == 0 {
+		err = fmt.Errorf("no repos are enabled")
+		return
+	}
+
+	releaseverCliArg, err := tdnf.GetReleaseverCliArg()
+	if err != nil {
+		return
+	}
+
+	err = r.ensureCachedMetadata()
+	if err != nil {
+		return
+	}
+
+	// Each entry of the repos args list enables more repos than the previous one, the last one has them all.
+	completeArgs := []string{
+		"provides",
+		convertPackageVersionToTdnfArg(pkgVer),
+		releaseverCliArg,
+	}
+	completeArgs = append(completeArgs, r.reposArgsList[len(r.reposArgsList)-1]...)
+
+	packagesByRepo = make(map[string][]string)
+	err = r.chroot.Run(func() (err error) {
+		stdout, stderr, err := shell.Execute("tdnf", completeArgs...)
+		if err != nil {
+			logger.Log.Debugf("Failed to lookup provide '%s' in all repos, tdnf error: '%s'", pkgVer.Name, stderr)
+			return
+		}
+
+		for _, matches := range tdnf.PackageLookupRepoMatchRegex.FindAllStringSubmatch(stdout, -1) {
+			packageName := matches[tdnf.PackageNameIndex]
+			repoID := matches[tdnf.PackageLookupRepoIDIndex]
+			if r.isLocalRepoID(repoID) {
+				continue
+			}
+			packagesByRepo[repoID] = append(packagesByRepo[repoID], packageName)
+			logger.Log.Debugf("'%s' is available from package '%s' in repo '%s'", pkgVer.Name, packageName, repoID)
+		}
+
+		return
+	})
+
+	return
+}
+
+// SetRepoMirrors configures ordered lists of mirror base URLs for some of the repos, keyed by repo ID.
+// Each repo starts with its first available mirror. If cloning or looking up a package fails later on,
+// the repos whose mirror became unavailable fail over to their next available mirror and the operation is retried.
+func (r *RpmRepoCloner) SetRepoMirrors(mirrors map[string][]string) (err error) {
+	knownRepoIDs, err := r.definedRepoIDs()
+	if err != nil {
+		return
+	}
+
+	for repoID, baseURLs := range mirrors {
+		if !knownRepoIDs[repoID] {
+			return fmt.Errorf("mirrors were given for an undefined repo (%s)", repoID)
+		}
+		if len(baseURLs) == 0 {
+			return fmt.Errorf("no mirrors were given for repo (%s)", repoID)
+		}
+	}
+
+	r.mirrors = newRepoMirrors(mirrors)
+	r.mirrors.client.Transport = r.mirrorProbeTransport()
+	r.mirrors.failover()
+
+	return r.applyMirrors(r.mirrors.activeMirrors())
+}
+
+// definedRepoIDs returns the IDs of all repos defined in the chroot's repo files.
+func (r *RpmRepoCloner) definedRepoIDs() (knownRepoIDs map[string]bool, err error) {
+	repoDir := filepath.Join(r.chroot.RootDir(), chrootRepoDir)
+	repoFiles, err := filepath.Glob(filepath.Join(repoDir, "*.repo"))
+	if err != nil {
+		return
+	}
+
+	knownRepoIDs = make(map[string]bool)
+	for _, repoFilePath := range repoFiles {
+		var repoIDs []string
+
+		repoIDs, err = readRepoIDs(repoFilePath)
+		if err != nil {
+			return
+		}
+		for _, repoID := range repoIDs {
+			knownRepoIDs[repoID] = true
+		}
+	}
+
+	return
+}
+
+// PackageMirrors returns the base URL of the mirror each cloned package was downloaded from, keyed by the RPM's
+// file name. Only packages from repos configured with SetRepoMirrors are included.
+func (r *RpmRepoCloner) PackageMirrors() (packageMirrors map[string]string) {
+	if r.mirrors == nil {
+		return map[string]string{}
+	}
+	return r.mirrors.packageMirrors()
+}
+
+// withMirrorFailover runs a repo operation. If it fails for any reason other than a missing package and some repos
+// failed over to another mirror, the operation is retried until it succeeds or no repo has a mirror left to try.
+// Must not be called inside the chroot, as the failover needs to refresh the packages cache.
+func (r *RpmRepoCloner) withMirrorFailover(operation func() error) (err error) {
+	for {
+		err = operation()
+		if err == nil || r.mirrors == nil || errors.Is(err, ErrPackageNotFound) {
+			return
+		}
+
+		switchedRepos := r.mirrors.failover()
+		if len(switchedRepos) == 0 {
+			return
+		}
+
+		logger.Log.Debugf("Retrying after failing over to other mirrors. Error: %s", err)
+		applyErr := r.applyMirrors(switchedRepos)
+		if applyErr != nil {
+			return fmt.Errorf("failed to switch repo mirrors:\n%w", applyErr)
+		}
+	}
+}
+
+// applyMirrors points the given repos to their new base URLs and refreshes their metadata, which TDNF would otherwise
+// keep using as long as it has not expired. Until the metadata cache is loaded, the repos will be refreshed with it.
+func (r *RpmRepoCloner) applyMirrors(baseURLs map[string]string) (err error) {
+	repoDir := filepath.Join(r.chroot.RootDir(), chrootRepoDir)
+	for repoID, baseURL := range baseURLs {
+		logger.Log.Debugf("Using mirror (%s) for repo (%s).", baseURL, repoID)
+		err = setRepoBaseURL(repoDir, repoID, baseURL)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(baseURLs) == 0 || (r.metadataCache != nil && !r.isCachedMetadataLoaded()) {
+		return
+	}
+
+	args, err := makecacheArgs()
+	if err != nil {
+		return
+	}
+
+	args = append(args, "--refresh", fmt.Sprintf("--disablerepo=%s", repoIDAll))
+	for repoID := range baseURLs {
+		args = append(args, fmt.Sprintf("--enablerepo=%s", repoID))
+	}
+
+	return r.chroot.Run(func() (err error) {
+		stdout, stderr, err := shell.Execute("tdnf", args...)
+		if err != nil {
+			logger.Log.Errorf("Failed to run 'tdnf makecache'. Stdout:\n%s\nStderr:\n%s\nError: %s.", stdout, stderr, err)
+		}
+		return
+	})
+}
+
 // ConvertDownloadedPackagesIntoRepo initializes the downloaded RPMs into an RPM repository.
 // Packages will be placed in a flat directory.
 func (r *RpmRepoCloner) ConvertDownloadedPackagesIntoRepo() (err error) {
@@ -481,6 +959,7 @@ func (r *RpmRepoCloner) ConvertDownloadedPackagesIntoRepo() (err error) {
 
 // ClonedRepoContents returns the non-local, downloaded packages.
 // This includes the toolchain packages along with other packages downloaded from the upstream repositories.
+// Packages cloned by this cloner are listed with the repo they were cloned from.
 func (r *RpmRepoCloner) ClonedRepoContents() (repoContents *repocloner.RepoContents, err error) {
 	releaseverCliArg, err := tdnf.GetReleaseverCliArg()
 	if err != nil {
@@ -507,6 +986,7 @@ func (r *RpmRepoCloner) ClonedRepoContents() (repoContents *repocloner.RepoConte
 			Version:      matches[tdnf.ListPackageVersion],
 			Architecture: matches[tdnf.ListPackageArch],
 			Distribution: matches[tdnf.ListPackageDist],
+			Repo:         matches[tdnf.ListPackageRepo],
 		}
 
 		pkgID := pkg.ID()
@@ -533,24 +1013,47 @@ func (r *RpmRepoCloner) ClonedRepoContents() (repoContents *repocloner.RepoConte
 
 		return shell.ExecuteLiveWithCallback(onStdout, logger.Log.Warn, true, "tdnf", tdnfArgs...)
 	})
+	if err != nil {
+		return
+	}
 
+	useUpstreamRepos(repoContents, r.clonedPackages)
 	return
 }
 
+// useUpstreamRepos replaces the repo TDNF lists each package from, which is always the clone directory's repo
+// or '@System', with the repo the package was cloned from. Packages not cloned by this cloner keep their listed repo.
+func useUpstreamRepos(repoContents *repocloner.RepoContents, clonedPackages map[string]ClonedPackage) {
+	for _, pkg := range repoContents.Repo {
+		clonedPackage, found := clonedPackages[fmt.Sprintf("%s.rpm", pkg.ID())]
+		if found && clonedPackage.Repo != "" {
+			pkg.Repo = clonedPackage.Repo
+		}
+	}
+}
+
 // CloneDirectory returns the directory where cloned packages are saved.
 func (r *RpmRepoCloner) CloneDirectory() string {
 	return r.mountedCloneDir
 }
 
-// Close closes the given RpmRepoCloner.
-func (r *RpmRepoCloner) Close() error {
-	const leaveChrootFilesOnDisk = false
-	return r.chroot.Close(leaveChrootFilesOnDisk)
+// Close closes the given RpmRepoCloner, removing its tmp dir unless SetKeepTmpDir was used.
+func (r *RpmRepoCloner) Close() (err error) {
+	// A failed initialization already closed the chroot.
+	if r.chroot != nil {
+		err = r.chroot.Close(r.keepTmpDir)
+		if err != nil {
+			return
+		}
+		r.chroot = nil
+	}
+	return r.releaseTmpDir()
 }
 
 // clonePackage clones a given package using pre-populated arguments.
 // It will gradually enable more repos to consider until the package is found.
-func (r *RpmRepoCloner) clonePackage(baseArgs []string) (preBuilt bool, err error) {
+// Returns the RPM files of the packages TDNF installed, each mapped to the ID of the repo it was resolved from.
+func (r *RpmRepoCloner) clonePackage(baseArgs []string) (preBuilt bool, installedPackages map[string]string, err error) {
 	const (
 		unresolvedOutputPrefix  = "No package"
 		toyboxConflictsPrefix   = "toybox conflicts"
@@ -599,13 +1102,17 @@ func (r *RpmRepoCloner) clonePackage(baseArgs []string) (preBuilt bool, err erro
 			}
 			// If a package was not available, update err
 			if strings.HasPrefix(trimmedLine, unresolvedOutputPrefix) && strings.HasSuffix(trimmedLine, unresolvedOutputPostfix) {
-				err = fmt.Errorf(trimmedLine)
+				err = fmt.Errorf("%w: %s", ErrPackageNotFound, trimmedLine)
 				break
 			}
 		}
 
 		if err == nil {
 			preBuilt = r.reposArgsHaveOnlyLocalSources(reposArgs)
+			installedPackages = parseInstalledPackages(stdout)
+			if r.mirrors != nil {
+				r.mirrors.recordServedPackages(installedPackages)
+			}
 			break
 		}
 	}
@@ -613,6 +1120,29 @@ func (r *RpmRepoCloner) clonePackage(baseArgs []string) (preBuilt bool, err erro
 	return
 }
 
+// parseInstalledPackages returns the RPM files of the packages listed in the output of 'tdnf install', each mapped to
+// the ID of the repo TDNF resolved it from.
+func parseInstalledPackages(tdnfOutput string) (installedPackages map[string]string) {
+	const repoIDField = 3
+
+	installedPackages = make(map[string]string)
+	for _, line := range strings.Split(tdnfOutput, "\n") {
+		matches := tdnf.InstallPackageRegex.FindStringSubmatch(line)
+		if len(matches) != tdnf.InstallMaxMatchLen {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) <= repoIDField {
+			continue
+		}
+
+		rpmFile := fmt.Sprintf("%s-%s.%s.%s.rpm", matches[tdnf.InstallPackageName], matches[tdnf.InstallPackageVersion], matches[tdnf.InstallPackageDist], matches[tdnf.InstallPackageArch])
+		installedPackages[rpmFile] = fields[repoIDField]
+	}
+	return
+}
+
 func convertPackageVersionToTdnfArg(pkgVer *pkgjson.PackageVer) (tdnfArg string) {
 	tdnfArg = pkgVer.Name
 
@@ -647,7 +1177,12 @@ func (r *RpmRepoCloner) GetEnabledRepos() uint64 {
 }
 
 // SetEnabledRepos tells the cloner which repos it is allowed to use for its queries.
+// A cloner constructed with ConstructLocalCloner never enables the remote repos.
 func (r *RpmRepoCloner) SetEnabledRepos(reposFlags uint64) {
+	if r.offline {
+		reposFlags = reposFlags & RepoFlagLocal
+	}
+
 	r.reposFlags = reposFlags
 	r.reposArgsList = [][]string{}
 	previousReposList := []string{fmt.Sprintf("--disablerepo=%s", repoIDAll)}
@@ -682,6 +1217,15 @@ func (r *RpmRepoCloner) SetEnabledRepos(reposFlags uint64) {
 		return
 	}
 
+	// A snapshot of captured repositories replaces all remote repositories.
+	if len(r.snapshotRepoIDs) > 0 {
+		for _, repoID := range r.snapshotRepoIDs {
+			previousReposList = append(previousReposList, fmt.Sprintf("--enablerepo=%s", repoID))
+		}
+		r.reposArgsList = append(r.reposArgsList, previousReposList)
+		return
+	}
+
 	previousReposList = append(previousReposList, fmt.Sprintf("--enablerepo=%s", repoIDAll))
 
 	if RepoFlagPreview&reposFlags == 0 {
@@ -705,17 +1249,61 @@ func (r *RpmRepoCloner) disabledDefaultMarinerReposArgs() (args []string) {
 }
 
 func (r *RpmRepoCloner) refreshPackagesCache() (err error) {
+	args, err := makecacheArgs()
+	if err != nil {
+		return
+	}
+
+	// Avoid reaching out to the network when offline or resolving from a snapshot. The local repo definitions
+	// of a snapshot are only guaranteed to exist once the snapshot repos have been configured.
+	// Remote repos using the metadata cache are only refreshed once it expires, see ensureCachedMetadata.
+	if r.offline || r.metadataCache != nil {
+		args = append(args, fmt.Sprintf("--disablerepo=%s", repoIDAll))
+		for _, repoID := range []string{repoIDBuilt, repoIDToolchain, r.repoIDCache} {
+			// The cache repo is only known once all repos are initialized.
+			if repoID != "" {
+				args = append(args, fmt.Sprintf("--enablerepo=%s", repoID))
+			}
+		}
+	} else if r.rpmmdSnapshotDir != "" {
+		if len(r.snapshotRepoIDs) == 0 {
+			logger.Log.Debug("Skipping packages cache refresh until the rpmmd snapshot repos are configured.")
+			return
+		}
+
+		args = append(args, fmt.Sprintf("--disablerepo=%s", repoIDAll))
+		for _, repoID := range append([]string{repoIDBuilt, repoIDToolchain, r.repoIDCache}, r.snapshotRepoIDs...) {
+			args = append(args, fmt.Sprintf("--enablerepo=%s", repoID))
+		}
+	} else {
+		return r.refreshRemoteMetadata(args)
+	}
+
+	stdout, stderr, err := shell.Execute("tdnf", args...)
+	if err != nil {
+		logger.Log.Errorf("Failed to run 'tdnf makecache'. Stdout:\n%s\nStderr:\n%s\nError: %s.", stdout, stderr, err)
+	}
+
+	return
+}
+
+// makecacheArgs returns the arguments of a 'tdnf makecache' call, without any repos enabled or disabled.
+func makecacheArgs() (args []string, err error) {
 	releaseverCliArg, err := tdnf.GetReleaseverCliArg()
 	if err != nil {
 		return
 	}
 
-	args := []string{
-		"makecache",
-		releaseverCliArg,
-		fmt.Sprintf("--enablerepo=%s", repoIDAll),
+	return []string{"makecache", releaseverCliArg}, nil
+}
+
+// refreshRemoteMetadata refreshes the metadata of all repos, local and remote. Must be run inside the chroot.
+func (r *RpmRepoCloner) refreshRemoteMetadata(baseArgs []string) (err error) {
+	if r.maxMetadataRefreshPerHost > 0 {
+		return r.refreshPackagesCachePerHost(baseArgs)
 	}
 
+	args := append(baseArgs, fmt.Sprintf("--enablerepo=%s", repoIDAll))
 	stdout, stderr, err := shell.Execute("tdnf", args...)
 	if err != nil {
 		logger.Log.Errorf("Failed to run 'tdnf makecache'. Stdout:\n%s\nStderr:\n%s\nError: %s.", stdout, stderr, err)
@@ -724,6 +1312,143 @@ func (r *RpmRepoCloner) refreshPackagesCache() (err error) {
 	return
 }
 
+// refreshPackagesCachePerHost refreshes the metadata of each repo with a separate 'tdnf makecache' call.
+// Repos from different hosts are refreshed in parallel, while at most 'maxMetadataRefreshPerHost' repos
+// are refreshed from the same host at once. Must be run inside the chroot.
+func (r *RpmRepoCloner) refreshPackagesCachePerHost(baseArgs []string) (err error) {
+	reposByHost, err := readRepoHosts(chrootRepoDir)
+	if err != nil {
+		return
+	}
+
+	var (
+		errLock sync.Mutex
+		wg      sync.WaitGroup
+	)
+
+	for host, repoIDs := range reposByHost {
+		hostLimiter := make(chan struct{}, r.maxMetadataRefreshPerHost)
+		for _, repoID := range repoIDs {
+			wg.Add(1)
+			go func(host, repoID string) {
+				defer wg.Done()
+
+				hostLimiter <- struct{}{}
+				defer func() { <-hostLimiter }()
+
+				logger.Log.Debugf("Refreshing metadata of repo (%s) from host (%s).", repoID, host)
+				args := append([]string{}, baseArgs...)
+				args = append(args, fmt.Sprintf("--disablerepo=%s", repoIDAll), fmt.Sprintf("--enablerepo=%s", repoID))
+
+				stdout, stderr, refreshErr := shell.Execute("tdnf", args...)
+				if refreshErr != nil {
+					logger.Log.Errorf("Failed to run 'tdnf makecache' for repo (%s). Stdout:\n%s\nStderr:\n%s\nError: %s.", repoID, stdout, stderr, refreshErr)
+
+					errLock.Lock()
+					if err == nil {
+						err = fmt.Errorf("failed to refresh metadata of repo (%s):\n%w", repoID, refreshErr)
+					}
+					errLock.Unlock()
+				}
+			}(host, repoID)
+		}
+	}
+
+	wg.Wait()
+
+	return
+}
+
+// readRepoHosts groups the IDs of all repos defined in the repo files under 'repoDir' by the host serving them.
+// Repos without a remote URL (e.g. 'file://' repos) are grouped under an empty host.
+func readRepoHosts(repoDir string) (reposByHost map[string][]string, err error) {
+	repoFiles, err := filepath.Glob(filepath.Join(repoDir, "*.repo"))
+	if err != nil {
+		return
+	}
+
+	reposByHost = make(map[string][]string)
+	for _, repoFilePath := range repoFiles {
+		var repoHosts map[string]string
+
+		repoHosts, err = readRepoFileHosts(repoFilePath)
+		if err != nil {
+			return
+		}
+
+		for repoID, host := range repoHosts {
+			reposByHost[host] = append(reposByHost[host], repoID)
+		}
+	}
+
+	for _, repoIDs := range reposByHost {
+		sort.Strings(repoIDs)
+	}
+
+	return
+}
+
+// readRepoFileHosts maps the ID of each repo defined in a repo file to the host of its first remote URL.
+func readRepoFileHosts(repoFilePath string) (repoHosts map[string]string, err error) {
+	repoURLs, err := readRepoFileURLs(repoFilePath)
+	if err != nil {
+		return
+	}
+
+	repoHosts = make(map[string]string, len(repoURLs))
+	for repoID, repoURL := range repoURLs {
+		repoHosts[repoID] = ""
+		if repoURL != nil {
+			repoHosts[repoID] = repoURL.Hostname()
+		}
+	}
+	return
+}
+
+// readRepoFileURLs maps the ID of each repo defined in a repo file to its first remote URL.
+// Repos with only local URLs map to the first of them, repos without any URL to nil.
+func readRepoFileURLs(repoFilePath string) (repoURLs map[string]*url.URL, err error) {
+	repoFile, err := os.Open(repoFilePath)
+	if err != nil {
+		return
+	}
+	defer repoFile.Close()
+
+	repoURLs = make(map[string]*url.URL)
+	currentRepoID := ""
+	scanner := bufio.NewScanner(repoFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		idMatches := tdnf.RepoIDRegex.FindStringSubmatch(line)
+		if len(idMatches) > tdnf.RepoIDIndex {
+			currentRepoID = idMatches[tdnf.RepoIDIndex]
+			repoURLs[currentRepoID] = nil
+			continue
+		}
+
+		urlMatches := tdnf.RepoURLRegex.FindStringSubmatch(line)
+		if currentRepoID == "" || len(urlMatches) <= tdnf.RepoURLIndex {
+			continue
+		}
+		if currentURL := repoURLs[currentRepoID]; currentURL != nil && currentURL.Hostname() != "" {
+			continue
+		}
+
+		repoURL, parseErr := url.Parse(urlMatches[tdnf.RepoURLIndex])
+		if parseErr != nil {
+			logger.Log.Warnf("Failed to parse the URL of repo (%s) in (%s): %s", currentRepoID, repoFilePath, parseErr)
+			continue
+		}
+		if repoURLs[currentRepoID] == nil || repoURL.Hostname() != "" {
+			repoURLs[currentRepoID] = repoURL
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
+
 func readRepoIDs(repoFilePath string) (repoIDs []string, err error) {
 	repoFile, err := os.Open(repoFilePath)
 	if err != nil {
@@ -749,6 +1474,10 @@ func readRepoIDs(repoFilePath string) (repoIDs []string, err error) {
 
 }
 
+func (r *RpmRepoCloner) isLocalRepoID(repoID string) bool {
+	return repoID == repoIDBuilt || repoID == repoIDToolchain || repoID == r.repoIDCache
+}
+
 func (r *RpmRepoCloner) reposArgsHaveOnlyLocalSources(reposArgs []string) bool {
 	const repoIDIndex = 1
 
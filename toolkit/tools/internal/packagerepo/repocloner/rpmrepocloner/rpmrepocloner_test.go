@@ -0,0 +1,118 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldNeverEnableRemoteReposOffline(t *testing.T) {
+	cloner := &RpmRepoCloner{offline: true, repoIDCache: repoIDCacheRegular}
+	cloner.SetEnabledRepos(RepoFlagAll)
+
+	assert.Equal(t, RepoFlagLocal, cloner.GetEnabledRepos())
+	assert.NotEmpty(t, cloner.reposArgsList)
+	for _, reposArgs := range cloner.reposArgsList {
+		for _, repoArg := range reposArgs {
+			if repoID := strings.TrimPrefix(repoArg, "--enablerepo="); repoID != repoArg {
+				assert.True(t, cloner.isLocalRepoID(repoID), "remote repo (%s) enabled offline", repoID)
+			}
+		}
+	}
+}
+
+func TestShouldListPackagesInstalledByTdnf(t *testing.T) {
+	const tdnfOutput = `
+Installing:
+ zlib                 x86_64          1.2.13-1.cm2          mariner-official-base  100.00k 102400
+ glibc                x86_64          2.35-3.cm2            toolchain-repo           5.01M 5253120
+
+Total installed size:   5.11M 5355520
+`
+
+	assert.Equal(t, map[string]string{
+		"zlib-1.2.13-1.cm2.x86_64.rpm": "mariner-official-base",
+		"glibc-2.35-3.cm2.x86_64.rpm":  "toolchain-repo",
+	}, parseInstalledPackages(tdnfOutput))
+	assert.Empty(t, parseInstalledPackages("Nothing to do.\n"))
+}
+
+func TestShouldListClonedPackagesFromTheirUpstreamRepos(t *testing.T) {
+	cloneDir := t.TempDir()
+	existingRPM := filepath.Join(cloneDir, "bash-5.1.8-2.cm2.x86_64.rpm")
+	for _, rpmPath := range []string{existingRPM, filepath.Join(cloneDir, "zlib-1.2.13-1.cm2.x86_64.rpm"), filepath.Join(cloneDir, "gtk3-3.24.28-1.cm2.x86_64.rpm")} {
+		assert.NoError(t, os.WriteFile(rpmPath, []byte(filepath.Base(rpmPath)), 0644))
+	}
+
+	cloner := &RpmRepoCloner{chrootCloneDir: cloneDir, clonedPackages: make(map[string]ClonedPackage)}
+	cloner.recordClonedPackages([]string{existingRPM}, false, map[string]string{
+		"zlib-1.2.13-1.cm2.x86_64.rpm":  "mariner-official-base",
+		"gtk3-3.24.28-1.cm2.x86_64.rpm": "mariner-extras",
+		"bash-5.1.8-2.cm2.x86_64.rpm":   "mariner-official-base",
+	})
+
+	repoContents := &repocloner.RepoContents{Repo: []*repocloner.RepoPackage{
+		{Name: "zlib", Version: "1.2.13-1", Architecture: "x86_64", Distribution: "cm2", Repo: "fetcher-cloned-repo"},
+		{Name: "gtk3", Version: "3.24.28-1", Architecture: "x86_64", Distribution: "cm2", Repo: "fetcher-cloned-repo"},
+		{Name: "bash", Version: "5.1.8-2", Architecture: "x86_64", Distribution: "cm2", Repo: "@System"},
+	}}
+	useUpstreamRepos(repoContents, cloner.ClonedPackages())
+
+	// 'bash' was in the clone directory before the clone, so its upstream repo is unknown.
+	assert.Equal(t, "mariner-official-base", repoContents.Repo[0].Repo)
+	assert.Equal(t, "mariner-extras", repoContents.Repo[1].Repo)
+	assert.Equal(t, "@System", repoContents.Repo[2].Repo)
+}
+
+func TestShouldAppendCABundleToExistingTrustStore(t *testing.T) {
+	const (
+		publicCA  = "-----BEGIN CERTIFICATE-----\npublic\n-----END CERTIFICATE-----"
+		privateCA = "-----BEGIN CERTIFICATE-----\nprivate\n-----END CERTIFICATE-----\n"
+	)
+
+	caBundle := filepath.Join(t.TempDir(), "private-ca.crt")
+	assert.NoError(t, os.WriteFile(caBundle, []byte(privateCA), 0644))
+
+	// The existing trust store does not end with a new line.
+	trustStorePath := filepath.Join(t.TempDir(), chrootCABundleFile)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(trustStorePath), os.ModePerm))
+	assert.NoError(t, os.WriteFile(trustStorePath, []byte(publicCA), 0644))
+
+	err := addTrustedCABundle(caBundle, trustStorePath)
+	assert.NoError(t, err)
+
+	contents, err := os.ReadFile(trustStorePath)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(contents), publicCA+"\n"))
+	assert.Contains(t, string(contents), "\n"+privateCA)
+
+	err = addTrustedCABundle(filepath.Join(t.TempDir(), "missing.crt"), trustStorePath)
+	assert.Error(t, err)
+}
+
+func TestShouldDefineRepoForEachCapturedSnapshotRepo(t *testing.T) {
+	snapshotDir := t.TempDir()
+	for _, repoMetadata := range []string{"base/repodata/repomd.xml", "extras/repodata/repomd.xml", "partial/packages/zlib.rpm"} {
+		path := filepath.Join(snapshotDir, repoMetadata)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), os.ModePerm))
+		assert.NoError(t, os.WriteFile(path, []byte("<repomd/>"), 0644))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(snapshotDir, "notes.txt"), []byte("ignored"), 0644))
+
+	repoIDs, repoDefinitions, err := snapshotRepoDefinitions(snapshotDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{repoIDSnapshotPrefix + "base", repoIDSnapshotPrefix + "extras"}, repoIDs)
+	assert.Contains(t, repoDefinitions, "["+repoIDSnapshotPrefix+"base]\n")
+	assert.Contains(t, repoDefinitions, "baseurl=file://"+filepath.Join(chrootRpmmdSnapshotDir, "extras")+"\n")
+	assert.NotContains(t, repoDefinitions, "partial")
+
+	_, _, err = snapshotRepoDefinitions(filepath.Join(snapshotDir, "partial"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+)
+
+// TLSClientIdentity is a PEM encoded TLS client certificate and its private key, held in memory.
+type TLSClientIdentity struct {
+	Certificate *x509.Certificate // The parsed client certificate
+	certPEM     []byte
+	keyPEM      []byte
+}
+
+// NewTLSClientIdentity parses a PEM encoded client certificate and its private key, failing if they do not match.
+func NewTLSClientIdentity(certPEM, keyPEM []byte) (identity *TLSClientIdentity, err error) {
+	keyPair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS client certificate or key:\n%w", err)
+	}
+
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TLS client certificate:\n%w", err)
+	}
+
+	return &TLSClientIdentity{
+		Certificate: certificate,
+		certPEM:     certPEM,
+		keyPEM:      keyPEM,
+	}, nil
+}
+
+// SetTLSClientIdentity makes the cloner present 'identity' to the repos, replacing any client certificate given to
+// ConstructCloner. TDNF only reads client certificates from files, so they are written into the worker chroot,
+// readable only by their owner, and are removed together with the chroot when the cloner is closed.
+func (r *RpmRepoCloner) SetTLSClientIdentity(identity *TLSClientIdentity) (err error) {
+	const secretFilePermissions = 0600
+
+	files := map[string][]byte{
+		chrootTLSClientCertFile: identity.certPEM,
+		chrootTLSClientKeyFile:  identity.keyPEM,
+	}
+	for chrootPath, contents := range files {
+		path := filepath.Join(r.chroot.RootDir(), chrootPath)
+		err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			return
+		}
+
+		err = os.WriteFile(path, contents, secretFilePermissions)
+		if err != nil {
+			return fmt.Errorf("failed to provision the worker with the TLS client identity:\n%w", err)
+		}
+
+		// WriteFile keeps the permissions of an existing file.
+		err = os.Chmod(path, secretFilePermissions)
+		if err != nil {
+			return
+		}
+	}
+
+	keyPair, err := tls.X509KeyPair(identity.certPEM, identity.keyPEM)
+	if err != nil {
+		return
+	}
+	// The mirror probes present the same identity, the configuration in use is never modified.
+	tlsConfig := &tls.Config{}
+	if r.tlsConfig != nil {
+		tlsConfig = r.tlsConfig.Clone()
+	}
+	tlsConfig.Certificates = []tls.Certificate{keyPair}
+	r.tlsConfig = tlsConfig
+	if r.mirrors != nil {
+		r.mirrors.client.Transport = r.mirrorProbeTransport()
+	}
+
+	logger.Log.Infof("Using the TLS client certificate of (%s) inside the cloner.", identity.Certificate.Subject)
+	return
+}
+
+// newClientTLSConfig creates the TLS configuration the cloner uses outside of TDNF, matching the network files given
+// to the chroot: it presents the client certificate and trusts the system's CAs along with the ones from 'caBundle'.
+// tlsClientCert, tlsClientKey, and caBundle are optional.
+func newClientTLSConfig(tlsClientCert, tlsClientKey, caBundle string) (tlsConfig *tls.Config, err error) {
+	tlsConfig = &tls.Config{}
+
+	if tlsClientCert != "" && tlsClientKey != "" {
+		var keyPair tls.Certificate
+
+		keyPair, err = tls.LoadX509KeyPair(tlsClientCert, tlsClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS client certificate (%s) and key (%s):\n%w", tlsClientCert, tlsClientKey, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	if caBundle != "" {
+		var certificates []byte
+
+		tlsConfig.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			logger.Log.Debugf("Failed to load the system's CAs, only trusting CA bundle (%s): %s", caBundle, err)
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+
+		certificates, err = os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle (%s):\n%w", caBundle, err)
+		}
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(certificates) {
+			return nil, fmt.Errorf("no certificates found in CA bundle (%s)", caBundle)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,15 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldRejectInvalidTLSClientIdentity(t *testing.T) {
+	_, err := NewTLSClientIdentity([]byte("not a certificate"), []byte("not a key"))
+	assert.ErrorContains(t, err, "invalid TLS client certificate or key")
+}
@@ -0,0 +1,164 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"golang.org/x/sys/unix"
+)
+
+// tmpDirLockSuffix names the lock file next to a cloner's tmp dir, held for as long as the cloner uses the dir.
+const tmpDirLockSuffix = ".lock"
+
+// mountsFile lists the mount points visible to this process.
+var mountsFile = "/proc/self/mounts"
+
+// errTmpDirInUse is returned when another cloner holds the lock of a tmp dir.
+var errTmpDirInUse = errors.New("tmp dir in use")
+
+// SetKeepTmpDir controls whether Close leaves the worker chroot and all other files in the cloner's tmp dir on disk,
+// e.g. to debug a failed clone. By default the tmp dir is removed.
+func (r *RpmRepoCloner) SetKeepTmpDir(keep bool) {
+	r.keepTmpDir = keep
+}
+
+// SweepStaleTmpDir removes 'tmpDir' if it was left behind by a crashed run and was last modified more than 'maxAge' ago.
+// The dir is kept if a running cloner holds its lock or if anything is still mounted below it, since removing it
+// would also remove the contents of the mounted directories. Returns whether the dir was removed.
+func SweepStaleTmpDir(tmpDir string, maxAge time.Duration) (swept bool, err error) {
+	info, err := os.Stat(tmpDir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+
+	age := time.Since(info.ModTime())
+	if age < maxAge {
+		logger.Log.Debugf("Keeping tmp dir (%s), it was modified %s ago.", tmpDir, age.Round(time.Second))
+		return
+	}
+
+	lock, err := lockTmpDir(tmpDir)
+	if errors.Is(err, errTmpDirInUse) {
+		logger.Log.Warnf("Keeping stale tmp dir (%s), it is in use by another run.", tmpDir)
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	defer unlockTmpDir(lock, tmpDir)
+
+	mounted, err := hasMountsBelow(tmpDir)
+	if err != nil {
+		return
+	}
+	if mounted {
+		logger.Log.Warnf("Keeping stale tmp dir (%s), directories are still mounted inside it.", tmpDir)
+		return
+	}
+
+	logger.Log.Infof("Removing tmp dir (%s) left behind by an earlier run %s ago.", tmpDir, age.Round(time.Second))
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to remove stale tmp dir (%s):\n%w", tmpDir, err)
+	}
+	return true, nil
+}
+
+// lockTmpDir takes the lock of 'tmpDir' without waiting. Fails with errTmpDirInUse if another cloner holds it.
+func lockTmpDir(tmpDir string) (lock *os.File, err error) {
+	err = os.MkdirAll(filepath.Dir(tmpDir), os.ModePerm)
+	if err != nil {
+		return
+	}
+
+	lock, err = os.OpenFile(tmpDir+tmpDirLockSuffix, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+
+	err = unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err != nil {
+		lock.Close()
+		lock = nil
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			err = fmt.Errorf("%w: (%s) is locked by another run", errTmpDirInUse, tmpDir)
+		}
+	}
+	return
+}
+
+// unlockTmpDir releases the lock taken by lockTmpDir and removes the lock file.
+func unlockTmpDir(lock *os.File, tmpDir string) {
+	// Removed while still locked, so no other run can lock the file which is about to disappear.
+	err := os.Remove(tmpDir + tmpDirLockSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Log.Warnf("Failed to remove the lock of tmp dir (%s). Error: %s", tmpDir, err)
+	}
+	lock.Close()
+}
+
+// releaseTmpDir removes the cloner's tmp dir, unless it should be kept, and releases its lock.
+func (r *RpmRepoCloner) releaseTmpDir() (err error) {
+	if r.tmpDirLock == nil {
+		return
+	}
+	defer func() {
+		unlockTmpDir(r.tmpDirLock, r.tmpDir)
+		r.tmpDirLock = nil
+	}()
+
+	if r.keepTmpDir {
+		logger.Log.Infof("Keeping tmp dir (%s).", r.tmpDir)
+		return
+	}
+
+	// The chroot's cleanup already removed its files, this catches anything created next to them.
+	err = os.RemoveAll(r.tmpDir)
+	if err != nil {
+		err = fmt.Errorf("failed to remove tmp dir (%s):\n%w", r.tmpDir, err)
+	}
+	return
+}
+
+// hasMountsBelow returns true if 'dir', or any directory inside it, is a mount point.
+func hasMountsBelow(dir string) (mounted bool, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+
+	mounts, err := os.Open(mountsFile)
+	if err != nil {
+		return
+	}
+	defer mounts.Close()
+
+	scanner := bufio.NewScanner(mounts)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		// Spaces in mount points are escaped as "\040".
+		mountPoint := strings.ReplaceAll(fields[1], `\040`, " ")
+		if mountPoint == dir || strings.HasPrefix(mountPoint, dir+string(filepath.Separator)) {
+			return true, nil
+		}
+	}
+
+	err = scanner.Err()
+	return
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTmpDirCloner sets up the tmp dir of a cloner the way initialize does. A real chroot needs root privileges.
+func newTmpDirCloner(t *testing.T) (r *RpmRepoCloner) {
+	tmpDir := filepath.Join(t.TempDir(), "worker")
+	lock, err := lockTmpDir(tmpDir)
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "var", "cache", "tdnf"), os.ModePerm))
+
+	return &RpmRepoCloner{tmpDir: tmpDir, tmpDirLock: lock}
+}
+
+func TestShouldRemoveTmpDirOnClose(t *testing.T) {
+	cloner := newTmpDirCloner(t)
+	assert.NoError(t, cloner.Close())
+	assert.NoDirExists(t, cloner.tmpDir)
+	assert.NoFileExists(t, cloner.tmpDir+tmpDirLockSuffix)
+
+	// A second close has nothing left to do.
+	assert.NoError(t, cloner.Close())
+}
+
+func TestShouldKeepTmpDirOnCloseIfRequested(t *testing.T) {
+	cloner := newTmpDirCloner(t)
+	cloner.SetKeepTmpDir(true)
+	assert.NoError(t, cloner.Close())
+	assert.DirExists(t, cloner.tmpDir)
+	assert.NoFileExists(t, cloner.tmpDir+tmpDirLockSuffix)
+}
+
+func TestShouldNotLockTmpDirTwice(t *testing.T) {
+	cloner := newTmpDirCloner(t)
+	defer cloner.Close()
+
+	_, err := lockTmpDir(cloner.tmpDir)
+	assert.ErrorIs(t, err, errTmpDirInUse)
+}
+
+func TestShouldSweepOnlyUnusedStaleTmpDirs(t *testing.T) {
+	oldMountsFile := mountsFile
+	defer func() {
+		mountsFile = oldMountsFile
+	}()
+	mountsFile = filepath.Join(t.TempDir(), "mounts")
+	assert.NoError(t, os.WriteFile(mountsFile, []byte("proc /proc proc rw 0 0\n"), 0644))
+
+	stale := time.Now().Add(-48 * time.Hour)
+	newTmpDir := func(modTime time.Time) (tmpDir string) {
+		tmpDir = filepath.Join(t.TempDir(), "worker")
+		assert.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "usr"), os.ModePerm))
+		assert.NoError(t, os.Chtimes(tmpDir, modTime, modTime))
+		return
+	}
+
+	swept, err := SweepStaleTmpDir(filepath.Join(t.TempDir(), "missing"), time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, swept)
+
+	recentDir := newTmpDir(time.Now())
+	swept, err = SweepStaleTmpDir(recentDir, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, swept)
+	assert.DirExists(t, recentDir)
+
+	staleDir := newTmpDir(stale)
+	swept, err = SweepStaleTmpDir(staleDir, time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, swept)
+	assert.NoDirExists(t, staleDir)
+
+	lockedDir := newTmpDir(stale)
+	lock, err := lockTmpDir(lockedDir)
+	assert.NoError(t, err)
+	swept, err = SweepStaleTmpDir(lockedDir, time.Hour)
+	unlockTmpDir(lock, lockedDir)
+	assert.NoError(t, err)
+	assert.False(t, swept)
+	assert.DirExists(t, lockedDir)
+
+	mountedDir := newTmpDir(stale)
+	mountLine := fmt.Sprintf("/dev/sda1 %s ext4 rw 0 0\n", filepath.Join(mountedDir, "localrpms"))
+	assert.NoError(t, os.WriteFile(mountsFile, []byte(mountLine), 0644))
+	swept, err = SweepStaleTmpDir(mountedDir, time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, swept)
+	assert.DirExists(t, mountedDir)
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+)
+
+// batchProvidesBackend is a repo backend able to look up the providers of several capabilities with a single query.
+// TDNF's 'provides' only accepts a single capability, so by default the cloner has no such backend.
+type batchProvidesBackend interface {
+	// whatProvidesBatch returns the packages providing each of the TDNF provide queries, keyed by query, searching
+	// only the repos enabled by 'reposArgs'. The packages must keep the order reported by the repos.
+	// Queries without any provider may be left out.
+	whatProvidesBatch(provideQueries []string, reposArgs []string) (providers map[string][]string, err error)
+}
+
+// SupportsBatchProvides returns true if WhatProvidesBatch resolves capabilities with batched queries instead of
+// falling back to a WhatProvides lookup per capability.
+func (r *RpmRepoCloner) SupportsBatchProvides() bool {
+	return r.batchProvides != nil
+}
+
+// WhatProvidesBatch finds the packages providing each of the requested PackageVers, keyed by the PackageVer's String().
+// Like WhatProvides, the repos are searched in order and each capability is resolved from the first repos offering it.
+// PackageVers no repo provides are left out of the result.
+// Each group of repos is queried once for all capabilities still unresolved if the repo backend supports batched
+// queries, see SupportsBatchProvides. Otherwise each capability is looked up on its own.
+func (r *RpmRepoCloner) WhatProvidesBatch(pkgVers []*pkgjson.PackageVer) (providers map[string][]string, err error) {
+	if r.batchProvides == nil {
+		return r.whatProvidesOneByOne(pkgVers)
+	}
+
+	err = r.ensureCachedMetadata()
+	if err != nil {
+		return
+	}
+
+	providers = make(map[string][]string)
+
+	// Several PackageVers may translate into the same query.
+	pendingQueries := make(map[string][]string)
+	for _, pkgVer := range pkgVers {
+		query := convertPackageVersionToTdnfArg(pkgVer)
+		pendingQueries[query] = append(pendingQueries[query], pkgVer.String())
+	}
+
+	// Consider the built (toolchain, local) RPMs first, then the already cached, and finally all remote packages.
+	for _, reposArgs := range r.reposArgsList {
+		if len(pendingQueries) == 0 {
+			break
+		}
+
+		queries := make([]string, 0, len(pendingQueries))
+		for query := range pendingQueries {
+			queries = append(queries, query)
+		}
+		sort.Strings(queries)
+
+		logger.Log.Debugf("Looking up the providers of %d capabilities using repos args: %v", len(queries), reposArgs)
+
+		var foundProviders map[string][]string
+		err = r.withMirrorFailover(func() (err error) {
+			foundProviders, err = r.batchProvides.whatProvidesBatch(queries, reposArgs)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for query, packageNames := range foundProviders {
+			keys, pending := pendingQueries[query]
+			if !pending || len(packageNames) == 0 {
+				continue
+			}
+
+			for _, key := range keys {
+				providers[key] = append([]string(nil), packageNames...)
+			}
+			delete(pendingQueries, query)
+		}
+	}
+
+	logger.Log.Debugf("Resolved %d of %d capabilities with batched lookups.", len(providers), len(pkgVers))
+	return
+}
+
+// whatProvidesOneByOne resolves each PackageVer with its own WhatProvides lookup.
+func (r *RpmRepoCloner) whatProvidesOneByOne(pkgVers []*pkgjson.PackageVer) (providers map[string][]string, err error) {
+	providers = make(map[string][]string)
+	for _, pkgVer := range pkgVers {
+		key := pkgVer.String()
+		if _, found := providers[key]; found {
+			continue
+		}
+
+		packageNames, lookupErr := r.WhatProvides(pkgVer)
+		if errors.Is(lookupErr, ErrPackageNotFound) {
+			continue
+		}
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		providers[key] = packageNames
+	}
+
+	return
+}
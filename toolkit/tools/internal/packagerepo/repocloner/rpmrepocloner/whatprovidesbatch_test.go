@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpmrepocloner
+
+import (
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingBatchBackend serves batched lookups from 'providers', keyed by repos args and then by query,
+// and records the queries of every call.
+type recordingBatchBackend struct {
+	providers map[string]map[string][]string
+	calls     [][]string
+}
+
+func (b *recordingBatchBackend) whatProvidesBatch(provideQueries []string, reposArgs []string) (providers map[string][]string, err error) {
+	b.calls = append(b.calls, provideQueries)
+
+	providers = make(map[string][]string)
+	for _, query := range provideQueries {
+		if packageNames, found := b.providers[reposArgs[0]][query]; found {
+			providers[query] = packageNames
+		}
+	}
+	return
+}
+
+func TestShouldResolveCapabilitiesWithSingleBatchedLookup(t *testing.T) {
+	backend := &recordingBatchBackend{
+		providers: map[string]map[string][]string{
+			"--remote": {
+				"bash":               {"bash-5.1.8-2.cm2.x86_64"},
+				"gcc-12.2.0":         {"gcc-12.2.0-1.cm2.x86_64"},
+				"libz.so.1()(64bit)": {"zlib-1.2.13-1.cm2.x86_64"},
+			},
+		},
+	}
+	cloner := &RpmRepoCloner{batchProvides: backend, reposArgsList: [][]string{{"--remote"}}}
+
+	pkgVers := []*pkgjson.PackageVer{
+		{Name: "bash"},
+		{Name: "gcc", Condition: "=", Version: "12.2.0"},
+		{Name: "libz.so.1()(64bit)"},
+		{Name: "missing"},
+	}
+	providers, err := cloner.WhatProvidesBatch(pkgVers)
+	assert.NoError(t, err)
+	assert.True(t, cloner.SupportsBatchProvides())
+
+	assert.Equal(t, [][]string{{"bash", "gcc-12.2.0", "libz.so.1()(64bit)", "missing"}}, backend.calls)
+	assert.Equal(t, map[string][]string{
+		pkgVers[0].String(): {"bash-5.1.8-2.cm2.x86_64"},
+		pkgVers[1].String(): {"gcc-12.2.0-1.cm2.x86_64"},
+		pkgVers[2].String(): {"zlib-1.2.13-1.cm2.x86_64"},
+	}, providers)
+}
+
+func TestShouldOnlyQueryLaterReposForUnresolvedCapabilities(t *testing.T) {
+	backend := &recordingBatchBackend{
+		providers: map[string]map[string][]string{
+			"--local": {
+				"bash": {"bash-5.1.8-2.cm2.x86_64"},
+			},
+			"--remote": {
+				"bash": {"bash-5.2.15-1.cm2.x86_64"},
+				"zlib": {"zlib-1.2.13-1.cm2.x86_64"},
+			},
+		},
+	}
+	cloner := &RpmRepoCloner{batchProvides: backend, reposArgsList: [][]string{{"--local"}, {"--remote"}}}
+
+	pkgVers := []*pkgjson.PackageVer{{Name: "bash"}, {Name: "zlib"}, {Name: "bash"}}
+	providers, err := cloner.WhatProvidesBatch(pkgVers)
+	assert.NoError(t, err)
+
+	assert.Equal(t, [][]string{{"bash", "zlib"}, {"zlib"}}, backend.calls)
+	assert.Equal(t, map[string][]string{
+		pkgVers[0].String(): {"bash-5.1.8-2.cm2.x86_64"},
+		pkgVers[1].String(): {"zlib-1.2.13-1.cm2.x86_64"},
+	}, providers)
+}
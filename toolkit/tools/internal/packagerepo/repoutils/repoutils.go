@@ -4,8 +4,12 @@
 package repoutils
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
@@ -15,6 +19,43 @@ import (
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
 )
 
+// Supported formats of the cloned repo contents summary.
+const (
+	// SummaryFormatFlat is the legacy format, a flat list of packages.
+	SummaryFormatFlat = "flat"
+	// SummaryFormatJSONGrouped groups packages by the repo they were cloned from and their architecture.
+	SummaryFormatJSONGrouped = "json-grouped"
+)
+
+// SummaryFormats lists all valid summary formats.
+var SummaryFormats = []string{SummaryFormatFlat, SummaryFormatJSONGrouped}
+
+// Supported algorithms of the checksums recorded in the cloned repo contents summary.
+const (
+	ChecksumAlgorithmSHA256 = "sha256"
+	ChecksumAlgorithmSHA512 = "sha512"
+
+	// checksumSeparator separates the algorithm from the hash in a recorded checksum.
+	checksumSeparator = ":"
+)
+
+// ChecksumAlgorithms lists all valid checksum algorithms.
+var ChecksumAlgorithms = []string{ChecksumAlgorithmSHA256, ChecksumAlgorithmSHA512}
+
+// GroupedRepoContents is the 'json-grouped' summary of a cloner's repo contents.
+type GroupedRepoContents struct {
+	Format string                                      `json:"Format"`
+	Repos  map[string]map[string][]*GroupedRepoPackage `json:"Repos"` // Repo ID -> architecture -> packages
+}
+
+// GroupedRepoPackage represents a package in a 'json-grouped' summary.
+type GroupedRepoPackage struct {
+	Name         string `json:"Name"`         // Name of the package
+	Version      string `json:"Version"`      // Version number of the package
+	Distribution string `json:"Distribution"` // Distribution tag of the package
+	Checksum     string `json:"Checksum"`     // "<algorithm>:<hash>" checksum of the package's RPM, empty if it could not be calculated
+}
+
 // RestoreClonedRepoContents restores a cloner's repo contents using a JSON file at `srcFile`.
 // Will convert the cloned content into a repo and verify its content is correct.
 //
@@ -22,6 +63,13 @@ import (
 // cache (with exception of the toolchain packages) then this routine will return an error.
 // This is done to ensure the cache only contains the desired packages.
 func RestoreClonedRepoContents(cloner repocloner.RepoCloner, srcFile string) (err error) {
+	const validateChecksums = true
+	return RestoreClonedRepoContentsWithValidation(cloner, srcFile, validateChecksums)
+}
+
+// RestoreClonedRepoContentsWithValidation restores a cloner's repo contents like RestoreClonedRepoContents.
+// If `validateChecksums` is set, every restored RPM is hashed and compared against the checksum recorded in the summary.
+func RestoreClonedRepoContentsWithValidation(cloner repocloner.RepoCloner, srcFile string, validateChecksums bool) (err error) {
 	const cloneDeps = false
 
 	timestamp.StartEvent("restoring cloned repo", nil)
@@ -29,8 +77,7 @@ func RestoreClonedRepoContents(cloner repocloner.RepoCloner, srcFile string) (er
 
 	logger.Log.Infof("Restoring cloned repository contents from (%s).", srcFile)
 
-	var repo *repocloner.RepoContents
-	err = jsonutils.ReadJSONFile(srcFile, &repo)
+	repo, err := readClonedRepoContents(srcFile)
 	if err != nil {
 		return
 	}
@@ -55,11 +102,27 @@ func RestoreClonedRepoContents(cloner repocloner.RepoCloner, srcFile string) (er
 		return
 	}
 
-	return verifyClonedRepoContents(clonedRepo.Repo, uniquePackages)
+	err = verifyClonedRepoContents(clonedRepo.Repo, uniquePackages)
+	if err != nil {
+		return
+	}
+
+	if !validateChecksums {
+		logger.Log.Warnf("Skipping the checksum validation of the restored packages.")
+		return
+	}
+
+	return verifyChecksums(uniquePackages, cloner.CloneDirectory())
 }
 
-// SaveClonedRepoContents saves a cloner's repo contents to a JSON file at `dstFile`.
+// SaveClonedRepoContents saves a cloner's repo contents to a JSON file at `dstFile` using the legacy flat format.
 func SaveClonedRepoContents(cloner repocloner.RepoCloner, dstFile string) (err error) {
+	return SaveClonedRepoContentsInFormat(cloner, dstFile, SummaryFormatFlat, ChecksumAlgorithmSHA256)
+}
+
+// SaveClonedRepoContentsInFormat saves a cloner's repo contents to a JSON file at `dstFile` using one of the SummaryFormats.
+// Checksums, if the format records them, are calculated with `checksumAlgorithm`, one of the ChecksumAlgorithms.
+func SaveClonedRepoContentsInFormat(cloner repocloner.RepoCloner, dstFile, format, checksumAlgorithm string) (err error) {
 	timestamp.StartEvent("saving cloned repo contents", nil)
 	defer timestamp.StopEvent(nil)
 
@@ -68,10 +131,203 @@ func SaveClonedRepoContents(cloner repocloner.RepoCloner, dstFile string) (err e
 		return
 	}
 
-	err = jsonutils.WriteJSONFile(dstFile, repo)
+	switch format {
+	case SummaryFormatFlat:
+		err = addChecksums(repo, cloner.CloneDirectory(), checksumAlgorithm)
+		if err != nil {
+			return
+		}
+		err = jsonutils.WriteJSONFile(dstFile, repo)
+	case SummaryFormatJSONGrouped:
+		var grouped *GroupedRepoContents
+
+		grouped, err = groupRepoContents(repo, cloner.CloneDirectory(), checksumAlgorithm)
+		if err != nil {
+			return
+		}
+		err = jsonutils.WriteJSONFile(dstFile, grouped)
+	default:
+		err = fmt.Errorf("unsupported summary format (%s), expected one of: %v", format, SummaryFormats)
+	}
+
 	return
 }
 
+// readClonedRepoContents reads a summary of a cloner's repo contents in any of the SummaryFormats.
+func readClonedRepoContents(srcFile string) (repo *repocloner.RepoContents, err error) {
+	data, err := os.ReadFile(srcFile)
+	if err != nil {
+		return
+	}
+
+	var grouped GroupedRepoContents
+	err = json.Unmarshal(data, &grouped)
+	if err != nil {
+		return
+	}
+
+	if grouped.Format != SummaryFormatJSONGrouped {
+		err = json.Unmarshal(data, &repo)
+		return
+	}
+
+	repo = &repocloner.RepoContents{}
+	for repoID, architectures := range grouped.Repos {
+		for architecture, packages := range architectures {
+			for _, pkg := range packages {
+				repo.Repo = append(repo.Repo, &repocloner.RepoPackage{
+					Name:         pkg.Name,
+					Version:      pkg.Version,
+					Architecture: architecture,
+					Distribution: pkg.Distribution,
+					Repo:         repoID,
+					Checksum:     pkg.Checksum,
+				})
+			}
+		}
+	}
+
+	// Map iteration is random, keep the restored order stable.
+	sort.Slice(repo.Repo, func(i, j int) bool {
+		return repo.Repo[i].ID() < repo.Repo[j].ID()
+	})
+
+	return
+}
+
+// groupRepoContents converts a flat list of packages into the 'json-grouped' summary format.
+func groupRepoContents(repo *repocloner.RepoContents, cloneDirectory, checksumAlgorithm string) (grouped *GroupedRepoContents, err error) {
+	// Fail early instead of silently recording no checksums.
+	_, err = GenerateChecksum(os.DevNull, checksumAlgorithm)
+	if err != nil {
+		return
+	}
+
+	grouped = &GroupedRepoContents{
+		Format: SummaryFormatJSONGrouped,
+		Repos:  make(map[string]map[string][]*GroupedRepoPackage),
+	}
+
+	for _, pkg := range repo.Repo {
+		if grouped.Repos[pkg.Repo] == nil {
+			grouped.Repos[pkg.Repo] = make(map[string][]*GroupedRepoPackage)
+		}
+
+		grouped.Repos[pkg.Repo][pkg.Architecture] = append(grouped.Repos[pkg.Repo][pkg.Architecture], &GroupedRepoPackage{
+			Name:         pkg.Name,
+			Version:      pkg.Version,
+			Distribution: pkg.Distribution,
+			Checksum:     packageChecksum(pkg, cloneDirectory, checksumAlgorithm),
+		})
+	}
+
+	return
+}
+
+// addChecksums records the checksum of each package's RPM for the 'flat' summary format.
+func addChecksums(repo *repocloner.RepoContents, cloneDirectory, checksumAlgorithm string) (err error) {
+	// Fail early instead of silently recording no checksums.
+	_, err = GenerateChecksum(os.DevNull, checksumAlgorithm)
+	if err != nil {
+		return
+	}
+
+	for _, pkg := range repo.Repo {
+		pkg.Checksum = packageChecksum(pkg, cloneDirectory, checksumAlgorithm)
+	}
+
+	return
+}
+
+// packageChecksum calculates the checksum of a package's RPM, returning an empty string if it could not be calculated.
+func packageChecksum(pkg *repocloner.RepoPackage, cloneDirectory, checksumAlgorithm string) (checksum string) {
+	rpmPath := filepath.Join(cloneDirectory, rpmFileName(pkg))
+	checksum, err := GenerateChecksum(rpmPath, checksumAlgorithm)
+	if err != nil {
+		logger.Log.Warnf("Failed to calculate the checksum of (%s): %s", rpmPath, err)
+	}
+
+	return
+}
+
+// GenerateChecksum calculates the checksum of a file with one of the ChecksumAlgorithms.
+// The checksum is prefixed with the algorithm, for example: "sha256:<hash>".
+func GenerateChecksum(path, algorithm string) (checksum string, err error) {
+	var hash string
+
+	switch algorithm {
+	case ChecksumAlgorithmSHA256:
+		hash, err = file.GenerateSHA256(path)
+	case ChecksumAlgorithmSHA512:
+		hash, err = file.GenerateSHA512(path)
+	default:
+		err = fmt.Errorf("unsupported checksum algorithm (%s), expected one of: %v", algorithm, ChecksumAlgorithms)
+	}
+
+	if err != nil {
+		return
+	}
+
+	checksum = algorithm + checksumSeparator + hash
+	return
+}
+
+// VerifyChecksum checks a file against a checksum generated by GenerateChecksum.
+// Checksums without an algorithm prefix are assumed to be SHA256, as recorded by older summaries.
+func VerifyChecksum(path, checksum string) (err error) {
+	algorithm := ChecksumAlgorithmSHA256
+	if prefix, _, found := strings.Cut(checksum, checksumSeparator); found {
+		algorithm = prefix
+	} else {
+		checksum = algorithm + checksumSeparator + checksum
+	}
+
+	actualChecksum, err := GenerateChecksum(path, algorithm)
+	if err != nil {
+		return
+	}
+
+	if actualChecksum != checksum {
+		err = fmt.Errorf("checksum mismatch for (%s): expected (%s), got (%s)", path, checksum, actualChecksum)
+	}
+
+	return
+}
+
+// verifyChecksums verifies the RPMs of all packages with a recorded checksum, reporting every mismatch.
+// Packages without a checksum, e.g. from summaries saved before checksums were recorded, are only warned about.
+func verifyChecksums(packages []*repocloner.RepoPackage, cloneDirectory string) (err error) {
+	uncheckedPackages := 0
+	mismatchedPackages := []string{}
+	for _, pkg := range packages {
+		if pkg.Checksum == "" {
+			uncheckedPackages++
+			continue
+		}
+
+		checksumErr := VerifyChecksum(filepath.Join(cloneDirectory, rpmFileName(pkg)), pkg.Checksum)
+		if checksumErr != nil {
+			logger.Log.Errorf("Restored package (%s) failed checksum validation: %s", pkg.ID(), checksumErr)
+			mismatchedPackages = append(mismatchedPackages, pkg.ID())
+		}
+	}
+
+	if uncheckedPackages > 0 {
+		logger.Log.Warnf("%d restored package(s) have no recorded checksum and were not validated. Save the summary again to record them.", uncheckedPackages)
+	}
+
+	if len(mismatchedPackages) > 0 {
+		return fmt.Errorf("%d restored package(s) failed checksum validation: %v", len(mismatchedPackages), mismatchedPackages)
+	}
+
+	return
+}
+
+// rpmFileName returns the expected file name of a package's RPM.
+func rpmFileName(pkg *repocloner.RepoPackage) string {
+	return fmt.Sprintf("%s-%s.%s.%s.rpm", pkg.Name, pkg.Version, pkg.Distribution, pkg.Architecture)
+}
+
 func removePackageDuplicates(packages []*repocloner.RepoPackage) []*repocloner.RepoPackage {
 	index := 0
 	seen := make(map[string]bool)
@@ -98,7 +354,7 @@ func filterOutDownloadedPackage(packages []*repocloner.RepoPackage, cloneDirecto
 		pkgVersion := fmt.Sprintf("%s.%s", pkg.Version, pkg.Distribution)
 
 		// Skip packages that are already present, this is expected for the toolchain
-		rpmName := fmt.Sprintf("%s-%s.%s.rpm", pkg.Name, pkgVersion, pkg.Architecture)
+		rpmName := rpmFileName(pkg)
 		expectedFile := filepath.Join(cloneDirectory, rpmName)
 
 		exists, _ := file.PathExists(expectedFile)
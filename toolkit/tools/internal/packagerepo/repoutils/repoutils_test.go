@@ -0,0 +1,238 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package repoutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRepoContents = &repocloner.RepoContents{
+	Repo: []*repocloner.RepoPackage{
+		{Name: "pkgA", Version: "1.0-1", Architecture: "x86_64", Distribution: "cm2", Repo: "fetcher-cloned-repo"},
+		{Name: "pkgB", Version: "2.0-3", Architecture: "noarch", Distribution: "cm2", Repo: "fetcher-cloned-repo"},
+	},
+}
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+func TestShouldReadFlatSummary(t *testing.T) {
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+	err := jsonutils.WriteJSONFile(summaryFile, testRepoContents)
+	assert.NoError(t, err)
+
+	repo, err := readClonedRepoContents(summaryFile)
+	assert.NoError(t, err)
+	assert.Len(t, repo.Repo, 2)
+	assert.Equal(t, testRepoContents.Repo[0].ID(), repo.Repo[0].ID())
+	assert.Equal(t, testRepoContents.Repo[1].ID(), repo.Repo[1].ID())
+}
+
+func TestShouldReadGroupedSummary(t *testing.T) {
+	cloneDir := t.TempDir()
+	rpmPath := filepath.Join(cloneDir, rpmFileName(testRepoContents.Repo[0]))
+	err := os.WriteFile(rpmPath, []byte("not a real rpm"), os.ModePerm)
+	assert.NoError(t, err)
+
+	grouped, err := groupRepoContents(testRepoContents, cloneDir, ChecksumAlgorithmSHA256)
+	assert.NoError(t, err)
+	assert.Equal(t, SummaryFormatJSONGrouped, grouped.Format)
+	assert.Len(t, grouped.Repos["fetcher-cloned-repo"]["x86_64"], 1)
+	assert.NotEmpty(t, grouped.Repos["fetcher-cloned-repo"]["x86_64"][0].Checksum)
+	// The RPM of 'pkgB' is missing, so its checksum is unknown.
+	assert.Empty(t, grouped.Repos["fetcher-cloned-repo"]["noarch"][0].Checksum)
+
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+	err = jsonutils.WriteJSONFile(summaryFile, grouped)
+	assert.NoError(t, err)
+
+	repo, err := readClonedRepoContents(summaryFile)
+	assert.NoError(t, err)
+	assert.Len(t, repo.Repo, 2)
+	assert.Equal(t, testRepoContents.Repo[0].ID(), repo.Repo[0].ID())
+	assert.Equal(t, testRepoContents.Repo[1].ID(), repo.Repo[1].ID())
+	assert.Equal(t, "fetcher-cloned-repo", repo.Repo[0].Repo)
+	assert.Equal(t, grouped.Repos["fetcher-cloned-repo"]["x86_64"][0].Checksum, repo.Repo[0].Checksum)
+}
+
+func TestShouldGenerateAndVerifyPrefixedChecksums(t *testing.T) {
+	testFile := filepath.Join(t.TempDir(), "test.rpm")
+	err := os.WriteFile(testFile, []byte("not a real rpm"), os.ModePerm)
+	assert.NoError(t, err)
+
+	for _, algorithm := range ChecksumAlgorithms {
+		checksum, err := GenerateChecksum(testFile, algorithm)
+		assert.NoError(t, err)
+		assert.True(t, strings.HasPrefix(checksum, algorithm+":"))
+		assert.NoError(t, VerifyChecksum(testFile, checksum))
+	}
+
+	_, err = GenerateChecksum(testFile, "md5")
+	assert.Error(t, err)
+
+	// A valid hash recorded under the wrong algorithm must not match.
+	sha256Checksum, err := GenerateChecksum(testFile, ChecksumAlgorithmSHA256)
+	assert.NoError(t, err)
+	assert.Error(t, VerifyChecksum(testFile, strings.Replace(sha256Checksum, ChecksumAlgorithmSHA256, ChecksumAlgorithmSHA512, 1)))
+}
+
+func TestShouldVerifyLegacyUnprefixedChecksums(t *testing.T) {
+	testFile := filepath.Join(t.TempDir(), "test.rpm")
+	err := os.WriteFile(testFile, []byte("not a real rpm"), os.ModePerm)
+	assert.NoError(t, err)
+
+	legacyChecksum, err := file.GenerateSHA256(testFile)
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyChecksum(testFile, legacyChecksum))
+
+	err = os.WriteFile(testFile, []byte("corrupted rpm"), os.ModePerm)
+	assert.NoError(t, err)
+	assert.Error(t, VerifyChecksum(testFile, legacyChecksum))
+}
+
+// fakeCloner serves a fixed set of packages from a clone directory, pretending they are always cloned.
+type fakeCloner struct {
+	cloneDir string
+	contents *repocloner.RepoContents
+}
+
+func (f *fakeCloner) Clone(cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, err error) {
+	return
+}
+
+func (f *fakeCloner) CloneDirectory() string {
+	return f.cloneDir
+}
+
+func (f *fakeCloner) ClonedRepoContents() (repoContents *repocloner.RepoContents, err error) {
+	repoContents = &repocloner.RepoContents{}
+	for _, pkg := range f.contents.Repo {
+		pkgCopy := *pkg
+		repoContents.Repo = append(repoContents.Repo, &pkgCopy)
+	}
+	return
+}
+
+func (f *fakeCloner) Close() error {
+	return nil
+}
+
+func (f *fakeCloner) ConvertDownloadedPackagesIntoRepo() error {
+	return nil
+}
+
+func (f *fakeCloner) WhatProvides(pkgVer *pkgjson.PackageVer) (packageNames []string, err error) {
+	return
+}
+
+func newFakeCloner(t *testing.T) *fakeCloner {
+	cloner := &fakeCloner{cloneDir: t.TempDir(), contents: testRepoContents}
+	for _, pkg := range testRepoContents.Repo {
+		err := os.WriteFile(filepath.Join(cloner.cloneDir, rpmFileName(pkg)), []byte(pkg.ID()), os.ModePerm)
+		assert.NoError(t, err)
+	}
+	return cloner
+}
+
+func TestShouldRecordChecksumsInFlatSummary(t *testing.T) {
+	cloner := newFakeCloner(t)
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+	assert.NoError(t, SaveClonedRepoContents(cloner, summaryFile))
+
+	repo, err := readClonedRepoContents(summaryFile)
+	assert.NoError(t, err)
+	for _, pkg := range repo.Repo {
+		assert.True(t, strings.HasPrefix(pkg.Checksum, ChecksumAlgorithmSHA256+":"), pkg.ID())
+	}
+
+	assert.NoError(t, RestoreClonedRepoContents(cloner, summaryFile))
+}
+
+func TestShouldDetectCorruptedRestoredPackage(t *testing.T) {
+	cloner := newFakeCloner(t)
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+	assert.NoError(t, SaveClonedRepoContents(cloner, summaryFile))
+
+	corruptedRPM := filepath.Join(cloner.cloneDir, rpmFileName(testRepoContents.Repo[1]))
+	assert.NoError(t, os.WriteFile(corruptedRPM, []byte("corrupted rpm"), os.ModePerm))
+
+	err := RestoreClonedRepoContents(cloner, summaryFile)
+	assert.ErrorContains(t, err, testRepoContents.Repo[1].ID())
+	assert.NotContains(t, err.Error(), testRepoContents.Repo[0].ID())
+
+	const validateChecksums = false
+	assert.NoError(t, RestoreClonedRepoContentsWithValidation(cloner, summaryFile, validateChecksums))
+}
+
+func TestShouldRestoreSummaryWithoutChecksums(t *testing.T) {
+	cloner := newFakeCloner(t)
+	summaryFile := filepath.Join(t.TempDir(), "summary.json")
+	assert.NoError(t, jsonutils.WriteJSONFile(summaryFile, testRepoContents))
+
+	summary, err := os.ReadFile(summaryFile)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(summary), "Checksum")
+
+	assert.NoError(t, RestoreClonedRepoContents(cloner, summaryFile))
+}
+
+// restoringCloner starts with an empty clone directory and clones the RPMs of the packages it knows about, with the
+// same contents as newFakeCloner writes.
+type restoringCloner struct {
+	fakeCloner
+	clonedPackages []string
+}
+
+func (r *restoringCloner) Clone(cloneDeps bool, packagesToClone ...*pkgjson.PackageVer) (allPackagesPrebuilt bool, err error) {
+	for _, pkgVer := range packagesToClone {
+		r.clonedPackages = append(r.clonedPackages, fmt.Sprintf("%s%s%s", pkgVer.Name, pkgVer.Condition, pkgVer.Version))
+		for _, pkg := range r.contents.Repo {
+			if pkg.Name == pkgVer.Name && fmt.Sprintf("%s.%s", pkg.Version, pkg.Distribution) == pkgVer.Version {
+				err = os.WriteFile(filepath.Join(r.cloneDir, rpmFileName(pkg)), []byte(pkg.ID()), os.ModePerm)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+func TestShouldRestoreSameCloneSetFromAllSummaryFormats(t *testing.T) {
+	for _, format := range SummaryFormats {
+		t.Run(format, func(t *testing.T) {
+			summaryFile := filepath.Join(t.TempDir(), "summary.json")
+			assert.NoError(t, SaveClonedRepoContentsInFormat(newFakeCloner(t), summaryFile, format, ChecksumAlgorithmSHA512))
+
+			repo, err := readClonedRepoContents(summaryFile)
+			assert.NoError(t, err)
+			assert.Len(t, repo.Repo, len(testRepoContents.Repo))
+			for i, pkg := range repo.Repo {
+				assert.Equal(t, testRepoContents.Repo[i].ID(), pkg.ID())
+				// The legacy flat summary does not record the source repo.
+				if format == SummaryFormatJSONGrouped {
+					assert.Equal(t, testRepoContents.Repo[i].Repo, pkg.Repo)
+				}
+				assert.True(t, strings.HasPrefix(pkg.Checksum, ChecksumAlgorithmSHA512+":"), pkg.ID())
+			}
+
+			cloner := &restoringCloner{fakeCloner: fakeCloner{cloneDir: t.TempDir(), contents: testRepoContents}}
+			assert.NoError(t, RestoreClonedRepoContents(cloner, summaryFile))
+			assert.Equal(t, []string{"pkgA=1.0-1.cm2", "pkgB=2.0-3.cm2"}, cloner.clonedPackages)
+		})
+	}
+}
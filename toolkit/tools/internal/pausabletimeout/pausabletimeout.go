@@ -0,0 +1,122 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Contexts with a timeout which can be paused while waiting for a shared resource.
+
+package pausabletimeout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// timeoutKey looks up the pausableTimeout of a context.
+type timeoutKey struct{}
+
+// pausableTimeout is a context expiring once its holder spent 'timeout' working. Its timer is paused while the holder
+// waits in Lock, so work queued behind a shared resource isn't charged for the time others spend using it.
+type pausableTimeout struct {
+	context.Context
+	cancel context.CancelFunc
+
+	lock      sync.Mutex
+	timer     *time.Timer
+	remaining time.Duration
+	started   time.Time // When the timer last started running
+	paused    bool
+	expired   bool
+}
+
+// WithTimeout returns a copy of 'ctx' expiring with context.DeadlineExceeded once 'timeout' ran out. Unlike
+// context.WithTimeout, the timeout doesn't run while the returned context waits in Lock.
+func WithTimeout(ctx context.Context, timeout time.Duration) (timeoutCtx context.Context, cancel context.CancelFunc) {
+	cancelCtx, cancelFunc := context.WithCancel(ctx)
+	t := &pausableTimeout{
+		Context:   cancelCtx,
+		cancel:    cancelFunc,
+		remaining: timeout,
+		started:   time.Now(),
+	}
+	t.timer = time.AfterFunc(timeout, t.expire)
+
+	cancel = func() {
+		t.timer.Stop()
+		t.cancel()
+	}
+	return t, cancel
+}
+
+func (t *pausableTimeout) expire() {
+	t.lock.Lock()
+	t.expired = true
+	t.lock.Unlock()
+	t.cancel()
+}
+
+// Deadline returns when the context times out if it doesn't have to wait for any more locks.
+func (t *pausableTimeout) Deadline() (deadline time.Time, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.paused {
+		return time.Now().Add(t.remaining), true
+	}
+	return t.started.Add(t.remaining), true
+}
+
+// Err returns context.DeadlineExceeded once the context timed out.
+func (t *pausableTimeout) Err() error {
+	t.lock.Lock()
+	expired := t.expired
+	t.lock.Unlock()
+
+	if expired {
+		return context.DeadlineExceeded
+	}
+	return t.Context.Err()
+}
+
+func (t *pausableTimeout) Value(key interface{}) interface{} {
+	if key == (timeoutKey{}) {
+		return t
+	}
+	return t.Context.Value(key)
+}
+
+func (t *pausableTimeout) pause() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.expired || !t.timer.Stop() {
+		return
+	}
+	t.remaining -= time.Since(t.started)
+	t.paused = true
+}
+
+func (t *pausableTimeout) resume() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.paused {
+		return
+	}
+	t.paused = false
+	t.started = time.Now()
+	t.timer.Reset(t.remaining)
+}
+
+// Lock locks 'lock' on behalf of 'ctx'. If 'ctx' was derived from WithTimeout, its timeout doesn't run while
+// it waits.
+func Lock(ctx context.Context, lock sync.Locker) {
+	t, found := ctx.Value(timeoutKey{}).(*pausableTimeout)
+	if !found {
+		lock.Lock()
+		return
+	}
+
+	t.pause()
+	lock.Lock()
+	t.resume()
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pausabletimeout
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testTimeout = 100 * time.Millisecond
+
+func TestShouldExpireAfterTimeout(t *testing.T) {
+	ctx, cancel := WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(testTimeout), deadline, testTimeout)
+
+	<-ctx.Done()
+	assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+}
+
+func TestShouldCancelWithParent(t *testing.T) {
+	parent, cancelParent := context.WithCancel(context.Background())
+	ctx, cancel := WithTimeout(parent, time.Hour)
+	defer cancel()
+
+	cancelParent()
+	<-ctx.Done()
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestShouldPauseTimeoutWhileWaitingForLock(t *testing.T) {
+	ctx, cancel := WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	lock := sync.Mutex{}
+	lock.Lock()
+	go func() {
+		time.Sleep(2 * testTimeout)
+		lock.Unlock()
+	}()
+
+	Lock(ctx, &lock)
+	lock.Unlock()
+	assert.NoError(t, ctx.Err())
+
+	<-ctx.Done()
+	assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+}
+
+func TestShouldLockWithoutTimeout(t *testing.T) {
+	lock := sync.Mutex{}
+	Lock(context.Background(), &lock)
+	lock.Unlock()
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/simple"
+	"gonum.org/v1/gonum/graph/topo"
+)
+
+// TopologicalBuildOrder returns the build nodes of the graph ordered so every build node comes after the build nodes it
+// depends on. A build node depends on another one if it reaches it through nodes which are not build nodes, usually the
+// run node of the other package, so run-time only cycles do not affect the order. Fails if the build nodes depend on
+// each other in a cycle, naming the nodes of each cycle.
+func (g *PkgGraph) TopologicalBuildOrder() (orderedNodes []*PkgNode, err error) {
+	buildGraph := simple.NewDirectedGraph()
+	buildNodes := make(map[int64]*PkgNode)
+	for _, node := range g.AllNodes() {
+		if node.Type == TypeLocalBuild {
+			buildNodes[node.ID()] = node
+			buildGraph.AddNode(simple.Node(node.ID()))
+		}
+	}
+
+	selfDependencies := []string{}
+	for id, buildNode := range buildNodes {
+		for _, dependencyID := range g.buildDependencies(buildNode) {
+			if dependencyID == id {
+				selfDependencies = append(selfDependencies, buildNode.FriendlyName())
+				continue
+			}
+			buildGraph.SetEdge(buildGraph.NewEdge(simple.Node(id), simple.Node(dependencyID)))
+		}
+	}
+
+	if len(selfDependencies) > 0 {
+		sort.Strings(selfDependencies)
+		return nil, fmt.Errorf("build nodes depend on themselves: %s", strings.Join(selfDependencies, ", "))
+	}
+
+	sorted, err := topo.SortStabilized(buildGraph, sortNodesByID)
+	if err != nil {
+		cycles, isUnorderable := err.(topo.Unorderable)
+		if !isUnorderable {
+			return nil, err
+		}
+		return nil, fmt.Errorf("build dependency cycle(s) found: %s", formatBuildCycles(cycles, buildNodes))
+	}
+
+	// Edges point from a dependant to its dependency, so the topological order must be reversed.
+	orderedNodes = make([]*PkgNode, 0, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		orderedNodes = append(orderedNodes, buildNodes[sorted[i].ID()])
+	}
+
+	return
+}
+
+// buildDependencies returns the IDs of the build nodes reachable from 'buildNode' without passing through
+// another build node.
+func (g *PkgGraph) buildDependencies(buildNode *PkgNode) (dependencyIDs []int64) {
+	visited := map[int64]bool{buildNode.ID(): true}
+	toVisit := []int64{buildNode.ID()}
+	for len(toVisit) > 0 {
+		currentID := toVisit[len(toVisit)-1]
+		toVisit = toVisit[:len(toVisit)-1]
+
+		successors := g.From(currentID)
+		for successors.Next() {
+			successor := successors.Node().(*PkgNode).This
+			if successor.Type == TypeLocalBuild {
+				dependencyIDs = append(dependencyIDs, successor.ID())
+				continue
+			}
+
+			if !visited[successor.ID()] {
+				visited[successor.ID()] = true
+				toVisit = append(toVisit, successor.ID())
+			}
+		}
+	}
+
+	return
+}
+
+// formatBuildCycles lists the friendly names of the build nodes in each cycle, e.g. "{a, b}; {c, d}".
+func formatBuildCycles(cycles topo.Unorderable, buildNodes map[int64]*PkgNode) string {
+	formattedCycles := make([]string, 0, len(cycles))
+	for _, cycle := range cycles {
+		names := make([]string, 0, len(cycle))
+		for _, node := range cycle {
+			names = append(names, buildNodes[node.ID()].FriendlyName())
+		}
+		sort.Strings(names)
+		formattedCycles = append(formattedCycles, fmt.Sprintf("{%s}", strings.Join(names, ", ")))
+	}
+	sort.Strings(formattedCycles)
+
+	return strings.Join(formattedCycles, "; ")
+}
+
+func sortNodesByID(nodes []graph.Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID() < nodes[j].ID()
+	})
+}
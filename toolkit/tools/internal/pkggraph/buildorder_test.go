@@ -0,0 +1,88 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+// addLocalPackage adds the run and build nodes of a local package to the graph.
+func addLocalPackage(t *testing.T, g *PkgGraph, name string) (runNode, buildNode *PkgNode) {
+	pkgVer := &pkgjson.PackageVer{Name: name, Version: "1.0", Condition: "="}
+
+	runNode, err := g.AddPkgNode(pkgVer, StateMeta, TypeLocalRun, NoSRPMPath, NoRPMPath, NoSpecPath, NoSourceDir, "x86_64", NoSourceRepo)
+	assert.NoError(t, err)
+	buildNode, err = g.AddPkgNode(pkgVer, StateBuild, TypeLocalBuild, NoSRPMPath, NoRPMPath, NoSpecPath, NoSourceDir, "x86_64", NoSourceRepo)
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(runNode, buildNode))
+	return
+}
+
+func buildOrderPositions(orderedNodes []*PkgNode) (positions map[string]int) {
+	positions = make(map[string]int)
+	for i, node := range orderedNodes {
+		positions[node.VersionedPkg.Name] = i
+	}
+	return
+}
+
+func TestTopologicalBuildOrderOfDiamond(t *testing.T) {
+	g := NewPkgGraph()
+	_, buildA := addLocalPackage(t, g, "a")
+	runB, buildB := addLocalPackage(t, g, "b")
+	runC, buildC := addLocalPackage(t, g, "c")
+	runD, _ := addLocalPackage(t, g, "d")
+
+	assert.NoError(t, g.AddEdge(buildA, runB))
+	assert.NoError(t, g.AddEdge(buildA, runC))
+	assert.NoError(t, g.AddEdge(buildB, runD))
+	assert.NoError(t, g.AddEdge(buildC, runD))
+
+	orderedNodes, err := g.TopologicalBuildOrder()
+	assert.NoError(t, err)
+	assert.Len(t, orderedNodes, 4)
+	for _, node := range orderedNodes {
+		assert.Equal(t, TypeLocalBuild, node.Type)
+	}
+
+	positions := buildOrderPositions(orderedNodes)
+	assert.Less(t, positions["d"], positions["b"])
+	assert.Less(t, positions["d"], positions["c"])
+	assert.Less(t, positions["b"], positions["a"])
+	assert.Less(t, positions["c"], positions["a"])
+}
+
+func TestTopologicalBuildOrderIgnoresRunCycles(t *testing.T) {
+	g := NewPkgGraph()
+	_, buildA := addLocalPackage(t, g, "a")
+	runB, _ := addLocalPackage(t, g, "b")
+	runC, _ := addLocalPackage(t, g, "c")
+
+	assert.NoError(t, g.AddEdge(buildA, runB))
+	assert.NoError(t, g.AddEdge(runB, runC))
+	assert.NoError(t, g.AddEdge(runC, runB))
+
+	orderedNodes, err := g.TopologicalBuildOrder()
+	assert.NoError(t, err)
+
+	positions := buildOrderPositions(orderedNodes)
+	assert.Less(t, positions["b"], positions["a"])
+	assert.Less(t, positions["c"], positions["a"])
+}
+
+func TestTopologicalBuildOrderFailsOnCycle(t *testing.T) {
+	g := NewPkgGraph()
+	runA, buildA := addLocalPackage(t, g, "a")
+	runB, buildB := addLocalPackage(t, g, "b")
+	addLocalPackage(t, g, "c")
+
+	assert.NoError(t, g.AddEdge(buildA, runB))
+	assert.NoError(t, g.AddEdge(buildB, runA))
+
+	_, err := g.TopologicalBuildOrder()
+	assert.EqualError(t, err, "build dependency cycle(s) found: {a-1.0-BUILD<Build>, b-1.0-BUILD<Build>}")
+}
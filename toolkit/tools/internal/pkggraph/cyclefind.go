@@ -5,10 +5,12 @@ package pkggraph
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
 
 	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/topo"
 )
 
 const (
@@ -64,6 +66,32 @@ func (g *PkgGraph) FindAnyDirectedCycle() (nodes []*PkgNode, err error) {
 	return
 }
 
+// FindCycles returns all simple cycles in the graph, found with Johnson's algorithm. Like with FindAnyDirectedCycle,
+// each cycle starts and ends with the same node and follows the edges, i.e. each node depends on the next one.
+// Returns an empty slice for acyclic graphs. The number of cycles may grow exponentially with the graph's size.
+func (g *PkgGraph) FindCycles() (cycles [][]*PkgNode) {
+	cycles = [][]*PkgNode{}
+	for _, cycle := range topo.DirectedCyclesIn(g) {
+		nodes := make([]*PkgNode, 0, len(cycle))
+		for _, node := range cycle {
+			nodes = append(nodes, node.(*PkgNode).This)
+		}
+		cycles = append(cycles, nodes)
+	}
+
+	return
+}
+
+// FormatCycle returns a human-readable chain of the nodes' friendly names, e.g. "a -> b -> a".
+func FormatCycle(cycle []*PkgNode) string {
+	names := make([]string, 0, len(cycle))
+	for _, node := range cycle {
+		names = append(names, node.FriendlyName())
+	}
+
+	return strings.Join(names, " -> ")
+}
+
 // cycleDFS implements a custom DFS that updates metaData.cycle with the first cycle it finds in a given graph.
 func cycleDFS(g *PkgGraph, rootID int64, metaData *dfsData) (foundCycle bool, err error) {
 	// Recursing on a node that has already been visited indicates a fatal error with the search.
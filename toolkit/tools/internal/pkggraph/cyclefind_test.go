@@ -4,8 +4,10 @@
 package pkggraph
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -39,3 +41,69 @@ func TestDFSNoCycle(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Nil(t, cycle)
 }
+
+// buildCycleTestGraph creates a graph with a remote run node for each name and an edge for each "from->to" pair.
+func buildCycleTestGraph(t *testing.T, names []string, edges [][2]string) (g *PkgGraph, nodes map[string]*PkgNode) {
+	g = NewPkgGraph()
+	nodes = make(map[string]*PkgNode)
+	for _, name := range names {
+		node, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+		assert.NoError(t, err)
+		nodes[name] = node
+	}
+	for _, edge := range edges {
+		assert.NoError(t, g.AddEdge(nodes[edge[0]], nodes[edge[1]]))
+	}
+	return
+}
+
+// cycleNames returns the package names along a cycle, rotated to start with the lowest name so cycles can be compared.
+func cycleNames(cycle []*PkgNode) (names []string) {
+	start := 0
+	for i, node := range cycle[:len(cycle)-1] {
+		if node.VersionedPkg.Name < cycle[start].VersionedPkg.Name {
+			start = i
+		}
+	}
+	for i := 0; i < len(cycle)-1; i++ {
+		names = append(names, cycle[(start+i)%(len(cycle)-1)].VersionedPkg.Name)
+	}
+	return
+}
+
+func TestFindCyclesShouldReturnEmptyForAcyclicGraph(t *testing.T) {
+	g, _ := buildCycleTestGraph(t, []string{"a", "b", "c"}, [][2]string{{"a", "b"}, {"b", "c"}, {"a", "c"}})
+
+	assert.Empty(t, g.FindCycles())
+}
+
+func TestFindCyclesShouldFindSingleCycle(t *testing.T) {
+	g, nodes := buildCycleTestGraph(t, []string{"a", "b", "c", "d"}, [][2]string{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"c", "d"}})
+
+	cycles := g.FindCycles()
+	assert.Len(t, cycles, 1)
+	assert.Equal(t, cycles[0][0], cycles[0][len(cycles[0])-1])
+	assert.Equal(t, []string{"a", "b", "c"}, cycleNames(cycles[0]))
+
+	// Each node depends on the next one.
+	for i := 0; i < len(cycles[0])-1; i++ {
+		assert.True(t, g.HasEdgeFromTo(cycles[0][i].ID(), cycles[0][i+1].ID()))
+	}
+
+	formatted := FormatCycle(cycles[0])
+	assert.Contains(t, formatted, nodes["a"].FriendlyName())
+	assert.Equal(t, 3, strings.Count(formatted, " -> "))
+}
+
+func TestFindCyclesShouldFindNestedCycles(t *testing.T) {
+	// a -> b -> c -> a, with the inner cycle b -> c -> b and the self-contained cycle d -> e -> d hanging off 'c'.
+	g, _ := buildCycleTestGraph(t, []string{"a", "b", "c", "d", "e"}, [][2]string{
+		{"a", "b"}, {"b", "c"}, {"c", "a"}, {"c", "b"}, {"c", "d"}, {"d", "e"}, {"e", "d"},
+	})
+
+	foundCycles := [][]string{}
+	for _, cycle := range g.FindCycles() {
+		foundCycles = append(foundCycles, cycleNames(cycle))
+	}
+	assert.ElementsMatch(t, [][]string{{"a", "b", "c"}, {"b", "c"}, {"d", "e"}}, foundCycles)
+}
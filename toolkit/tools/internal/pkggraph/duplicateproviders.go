@@ -0,0 +1,57 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+// DuplicateProviders finds capabilities provided by more than one local package with overlapping versions, so
+// resolving them may pick either package. Returns the local run nodes of all such providers, keyed by the capability's
+// name and ordered by version. Providers whose versions do not overlap, e.g. 'foo = 1.0' and 'foo = 2.0', are not
+// duplicates.
+func (g *PkgGraph) DuplicateProviders() (duplicates map[string][]*PkgNode) {
+	duplicates = make(map[string][]*PkgNode)
+
+	for capability, lookupNodes := range g.lookupTable() {
+		providers := []*PkgNode{}
+		for _, lookupNode := range lookupNodes {
+			if lookupNode.RunNode != nil && lookupNode.RunNode.Type == TypeLocalRun {
+				providers = append(providers, lookupNode.RunNode)
+			}
+		}
+
+		duplicated := make([]bool, len(providers))
+		for i := range providers {
+			for j := i + 1; j < len(providers); j++ {
+				if providersOverlap(providers[i], providers[j]) {
+					duplicated[i] = true
+					duplicated[j] = true
+				}
+			}
+		}
+
+		for i, provider := range providers {
+			if duplicated[i] {
+				duplicates[capability] = append(duplicates[capability], provider)
+			}
+		}
+	}
+
+	return
+}
+
+// providersOverlap checks if two run nodes from different RPMs provide a common version of their capability.
+func providersOverlap(provider, otherProvider *PkgNode) bool {
+	if provider.RpmPath == otherProvider.RpmPath {
+		return false
+	}
+
+	interval, err := provider.VersionedPkg.Interval()
+	if err != nil {
+		return false
+	}
+	otherInterval, err := otherProvider.VersionedPkg.Interval()
+	if err != nil {
+		return false
+	}
+
+	return interval.Satisfies(&otherInterval)
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func addLocalProviderHelper(t *testing.T, g *PkgGraph, capability *pkgjson.PackageVer, rpmName string) (node *PkgNode) {
+	node, err := g.AddPkgNode(capability, StateMeta, TypeLocalRun, rpmName+".src.rpm", fmt.Sprintf("/rpms/x86_64/%s.rpm", rpmName), rpmName+".spec", "SOURCES", "x86_64", "local")
+	assert.NoError(t, err)
+	return
+}
+
+func TestShouldFindDuplicateProviders(t *testing.T) {
+	g := NewPkgGraph()
+
+	// Both OpenSSL variants provide 'libcrypto.so.1.1' in any version.
+	openssl := addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "libcrypto.so.1.1()(64bit)"}, "openssl-libs-1.1.1k-1.cm2.x86_64")
+	opensslFIPS := addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "libcrypto.so.1.1()(64bit)", Version: "1.1.1k", Condition: "="}, "openssl-fips-1.1.1k-1.cm2.x86_64")
+
+	// 'python3 = 3.9' and 'python3 = 3.12' can't satisfy the same request.
+	addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "python3", Version: "3.9.14", Condition: "="}, "python39-3.9.14-1.cm2.x86_64")
+	addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "python3", Version: "3.12.0", Condition: "="}, "python3-3.12.0-1.cm2.x86_64")
+
+	// Remote nodes are requirements, not providers.
+	_, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "zlib"})
+	assert.NoError(t, err)
+	_, err = g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "zlib", Version: "1.2.13", Condition: ">="})
+	assert.NoError(t, err)
+
+	duplicates := g.DuplicateProviders()
+	assert.Len(t, duplicates, 1)
+	assert.ElementsMatch(t, []*PkgNode{openssl, opensslFIPS}, duplicates["libcrypto.so.1.1()(64bit)"])
+}
+
+func TestShouldNotFindDuplicateProvidersForDisjointVersions(t *testing.T) {
+	g := NewPkgGraph()
+	addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "golang", Version: "1.19.12", Condition: "="}, "golang-1.19.12-1.cm2.x86_64")
+	addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "golang", Version: "1.20.7", Condition: ">="}, "golang-1.20.7-1.cm2.x86_64")
+
+	assert.Empty(t, g.DuplicateProviders())
+
+	// A provider of any version overlaps with both.
+	addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "golang"}, "msft-golang-1.20.7-1.cm2.x86_64")
+	assert.Len(t, g.DuplicateProviders()["golang"], 3)
+}
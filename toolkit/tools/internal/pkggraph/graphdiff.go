@@ -0,0 +1,117 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NodeChange is a node present in both graphs whose state or type differs between them.
+type NodeChange struct {
+	Old *PkgNode
+	New *PkgNode
+}
+
+// GraphDiff holds the node level differences between two graphs.
+type GraphDiff struct {
+	Added   []*PkgNode   // Nodes only present in the new graph
+	Removed []*PkgNode   // Nodes only present in the old graph
+	Changed []NodeChange // Nodes present in both graphs with a different state or type
+}
+
+// IsEmpty checks if the graphs have the same nodes, in the same states.
+func (d GraphDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffGraphs compares the nodes of two graphs. Nodes are matched by their friendly name, without the state, and their
+// architecture. Local, remote, and pre-built run nodes of a package are matched with each other so a package moving
+// between them is reported as a type change. Pure meta nodes are ignored, they are only identified by their node IDs.
+func DiffGraphs(old, new *PkgGraph) (diff GraphDiff) {
+	oldNodes := nodesByDiffIdentity(old)
+	newNodes := nodesByDiffIdentity(new)
+
+	for identity, newCandidates := range newNodes {
+		oldCandidates := oldNodes[identity]
+		for i, newNode := range newCandidates {
+			if i >= len(oldCandidates) {
+				diff.Added = append(diff.Added, newNode)
+				continue
+			}
+
+			oldNode := oldCandidates[i]
+			if oldNode.State != newNode.State || oldNode.Type != newNode.Type {
+				diff.Changed = append(diff.Changed, NodeChange{Old: oldNode, New: newNode})
+			}
+		}
+	}
+
+	for identity, oldCandidates := range oldNodes {
+		for i := len(newNodes[identity]); i < len(oldCandidates); i++ {
+			diff.Removed = append(diff.Removed, oldCandidates[i])
+		}
+	}
+
+	sortNodesByFriendlyName(diff.Added)
+	sortNodesByFriendlyName(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return diff.Changed[i].New.FriendlyName() < diff.Changed[j].New.FriendlyName()
+	})
+
+	return
+}
+
+// nodesByDiffIdentity groups the nodes of a graph by their diff identity. Nodes sharing an identity (e.g. remote nodes
+// of the same package with different version conditions) are ordered by their version constraints so they pair up the
+// same way in both graphs, regardless of their states.
+func nodesByDiffIdentity(g *PkgGraph) (nodes map[string][]*PkgNode) {
+	nodes = make(map[string][]*PkgNode)
+	if g == nil {
+		return
+	}
+
+	for _, node := range g.AllNodes() {
+		if node.Type == TypePureMeta {
+			continue
+		}
+
+		identity := diffIdentity(node)
+		nodes[identity] = append(nodes[identity], node)
+	}
+
+	for _, candidates := range nodes {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return versionConstraints(candidates[i]) < versionConstraints(candidates[j])
+		})
+	}
+
+	return
+}
+
+// diffIdentity returns the friendly name a node would have in a fixed state, combined with its architecture.
+func diffIdentity(node *PkgNode) string {
+	identityNode := *node
+	identityNode.State = StateMeta
+
+	switch identityNode.Type {
+	case TypeLocalRun, TypeRemoteRun, TypePreBuilt:
+		identityNode.Type = TypeLocalRun
+	}
+
+	return fmt.Sprintf("%s@%s", identityNode.FriendlyName(), node.Architecture)
+}
+
+func versionConstraints(node *PkgNode) string {
+	if node.VersionedPkg == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s%s,%s%s", node.VersionedPkg.Condition, node.VersionedPkg.Version, node.VersionedPkg.SCondition, node.VersionedPkg.SVersion)
+}
+
+func sortNodesByFriendlyName(nodes []*PkgNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].FriendlyName() < nodes[j].FriendlyName()
+	})
+}
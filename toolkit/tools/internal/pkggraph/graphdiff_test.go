@@ -0,0 +1,79 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+// addDiffTestNode adds a node for version 1.0 of a package to the graph.
+func addDiffTestNode(t *testing.T, g *PkgGraph, name string, state NodeState, nodeType NodeType, architecture string) *PkgNode {
+	node, err := g.AddPkgNode(&pkgjson.PackageVer{Name: name, Version: "1.0", Condition: "="}, state, nodeType, NoSRPMPath, NoRPMPath, NoSpecPath, NoSourceDir, architecture, NoSourceRepo)
+	assert.NoError(t, err)
+	return node
+}
+
+func TestDiffGraphsReportsStateChange(t *testing.T) {
+	oldGraph := NewPkgGraph()
+	addDiffTestNode(t, oldGraph, "zlib", StateUnresolved, TypeRemoteRun, "x86_64")
+	addDiffTestNode(t, oldGraph, "bash", StateUpToDate, TypeLocalRun, "x86_64")
+
+	newGraph := NewPkgGraph()
+	addDiffTestNode(t, newGraph, "zlib", StateCached, TypeRemoteRun, "x86_64")
+	addDiffTestNode(t, newGraph, "bash", StateUpToDate, TypeLocalRun, "x86_64")
+
+	diff := DiffGraphs(oldGraph, newGraph)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Len(t, diff.Changed, 1)
+	assert.Equal(t, "zlib", diff.Changed[0].New.VersionedPkg.Name)
+	assert.Equal(t, StateUnresolved, diff.Changed[0].Old.State)
+	assert.Equal(t, StateCached, diff.Changed[0].New.State)
+}
+
+func TestDiffGraphsReportsTypeChange(t *testing.T) {
+	oldGraph := NewPkgGraph()
+	addDiffTestNode(t, oldGraph, "openssl", StateUnresolved, TypeRemoteRun, "x86_64")
+
+	newGraph := NewPkgGraph()
+	addDiffTestNode(t, newGraph, "openssl", StateBuild, TypeLocalRun, "x86_64")
+
+	diff := DiffGraphs(oldGraph, newGraph)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Len(t, diff.Changed, 1)
+	assert.Equal(t, TypeRemoteRun, diff.Changed[0].Old.Type)
+	assert.Equal(t, TypeLocalRun, diff.Changed[0].New.Type)
+}
+
+func TestDiffGraphsReportsAddedAndRemovedNodes(t *testing.T) {
+	oldGraph := NewPkgGraph()
+	addDiffTestNode(t, oldGraph, "bash", StateUpToDate, TypeLocalRun, "x86_64")
+	addDiffTestNode(t, oldGraph, "python2", StateUnresolved, TypeRemoteRun, "x86_64")
+
+	newGraph := NewPkgGraph()
+	addDiffTestNode(t, newGraph, "bash", StateUpToDate, TypeLocalRun, "x86_64")
+	addDiffTestNode(t, newGraph, "python3", StateUnresolved, TypeRemoteRun, "x86_64")
+	addDiffTestNode(t, newGraph, "curl", StateUnresolved, TypeRemoteRun, "x86_64")
+
+	diff := DiffGraphs(oldGraph, newGraph)
+	assert.Empty(t, diff.Changed)
+
+	assert.Len(t, diff.Added, 2)
+	assert.Equal(t, "curl", diff.Added[0].VersionedPkg.Name)
+	assert.Equal(t, "python3", diff.Added[1].VersionedPkg.Name)
+
+	assert.Len(t, diff.Removed, 1)
+	assert.Equal(t, "python2", diff.Removed[0].VersionedPkg.Name)
+}
+
+func TestDiffGraphsOfSameGraphIsEmpty(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	assert.True(t, DiffGraphs(g, g).IsEmpty())
+}
@@ -0,0 +1,154 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+)
+
+const graphMLNamespace = "http://graphml.graphdrawing.org/xmlns"
+
+// GraphML <data> keys of the node attributes.
+const (
+	graphMLKeyLabel   = "label"
+	graphMLKeyName    = "name"
+	graphMLKeyVersion = "version"
+	graphMLKeyType    = "type"
+	graphMLKeyState   = "state"
+)
+
+type graphMLDocument struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	ID     string `xml:"id,attr"`
+	Source string `xml:"source,attr"`
+	Target string `xml:"target,attr"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// WriteGraphMLFile writes the graph to a GraphML file, e.g. to load it into yEd or Gephi. Each node carries its
+// friendly name as a label, its package name, version, type, and state. Like in the DOT format, edges point from
+// a dependant to its dependency.
+func WriteGraphMLFile(g *PkgGraph, path string) (err error) {
+	logger.Log.Infof("Writing GraphML graph to %s", path)
+	f, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return WriteGraphML(g, f)
+}
+
+// WriteGraphML serializes the graph in the GraphML format to the writer.
+func WriteGraphML(g *PkgGraph, output io.Writer) (err error) {
+	document := graphMLDocument{
+		Xmlns: graphMLNamespace,
+		Graph: graphMLGraph{
+			ID:          "G",
+			EdgeDefault: "directed",
+		},
+	}
+	for _, key := range []string{graphMLKeyLabel, graphMLKeyName, graphMLKeyVersion, graphMLKeyType, graphMLKeyState} {
+		document.Keys = append(document.Keys, graphMLKey{ID: key, For: "node", AttrName: key, AttrType: "string"})
+	}
+
+	nodes := g.AllNodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID() < nodes[j].ID()
+	})
+	for _, node := range nodes {
+		document.Graph.Nodes = append(document.Graph.Nodes, newGraphMLNode(node))
+	}
+
+	for _, node := range nodes {
+		dependencies := g.From(node.ID())
+		dependencyIDs := make([]int64, 0, dependencies.Len())
+		for dependencies.Next() {
+			dependencyIDs = append(dependencyIDs, dependencies.Node().ID())
+		}
+		sort.Slice(dependencyIDs, func(i, j int) bool {
+			return dependencyIDs[i] < dependencyIDs[j]
+		})
+
+		for _, dependencyID := range dependencyIDs {
+			document.Graph.Edges = append(document.Graph.Edges, graphMLEdge{
+				ID:     fmt.Sprintf("e%d", len(document.Graph.Edges)),
+				Source: graphMLNodeID(node.ID()),
+				Target: graphMLNodeID(dependencyID),
+			})
+		}
+	}
+
+	_, err = io.WriteString(output, xml.Header)
+	if err != nil {
+		return
+	}
+
+	encoder := xml.NewEncoder(output)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(document)
+	if err != nil {
+		return
+	}
+
+	_, err = io.WriteString(output, "\n")
+	return
+}
+
+func newGraphMLNode(node *PkgNode) (graphNode graphMLNode) {
+	graphNode.ID = graphMLNodeID(node.ID())
+	graphNode.Data = []graphMLData{
+		{Key: graphMLKeyLabel, Value: node.FriendlyName()},
+		{Key: graphMLKeyType, Value: node.Type.String()},
+		{Key: graphMLKeyState, Value: node.State.String()},
+	}
+
+	if node.VersionedPkg != nil {
+		graphNode.Data = append(graphNode.Data,
+			graphMLData{Key: graphMLKeyName, Value: node.VersionedPkg.Name},
+			graphMLData{Key: graphMLKeyVersion, Value: node.VersionedPkg.Version},
+		)
+	}
+
+	return
+}
+
+func graphMLNodeID(id int64) string {
+	return fmt.Sprintf("n%d", id)
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteGraphMLFile(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	graphFile := filepath.Join(t.TempDir(), "test_graph.graphml")
+	err = WriteGraphMLFile(g, graphFile)
+	assert.NoError(t, err)
+
+	f, err := os.Open(graphFile)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// Walk the whole document, the decoder fails on XML which is not well-formed.
+	nodeCount, edgeCount := 0, 0
+	decoder := xml.NewDecoder(f)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		if element, ok := token.(xml.StartElement); ok {
+			switch element.Name.Local {
+			case "node":
+				nodeCount++
+			case "edge":
+				edgeCount++
+			}
+		}
+	}
+
+	assert.Equal(t, len(allNodes), nodeCount)
+	assert.Equal(t, len(edges), edgeCount)
+	assert.Equal(t, g.Edges().Len(), edgeCount)
+}
+
+func TestWriteGraphMLNodeAttributes(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	graphFile := filepath.Join(t.TempDir(), "test_graph.graphml")
+	err = WriteGraphMLFile(g, graphFile)
+	assert.NoError(t, err)
+
+	contents, err := os.ReadFile(graphFile)
+	assert.NoError(t, err)
+
+	var document graphMLDocument
+	err = xml.Unmarshal(contents, &document)
+	assert.NoError(t, err)
+	assert.Equal(t, graphMLNamespace, document.XMLName.Space)
+	assert.Equal(t, "directed", document.Graph.EdgeDefault)
+
+	lookup, err := g.FindExactPkgNodeFromPkg(pkgARun.VersionedPkg)
+	assert.NoError(t, err)
+	runNode := lookup.RunNode
+
+	var runNodeData map[string]string
+	for _, node := range document.Graph.Nodes {
+		if node.ID != graphMLNodeID(runNode.ID()) {
+			continue
+		}
+		runNodeData = make(map[string]string)
+		for _, data := range node.Data {
+			runNodeData[data.Key] = data.Value
+		}
+	}
+
+	assert.Equal(t, map[string]string{
+		graphMLKeyLabel:   runNode.FriendlyName(),
+		graphMLKeyName:    runNode.VersionedPkg.Name,
+		graphMLKeyVersion: runNode.VersionedPkg.Version,
+		graphMLKeyType:    "Run",
+		graphMLKeyState:   runNode.State.String(),
+	}, runNodeData)
+}
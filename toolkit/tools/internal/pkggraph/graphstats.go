@@ -0,0 +1,29 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+// GraphStats is a census of a graph's nodes and edges.
+type GraphStats struct {
+	Nodes        int
+	Edges        int
+	NodesByType  map[NodeType]int  // Only types with at least one node are included
+	NodesByState map[NodeState]int // Only states with at least one node are included
+}
+
+// Stats counts the graph's nodes by type and by state, as well as its edges.
+func (g *PkgGraph) Stats() (stats GraphStats) {
+	stats = GraphStats{
+		NodesByType:  make(map[NodeType]int),
+		NodesByState: make(map[NodeState]int),
+	}
+
+	for _, n := range g.AllNodes() {
+		stats.Nodes++
+		stats.NodesByType[n.Type]++
+		stats.NodesByState[n.State]++
+	}
+	stats.Edges = g.Edges().Len()
+
+	return
+}
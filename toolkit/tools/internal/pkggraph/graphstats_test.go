@@ -0,0 +1,44 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldCountNodesByTypeAndState(t *testing.T) {
+	g := NewPkgGraph()
+
+	runNode := addLocalProviderHelper(t, g, &pkgjson.PackageVer{Name: "bash", Version: "5.1.8", Condition: "="}, "bash-5.1.8-1.cm2.x86_64")
+	buildNode, err := g.AddPkgNode(&pkgjson.PackageVer{Name: "bash", Version: "5.1.8", Condition: "="}, StateBuild, TypeLocalBuild, "bash.src.rpm", "/rpms/x86_64/bash-5.1.8-1.cm2.x86_64.rpm", "bash.spec", "SOURCES", "x86_64", "local")
+	assert.NoError(t, err)
+	assert.NoError(t, g.AddEdge(runNode, buildNode))
+
+	for _, name := range []string{"glibc", "ncurses"} {
+		remoteNode, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+		assert.NoError(t, err)
+		assert.NoError(t, g.AddEdge(buildNode, remoteNode))
+	}
+
+	cachedNode, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "zlib"})
+	assert.NoError(t, err)
+	cachedNode.State = StateCached
+
+	stats := g.Stats()
+	assert.Equal(t, 5, stats.Nodes)
+	assert.Equal(t, 3, stats.Edges)
+	assert.Equal(t, map[NodeType]int{TypeLocalRun: 1, TypeLocalBuild: 1, TypeRemoteRun: 3}, stats.NodesByType)
+	assert.Equal(t, map[NodeState]int{StateMeta: 1, StateBuild: 1, StateUnresolved: 2, StateCached: 1}, stats.NodesByState)
+}
+
+func TestShouldReportEmptyGraphStats(t *testing.T) {
+	stats := NewPkgGraph().Stats()
+	assert.Zero(t, stats.Nodes)
+	assert.Zero(t, stats.Edges)
+	assert.Empty(t, stats.NodesByType)
+	assert.Empty(t, stats.NodesByState)
+}
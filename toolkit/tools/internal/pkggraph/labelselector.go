@@ -0,0 +1,123 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	labelSelectorOr  = "||"
+	labelSelectorAnd = "&&"
+)
+
+// labelRequirement is a single "key=value", "key!=value" or "key" term of a label selector.
+type labelRequirement struct {
+	key     string
+	value   string
+	negated bool
+	// existsOnly is set for bare "key" terms, which only require the annotation to be present.
+	existsOnly bool
+}
+
+// LabelSelector selects nodes based on their annotations.
+type LabelSelector struct {
+	expression string
+	// anyOf holds the '||' separated clauses, each of them a list of '&&' separated requirements.
+	anyOf [][]labelRequirement
+}
+
+// ParseLabelSelector parses a label selector expression such as "tier=core && optional=false || critical".
+// Terms are "key=value", "key!=value" or a bare "key" requiring the annotation to be present. A "key!=value" term
+// also matches nodes without the annotation. '&&' binds tighter than '||', parentheses are not supported.
+func ParseLabelSelector(expression string) (selector *LabelSelector, err error) {
+	selector = &LabelSelector{expression: expression}
+
+	for _, clause := range strings.Split(expression, labelSelectorOr) {
+		requirements := []labelRequirement{}
+		for _, term := range strings.Split(clause, labelSelectorAnd) {
+			var requirement labelRequirement
+			requirement, err = parseLabelRequirement(term)
+			if err != nil {
+				err = fmt.Errorf("invalid label selector (%s):\n%w", expression, err)
+				return
+			}
+			requirements = append(requirements, requirement)
+		}
+		selector.anyOf = append(selector.anyOf, requirements)
+	}
+
+	return
+}
+
+// Matches returns true if the node's annotations satisfy the selector.
+func (s *LabelSelector) Matches(node *PkgNode) bool {
+	for _, requirements := range s.anyOf {
+		if node.matchesAllLabels(requirements) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the expression the selector was parsed from.
+func (s *LabelSelector) String() string {
+	return s.expression
+}
+
+func (n *PkgNode) matchesAllLabels(requirements []labelRequirement) bool {
+	for _, requirement := range requirements {
+		value, found := n.Annotation(requirement.key)
+		switch {
+		case requirement.existsOnly:
+			if !found {
+				return false
+			}
+		case requirement.negated:
+			if found && value == requirement.value {
+				return false
+			}
+		default:
+			if !found || value != requirement.value {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func parseLabelRequirement(term string) (requirement labelRequirement, err error) {
+	const (
+		equalsOperator    = "="
+		notEqualsOperator = "!="
+	)
+
+	term = strings.TrimSpace(term)
+	if term == "" {
+		err = fmt.Errorf("empty term")
+		return
+	}
+
+	key, value, found := strings.Cut(term, notEqualsOperator)
+	if found {
+		requirement.negated = true
+	} else {
+		key, value, found = strings.Cut(term, equalsOperator)
+		requirement.existsOnly = !found
+	}
+
+	requirement.key = strings.TrimSpace(key)
+	requirement.value = strings.TrimSpace(value)
+	if requirement.key == "" {
+		err = fmt.Errorf("term (%s) has no key", term)
+		return
+	}
+	if strings.ContainsAny(requirement.key, "=! ") || strings.Contains(requirement.value, equalsOperator) {
+		err = fmt.Errorf("term (%s) is malformed", term)
+		return
+	}
+
+	return
+}
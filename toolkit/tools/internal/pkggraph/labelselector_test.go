@@ -0,0 +1,41 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func labeledNode(annotations map[string]string) *PkgNode {
+	return &PkgNode{Annotations: annotations}
+}
+
+func TestLabelSelectorShouldMatchAllTerms(t *testing.T) {
+	selector, err := ParseLabelSelector("tier=core && optional=false")
+	assert.NoError(t, err)
+
+	assert.True(t, selector.Matches(labeledNode(map[string]string{"tier": "core", "optional": "false"})))
+	assert.False(t, selector.Matches(labeledNode(map[string]string{"tier": "core", "optional": "true"})))
+	assert.False(t, selector.Matches(labeledNode(map[string]string{"tier": "core"})))
+	assert.False(t, selector.Matches(labeledNode(nil)))
+}
+
+func TestLabelSelectorShouldMatchAnyClause(t *testing.T) {
+	selector, err := ParseLabelSelector("tier=core && optional!=true || critical")
+	assert.NoError(t, err)
+
+	assert.True(t, selector.Matches(labeledNode(map[string]string{"tier": "core"})))
+	assert.True(t, selector.Matches(labeledNode(map[string]string{"tier": "extended", "critical": ""})))
+	assert.False(t, selector.Matches(labeledNode(map[string]string{"tier": "core", "optional": "true"})))
+	assert.False(t, selector.Matches(labeledNode(map[string]string{"tier": "extended"})))
+}
+
+func TestLabelSelectorShouldRejectMalformedExpressions(t *testing.T) {
+	for _, expression := range []string{"", "tier=core &&", "=core", "tier==core", "tier=core || || optional"} {
+		_, err := ParseLabelSelector(expression)
+		assert.Error(t, err, expression)
+	}
+}
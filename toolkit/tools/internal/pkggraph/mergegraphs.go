@@ -0,0 +1,171 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"gonum.org/v1/gonum/graph"
+)
+
+// stateProgressions list the states a node moves through while it is resolved or built, each state mapped to how far
+// along it is. Two copies of a node in states of the same progression reconcile to the later one.
+var stateProgressions = []map[NodeState]int{
+	{StateUnresolved: 0, StateCached: 1, StateUpToDate: 1},
+	{StateBuild: 0, StateDelta: 1, StateBuildError: 1, StateUpToDate: 2},
+}
+
+// MergeGraphs returns a new graph with the union of the nodes and edges of 'graphs'. The input graphs are not modified.
+//
+// Nodes present in several graphs are merged into one:
+//   - goal nodes are matched by their goal name,
+//   - other nodes by their type, package name, and version constraints. Local run nodes also match remote run nodes of
+//     the same package, in which case the local run node is kept, as it is in a graph's lookup table,
+//   - pure meta nodes never match, they are only identified by their node IDs.
+//
+// The merged node takes the state which is further along in resolving or building the package (e.g. 'Cached' over
+// 'Unresolved', 'UpToDate' over 'Build'). Copies of a node in unrelated states, or resolved to different RPMs, are
+// a conflict and fail the merge.
+func MergeGraphs(graphs ...*PkgGraph) (merged *PkgGraph, err error) {
+	merged = NewPkgGraph()
+	mergedNodes := make(map[string][]*PkgNode)
+
+	for graphIndex, g := range graphs {
+		if g == nil {
+			continue
+		}
+
+		nodes := g.AllNodes()
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[i].ID() < nodes[j].ID()
+		})
+
+		// Several nodes of a single graph may share an identity (e.g. remote nodes of the same capability),
+		// pair them up in order with the ones already merged.
+		matchedCount := make(map[string]int)
+		mergedNodeOf := make(map[int64]*PkgNode, len(nodes))
+		for _, node := range nodes {
+			if node.Type == TypePureMeta {
+				mergedNodeOf[node.ID()], err = merged.addMergedNode(node)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			identity := mergeIdentity(node)
+			candidates := mergedNodes[identity]
+			if matchedCount[identity] >= len(candidates) {
+				var newNode *PkgNode
+				newNode, err = merged.addMergedNode(node)
+				if err != nil {
+					return nil, err
+				}
+				mergedNodes[identity] = append(candidates, newNode)
+				matchedCount[identity]++
+				mergedNodeOf[node.ID()] = newNode
+				continue
+			}
+
+			mergedNode := candidates[matchedCount[identity]]
+			matchedCount[identity]++
+			err = reconcileNodes(mergedNode, node)
+			if err != nil {
+				return nil, fmt.Errorf("failed to merge graph #%d:\n%w", graphIndex, err)
+			}
+			mergedNodeOf[node.ID()] = mergedNode
+		}
+
+		for _, node := range nodes {
+			from := mergedNodeOf[node.ID()]
+			for _, dependency := range graph.NodesOf(g.From(node.ID())) {
+				to := mergedNodeOf[dependency.ID()]
+				if from != to && !merged.HasEdgeFromTo(from.ID(), to.ID()) {
+					merged.SetEdge(merged.NewEdge(from, to))
+				}
+			}
+		}
+	}
+
+	logger.Log.Debugf("Merged %d graph(s) into a graph with %d nodes", len(graphs), merged.Nodes().Len())
+
+	return
+}
+
+// addMergedNode adds a deep copy of a node from another graph, with a new ID unique in this graph.
+func (g *PkgGraph) addMergedNode(node *PkgNode) (newNode *PkgNode, err error) {
+	newNode = deepCopyNode(node)
+	newNode.nodeID = g.NewNode().ID()
+	newNode.This = newNode
+
+	err = g.safeAddNode(newNode)
+	return
+}
+
+// mergeIdentity returns the key under which copies of a node from different graphs are merged.
+func mergeIdentity(node *PkgNode) string {
+	if node.Type == TypeGoal {
+		return fmt.Sprintf("Goal:%s", node.GoalName)
+	}
+
+	nodeType := node.Type
+	if nodeType == TypeRemoteRun {
+		nodeType = TypeLocalRun
+	}
+
+	name := NoName
+	if node.VersionedPkg != nil {
+		name = node.VersionedPkg.Name
+	}
+
+	return fmt.Sprintf("%s:%s:%s", nodeType, name, versionConstraints(node))
+}
+
+// reconcileNodes updates 'mergedNode' with the data of 'node', another copy of it from a different graph.
+func reconcileNodes(mergedNode, node *PkgNode) (err error) {
+	// A locally built package replaces the remote one, the same way the lookup table prefers local run nodes.
+	if mergedNode.Type != node.Type {
+		if node.Type == TypeLocalRun {
+			replaceNodeData(mergedNode, node)
+		}
+		return
+	}
+
+	if mergedNode.State == node.State {
+		if isResolvedState(node.State) && mergedNode.RpmPath != node.RpmPath {
+			return fmt.Errorf("'%s' is resolved to different RPMs: '%s' and '%s'", node.FriendlyName(), mergedNode.RpmPath, node.RpmPath)
+		}
+		return
+	}
+
+	for _, progression := range stateProgressions {
+		mergedProgress, mergedFound := progression[mergedNode.State]
+		progress, found := progression[node.State]
+		if !mergedFound || !found || mergedProgress == progress {
+			continue
+		}
+
+		if progress > mergedProgress {
+			replaceNodeData(mergedNode, node)
+		}
+		return
+	}
+
+	return fmt.Errorf("'%s' has incompatible states in different graphs: '%s' and '%s'", node.FriendlyName(), mergedNode.State, node.State)
+}
+
+// isResolvedState checks if a node in the state has an RPM which can be used to satisfy its dependents.
+func isResolvedState(state NodeState) bool {
+	return state == StateCached || state == StateUpToDate
+}
+
+// replaceNodeData replaces all data of 'mergedNode' with a deep copy of the data of 'node', keeping its ID.
+func replaceNodeData(mergedNode, node *PkgNode) {
+	nodeID := mergedNode.nodeID
+	*mergedNode = *deepCopyNode(node)
+	mergedNode.nodeID = nodeID
+	mergedNode.This = mergedNode
+}
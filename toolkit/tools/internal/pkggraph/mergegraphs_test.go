@@ -0,0 +1,117 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+// findMergedNode returns the only node of the graph with the package name and type.
+func findMergedNode(t *testing.T, g *PkgGraph, name string, nodeType NodeType) (found *PkgNode) {
+	for _, node := range g.AllNodes() {
+		if node.Type == nodeType && node.VersionedPkg != nil && node.VersionedPkg.Name == name {
+			assert.Nil(t, found, "more than one '%s' node of type '%s'", name, nodeType)
+			found = node
+		}
+	}
+	assert.NotNil(t, found, "no '%s' node of type '%s'", name, nodeType)
+	return
+}
+
+func TestShouldMergeGraphsSharingNodes(t *testing.T) {
+	zlibVer := &pkgjson.PackageVer{Name: "zlib", Version: "1.2.13", Condition: ">="}
+	opensslVer := &pkgjson.PackageVer{Name: "openssl", Version: "1.1.1k", Condition: "="}
+
+	// The first machine builds 'curl' and 'openssl', the second one only 'openssl' and a 'wget' depending on it.
+	first := NewPkgGraph()
+	curl, err := first.AddPkgNode(&pkgjson.PackageVer{Name: "curl", Version: "8.0.1", Condition: "="}, StateBuild, TypeLocalRun, "curl.src.rpm", "/rpms/curl.rpm", "curl.spec", NoSourceDir, "x86_64", LocalRepo)
+	assert.NoError(t, err)
+	firstOpenssl, err := first.AddPkgNode(opensslVer, StateBuild, TypeLocalRun, "openssl.src.rpm", "/rpms/openssl.rpm", "openssl.spec", NoSourceDir, "x86_64", LocalRepo)
+	assert.NoError(t, err)
+	firstZlib, err := first.AddRemoteUnresolvedNode(zlibVer)
+	assert.NoError(t, err)
+	assert.NoError(t, first.AddEdge(curl, firstOpenssl))
+	assert.NoError(t, first.AddEdge(curl, firstZlib))
+	assert.NoError(t, first.AddEdge(firstOpenssl, firstZlib))
+
+	second := NewPkgGraph()
+	wget, err := second.AddPkgNode(&pkgjson.PackageVer{Name: "wget", Version: "1.21.2", Condition: "="}, StateBuild, TypeLocalRun, "wget.src.rpm", "/rpms/wget.rpm", "wget.spec", NoSourceDir, "x86_64", LocalRepo)
+	assert.NoError(t, err)
+	secondOpenssl, err := second.AddPkgNode(opensslVer, StateUpToDate, TypeLocalRun, "openssl.src.rpm", "/rpms/openssl.rpm", "openssl.spec", NoSourceDir, "x86_64", LocalRepo)
+	assert.NoError(t, err)
+	secondZlib, err := second.AddPkgNode(zlibVer, StateCached, TypeRemoteRun, NoSRPMPath, "/cache/zlib-1.2.13-1.cm2.x86_64.rpm", NoSpecPath, NoSourceDir, "x86_64", "fetcher-cloned-repo")
+	assert.NoError(t, err)
+	assert.NoError(t, second.AddEdge(wget, secondOpenssl))
+	assert.NoError(t, second.AddEdge(secondOpenssl, secondZlib))
+
+	merged, err := MergeGraphs(first, second)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, merged.Nodes().Len())
+
+	mergedCurl := findMergedNode(t, merged, "curl", TypeLocalRun)
+	mergedWget := findMergedNode(t, merged, "wget", TypeLocalRun)
+	mergedOpenssl := findMergedNode(t, merged, "openssl", TypeLocalRun)
+	mergedZlib := findMergedNode(t, merged, "zlib", TypeRemoteRun)
+
+	// The later states win.
+	assert.Equal(t, StateUpToDate, mergedOpenssl.State)
+	assert.Equal(t, StateCached, mergedZlib.State)
+	assert.Equal(t, "/cache/zlib-1.2.13-1.cm2.x86_64.rpm", mergedZlib.RpmPath)
+
+	// The shared edge is only added once.
+	assert.Equal(t, 4, merged.Edges().Len())
+	assert.ElementsMatch(t, []*PkgNode{mergedOpenssl, mergedZlib}, merged.Dependencies(mergedCurl))
+	assert.ElementsMatch(t, []*PkgNode{mergedOpenssl}, merged.Dependencies(mergedWget))
+	assert.ElementsMatch(t, []*PkgNode{mergedCurl, mergedWget}, merged.Dependents(mergedOpenssl))
+	assert.ElementsMatch(t, []*PkgNode{mergedCurl, mergedOpenssl}, merged.Dependents(mergedZlib))
+
+	// The input graphs are left untouched.
+	assert.Equal(t, StateBuild, firstOpenssl.State)
+	assert.Equal(t, StateUnresolved, firstZlib.State)
+	assert.Equal(t, 3, first.Nodes().Len())
+}
+
+func TestShouldPreferLocalRunNodeWhenMerging(t *testing.T) {
+	bashVer := &pkgjson.PackageVer{Name: "bash", Version: "5.1.8", Condition: "="}
+
+	remote := NewPkgGraph()
+	_, err := remote.AddPkgNode(bashVer, StateCached, TypeRemoteRun, NoSRPMPath, "/cache/bash.rpm", NoSpecPath, NoSourceDir, "x86_64", "fetcher-cloned-repo")
+	assert.NoError(t, err)
+
+	local := NewPkgGraph()
+	_, err = local.AddPkgNode(bashVer, StateBuild, TypeLocalRun, "bash.src.rpm", "/rpms/bash.rpm", "bash.spec", NoSourceDir, "x86_64", LocalRepo)
+	assert.NoError(t, err)
+
+	for _, graphs := range [][]*PkgGraph{{remote, local}, {local, remote}} {
+		merged, err := MergeGraphs(graphs...)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, merged.Nodes().Len())
+
+		mergedBash := findMergedNode(t, merged, "bash", TypeLocalRun)
+		assert.Equal(t, StateBuild, mergedBash.State)
+		assert.Equal(t, "/rpms/bash.rpm", mergedBash.RpmPath)
+	}
+}
+
+func TestShouldFailToMergeConflictingNodes(t *testing.T) {
+	newGraphWithNode := func(state NodeState, rpmPath string) *PkgGraph {
+		g := NewPkgGraph()
+		_, err := g.AddPkgNode(&pkgjson.PackageVer{Name: "glibc", Version: "2.35", Condition: "="}, state, TypeLocalRun, "glibc.src.rpm", rpmPath, "glibc.spec", NoSourceDir, "x86_64", LocalRepo)
+		assert.NoError(t, err)
+		return g
+	}
+
+	// The same node can't be waiting on a build in one graph and on a download in another.
+	_, err := MergeGraphs(newGraphWithNode(StateBuild, "/rpms/glibc.rpm"), newGraphWithNode(StateUnresolved, "/rpms/glibc.rpm"))
+	assert.ErrorContains(t, err, "incompatible states")
+
+	_, err = MergeGraphs(newGraphWithNode(StateUpToDate, "/rpms/glibc.rpm"), newGraphWithNode(StateUpToDate, "/other/glibc.rpm"))
+	assert.ErrorContains(t, err, "different RPMs")
+
+	_, err = MergeGraphs(newGraphWithNode(StateUpToDate, "/rpms/glibc.rpm"), newGraphWithNode(StateUpToDate, "/rpms/glibc.rpm"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"sort"
+)
+
+// PathsBetween returns up to 'maxPaths' simple paths following the edges from 'from' to 'to', i.e. the chains of
+// dependencies explaining why 'from' needs 'to'. Each path starts with 'from' and ends with 'to'.
+// Shorter paths are not guaranteed to come first. Returns no paths if 'to' can't be reached or 'maxPaths' is not positive.
+func (g *PkgGraph) PathsBetween(from, to *PkgNode, maxPaths int) [][]*PkgNode {
+	return g.PathsBetweenWithMaxDepth(from, to, maxPaths, 0)
+}
+
+// PathsBetweenWithMaxDepth is PathsBetween, only returning paths of at most 'maxDepth' edges.
+// A 'maxDepth' of 0 doesn't limit the paths' length.
+func (g *PkgGraph) PathsBetweenWithMaxDepth(from, to *PkgNode, maxPaths, maxDepth int) (paths [][]*PkgNode) {
+	paths = [][]*PkgNode{}
+	if maxPaths <= 0 || g.Node(from.ID()) == nil || g.Node(to.ID()) == nil {
+		return
+	}
+
+	// Only nodes from which 'to' is reachable can be part of a path, skipping all others
+	// keeps the search from exploring the dead ends of dense graphs.
+	reachesTo := map[int64]bool{to.ID(): true}
+	queue := []*PkgNode{to.This}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, dependent := range g.Dependents(node) {
+			if !reachesTo[dependent.ID()] {
+				reachesTo[dependent.ID()] = true
+				queue = append(queue, dependent)
+			}
+		}
+	}
+
+	if !reachesTo[from.ID()] {
+		return
+	}
+
+	onPath := map[int64]bool{}
+	path := []*PkgNode{}
+	var walk func(node *PkgNode)
+	walk = func(node *PkgNode) {
+		path = append(path, node)
+		onPath[node.ID()] = true
+		defer func() {
+			path = path[:len(path)-1]
+			onPath[node.ID()] = false
+		}()
+
+		if node.ID() == to.ID() {
+			paths = append(paths, append([]*PkgNode(nil), path...))
+			return
+		}
+		if maxDepth > 0 && len(path) > maxDepth {
+			return
+		}
+
+		for _, dependency := range g.sortedDependencies(node) {
+			if len(paths) >= maxPaths {
+				return
+			}
+			if reachesTo[dependency.ID()] && !onPath[dependency.ID()] {
+				walk(dependency)
+			}
+		}
+	}
+	walk(from.This)
+
+	return
+}
+
+// sortedDependencies returns the dependencies of 'node' sorted by ID, so searches visit them in a stable order.
+func (g *PkgGraph) sortedDependencies(node *PkgNode) (dependencies []*PkgNode) {
+	dependencies = g.Dependencies(node)
+	sort.Slice(dependencies, func(i, j int) bool {
+		return dependencies[i].ID() < dependencies[j].ID()
+	})
+	return
+}
@@ -0,0 +1,63 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pathNames returns the package names along each path.
+func pathNames(paths [][]*PkgNode) (names [][]string) {
+	names = [][]string{}
+	for _, path := range paths {
+		pathNames := []string{}
+		for _, node := range path {
+			pathNames = append(pathNames, node.VersionedPkg.Name)
+		}
+		names = append(names, pathNames)
+	}
+	return
+}
+
+// buildPathsTestGraph creates a graph where "root" reaches "leaf" through both "a" and "b -> c".
+// "d" is a dead end and "e" depends on "root", creating a cycle.
+func buildPathsTestGraph(t *testing.T) (g *PkgGraph, nodes map[string]*PkgNode) {
+	return buildCycleTestGraph(t,
+		[]string{"root", "a", "b", "c", "d", "e", "leaf"},
+		[][2]string{{"root", "a"}, {"root", "b"}, {"root", "d"}, {"a", "leaf"}, {"b", "c"}, {"c", "leaf"}, {"c", "e"}, {"e", "root"}},
+	)
+}
+
+func TestPathsBetweenShouldFindAllPaths(t *testing.T) {
+	g, nodes := buildPathsTestGraph(t)
+
+	paths := pathNames(g.PathsBetween(nodes["root"], nodes["leaf"], 10))
+	assert.ElementsMatch(t, [][]string{{"root", "a", "leaf"}, {"root", "b", "c", "leaf"}}, paths)
+}
+
+func TestPathsBetweenShouldStopAtMaxPaths(t *testing.T) {
+	g, nodes := buildPathsTestGraph(t)
+
+	assert.Len(t, g.PathsBetween(nodes["root"], nodes["leaf"], 1), 1)
+	assert.Empty(t, g.PathsBetween(nodes["root"], nodes["leaf"], 0))
+}
+
+func TestPathsBetweenShouldHonorMaxDepth(t *testing.T) {
+	g, nodes := buildPathsTestGraph(t)
+
+	paths := pathNames(g.PathsBetweenWithMaxDepth(nodes["root"], nodes["leaf"], 10, 2))
+	assert.Equal(t, [][]string{{"root", "a", "leaf"}}, paths)
+
+	paths = pathNames(g.PathsBetweenWithMaxDepth(nodes["root"], nodes["leaf"], 10, 3))
+	assert.Len(t, paths, 2)
+}
+
+func TestPathsBetweenShouldReturnEmptyForUnreachableNode(t *testing.T) {
+	g, nodes := buildPathsTestGraph(t)
+
+	assert.Empty(t, g.PathsBetween(nodes["leaf"], nodes["root"], 10))
+	assert.Empty(t, g.PathsBetween(nodes["d"], nodes["leaf"], 10))
+}
@@ -4,21 +4,26 @@
 package pkggraph
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"encoding/gob"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/file"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner/rpmrepocloner"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/retry"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/timestamp"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/versioncompare"
@@ -75,6 +80,14 @@ const (
 	NoSRPMPath     = "<NO_SRPM_PATH>"
 )
 
+// Well known node annotation keys
+const (
+	// AnnotationResolveTimeout overrides the maximum time a node's resolution may take (e.g. "10m").
+	AnnotationResolveTimeout = "resolve-timeout"
+	// AnnotationHostProvided marks resolved nodes satisfied by the build environment, which intentionally have no RPM.
+	AnnotationHostProvided = "host-provided"
+)
+
 // Dot encoding/decoding keys
 const (
 	dotKeyNodeInBase64 = "NodeInBase64"
@@ -83,6 +96,11 @@ const (
 	dotKeyFill         = "style"
 )
 
+// Compressed DOT files are written when the file name has this extension. Reading detects compression by the magic bytes.
+const gzipFileExtension = ".gz"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
 // Determines if a type of node is valid for inclusion in the lookup tables.
 var lookupNodesTypes = map[NodeType]bool{
 	TypeLocalBuild: true,
@@ -105,6 +123,7 @@ type PkgNode struct {
 	SourceRepo   string              // The location this package was acquired from
 	GoalName     string              // Optional string for goal nodes
 	Implicit     bool                // If the package is an implicit provide
+	Annotations  map[string]string   // Optional free-form key-value metadata attached to the node by graph producers
 	This         *PkgNode            // Self reference since the graph library returns nodes by value, not reference
 }
 
@@ -116,7 +135,8 @@ func (n PkgNode) ID() int64 {
 // PkgGraph implements a simple.DirectedGraph using pkggraph Nodes.
 type PkgGraph struct {
 	*simple.DirectedGraph
-	nodeLookup map[string][]*LookupNode
+	nodeLookup   map[string][]*LookupNode
+	rpmPathIndex *rpmPathIndex
 }
 
 // LookupNode represents a graph node for a package in the lookup list
@@ -531,6 +551,7 @@ func (g *PkgGraph) AddRemoteUnresolvedNode(versionedPkg *pkgjson.PackageVer) (ne
 func (g *PkgGraph) RemovePkgNode(pkgNode *PkgNode) {
 	g.RemoveNode(pkgNode.ID())
 	g.removePkgNodeFromLookup(pkgNode)
+	g.InvalidateRpmPathIndex()
 }
 
 // FindDoubleConditionalPkgNodeFromPkg has the same behavior as FindConditionalPkgNodeFromPkg but supports two conditionals
@@ -618,6 +639,29 @@ func (g *PkgGraph) AllNodes() []*PkgNode {
 	return nodes
 }
 
+// EachNode calls 'fn' for every node in the graph, without building a list of all nodes first. It stops at the
+// first error returned by 'fn' and returns it. Nodes must not be added to or removed from the graph meanwhile.
+func (g *PkgGraph) EachNode(fn func(*PkgNode) error) (err error) {
+	nodes := g.Nodes()
+	for nodes.Next() {
+		err = fn(nodes.Node().(*PkgNode).This)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// EachRunNode is like EachNode, but only visits the nodes of type TypeLocalRun and TypeRemoteRun, like AllRunNodes.
+func (g *PkgGraph) EachRunNode(fn func(*PkgNode) error) error {
+	return g.EachNode(func(n *PkgNode) error {
+		if n.Type != TypeLocalRun && n.Type != TypeRemoteRun {
+			return nil
+		}
+		return fn(n)
+	})
+}
+
 // AllNodesFrom returns a list of all nodes accessible from a root node
 func (g *PkgGraph) AllNodesFrom(rootNode *PkgNode) []*PkgNode {
 	count := g.Nodes().Len()
@@ -632,6 +676,25 @@ func (g *PkgGraph) AllNodesFrom(rootNode *PkgNode) []*PkgNode {
 	return nodes
 }
 
+// Dependents returns the nodes which depend on the given node.
+func (g *PkgGraph) Dependents(n *PkgNode) []*PkgNode {
+	return pkgNodesOf(g.To(n.ID()))
+}
+
+// Dependencies returns the nodes the given node depends on.
+func (g *PkgGraph) Dependencies(n *PkgNode) []*PkgNode {
+	return pkgNodesOf(g.From(n.ID()))
+}
+
+// pkgNodesOf returns the nodes of the iterator as PkgNodes.
+func pkgNodesOf(it graph.Nodes) []*PkgNode {
+	nodes := make([]*PkgNode, 0, it.Len())
+	for _, n := range graph.NodesOf(it) {
+		nodes = append(nodes, n.(*PkgNode).This)
+	}
+	return nodes
+}
+
 // AllRunNodes returns a list of all run nodes in the graph
 // It traverses the graph and returns all nodes of type TypeLocalRun and
 // TypeRemoteRun.
@@ -711,6 +774,20 @@ func (n *PkgNode) FriendlyName() string {
 	}
 }
 
+// Annotation returns the value of an annotation on the node and whether it was set.
+func (n *PkgNode) Annotation(key string) (value string, found bool) {
+	value, found = n.Annotations[key]
+	return
+}
+
+// SetAnnotation sets the value of an annotation on the node.
+func (n *PkgNode) SetAnnotation(key, value string) {
+	if n.Annotations == nil {
+		n.Annotations = make(map[string]string)
+	}
+	n.Annotations[key] = value
+}
+
 // SpecName returns the name of the spec associated with this node.
 // Returns "." if the node doesn't have a spec file path or URL.
 func (n *PkgNode) SpecName() string {
@@ -764,7 +841,21 @@ func (n *PkgNode) Equal(otherNode *PkgNode) bool {
 		n.Architecture == otherNode.Architecture &&
 		n.SourceRepo == otherNode.SourceRepo &&
 		n.GoalName == otherNode.GoalName &&
-		n.Implicit == otherNode.Implicit
+		n.Implicit == otherNode.Implicit &&
+		annotationsEqual(n.Annotations, otherNode.Annotations)
+}
+
+func annotationsEqual(annotations, otherAnnotations map[string]string) bool {
+	if len(annotations) != len(otherAnnotations) {
+		return false
+	}
+	for key, value := range annotations {
+		otherValue, found := otherAnnotations[key]
+		if !found || value != otherValue {
+			return false
+		}
+	}
+	return true
 }
 
 func registerTypes() {
@@ -839,6 +930,15 @@ func (n PkgNode) MarshalBinary() (data []byte, err error) {
 		err = fmt.Errorf("encoding Implicit: %s", err.Error())
 		return
 	}
+	// Annotations were added later and are optional, only encode them when present so nodes without
+	// annotations keep the same encoding as before.
+	if len(n.Annotations) > 0 {
+		err = encoder.Encode(n.Annotations)
+		if err != nil {
+			err = fmt.Errorf("encoding Annotations: %s", err.Error())
+			return
+		}
+	}
 	return outBuffer.Bytes(), err
 }
 
@@ -908,6 +1008,15 @@ func (n *PkgNode) UnmarshalBinary(inBuffer []byte) (err error) {
 		err = fmt.Errorf("decoding Implicit: %s", err.Error())
 		return
 	}
+	// Annotations are optional, reaching the end of the data means the node has none.
+	n.Annotations = nil
+	err = decoder.Decode(&n.Annotations)
+	if err == io.EOF {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("decoding Annotations: %s", err.Error())
+		return
+	}
 	n.This = n
 	return
 }
@@ -1121,6 +1230,46 @@ func (g *PkgGraph) CreateSubGraph(rootNode *PkgNode) (subGraph *PkgGraph, err er
 	return
 }
 
+// DependencyClosure returns a new graph with the roots, every node they transitively depend on, and the edges between
+// them. The nodes are deep copies keeping their IDs, states, and types, so changes to one graph don't affect the other.
+func (g *PkgGraph) DependencyClosure(roots []*PkgNode) (closure *PkgGraph, err error) {
+	search := traverse.DepthFirst{}
+	closure = NewPkgGraph()
+
+	// The search remembers visited nodes between walks, so dependencies shared by several roots are only copied once.
+	for _, root := range roots {
+		if g.Node(root.ID()) == nil {
+			return nil, fmt.Errorf("root '%s' is not part of the graph", root.FriendlyName())
+		}
+
+		search.Walk(g, root, func(n graph.Node) bool {
+			closure.AddNode(deepCopyNode(n.(*PkgNode)))
+			return false
+		})
+	}
+
+	for _, node := range graph.NodesOf(closure.Nodes()) {
+		for _, dependency := range graph.NodesOf(g.From(node.ID())) {
+			closure.SetEdge(closure.NewEdge(node, closure.Node(dependency.ID())))
+		}
+	}
+
+	logger.Log.Debugf("Created dependency closure with %d nodes for %d root(s)", closure.Nodes().Len(), len(roots))
+
+	return
+}
+
+// deepCopyNode returns a copy of a node, with the same ID, which shares no data with the original.
+func deepCopyNode(node *PkgNode) (nodeCopy *PkgNode) {
+	nodeCopy = node.Copy()
+	nodeCopy.GoalName = node.GoalName
+	if node.VersionedPkg != nil {
+		versionedPkg := *node.VersionedPkg
+		nodeCopy.VersionedPkg = &versionedPkg
+	}
+	return
+}
+
 // FindRPMFiles returns a list of all RPMs built by an SRPM and a list of these RPMs that are not available on the disk.
 // The function will lock 'graphMutex' before performing the check if the mutex is not nil.
 func FindRPMFiles(srpmPath string, pkgGraph *PkgGraph, graphMutex *sync.RWMutex) (expectedFiles, missingFiles []string) {
@@ -1131,7 +1280,7 @@ func FindRPMFiles(srpmPath string, pkgGraph *PkgGraph, graphMutex *sync.RWMutex)
 	return
 }
 
-// WriteDOTGraphFile writes the graph to a DOT graph format file
+// WriteDOTGraphFile writes the graph to a DOT graph format file. The file is gzip-compressed if its name ends with ".gz".
 func WriteDOTGraphFile(g graph.Directed, filename string) (err error) {
 	logger.Log.Infof("Writing DOT graph to %s", filename)
 	f, err := os.Create(filename)
@@ -1140,16 +1289,29 @@ func WriteDOTGraphFile(g graph.Directed, filename string) (err error) {
 	}
 	defer f.Close()
 
-	err = WriteDOTGraph(g, f)
+	if !strings.HasSuffix(filename, gzipFileExtension) {
+		err = WriteDOTGraph(g, f)
+		return
+	}
+
+	gzipWriter := gzip.NewWriter(f)
+	err = WriteDOTGraph(g, gzipWriter)
+	if err != nil {
+		gzipWriter.Close()
+		return
+	}
 
+	// Closing flushes the remaining compressed data, the file is incomplete if it fails.
+	err = gzipWriter.Close()
 	return
 }
 
-// ReadDOTGraphFile reads the graph from a DOT graph format file
+// ReadDOTGraphFile reads the graph from a DOT graph format file. Gzip-compressed files are detected by their magic
+// bytes and decompressed transparently.
 func ReadDOTGraphFile(filename string) (outputGraph *PkgGraph, err error) {
 	logger.Log.Infof("Reading DOT graph from %s", filename)
 
-	f, err := os.Open(filename)
+	f, err := openDOTGraphFile(filename)
 	if err != nil {
 		return
 	}
@@ -1161,6 +1323,120 @@ func ReadDOTGraphFile(filename string) (outputGraph *PkgGraph, err error) {
 	return
 }
 
+// openDOTGraphFile opens a DOT graph file for reading, decompressing it on the fly if it is gzip-compressed.
+func openDOTGraphFile(filename string) (reader io.ReadCloser, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+
+	bufferedFile := bufio.NewReader(f)
+	magic, err := bufferedFile.Peek(len(gzipMagic))
+	// A file shorter than the magic bytes can't be compressed, let the DOT parser report it.
+	if err != nil && err != io.EOF {
+		f.Close()
+		return
+	}
+	err = nil
+
+	if !bytes.Equal(magic, gzipMagic) {
+		reader = &fileReadCloser{Reader: bufferedFile, file: f}
+		return
+	}
+
+	gzipReader, err := gzip.NewReader(bufferedFile)
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("failed to decompress graph file '%s':\n%w", filename, err)
+		return
+	}
+	reader = &fileReadCloser{Reader: gzipReader, file: f, decompressor: gzipReader}
+	return
+}
+
+// fileReadCloser reads from a (possibly decompressing) reader wrapping 'file', closing both once done.
+type fileReadCloser struct {
+	io.Reader
+	file         *os.File
+	decompressor io.Closer
+}
+
+func (r *fileReadCloser) Close() (err error) {
+	if r.decompressor != nil {
+		err = r.decompressor.Close()
+	}
+
+	fileErr := r.file.Close()
+	if err == nil {
+		err = fileErr
+	}
+	return
+}
+
+// ReadDOTGraphFileWithWait de-serializes a graph from a DOT formatted file, retrying with an exponential backoff for up
+// to 'maxWait' while the file is missing, incomplete, or fails to parse. This covers the case where the file is still
+// being written by another process. A non-positive 'maxWait' behaves the same as ReadDOTGraphFile.
+func ReadDOTGraphFileWithWait(filename string, maxWait time.Duration) (outputGraph *PkgGraph, err error) {
+	const (
+		initialDelay  = 250 * time.Millisecond
+		backoffFactor = 2.0
+		// Effectively unlimited, the retries are bounded by 'maxWait' instead.
+		maxAttempts = math.MaxInt32
+	)
+
+	if maxWait <= 0 {
+		return ReadDOTGraphFile(filename)
+	}
+
+	cancel := make(chan struct{})
+	timer := time.AfterFunc(maxWait, func() { close(cancel) })
+	defer timer.Stop()
+
+	_, err = retry.RunWithExpBackoff(func() (readErr error) {
+		outputGraph, readErr = readCompleteDOTGraphFile(filename)
+		if readErr != nil {
+			logger.Log.Infof("Graph file '%s' is not ready yet, waiting: %s", filename, readErr)
+		}
+		return
+	}, maxAttempts, initialDelay, backoffFactor, cancel)
+	if err != nil {
+		err = fmt.Errorf("graph file '%s' was not ready after waiting %s:\n%w", filename, maxWait, err)
+	}
+
+	return
+}
+
+// readCompleteDOTGraphFile de-serializes a graph from a DOT formatted file, returning an error if the file does not
+// end with the closing brace of the graph.
+func readCompleteDOTGraphFile(filename string) (outputGraph *PkgGraph, err error) {
+	const dotGraphClosingToken = "}"
+
+	f, err := openDOTGraphFile(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	// A truncated compressed file fails with an unexpected EOF here.
+	contents, err := io.ReadAll(f)
+	if err != nil {
+		return
+	}
+
+	if !strings.HasSuffix(strings.TrimSpace(string(contents)), dotGraphClosingToken) {
+		err = fmt.Errorf("graph file '%s' is incomplete, missing closing '%s'", filename, dotGraphClosingToken)
+		return
+	}
+
+	outputGraph = NewPkgGraph()
+	err = ReadDOTGraph(outputGraph, bytes.NewReader(contents))
+	if err != nil {
+		outputGraph = nil
+	}
+
+	return
+}
+
 // ReadDOTGraph de-serializes a graph from a DOT formatted object
 func ReadDOTGraph(g graph.DirectedBuilder, input io.Reader) (err error) {
 	bytes, err := io.ReadAll(input)
@@ -1194,6 +1470,79 @@ func (g *PkgGraph) DeepCopy() (deepCopy *PkgGraph, err error) {
 	return
 }
 
+// Validate checks the graph for structural problems which would prevent other tools from consuming it.
+// It does not require access to any package repositories.
+func (g *PkgGraph) Validate() (err error) {
+	const maxReportedProblems = 20
+
+	problems := []string{}
+	localNodes := make(map[string]*PkgNode)
+	for _, n := range g.AllNodes() {
+		nodeErr := validateNode(n)
+		if nodeErr != nil {
+			problems = append(problems, nodeErr.Error())
+			continue
+		}
+
+		// Local build, run, and test nodes must be unique for a given package version.
+		if n.Type == TypeLocalBuild || n.Type == TypeLocalRun || n.Type == TypeTest {
+			interval, _ := n.VersionedPkg.Interval()
+			key := fmt.Sprintf("%s|%s|%s", n.Type, n.VersionedPkg.Name, interval.String())
+			if existingNode, found := localNodes[key]; found {
+				problems = append(problems, fmt.Sprintf("nodes with IDs %d and %d are duplicates of '%s'", existingNode.ID(), n.ID(), n.FriendlyName()))
+				continue
+			}
+			localNodes[key] = n
+		}
+	}
+
+	if len(problems) == 0 {
+		return
+	}
+
+	totalProblems := len(problems)
+	if totalProblems > maxReportedProblems {
+		problems = append(problems[:maxReportedProblems], fmt.Sprintf("... and %d more", totalProblems-maxReportedProblems))
+	}
+
+	return fmt.Errorf("found %d problem(s) in the graph:\n%s", totalProblems, strings.Join(problems, "\n"))
+}
+
+// ValidateRpmPaths returns an error for every resolved node, i.e. cached, up-to-date, or prebuilt, whose RPM path
+// is empty or points to a missing file. Nodes annotated with AnnotationHostProvided need no RPM and are skipped.
+func (g *PkgGraph) ValidateRpmPaths() (errs []error) {
+	nodes := g.AllNodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID() < nodes[j].ID()
+	})
+
+	for _, n := range nodes {
+		if n.State != StateCached && n.State != StateUpToDate && n.Type != TypePreBuilt {
+			continue
+		}
+
+		if _, hostProvided := n.Annotation(AnnotationHostProvided); hostProvided {
+			continue
+		}
+
+		if n.RpmPath == "" || n.RpmPath == NoRPMPath {
+			errs = append(errs, fmt.Errorf("resolved node '%s' has no RPM path", n.FriendlyName()))
+			continue
+		}
+
+		exists, err := file.PathExists(n.RpmPath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to check the RPM '%s' of node '%s':\n%w", n.RpmPath, n.FriendlyName(), err))
+			continue
+		}
+		if !exists {
+			errs = append(errs, fmt.Errorf("RPM '%s' of resolved node '%s' does not exist", n.RpmPath, n.FriendlyName()))
+		}
+	}
+
+	return
+}
+
 func (g *PkgGraph) MakeDAG() (err error) {
 	return g.MakeDAGUsingUpstreamRepos(false, false, nil)
 }
@@ -1233,6 +1582,9 @@ func (n *PkgNode) Copy() (copy *PkgNode) {
 		SourceRepo:   n.SourceRepo,
 		Implicit:     n.Implicit,
 	}
+	for key, value := range n.Annotations {
+		copy.SetAnnotation(key, value)
+	}
 	copy.This = copy
 	return
 }
@@ -1557,6 +1909,7 @@ func (g *PkgGraph) safeAddNode(pkgNode *PkgNode) (err error) {
 	}()
 
 	g.AddNode(pkgNode)
+	g.InvalidateRpmPathIndex()
 
 	return
 }
@@ -1581,6 +1934,41 @@ func formatCycleErrorMessage(cycle []*PkgNode, err error) error {
 	return fmt.Errorf("cycles detected in dependency graph")
 }
 
+// validateNode checks a single node has a known state and type along with the fields its type requires.
+func validateNode(n *PkgNode) (err error) {
+	if n.State <= StateUnknown || n.State >= StateMAX {
+		return fmt.Errorf("node with ID %d has an invalid state (%d)", n.ID(), n.State)
+	}
+
+	if n.Type <= TypeUnknown || n.Type >= TypeMAX {
+		return fmt.Errorf("node with ID %d has an invalid type (%d)", n.ID(), n.Type)
+	}
+
+	switch n.Type {
+	case TypeGoal:
+		if n.GoalName == "" {
+			return fmt.Errorf("goal node with ID %d has no name", n.ID())
+		}
+	case TypePureMeta:
+		// Meta nodes carry no package information.
+	default:
+		if n.VersionedPkg == nil {
+			return fmt.Errorf("node with ID %d of type '%s' has no package information", n.ID(), n.Type)
+		}
+
+		_, err = n.VersionedPkg.Interval()
+		if err != nil {
+			return fmt.Errorf("node '%s' has an invalid version:\n%w", n.FriendlyName(), err)
+		}
+
+		if n.Type == TypeLocalBuild && (n.SrpmPath == "" || n.SrpmPath == NoSRPMPath) {
+			return fmt.Errorf("build node '%s' has no SRPM path", n.FriendlyName())
+		}
+	}
+
+	return
+}
+
 // pkgNodesListToPackageVerSet converts a list of "*PkgNode" elements to a set of "*PackageVer" elements.
 func pkgNodesListToPackageVerSet(nodes []*PkgNode) (packageVerSet map[*pkgjson.PackageVer]bool) {
 	packageVerSet = make(map[*pkgjson.PackageVer]bool)
@@ -5,10 +5,14 @@ package pkggraph
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
@@ -859,6 +863,30 @@ func TestEncodeDecodeDOT(t *testing.T) {
 	checkTestGraph(t, gIn)
 }
 
+// Annotations must survive a DOT round trip.
+func TestEncodeDecodeAnnotations(t *testing.T) {
+	gOut := NewPkgGraph()
+	annotated, err := gOut.AddPkgNode(&pkgjson.PackageVer{Name: "D", Version: "1"}, StateUnresolved, TypeRemoteRun, NoSRPMPath, NoRPMPath, NoSpecPath, NoSourceDir, NoArchitecture, NoSourceRepo)
+	assert.NoError(t, err)
+	annotated.SetAnnotation(AnnotationResolveTimeout, "10m")
+
+	var buf bytes.Buffer
+	err = WriteDOTGraph(gOut, &buf)
+	assert.NoError(t, err)
+
+	gIn := NewPkgGraph()
+	err = ReadDOTGraph(gIn, &buf)
+	assert.NoError(t, err)
+
+	runNodes := gIn.AllRunNodes()
+	assert.Len(t, runNodes, 1)
+	assert.True(t, runNodes[0].Equal(annotated))
+
+	timeout, found := runNodes[0].Annotation(AnnotationResolveTimeout)
+	assert.True(t, found)
+	assert.Equal(t, "10m", timeout)
+}
+
 // Test the deep copy functionality works as expected.
 func TestDeepCopy(t *testing.T) {
 
@@ -916,6 +944,63 @@ func TestReadWriteGraph(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestReadWriteCompressedGraph(t *testing.T) {
+	gOut, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	graphFile := filepath.Join(t.TempDir(), "test_graph.dot.gz")
+	err = WriteDOTGraphFile(gOut, graphFile)
+	assert.NoError(t, err)
+
+	// The output must be a valid gzip stream, not plain DOT.
+	compressed, err := ioutil.ReadFile(graphFile)
+	assert.NoError(t, err)
+	assert.Equal(t, gzipMagic, compressed[:len(gzipMagic)])
+
+	gIn, err := ReadDOTGraphFile(graphFile)
+	assert.NoError(t, err)
+	checkTestGraph(t, gIn)
+
+	gIn, err = ReadDOTGraphFileWithWait(graphFile, time.Second)
+	assert.NoError(t, err)
+	checkTestGraph(t, gIn)
+}
+
+// Compression is detected by content, so a compressed file without the ".gz" extension is still readable.
+func TestReadCompressedGraphWithoutExtension(t *testing.T) {
+	gOut, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	compressedFile := filepath.Join(t.TempDir(), "test_graph.dot.gz")
+	err = WriteDOTGraphFile(gOut, compressedFile)
+	assert.NoError(t, err)
+
+	graphFile := strings.TrimSuffix(compressedFile, gzipFileExtension)
+	err = os.Rename(compressedFile, graphFile)
+	assert.NoError(t, err)
+
+	gIn, err := ReadDOTGraphFile(graphFile)
+	assert.NoError(t, err)
+	checkTestGraph(t, gIn)
+}
+
+func TestShouldFailToWaitForTruncatedCompressedDOTFile(t *testing.T) {
+	gOut, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	graphFile := filepath.Join(t.TempDir(), "graph.dot.gz")
+	err = WriteDOTGraphFile(gOut, graphFile)
+	assert.NoError(t, err)
+
+	compressed, err := ioutil.ReadFile(graphFile)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(graphFile, compressed[:len(compressed)/2], 0644)
+	assert.NoError(t, err)
+
+	_, err = ReadDOTGraphFileWithWait(graphFile, 500*time.Millisecond)
+	assert.Error(t, err)
+}
+
 // Validate the reference graph is valid, and that it matches the output of the test graph.
 func TestReferenceDOTFile(t *testing.T) {
 	gIn, err := ReadDOTGraphFile("test_graph_reference.dot")
@@ -945,6 +1030,37 @@ func TestReferenceDOTFile(t *testing.T) {
 	assert.Equal(t, 0, bytes.Compare(bytesFromCode, bytesFromFile))
 }
 
+// Make sure a graph file which is still being written is read once it is complete
+func TestShouldWaitForIncompleteDOTFile(t *testing.T) {
+	reference, err := ioutil.ReadFile("test_graph_reference.dot")
+	assert.NoError(t, err)
+
+	graphFile := filepath.Join(t.TempDir(), "graph.dot")
+	err = ioutil.WriteFile(graphFile, reference[:len(reference)/2], 0644)
+	assert.NoError(t, err)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ioutil.WriteFile(graphFile, reference, 0644)
+	}()
+
+	gIn, err := ReadDOTGraphFileWithWait(graphFile, 10*time.Second)
+	assert.NoError(t, err)
+	checkTestGraph(t, gIn)
+}
+
+func TestShouldFailToWaitForTruncatedDOTFile(t *testing.T) {
+	reference, err := ioutil.ReadFile("test_graph_reference.dot")
+	assert.NoError(t, err)
+
+	graphFile := filepath.Join(t.TempDir(), "graph.dot")
+	err = ioutil.WriteFile(graphFile, reference[:len(reference)/2], 0644)
+	assert.NoError(t, err)
+
+	_, err = ReadDOTGraphFileWithWait(graphFile, 500*time.Millisecond)
+	assert.Error(t, err)
+}
+
 // Make sure we can extract a subgraph
 func TestSubgraph(t *testing.T) {
 	g, err := buildTestGraphHelper()
@@ -976,6 +1092,162 @@ func TestSubgraph(t *testing.T) {
 	assert.Equal(t, len(component), len(subGraph.AllNodes()))
 }
 
+func TestDependencyClosure(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	rootB, err := g.FindBestPkgNode(&pkgjson.PackageVer{Name: "B"})
+	assert.NoError(t, err)
+	rootC2, err := g.FindExactPkgNodeFromPkg(&pkgC2)
+	assert.NoError(t, err)
+
+	closure, err := g.DependencyClosure([]*PkgNode{rootB.RunNode, rootC2.RunNode})
+	assert.NoError(t, err)
+
+	component := []*PkgNode{
+		pkgBRun, pkgBBuild, pkgCRun, pkgCBuild, pkgD2Unresolved, pkgD3Unresolved,
+		pkgC2Run, pkgC2Build, pkgD4Unresolved, pkgD5Unresolved, pkgD6Unresolved,
+	}
+	containsNode := func(node *PkgNode) (found bool) {
+		for _, n := range closure.AllNodes() {
+			found = found || node.Equal(n)
+		}
+		return
+	}
+
+	assert.Equal(t, len(component), closure.Nodes().Len())
+	for _, mustHave := range component {
+		assert.True(t, containsNode(mustHave), "missing %s", mustHave.FriendlyName())
+	}
+	assert.Equal(t, 9, closure.Edges().Len())
+
+	// 'A' depends on 'B', but is not a dependency of either root.
+	for _, unrelated := range []*PkgNode{pkgARun, pkgABuild, pkgD1Unresolved} {
+		assert.False(t, containsNode(unrelated), "unexpected %s", unrelated.FriendlyName())
+	}
+}
+
+func TestDependencyClosureCopiesNodes(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	root, err := g.FindBestPkgNode(&pkgjson.PackageVer{Name: "B"})
+	assert.NoError(t, err)
+	originalState := root.RunNode.State
+	originalVersion := root.RunNode.VersionedPkg.Version
+
+	closure, err := g.DependencyClosure([]*PkgNode{root.RunNode})
+	assert.NoError(t, err)
+
+	closureRoot := closure.Node(root.RunNode.ID()).(*PkgNode)
+	assert.NotSame(t, root.RunNode, closureRoot)
+	assert.Same(t, closureRoot, closureRoot.This)
+
+	closureRoot.State = StateCached
+	closureRoot.VersionedPkg.Version = "999"
+	assert.Equal(t, originalState, root.RunNode.State)
+	assert.Equal(t, originalVersion, root.RunNode.VersionedPkg.Version)
+}
+
+func TestDependencyClosureRejectsForeignRoot(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	foreignNode := &PkgNode{nodeID: 1000, VersionedPkg: &pkgjson.PackageVer{Name: "foreign"}}
+	_, err = g.DependencyClosure([]*PkgNode{foreignNode})
+	assert.Error(t, err)
+}
+
+func TestShouldListDependentsAndDependencies(t *testing.T) {
+	g := NewPkgGraph()
+	nodes := make(map[string]*PkgNode)
+	for _, name := range []string{"app", "lib", "libc"} {
+		node, err := g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: name})
+		assert.NoError(t, err)
+		nodes[name] = node
+	}
+	assert.NoError(t, g.AddEdge(nodes["app"], nodes["lib"]))
+	assert.NoError(t, g.AddEdge(nodes["app"], nodes["libc"]))
+	assert.NoError(t, g.AddEdge(nodes["lib"], nodes["libc"]))
+
+	assert.ElementsMatch(t, []*PkgNode{nodes["lib"], nodes["libc"]}, g.Dependencies(nodes["app"]))
+	assert.ElementsMatch(t, []*PkgNode{nodes["libc"]}, g.Dependencies(nodes["lib"]))
+	assert.ElementsMatch(t, []*PkgNode{nodes["app"]}, g.Dependents(nodes["lib"]))
+	assert.ElementsMatch(t, []*PkgNode{nodes["app"], nodes["lib"]}, g.Dependents(nodes["libc"]))
+
+	// Nothing depends on the root and the leaf depends on nothing.
+	assert.Empty(t, g.Dependents(nodes["app"]))
+	assert.Empty(t, g.Dependencies(nodes["libc"]))
+}
+
+func TestShouldVisitEachNodeOnce(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	visits := make(map[*PkgNode]int)
+	assert.NoError(t, g.EachNode(func(n *PkgNode) error {
+		visits[n]++
+		return nil
+	}))
+	assert.Len(t, visits, len(g.AllNodes()))
+	for _, n := range g.AllNodes() {
+		assert.Equal(t, 1, visits[n], "node %s", n.FriendlyName())
+	}
+
+	runVisits := make(map[*PkgNode]int)
+	assert.NoError(t, g.EachRunNode(func(n *PkgNode) error {
+		runVisits[n]++
+		return nil
+	}))
+	assert.Len(t, runVisits, len(g.AllRunNodes()))
+	for _, n := range g.AllRunNodes() {
+		assert.Equal(t, 1, runVisits[n], "node %s", n.FriendlyName())
+	}
+}
+
+func TestShouldStopVisitingNodesOnError(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+	assert.Greater(t, len(g.AllRunNodes()), 2)
+
+	errStop := errors.New("stop")
+	visits := 0
+	err = g.EachRunNode(func(n *PkgNode) error {
+		visits++
+		if visits == 2 {
+			return errStop
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 2, visits)
+}
+
+func TestShouldReportResolvedNodesWithMissingRPMs(t *testing.T) {
+	existingRPM := filepath.Join(t.TempDir(), "zlib-1.2.13-1.cm2.x86_64.rpm")
+	assert.NoError(t, os.WriteFile(existingRPM, []byte{}, 0644))
+	missingRPM := filepath.Join(t.TempDir(), "glibc-2.35-3.cm2.x86_64.rpm")
+
+	g := NewPkgGraph()
+	addNode := func(name string, state NodeState, nodeType NodeType, rpmPath string) *PkgNode {
+		n, err := g.AddPkgNode(&pkgjson.PackageVer{Name: name}, state, nodeType, NoSRPMPath, rpmPath, NoSpecPath, NoSourceDir, NoArchitecture, NoSourceRepo)
+		assert.NoError(t, err)
+		return n
+	}
+	addNode("zlib", StateCached, TypeRemoteRun, existingRPM)
+	addNode("glibc", StateCached, TypeRemoteRun, missingRPM)
+	addNode("gcc", StateUpToDate, TypePreBuilt, NoRPMPath)
+	addNode("bash", StateUnresolved, TypeRemoteRun, NoRPMPath)
+	addNode("/bin/sh", StateUpToDate, TypeRemoteRun, NoRPMPath).SetAnnotation(AnnotationHostProvided, "true")
+
+	errs := g.ValidateRpmPaths()
+	assert.Len(t, errs, 2)
+	assert.ErrorContains(t, errs[0], "'"+missingRPM+"'")
+	assert.ErrorContains(t, errs[0], "does not exist")
+	assert.ErrorContains(t, errs[1], "gcc")
+	assert.ErrorContains(t, errs[1], "has no RPM path")
+}
+
 // Make sure we can encode/decode a subgraph
 func TestEncodingSubGraph(t *testing.T) {
 	g, err := buildTestGraphHelper()
@@ -1069,3 +1341,32 @@ func TestShouldGetSRPMNameFromEmptySRPMPath(t *testing.T) {
 
 	assert.Equal(t, ".", node.SRPMFileName())
 }
+
+func TestShouldValidateTestGraph(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	assert.NoError(t, g.Validate())
+}
+
+func TestShouldFailValidationForInvalidNodeState(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	lookup, err := g.FindBestPkgNode(&pkgA)
+	assert.NoError(t, err)
+	lookup.RunNode.State = StateMAX
+
+	assert.Error(t, g.Validate())
+}
+
+func TestShouldFailValidationForBuildNodeWithoutSRPM(t *testing.T) {
+	g, err := buildTestGraphHelper()
+	assert.NoError(t, err)
+
+	lookup, err := g.FindBestPkgNode(&pkgB)
+	assert.NoError(t, err)
+	lookup.BuildNode.SrpmPath = NoSRPMPath
+
+	assert.Error(t, g.Validate())
+}
@@ -0,0 +1,76 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"path/filepath"
+)
+
+// rpmPathIndex maps the RPM paths of a graph's nodes, both in full and as base names, to the nodes owning them.
+type rpmPathIndex struct {
+	byPath     map[string]*PkgNode
+	byBaseName map[string]*PkgNode
+}
+
+// FindNodeByRpmPath returns the node owning an RPM, given either its full path or only its file name. If several nodes
+// share the RPM, e.g. the build and run nodes of a local package, run nodes are preferred.
+//
+// The lookup uses a snapshot of the nodes' RPM paths, taken on the first call. Adding or removing nodes through the
+// graph discards it, but after changing the 'RpmPath' of existing nodes callers must call InvalidateRpmPathIndex.
+func (g *PkgGraph) FindNodeByRpmPath(path string) (node *PkgNode, found bool) {
+	if g.rpmPathIndex == nil {
+		g.rpmPathIndex = g.buildRpmPathIndex()
+	}
+
+	node, found = g.rpmPathIndex.byPath[path]
+	if !found {
+		node, found = g.rpmPathIndex.byBaseName[filepath.Base(path)]
+	}
+	return
+}
+
+// InvalidateRpmPathIndex discards the snapshot of the nodes' RPM paths used by FindNodeByRpmPath.
+func (g *PkgGraph) InvalidateRpmPathIndex() {
+	g.rpmPathIndex = nil
+}
+
+// buildRpmPathIndex indexes the RPM paths of all nodes.
+func (g *PkgGraph) buildRpmPathIndex() (index *rpmPathIndex) {
+	index = &rpmPathIndex{
+		byPath:     make(map[string]*PkgNode),
+		byBaseName: make(map[string]*PkgNode),
+	}
+
+	for _, n := range g.AllNodes() {
+		if n.RpmPath == "" || n.RpmPath == NoRPMPath {
+			continue
+		}
+
+		if isPreferredRpmOwner(n, index.byPath[n.RpmPath]) {
+			index.byPath[n.RpmPath] = n
+		}
+
+		baseName := filepath.Base(n.RpmPath)
+		if isPreferredRpmOwner(n, index.byBaseName[baseName]) {
+			index.byBaseName[baseName] = n
+		}
+	}
+
+	return
+}
+
+// isPreferredRpmOwner checks if 'candidate' should own an RPM instead of 'current'. Run nodes are preferred, ties are
+// broken by the lowest node ID so the choice does not depend on the iteration order of the graph.
+func isPreferredRpmOwner(candidate, current *PkgNode) bool {
+	if current == nil {
+		return true
+	}
+
+	candidateIsRun := candidate.Type == TypeLocalRun || candidate.Type == TypeRemoteRun
+	currentIsRun := current.Type == TypeLocalRun || current.Type == TypeRemoteRun
+	if candidateIsRun != currentIsRun {
+		return candidateIsRun
+	}
+	return candidate.ID() < current.ID()
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package pkggraph
+
+import (
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/pkgjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldFindNodeByRpmPath(t *testing.T) {
+	const (
+		zlibRPM   = "/rpms/x86_64/zlib-1.2.13-1.cm2.x86_64.rpm"
+		remoteRPM = "/cache/glibc-2.35-3.cm2.x86_64.rpm"
+	)
+
+	g := NewPkgGraph()
+	zlibPkg := &pkgjson.PackageVer{Name: "zlib", Version: "1.2.13-1.cm2"}
+	zlibRun, err := g.AddPkgNode(zlibPkg, StateMeta, TypeLocalRun, "zlib.src.rpm", zlibRPM, "zlib.spec", "SOURCES", "x86_64", "local")
+	assert.NoError(t, err)
+	zlibBuild, err := g.AddPkgNode(zlibPkg, StateBuild, TypeLocalBuild, "zlib.src.rpm", zlibRPM, "zlib.spec", "SOURCES", "x86_64", "local")
+	assert.NoError(t, err)
+	glibcRun, err := g.AddPkgNode(&pkgjson.PackageVer{Name: "glibc"}, StateCached, TypeRemoteRun, NoSRPMPath, remoteRPM, NoSpecPath, NoSourceDir, NoArchitecture, NoSourceRepo)
+	assert.NoError(t, err)
+	_, err = g.AddRemoteUnresolvedNode(&pkgjson.PackageVer{Name: "bash"})
+	assert.NoError(t, err)
+
+	// The build node shares the RPM with the run node.
+	node, found := g.FindNodeByRpmPath(zlibRPM)
+	assert.True(t, found)
+	assert.Same(t, zlibRun, node)
+	assert.NotSame(t, zlibBuild, node)
+
+	node, found = g.FindNodeByRpmPath("glibc-2.35-3.cm2.x86_64.rpm")
+	assert.True(t, found)
+	assert.Same(t, glibcRun, node)
+
+	node, found = g.FindNodeByRpmPath(remoteRPM)
+	assert.True(t, found)
+	assert.Same(t, glibcRun, node)
+
+	_, found = g.FindNodeByRpmPath("/cache/bash-5.1.8-1.cm2.x86_64.rpm")
+	assert.False(t, found)
+
+	_, found = g.FindNodeByRpmPath(NoRPMPath)
+	assert.False(t, found)
+
+	// The index is a snapshot until it is invalidated.
+	const movedRPM = "/moved/glibc-2.35-3.cm2.x86_64.rpm"
+	glibcRun.RpmPath = movedRPM
+	_, found = g.FindNodeByRpmPath(movedRPM)
+	assert.True(t, found, "base name still matches the snapshot")
+	node, found = g.FindNodeByRpmPath(remoteRPM)
+	assert.True(t, found)
+	assert.Same(t, glibcRun, node)
+
+	g.InvalidateRpmPathIndex()
+	node, found = g.FindNodeByRpmPath(movedRPM)
+	assert.True(t, found)
+	assert.Same(t, glibcRun, node)
+
+	// Adding a node discards the snapshot.
+	bashRPM := "/cache/bash-5.1.8-1.cm2.x86_64.rpm"
+	bashRun, err := g.AddPkgNode(&pkgjson.PackageVer{Name: "bash", Version: "5.1.8-1.cm2"}, StateCached, TypeRemoteRun, NoSRPMPath, bashRPM, NoSpecPath, NoSourceDir, NoArchitecture, NoSourceRepo)
+	assert.NoError(t, err)
+	node, found = g.FindNodeByRpmPath(bashRPM)
+	assert.True(t, found)
+	assert.Same(t, bashRun, node)
+}
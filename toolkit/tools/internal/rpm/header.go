@@ -0,0 +1,215 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+)
+
+// Main header tags describing the package.
+const (
+	headerTagName           = 1000
+	headerTagVersion        = 1001
+	headerTagRelease        = 1002
+	headerTagEpoch          = 1003
+	headerTagArch           = 1022
+	headerTagOldFileNames   = 1027
+	headerTagProvideName    = 1047
+	headerTagRequireFlags   = 1048
+	headerTagRequireName    = 1049
+	headerTagRequireVersion = 1050
+	headerTagProvideFlags   = 1112
+	headerTagProvideVersion = 1113
+	headerTagDirIndexes     = 1116
+	headerTagBaseNames      = 1117
+	headerTagDirNames       = 1118
+)
+
+// Comparison bits of a dependency's flags.
+const (
+	dependencyFlagLess    = 1 << 1
+	dependencyFlagGreater = 1 << 2
+	dependencyFlagEqual   = 1 << 3
+)
+
+// PackageInfo describes an RPM file as recorded in its header.
+type PackageInfo struct {
+	Name    string
+	Epoch   string // Empty if the package has no epoch
+	Version string
+	Release string
+	Arch    string
+
+	// Capabilities in the format of 'rpm -qP' and 'rpm -qR', e.g. "glibc >= 2.35".
+	Provides []string
+	Requires []string
+
+	// Absolute paths of the files and directories installed by the package.
+	Files []string
+}
+
+// NEVRA returns the package's "<name>-[<epoch>:]<version>-<release>.<arch>".
+func (p *PackageInfo) NEVRA() string {
+	evr := fmt.Sprintf("%s-%s", p.Version, p.Release)
+	if p.Epoch != "" {
+		evr = fmt.Sprintf("%s%s%s", p.Epoch, epochSeparator, evr)
+	}
+	return fmt.Sprintf("%s-%s.%s", p.Name, evr, p.Arch)
+}
+
+// ReadPackageHeader reads the name, version, architecture, provides, requires, and files of an RPM file directly from
+// its header, without invoking 'rpm' or 'tdnf'. Files provided by the package are not part of its provides.
+func ReadPackageHeader(rpmFile string) (info *PackageInfo, err error) {
+	logger.Log.Debugf("Reading the header of RPM (%s)", rpmFile)
+
+	rpmHandle, err := os.Open(rpmFile)
+	if err != nil {
+		return
+	}
+	defer rpmHandle.Close()
+
+	_, mainHeader, err := readRPMHeaders(bufio.NewReader(rpmHandle))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the headers of (%s):\n%w", rpmFile, err)
+	}
+
+	info = &PackageInfo{}
+	requiredTags := []struct {
+		tag   uint32
+		value *string
+	}{
+		{headerTagName, &info.Name},
+		{headerTagVersion, &info.Version},
+		{headerTagRelease, &info.Release},
+		{headerTagArch, &info.Arch},
+	}
+	for _, requiredTag := range requiredTags {
+		var found bool
+		*requiredTag.value, found = mainHeader.stringValue(requiredTag.tag)
+		if !found {
+			return nil, fmt.Errorf("(%s) has no tag (%d) in its header", rpmFile, requiredTag.tag)
+		}
+	}
+
+	epoch, found := mainHeader.int32Value(headerTagEpoch)
+	if found {
+		info.Epoch = fmt.Sprint(epoch)
+	}
+
+	info.Provides, err = mainHeader.dependencies(headerTagProvideName, headerTagProvideFlags, headerTagProvideVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provides in (%s):\n%w", rpmFile, err)
+	}
+
+	info.Requires, err = mainHeader.dependencies(headerTagRequireName, headerTagRequireFlags, headerTagRequireVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid requires in (%s):\n%w", rpmFile, err)
+	}
+
+	info.Files, err = mainHeader.files()
+	if err != nil {
+		return nil, fmt.Errorf("invalid file list in (%s):\n%w", rpmFile, err)
+	}
+
+	return
+}
+
+// files joins the compressed file list of the header back into absolute paths. Headers of packages built without
+// 'rpmlib(CompressedFileNames)' list the full paths instead.
+func (h *rpmHeader) files() (files []string, err error) {
+	baseNames, found := h.stringValues(headerTagBaseNames)
+	if !found {
+		files, _ = h.stringValues(headerTagOldFileNames)
+		return
+	}
+
+	dirIndexes, _ := h.int32Values(headerTagDirIndexes)
+	dirNames, _ := h.stringValues(headerTagDirNames)
+	if len(dirIndexes) != len(baseNames) {
+		return nil, fmt.Errorf("found %d base names and %d directory indexes", len(baseNames), len(dirIndexes))
+	}
+
+	for i, baseName := range baseNames {
+		if int(dirIndexes[i]) >= len(dirNames) {
+			return nil, fmt.Errorf("directory index (%d) of '%s' is out of range", dirIndexes[i], baseName)
+		}
+		files = append(files, dirNames[dirIndexes[i]]+baseName)
+	}
+	return
+}
+
+// dependencies formats the dependencies stored in the parallel name, flags, and version tags.
+func (h *rpmHeader) dependencies(nameTag, flagsTag, versionTag uint32) (dependencies []string, err error) {
+	names, _ := h.stringValues(nameTag)
+	flags, _ := h.int32Values(flagsTag)
+	versions, _ := h.stringValues(versionTag)
+
+	if len(flags) != len(names) || len(versions) != len(names) {
+		return nil, fmt.Errorf("found %d names, %d flags, and %d versions", len(names), len(flags), len(versions))
+	}
+
+	for i, name := range names {
+		operator := dependencyOperator(flags[i])
+		if operator == "" || versions[i] == "" {
+			dependencies = append(dependencies, name)
+			continue
+		}
+		dependencies = append(dependencies, strings.Join([]string{name, operator, versions[i]}, " "))
+	}
+	return
+}
+
+// dependencyOperator returns the comparison operator (e.g. ">=") of a dependency's flags, empty if it has none.
+func dependencyOperator(flags uint32) (operator string) {
+	if flags&dependencyFlagLess != 0 {
+		operator += "<"
+	}
+	if flags&dependencyFlagGreater != 0 {
+		operator += ">"
+	}
+	if flags&dependencyFlagEqual != 0 {
+		operator += "="
+	}
+	return
+}
+
+// stringValues returns all elements of a string array tag.
+func (h *rpmHeader) stringValues(tag uint32) (values []string, found bool) {
+	entry, found := h.entries[tag]
+	if !found || entry.entryType != headerTypeStringArray {
+		return nil, false
+	}
+
+	data := h.data[entry.offset:]
+	for i := uint32(0); i < entry.count; i++ {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil, false
+		}
+		values = append(values, string(data[:end]))
+		data = data[end+1:]
+	}
+	return values, true
+}
+
+// int32Values returns all elements of an int32 tag.
+func (h *rpmHeader) int32Values(tag uint32) (values []uint32, found bool) {
+	entry, found := h.entries[tag]
+	if !found || entry.entryType != headerTypeInt32 || uint64(entry.offset)+4*uint64(entry.count) > uint64(len(h.data)) {
+		return nil, false
+	}
+
+	for i := uint32(0); i < entry.count; i++ {
+		start := entry.offset + 4*i
+		values = append(values, binary.BigEndian.Uint32(h.data[start:start+4]))
+	}
+	return values, true
+}
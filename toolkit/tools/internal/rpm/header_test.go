@@ -0,0 +1,54 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpm
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The fixtures are minimal RPMs: "header" has an epoch, versioned and unversioned provides, and an 'rpmlib()'
+// requirement, "files" has a compressed file list and a file requirement.
+var headerFixturesDir = filepath.Join(specsDir, "headers")
+
+func TestReadPackageHeaderShouldReturnNEVRAAndDependencies(t *testing.T) {
+	info, err := ReadPackageHeader(filepath.Join(headerFixturesDir, "header-1.0-1.cm2.x86_64.rpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, "header", info.Name)
+	assert.Equal(t, "2", info.Epoch)
+	assert.Equal(t, "1.0", info.Version)
+	assert.Equal(t, "1.cm2", info.Release)
+	assert.Equal(t, "x86_64", info.Arch)
+	assert.Equal(t, "header-2:1.0-1.cm2.x86_64", info.NEVRA())
+	assert.Equal(t, []string{"header = 2:1.0-1.cm2", "header(x86-64) = 2:1.0-1.cm2", "libheader.so.1()(64bit)"}, info.Provides)
+	assert.Equal(t, []string{"glibc >= 2.35", "rpmlib(CompressedFileNames) <= 3.0.4-1"}, info.Requires)
+}
+
+func TestReadPackageHeaderShouldAllowPackageWithoutEpochOrDependencies(t *testing.T) {
+	info, err := ReadPackageHeader(signatureFixture("unsigned-1.0-1.cm2.x86_64.rpm"))
+	assert.NoError(t, err)
+	assert.Empty(t, info.Epoch)
+	assert.Equal(t, "unsigned-1.0-1.cm2.x86_64", info.NEVRA())
+	assert.Empty(t, info.Provides)
+	assert.Empty(t, info.Requires)
+}
+
+func TestReadPackageHeaderShouldRejectNonRPMFile(t *testing.T) {
+	_, err := ReadPackageHeader(signatureFixture("trusted-keyring.gpg"))
+	assert.ErrorContains(t, err, "not an RPM file")
+}
+
+func TestReadPackageHeaderShouldReturnFiles(t *testing.T) {
+	info, err := ReadPackageHeader(filepath.Join(headerFixturesDir, "files-1.0-1.cm2.noarch.rpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"files = 1.0-1.cm2"}, info.Provides)
+	assert.Equal(t, []string{"/bin/sh"}, info.Requires)
+	assert.Equal(t, []string{"/usr/bin/files", "/etc/files.conf", "/usr/bin/files-helper"}, info.Files)
+
+	info, err = ReadPackageHeader(filepath.Join(headerFixturesDir, "header-1.0-1.cm2.x86_64.rpm"))
+	assert.NoError(t, err)
+	assert.Empty(t, info.Files)
+}
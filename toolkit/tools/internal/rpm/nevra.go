@@ -0,0 +1,42 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const rpmFileExtension = ".rpm"
+
+// nevraRegex splits "<name>-[<epoch>:]<version>-<release>.<arch>" into its name, optional epoch, version, release,
+// and architecture.
+var nevraRegex = regexp.MustCompile(`^(.+)-(?:(\d+):)?([^-:]+)-([^-]+)\.([^.]+)$`)
+
+// ParseNEVRA parses a package's "<name>-[<epoch>:]<version>-<release>.<arch>", optionally ending with ".rpm" like an
+// RPM's file name. The returned PackageInfo has no provides or requires.
+func ParseNEVRA(nevra string) (info *PackageInfo, err error) {
+	matches := nevraRegex.FindStringSubmatch(strings.TrimSuffix(nevra, rpmFileExtension))
+	if matches == nil {
+		return nil, fmt.Errorf("(%s) is not in the '<name>-[<epoch>:]<version>-<release>.<arch>' format", nevra)
+	}
+
+	return &PackageInfo{
+		Name:    matches[1],
+		Epoch:   matches[2],
+		Version: matches[3],
+		Release: matches[4],
+		Arch:    matches[5],
+	}, nil
+}
+
+// SameNEVRA returns true if both describe the same package. RPM file names never include the epoch, so epochs are only
+// compared if both have one.
+func (p *PackageInfo) SameNEVRA(other *PackageInfo) bool {
+	if p.Epoch != "" && other.Epoch != "" && p.Epoch != other.Epoch {
+		return false
+	}
+	return p.Name == other.Name && p.Version == other.Version && p.Release == other.Release && p.Arch == other.Arch
+}
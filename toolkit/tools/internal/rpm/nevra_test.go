@@ -0,0 +1,35 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShouldParseNEVRA(t *testing.T) {
+	info, err := ParseNEVRA("perl-Text-Tabs+Wrap-1:2021.0726-1.cm2.noarch.rpm")
+	assert.NoError(t, err)
+	assert.Equal(t, &PackageInfo{Name: "perl-Text-Tabs+Wrap", Epoch: "1", Version: "2021.0726", Release: "1.cm2", Arch: "noarch"}, info)
+	assert.Equal(t, "perl-Text-Tabs+Wrap-1:2021.0726-1.cm2.noarch", info.NEVRA())
+
+	info, err = ParseNEVRA("zlib-1.2.13-1.cm2.x86_64")
+	assert.NoError(t, err)
+	assert.Equal(t, &PackageInfo{Name: "zlib", Version: "1.2.13", Release: "1.cm2", Arch: "x86_64"}, info)
+
+	_, err = ParseNEVRA("zlib.rpm")
+	assert.Error(t, err)
+}
+
+func TestShouldOnlyCompareEpochsIfBothAreSet(t *testing.T) {
+	withoutEpoch := &PackageInfo{Name: "zlib", Version: "1.2.13", Release: "1.cm2", Arch: "x86_64"}
+	withEpoch := &PackageInfo{Name: "zlib", Epoch: "1", Version: "1.2.13", Release: "1.cm2", Arch: "x86_64"}
+	otherEpoch := &PackageInfo{Name: "zlib", Epoch: "2", Version: "1.2.13", Release: "1.cm2", Arch: "x86_64"}
+
+	assert.True(t, withoutEpoch.SameNEVRA(withEpoch))
+	assert.True(t, withEpoch.SameNEVRA(withoutEpoch))
+	assert.False(t, withEpoch.SameNEVRA(otherEpoch))
+	assert.False(t, withoutEpoch.SameNEVRA(&PackageInfo{Name: "zlib", Version: "1.2.13", Release: "1.cm2", Arch: "aarch64"}))
+}
@@ -343,6 +343,40 @@ func QueryRPMProvides(rpmFile string) (provides []string, err error) {
 	return
 }
 
+// QueryRPMRequires returns what an RPM file requires, including requires added by a generator.
+func QueryRPMRequires(rpmFile string) (requires []string, err error) {
+	const queryRequiresOption = "-qRp"
+
+	logger.Log.Debugf("Querying RPM requires (%s)", rpmFile)
+	stdout, stderr, err := shell.Execute(rpmProgram, queryRequiresOption, rpmFile)
+	if err != nil {
+		logger.Log.Warn(stderr)
+		return
+	}
+
+	requires = sanitizeOutput(stdout)
+	return
+}
+
+// QueryHeader returns the value of a single header tag (e.g. "LICENSE") of an RPM file.
+func QueryHeader(rpmFile, tag string) (value string, err error) {
+	const queryPackageFileArg = "-p"
+
+	queryFormat := fmt.Sprintf("%%{%s}", tag)
+	results, err := QueryPackage(rpmFile, queryFormat, nil, queryPackageFileArg)
+	if err != nil {
+		return
+	}
+
+	if len(results) == 0 {
+		err = fmt.Errorf("no value returned for header tag (%s) of (%s)", tag, rpmFile)
+		return
+	}
+
+	value = results[0]
+	return
+}
+
 // ResolveCompetingPackages takes in a list of RPMs and returns only the ones, which would
 // end up being installed after resolving outdated, obsoleted, or conflicting packages.
 func ResolveCompetingPackages(rootDir string, rpmPaths ...string) (resolvedRPMs []string, err error) {
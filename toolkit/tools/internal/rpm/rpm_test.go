@@ -151,3 +151,10 @@ func TestShouldNotFindCheckSectionInSpecWithoutCheckSection(t *testing.T) {
 	assert.NoError(t, err)
 	assert.False(t, hasCheckSection)
 }
+
+func TestCompareVersionsShouldOrderVersionsAndReleases(t *testing.T) {
+	assert.Equal(t, -1, CompareVersions("1.2.3-1.cm2", "1.10.0-1.cm2"))
+	assert.Equal(t, 1, CompareVersions("1.2.3-10.cm2", "1.2.3-9.cm2"))
+	assert.Equal(t, 1, CompareVersions("1:1.0.0-1.cm2", "2.0.0-1.cm2"))
+	assert.Equal(t, 0, CompareVersions("1.2.3-1.cm2", "1.2.3-1.cm2"))
+}
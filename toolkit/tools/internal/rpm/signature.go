@@ -0,0 +1,398 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpm
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/shell"
+)
+
+// RPM file layout: a fixed size lead, the signature header padded to 8 bytes, the main header, and the payload.
+const (
+	rpmLeadSize           = 96
+	headerIntroSize       = 16
+	headerIndexEntrySize  = 16
+	signatureHeaderAlign  = 8
+	maxHeaderSectionBytes = 256 * 1024 * 1024
+
+	headerTypeInt32       = 4
+	headerTypeString      = 6
+	headerTypeBin         = 7
+	headerTypeStringArray = 8
+
+	signatureTagDSAHeader    = 267
+	signatureTagRSAHeader    = 268
+	signatureTagSHA256Header = 273
+	signatureTagPGP          = 1002
+	signatureTagGPG          = 1005
+
+	headerTagPayloadDigest     = 5092
+	headerTagPayloadDigestAlgo = 5093
+
+	// OpenPGP hash algorithm IDs.
+	pgpHashMD5    = 1
+	pgpHashSHA1   = 2
+	pgpHashSHA256 = 8
+	pgpHashSHA384 = 9
+	pgpHashSHA512 = 10
+	pgpHashSHA224 = 11
+
+	pgpPacketTagSignature = 2
+)
+
+var (
+	rpmLeadMagic     = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic   = []byte{0x8e, 0xad, 0xe8, 0x01}
+	payloadDigesters = map[uint32]func() hash.Hash{
+		pgpHashSHA256: sha256.New,
+		pgpHashSHA384: sha512.New384,
+		pgpHashSHA512: sha512.New,
+	}
+	pgpHashNames = map[byte]string{
+		pgpHashMD5:    "MD5",
+		pgpHashSHA1:   "SHA1",
+		pgpHashSHA224: "SHA224",
+		pgpHashSHA256: "SHA256",
+		pgpHashSHA384: "SHA384",
+		pgpHashSHA512: "SHA512",
+	}
+)
+
+// rpmHeader is a parsed RPM header. 'blob' holds the header exactly as stored in the file, which is what the
+// header digests and signatures are computed over.
+type rpmHeader struct {
+	blob    []byte
+	data    []byte
+	entries map[uint32]headerIndexEntry
+}
+
+type headerIndexEntry struct {
+	tag       uint32
+	entryType uint32
+	offset    uint32
+	count     uint32
+}
+
+// VerifySignature checks that an RPM file carries a header signature made by a key from 'keyringFile' (a binary
+// GPG keyring, e.g. created with 'gpg --export'), and that its header and payload match the signed digests.
+// Unsigned RPMs fail the verification.
+func VerifySignature(rpmFile, keyringFile string) (err error) {
+	logger.Log.Debugf("Verifying the signature of RPM (%s)", rpmFile)
+
+	rpmHandle, err := os.Open(rpmFile)
+	if err != nil {
+		return
+	}
+	defer rpmHandle.Close()
+	reader := bufio.NewReader(rpmHandle)
+
+	signatureHeader, mainHeader, err := readRPMHeaders(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read the headers of (%s):\n%w", rpmFile, err)
+	}
+
+	headerSHA256, found := signatureHeader.stringValue(signatureTagSHA256Header)
+	if found {
+		actualSHA256 := sha256.Sum256(mainHeader.blob)
+		if hex.EncodeToString(actualSHA256[:]) != headerSHA256 {
+			return fmt.Errorf("header SHA256 digest of (%s) does not match", rpmFile)
+		}
+	}
+
+	err = verifyPayloadDigest(reader, mainHeader)
+	if err != nil {
+		return fmt.Errorf("failed to verify the payload of (%s):\n%w", rpmFile, err)
+	}
+
+	signature, found := signatureHeader.binValue(signatureTagRSAHeader)
+	if !found {
+		signature, found = signatureHeader.binValue(signatureTagDSAHeader)
+	}
+	if !found {
+		return fmt.Errorf("(%s) has no header signature", rpmFile)
+	}
+
+	err = verifyDetachedSignature(signature, mainHeader.blob, keyringFile)
+	if err != nil {
+		return fmt.Errorf("failed to verify the header signature of (%s):\n%w", rpmFile, err)
+	}
+
+	return
+}
+
+// SignatureHashAlgorithm returns the hash algorithm (e.g. "SHA256") used by an RPM's header signature, falling back to
+// its legacy signature. Returns an empty string if the RPM is not signed. The signature itself is not verified.
+func SignatureHashAlgorithm(rpmFile string) (hashAlgorithm string, err error) {
+	rpmHandle, err := os.Open(rpmFile)
+	if err != nil {
+		return
+	}
+	defer rpmHandle.Close()
+
+	signatureHeader, _, err := readRPMHeaders(bufio.NewReader(rpmHandle))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the headers of (%s):\n%w", rpmFile, err)
+	}
+
+	for _, tag := range []uint32{signatureTagRSAHeader, signatureTagDSAHeader, signatureTagPGP, signatureTagGPG} {
+		signature, found := signatureHeader.binValue(tag)
+		if !found {
+			continue
+		}
+
+		hashAlgorithm, err = pgpSignatureHashAlgorithm(signature)
+		if err != nil {
+			err = fmt.Errorf("invalid signature in (%s):\n%w", rpmFile, err)
+		}
+		return
+	}
+
+	return
+}
+
+// pgpSignatureHashAlgorithm returns the name of the hash algorithm of an OpenPGP signature packet.
+func pgpSignatureHashAlgorithm(packet []byte) (hashAlgorithm string, err error) {
+	const (
+		packetFormatBit    = 0x80
+		newPacketFormatBit = 0x40
+
+		// Offsets of the hash algorithm in the packet body of version 3 and version 4+ signatures.
+		v3HashAlgorithmOffset = 16
+		v4HashAlgorithmOffset = 3
+	)
+
+	if len(packet) == 0 || packet[0]&packetFormatBit == 0 {
+		return "", fmt.Errorf("not an OpenPGP packet")
+	}
+
+	var (
+		tag        byte
+		headerSize int
+	)
+	if packet[0]&newPacketFormatBit != 0 {
+		tag = packet[0] & 0x3f
+		switch {
+		case len(packet) < 2:
+			return "", fmt.Errorf("truncated OpenPGP packet")
+		case packet[1] < 192:
+			headerSize = 2
+		case packet[1] < 224:
+			headerSize = 3
+		default:
+			headerSize = 6
+		}
+	} else {
+		tag = (packet[0] >> 2) & 0xf
+		headerSize = 1 + map[byte]int{0: 1, 1: 2, 2: 4, 3: 0}[packet[0]&0x3]
+	}
+
+	if tag != pgpPacketTagSignature {
+		return "", fmt.Errorf("OpenPGP packet (%d) is not a signature", tag)
+	}
+	if len(packet) <= headerSize {
+		return "", fmt.Errorf("truncated OpenPGP signature")
+	}
+
+	body := packet[headerSize:]
+	hashAlgorithmOffset := v4HashAlgorithmOffset
+	if body[0] < 4 {
+		hashAlgorithmOffset = v3HashAlgorithmOffset
+	}
+	if len(body) <= hashAlgorithmOffset {
+		return "", fmt.Errorf("truncated OpenPGP signature")
+	}
+
+	hashAlgorithm, found := pgpHashNames[body[hashAlgorithmOffset]]
+	if !found {
+		return "", fmt.Errorf("unknown OpenPGP hash algorithm (%d)", body[hashAlgorithmOffset])
+	}
+	return
+}
+
+// readRPMHeaders reads the lead, signature header, and main header, leaving 'reader' at the start of the payload.
+func readRPMHeaders(reader io.Reader) (signatureHeader, mainHeader *rpmHeader, err error) {
+	lead := make([]byte, rpmLeadSize)
+	_, err = io.ReadFull(reader, lead)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(lead[:len(rpmLeadMagic)], rpmLeadMagic) {
+		err = fmt.Errorf("not an RPM file")
+		return
+	}
+
+	signatureHeader, err = readRPMHeader(reader)
+	if err != nil {
+		err = fmt.Errorf("invalid signature header:\n%w", err)
+		return
+	}
+
+	padding := (signatureHeaderAlign - len(signatureHeader.blob)%signatureHeaderAlign) % signatureHeaderAlign
+	_, err = io.CopyN(io.Discard, reader, int64(padding))
+	if err != nil {
+		return
+	}
+
+	mainHeader, err = readRPMHeader(reader)
+	if err != nil {
+		err = fmt.Errorf("invalid main header:\n%w", err)
+	}
+	return
+}
+
+func readRPMHeader(reader io.Reader) (header *rpmHeader, err error) {
+	intro := make([]byte, headerIntroSize)
+	_, err = io.ReadFull(reader, intro)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(intro[:len(rpmHeaderMagic)], rpmHeaderMagic) {
+		err = fmt.Errorf("bad header magic")
+		return
+	}
+
+	indexCount := uint64(binary.BigEndian.Uint32(intro[8:12]))
+	dataSize := uint64(binary.BigEndian.Uint32(intro[12:16]))
+	indexSize := indexCount * headerIndexEntrySize
+	if indexSize+dataSize > maxHeaderSectionBytes {
+		err = fmt.Errorf("header too large (%d index entries, %d data bytes)", indexCount, dataSize)
+		return
+	}
+
+	rest := make([]byte, indexSize+dataSize)
+	_, err = io.ReadFull(reader, rest)
+	if err != nil {
+		return
+	}
+
+	header = &rpmHeader{
+		blob:    append(intro, rest...),
+		data:    rest[indexSize:],
+		entries: make(map[uint32]headerIndexEntry),
+	}
+	for i := uint64(0); i < indexCount; i++ {
+		rawEntry := rest[i*headerIndexEntrySize : (i+1)*headerIndexEntrySize]
+		entry := headerIndexEntry{
+			tag:       binary.BigEndian.Uint32(rawEntry[0:4]),
+			entryType: binary.BigEndian.Uint32(rawEntry[4:8]),
+			offset:    binary.BigEndian.Uint32(rawEntry[8:12]),
+			count:     binary.BigEndian.Uint32(rawEntry[12:16]),
+		}
+		if uint64(entry.offset) > dataSize {
+			err = fmt.Errorf("tag (%d) points outside of the header data", entry.tag)
+			return
+		}
+		header.entries[entry.tag] = entry
+	}
+
+	return
+}
+
+// binValue returns the value of a binary tag.
+func (h *rpmHeader) binValue(tag uint32) (value []byte, found bool) {
+	entry, found := h.entries[tag]
+	if !found || entry.entryType != headerTypeBin || uint64(entry.offset)+uint64(entry.count) > uint64(len(h.data)) {
+		return nil, false
+	}
+	return h.data[entry.offset : entry.offset+entry.count], true
+}
+
+// stringValue returns the value of a string tag, or the first element of a string array tag.
+func (h *rpmHeader) stringValue(tag uint32) (value string, found bool) {
+	entry, found := h.entries[tag]
+	if !found || (entry.entryType != headerTypeString && entry.entryType != headerTypeStringArray) {
+		return "", false
+	}
+
+	data := h.data[entry.offset:]
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", false
+	}
+	return string(data[:end]), true
+}
+
+// int32Value returns the first element of an int32 tag.
+func (h *rpmHeader) int32Value(tag uint32) (value uint32, found bool) {
+	entry, found := h.entries[tag]
+	if !found || entry.entryType != headerTypeInt32 || uint64(entry.offset)+4 > uint64(len(h.data)) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(h.data[entry.offset : entry.offset+4]), true
+}
+
+// verifyPayloadDigest compares the rest of 'reader' against the payload digest of the main header, if it has one.
+// Older RPMs without a payload digest only have their header covered by the signature.
+func verifyPayloadDigest(reader io.Reader, mainHeader *rpmHeader) (err error) {
+	expectedDigest, found := mainHeader.stringValue(headerTagPayloadDigest)
+	if !found {
+		logger.Log.Debugf("RPM has no payload digest, only verifying its header")
+		return
+	}
+
+	algorithm, found := mainHeader.int32Value(headerTagPayloadDigestAlgo)
+	if !found {
+		algorithm = pgpHashSHA256
+	}
+	newDigester, supported := payloadDigesters[algorithm]
+	if !supported {
+		return fmt.Errorf("unsupported payload digest algorithm (%d)", algorithm)
+	}
+
+	digester := newDigester()
+	_, err = io.Copy(digester, reader)
+	if err != nil {
+		return
+	}
+
+	if hex.EncodeToString(digester.Sum(nil)) != expectedDigest {
+		return fmt.Errorf("payload digest does not match")
+	}
+	return
+}
+
+// verifyDetachedSignature verifies an OpenPGP signature of 'data' using only the keys from 'keyringFile'.
+func verifyDetachedSignature(signature, data []byte, keyringFile string) (err error) {
+	// GPG resolves relative keyring paths against its home directory.
+	keyringFile, err = filepath.Abs(keyringFile)
+	if err != nil {
+		return
+	}
+
+	// Use a throwaway home directory, so neither the user's keys nor their trust settings are involved.
+	gpgHome, err := os.MkdirTemp("", "rpmverify")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(gpgHome)
+
+	signatureFile := filepath.Join(gpgHome, "header.sig")
+	dataFile := filepath.Join(gpgHome, "header")
+	err = os.WriteFile(signatureFile, signature, 0600)
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(dataFile, data, 0600)
+	if err != nil {
+		return
+	}
+
+	_, stderr, err := shell.Execute("gpg", "--batch", "--homedir", gpgHome, "--no-default-keyring", "--keyring", keyringFile, "--trust-model", "always", "--verify", signatureFile, dataFile)
+	if err != nil {
+		return fmt.Errorf("%s\n%w", stderr, err)
+	}
+	return
+}
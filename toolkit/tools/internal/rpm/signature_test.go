@@ -0,0 +1,95 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpm
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The fixtures are minimal RPMs with the same header layout as real ones. The header of "signed" and "tampered" is
+// signed with the key in "trusted-keyring.gpg", "tampered" has a modified payload.
+var signatureFixturesDir = filepath.Join(specsDir, "signatures")
+
+func signatureFixture(name string) string {
+	return filepath.Join(signatureFixturesDir, name)
+}
+
+func TestVerifySignatureShouldAcceptTrustedSignature(t *testing.T) {
+	err := VerifySignature(signatureFixture("signed-1.0-1.cm2.x86_64.rpm"), signatureFixture("trusted-keyring.gpg"))
+	assert.NoError(t, err)
+}
+
+func TestVerifySignatureShouldRejectUntrustedSignature(t *testing.T) {
+	err := VerifySignature(signatureFixture("signed-1.0-1.cm2.x86_64.rpm"), signatureFixture("untrusted-keyring.gpg"))
+	assert.Error(t, err)
+}
+
+func TestVerifySignatureShouldRejectUnsignedRPM(t *testing.T) {
+	err := VerifySignature(signatureFixture("unsigned-1.0-1.cm2.x86_64.rpm"), signatureFixture("trusted-keyring.gpg"))
+	assert.ErrorContains(t, err, "no header signature")
+}
+
+func TestVerifySignatureShouldRejectTamperedPayload(t *testing.T) {
+	err := VerifySignature(signatureFixture("tampered-1.0-1.cm2.x86_64.rpm"), signatureFixture("trusted-keyring.gpg"))
+	assert.ErrorContains(t, err, "payload digest does not match")
+}
+
+func TestVerifySignatureShouldRejectNonRPMFile(t *testing.T) {
+	err := VerifySignature(signatureFixture("trusted-keyring.gpg"), signatureFixture("trusted-keyring.gpg"))
+	assert.Error(t, err)
+}
+
+func TestSignatureHashAlgorithmShouldReturnHashOfHeaderSignature(t *testing.T) {
+	hashAlgorithm, err := SignatureHashAlgorithm(signatureFixture("signed-1.0-1.cm2.x86_64.rpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, "SHA512", hashAlgorithm)
+}
+
+func TestSignatureHashAlgorithmShouldReturnEmptyForUnsignedRPM(t *testing.T) {
+	hashAlgorithm, err := SignatureHashAlgorithm(signatureFixture("unsigned-1.0-1.cm2.x86_64.rpm"))
+	assert.NoError(t, err)
+	assert.Empty(t, hashAlgorithm)
+}
+
+func TestSignatureHashAlgorithmShouldRejectNonRPMFile(t *testing.T) {
+	_, err := SignatureHashAlgorithm(signatureFixture("trusted-keyring.gpg"))
+	assert.Error(t, err)
+}
+
+func TestShouldReadHashAlgorithmOfSignaturePackets(t *testing.T) {
+	// Version 4 signature in a new format packet: version, type, public key algorithm (RSA), hash algorithm.
+	hashAlgorithm, err := pgpSignatureHashAlgorithm([]byte{0xc2, 0x04, 0x04, 0x00, 0x01, pgpHashSHA256})
+	assert.NoError(t, err)
+	assert.Equal(t, "SHA256", hashAlgorithm)
+
+	// Version 3 signature in an old format packet with a one byte length: version, hashed length (5), type,
+	// creation time, key ID, public key algorithm (DSA), hash algorithm.
+	v3Body := []byte{0x03, 0x05, 0x00, 0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 0x11, pgpHashSHA1}
+	hashAlgorithm, err = pgpSignatureHashAlgorithm(append([]byte{0x88, byte(len(v3Body))}, v3Body...))
+	assert.NoError(t, err)
+	assert.Equal(t, "SHA1", hashAlgorithm)
+
+	// Version 4 signature in an old format packet with a two byte length.
+	hashAlgorithm, err = pgpSignatureHashAlgorithm([]byte{0x89, 0x00, 0x04, 0x04, 0x00, 0x01, pgpHashMD5})
+	assert.NoError(t, err)
+	assert.Equal(t, "MD5", hashAlgorithm)
+}
+
+func TestShouldRejectInvalidSignaturePackets(t *testing.T) {
+	_, err := pgpSignatureHashAlgorithm(nil)
+	assert.Error(t, err)
+
+	// Public key packet (tag 6) instead of a signature.
+	_, err = pgpSignatureHashAlgorithm([]byte{0xc6, 0x04, 0x04, 0x00, 0x01, pgpHashSHA256})
+	assert.ErrorContains(t, err, "not a signature")
+
+	_, err = pgpSignatureHashAlgorithm([]byte{0xc2, 0x04, 0x04, 0x00})
+	assert.ErrorContains(t, err, "truncated")
+
+	_, err = pgpSignatureHashAlgorithm([]byte{0xc2, 0x04, 0x04, 0x00, 0x01, 0x63})
+	assert.ErrorContains(t, err, "unknown OpenPGP hash algorithm")
+}
@@ -0,0 +1,174 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package rpm
+
+import (
+	"strings"
+)
+
+const (
+	epochSeparator   = ":"
+	releaseSeparator = "-"
+
+	// tildeSeparator marks a pre-release, sorting before everything else, even the end of the version.
+	tildeSeparator = '~'
+	// caretSeparator marks a post-release snapshot, sorting after the end of the version but before any other segment.
+	caretSeparator = '^'
+)
+
+// CompareVersions compares two "[<epoch>:]<version>[-<release>]" strings the way RPM orders package versions.
+// Returns -1 if 'versionA' is lower than 'versionB', 1 if it is higher and 0 if they are equal.
+//
+// A missing epoch is treated as epoch 0. Releases are only compared if both strings have one, so "1.0" equals "1.0-5".
+func CompareVersions(versionA, versionB string) int {
+	epochA, versionA, releaseA := splitEVR(versionA)
+	epochB, versionB, releaseB := splitEVR(versionB)
+
+	result := compareVersionSegments(epochA, epochB)
+	if result == 0 {
+		result = compareVersionSegments(versionA, versionB)
+	}
+	if result == 0 && releaseA != "" && releaseB != "" {
+		result = compareVersionSegments(releaseA, releaseB)
+	}
+
+	return result
+}
+
+// splitEVR splits a "[<epoch>:]<version>[-<release>]" string. The epoch defaults to "0".
+func splitEVR(evr string) (epoch, version, release string) {
+	epoch = "0"
+	version = evr
+
+	if prefix, rest, found := strings.Cut(version, epochSeparator); found && isAllDigits(prefix) {
+		if prefix != "" {
+			epoch = prefix
+		}
+		version = rest
+	}
+
+	if separatorIndex := strings.LastIndex(version, releaseSeparator); separatorIndex >= 0 {
+		release = version[separatorIndex+1:]
+		version = version[:separatorIndex]
+	}
+
+	return
+}
+
+// compareVersionSegments implements RPM's 'rpmvercmp()': both strings are split into runs of digits and runs of
+// letters, ignoring all other characters. Numeric runs are compared as numbers and are newer than alphabetic runs,
+// alphabetic runs are compared lexically. '~' sorts before and '^' after the end of the string.
+func compareVersionSegments(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	for len(a) > 0 || len(b) > 0 {
+		a = strings.TrimLeftFunc(a, isVersionSeparator)
+		b = strings.TrimLeftFunc(b, isVersionSeparator)
+
+		if startsWith(a, tildeSeparator) || startsWith(b, tildeSeparator) {
+			if !startsWith(a, tildeSeparator) {
+				return 1
+			}
+			if !startsWith(b, tildeSeparator) {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if startsWith(a, caretSeparator) || startsWith(b, caretSeparator) {
+			switch {
+			case len(a) == 0:
+				return -1
+			case len(b) == 0:
+				return 1
+			case !startsWith(a, caretSeparator):
+				return 1
+			case !startsWith(b, caretSeparator):
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		isNumeric := isDigit(rune(a[0]))
+		segmentFunc := isLetter
+		if isNumeric {
+			segmentFunc = isDigit
+		}
+
+		segmentA, restA := cutSegment(a, segmentFunc)
+		segmentB, restB := cutSegment(b, segmentFunc)
+
+		// Segments of different types, numeric ones are newer.
+		if segmentB == "" {
+			if isNumeric {
+				return 1
+			}
+			return -1
+		}
+
+		if isNumeric {
+			segmentA = strings.TrimLeft(segmentA, "0")
+			segmentB = strings.TrimLeft(segmentB, "0")
+			if len(segmentA) != len(segmentB) {
+				if len(segmentA) > len(segmentB) {
+					return 1
+				}
+				return -1
+			}
+		}
+
+		if result := strings.Compare(segmentA, segmentB); result != 0 {
+			return result
+		}
+
+		a, b = restA, restB
+	}
+
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// cutSegment splits the leading run of characters matching 'segmentFunc' from 's'.
+func cutSegment(s string, segmentFunc func(rune) bool) (segment, rest string) {
+	end := strings.IndexFunc(s, func(r rune) bool { return !segmentFunc(r) })
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], s[end:]
+}
+
+func startsWith(s string, separator byte) bool {
+	return len(s) > 0 && s[0] == separator
+}
+
+func isVersionSeparator(r rune) bool {
+	return !isDigit(r) && !isLetter(r) && r != tildeSeparator && r != caretSeparator
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// isLetter only accepts ASCII letters, like RPM does.
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isAllDigits(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return !isDigit(r) }) < 0
+}
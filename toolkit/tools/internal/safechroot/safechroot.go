@@ -74,6 +74,9 @@ var (
 	activeChroots      []*Chroot
 )
 
+// cleanupSignals receives the signals which clean up all Chroots, see registerSIGTERMCleanup.
+var cleanupSignals chan os.Signal
+
 var defaultChrootEnv = []string{
 	"USER=root",
 	"HOME=/root",
@@ -424,9 +427,20 @@ func (c *Chroot) Close(leaveOnDisk bool) (err error) {
 // registerSIGTERMCleanup will register SIGTERM handling to force all Chroots
 // to Close before exiting the application.
 func registerSIGTERMCleanup() {
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, unix.SIGINT, unix.SIGTERM)
-	go cleanupAllChrootsOnSignal(signals)
+	cleanupSignals = make(chan os.Signal, 1)
+	EnableSignalCleanup()
+	go cleanupAllChrootsOnSignal(cleanupSignals)
+}
+
+// DisableSignalCleanup stops SIGINT and SIGTERM from cleaning up all Chroots and exiting the application,
+// so the application can shut down gracefully instead. Chroots are still cleaned up on a logger.Log.Fatal.
+func DisableSignalCleanup() {
+	signal.Stop(cleanupSignals)
+}
+
+// EnableSignalCleanup restores the cleanup of all Chroots on SIGINT and SIGTERM after DisableSignalCleanup.
+func EnableSignalCleanup() {
+	signal.Notify(cleanupSignals, unix.SIGINT, unix.SIGTERM)
 }
 
 // cleanupAllChrootsOnSignal will cleanup all chroots on an os signal.
@@ -31,6 +31,17 @@ var (
 	PackageLookupNameMatchRegex = regexp.MustCompile(`([^:\s]+(x86_64|aarch64|noarch))\s*:[^\n]*\nRepo\s+:\s+[^@]`)
 	PackageNameIndex            = 1
 
+	// Same as PackageLookupNameMatchRegex, but also captures the ID of the repo providing the package.
+	// For:
+	//		X-1.0-1.cm2.x86_64 : The X package
+	//		Repo	: mariner-official-base
+	//
+	// We'd get:
+	//   - package:    X-1.0-1.cm2.x86_64
+	//   - repo_id:    mariner-official-base
+	PackageLookupRepoMatchRegex = regexp.MustCompile(`([^:\s]+(x86_64|aarch64|noarch))\s*:[^\n]*\nRepo\s+:\s+([^@\s]\S*)`)
+	PackageLookupRepoIDIndex    = 3
+
 	// Every line containing a repo ID will be of the form:
 	//		[<repo_name>]
 	// For:
@@ -44,6 +55,18 @@ var (
 	RepoIDRegex = regexp.MustCompile(`(?:\[)([^]]+)(?:\])`)
 	RepoIDIndex = 1
 
+	// Every line containing a repo's remote location will be of the form:
+	//		<key>=<url>
+	// For:
+	//
+	//		baseurl=https://packages.microsoft.com/cbl-mariner/2.0/prod/base/$basearch
+	//
+	// We'd get:
+	//   - key:    baseurl
+	//   - url:    https://packages.microsoft.com/cbl-mariner/2.0/prod/base/$basearch
+	RepoURLRegex = regexp.MustCompile(`^\s*(baseurl|metalink|mirrorlist)\s*=\s*(\S+)`)
+	RepoURLIndex = 2
+
 	// Every valid line will be of the form: <package_name>.<architecture> <version>.<dist> <repo_id>
 	// For:
 	//
@@ -54,7 +77,8 @@ var (
 	//   - architecture:    aarch64
 	//   - version:         1.1b.8_X-22~rc1
 	//   - dist:            cm1
-	ListedPackageRegex = regexp.MustCompile(`^\s*([[:alnum:]_.+-]+)\.([[:alnum:]_+-]+)\s+([[:alnum:]._+~-]+)\.([[:alpha:]]+[[:digit:]]+)`)
+	//   - repo_id:         fetcher-cloned-repo (optional, empty if missing)
+	ListedPackageRegex = regexp.MustCompile(`^\s*([[:alnum:]_.+-]+)\.([[:alnum:]_+-]+)\s+([[:alnum:]._+~-]+)\.([[:alpha:]]+[[:digit:]]+)(?:\s+(\S+))?`)
 )
 
 const (
@@ -72,6 +96,7 @@ const (
 	ListPackageArch    = iota
 	ListPackageVersion = iota
 	ListPackageDist    = iota
+	ListPackageRepo    = iota
 	ListMaxMatchLen    = iota
 )
 
@@ -72,3 +72,23 @@ func TestGetMajorVersionFromString_RejectTrailingDot(t *testing.T) {
 	_, err := getMajorVersionFromString(fullVersion)
 	assert.Error(t, err)
 }
+
+func TestPackageLookupRepoMatchRegex_CapturesRepoID(t *testing.T) {
+	output := "X-1.0-1.cm2.x86_64 : The X package\nRepo\t : mariner-official-base\n" +
+		"X-1.0-1.cm2.x86_64 : The X package\nRepo\t : upstream-mirror\n" +
+		"X-0.9-1.cm2.x86_64 : The X package\nRepo\t : @System\n"
+
+	matches := PackageLookupRepoMatchRegex.FindAllStringSubmatch(output, -1)
+	assert.Len(t, matches, 2)
+	assert.Equal(t, "X-1.0-1.cm2.x86_64", matches[0][PackageNameIndex])
+	assert.Equal(t, "mariner-official-base", matches[0][PackageLookupRepoIDIndex])
+	assert.Equal(t, "upstream-mirror", matches[1][PackageLookupRepoIDIndex])
+}
+
+func TestRepoURLRegex_CapturesURL(t *testing.T) {
+	matches := RepoURLRegex.FindStringSubmatch("baseurl = https://mirror.example.com/base/$basearch")
+	assert.Len(t, matches, 3)
+	assert.Equal(t, "https://mirror.example.com/base/$basearch", matches[RepoURLIndex])
+
+	assert.Nil(t, RepoURLRegex.FindStringSubmatch("gpgkey=file:///etc/pki/rpm-gpg/MICROSOFT-RPM-GPG-KEY"))
+}
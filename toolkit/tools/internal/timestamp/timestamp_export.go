@@ -0,0 +1,130 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Export of completed timing data for external tools
+
+package timestamp
+
+import (
+	"encoding/csv"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+)
+
+// Column order of the exported CSV files.
+var exportCSVHeader = []string{"Name", "Parent", "Start", "End", "DurationSeconds"}
+
+var (
+	// Timestamps of the last timing data completed with CompleteTiming, used by the exports
+	completedTimeStamps map[int64]*TimeStamp
+)
+
+// A single step of the timing data, flattened for the exports
+type exportedEvent struct {
+	Name            string     `json:"Name"`            // Full name of the step, i.e A/B/C
+	Parent          string     `json:"Parent"`          // Full name of the parent step, empty for the root
+	Start           *time.Time `json:"Start"`           // Start time of the step
+	End             *time.Time `json:"End"`             // End time of the step, nil if the step never stopped
+	DurationSeconds float64    `json:"DurationSeconds"` // Elapsed time in seconds, -1 if the step never stopped
+}
+
+// Writes the steps of the timing data completed last with CompleteTiming to a JSON file, as a flat list ordered by start time
+func ExportJSON(path string) (err error) {
+	events, err := completedEvents()
+	if err != nil {
+		return
+	}
+
+	logger.Log.Debugf("Exporting %d timestamp(s) to %s", len(events), path)
+	return jsonutils.WriteJSONFile(path, events)
+}
+
+// Writes the steps of the timing data completed last with CompleteTiming to a CSV file, one row per step ordered by start time.
+// The columns are always: Name, Parent, Start, End, DurationSeconds.
+func ExportCSV(path string) (err error) {
+	events, err := completedEvents()
+	if err != nil {
+		return
+	}
+
+	logger.Log.Debugf("Exporting %d timestamp(s) to %s", len(events), path)
+	csvFile, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer csvFile.Close()
+
+	writer := csv.NewWriter(csvFile)
+	err = writer.Write(exportCSVHeader)
+	if err != nil {
+		return
+	}
+
+	for _, event := range events {
+		err = writer.Write([]string{
+			event.Name,
+			event.Parent,
+			formatExportTime(event.Start),
+			formatExportTime(event.End),
+			strconv.FormatFloat(event.DurationSeconds, 'f', -1, 64),
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// Returns the flattened steps of the last completed timing data
+func completedEvents() (events []exportedEvent, err error) {
+	if completedTimeStamps == nil {
+		return nil, errors.New("no completed timing data to export. Make sure CompleteTiming is called first")
+	}
+	return flattenTimeStamps(completedTimeStamps), nil
+}
+
+// Flattens the timestamp tree into a list of steps, ordered by start time and then by ID
+func flattenTimeStamps(nodes map[int64]*TimeStamp) (events []exportedEvent) {
+	timeStamps := make([]*TimeStamp, 0, len(nodes))
+	for _, ts := range nodes {
+		timeStamps = append(timeStamps, ts)
+	}
+	sort.Slice(timeStamps, func(i, j int) bool {
+		left, right := timeStamps[i], timeStamps[j]
+		if left.StartTime != nil && right.StartTime != nil && !left.StartTime.Equal(*right.StartTime) {
+			return left.StartTime.Before(*right.StartTime)
+		}
+		return left.ID < right.ID
+	})
+
+	events = make([]exportedEvent, 0, len(timeStamps))
+	for _, ts := range timeStamps {
+		event := exportedEvent{
+			Name:            ts.DisplayName(),
+			Parent:          ts.parentTimestamp.DisplayName(),
+			Start:           ts.StartTime,
+			End:             ts.EndTime,
+			DurationSeconds: -1,
+		}
+		if ts.EndTime != nil && ts.StartTime != nil {
+			event.DurationSeconds = ts.ElapsedTime().Seconds()
+		}
+		events = append(events, event)
+	}
+	return
+}
+
+func formatExportTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
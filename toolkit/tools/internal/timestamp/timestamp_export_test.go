@@ -0,0 +1,111 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package timestamp
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/jsonutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenTimeStamps(t *testing.T) {
+	assert := assert.New(t)
+
+	// construct the following timestamp tree, with A still running
+	// root (1h)
+	//   -> A
+	//     -> B (10m)
+	rootTS, _ := newTimeStamp("root", nil)
+	tsA, _ := newTimeStamp("A", nil)
+	tsB, _ := newTimeStamp("B", nil)
+	rootTS.ID, tsA.ID, tsB.ID = 0, 1, 2
+	rootTS.addSubStep(tsA)
+	tsA.addSubStep(tsB)
+
+	startA := defaultStartTime.Add(time.Minute)
+	startB := defaultStartTime.Add(2 * time.Minute)
+	rootTS.StartTime, tsA.StartTime, tsB.StartTime = &defaultStartTime, &startA, &startB
+	rootTS.complete(defaultEndTime)
+	tsB.complete(startB.Add(10 * time.Minute))
+
+	events := flattenTimeStamps(map[int64]*TimeStamp{0: rootTS, 1: tsA, 2: tsB})
+	assert.Len(events, 3)
+
+	assert.Equal("root", events[0].Name)
+	assert.Equal("", events[0].Parent)
+	assert.Equal(float64(3600), events[0].DurationSeconds)
+
+	assert.Equal("root/A", events[1].Name)
+	assert.Equal("root", events[1].Parent)
+	assert.Nil(events[1].End)
+	assert.Equal(float64(-1), events[1].DurationSeconds)
+
+	assert.Equal("root/A/B", events[2].Name)
+	assert.Equal("root/A", events[2].Parent)
+	assert.Equal(float64(600), events[2].DurationSeconds)
+}
+
+func TestExportWithoutCompletedTiming(t *testing.T) {
+	completedTimeStamps = nil
+
+	assert.Error(t, ExportJSON(filepath.Join(t.TempDir(), "timing.json")))
+	assert.Error(t, ExportCSV(filepath.Join(t.TempDir(), "timing.csv")))
+}
+
+func TestExportCompletedTiming(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir := t.TempDir()
+	root, err := BeginTiming("test", filepath.Join(testDir, "timing.jsonl"))
+	assert.NoError(err)
+
+	tsA, err := StartEvent("A", root)
+	assert.NoError(err)
+	tsB, err := StartEvent("B", tsA)
+	assert.NoError(err)
+	time.Sleep(10 * time.Millisecond)
+	StopEvent(tsB)
+	StopEvent(tsA)
+	assert.NoError(CompleteTiming())
+
+	jsonFile := filepath.Join(testDir, "timing.json")
+	assert.NoError(ExportJSON(jsonFile))
+
+	var events []exportedEvent
+	assert.NoError(jsonutils.ReadJSONFile(jsonFile, &events))
+	assert.Len(events, 3)
+
+	parents := make(map[string]string)
+	for _, event := range events {
+		parents[event.Name] = event.Parent
+		if assert.NotNil(event.End) {
+			assert.InDelta(event.End.Sub(*event.Start).Seconds(), event.DurationSeconds, 1e-6)
+		}
+	}
+	assert.Equal(map[string]string{"test": "", "test/A": "test", "test/A/B": "test/A"}, parents)
+	assert.GreaterOrEqual(events[2].DurationSeconds, 0.01)
+
+	csvFile := filepath.Join(testDir, "timing.csv")
+	assert.NoError(ExportCSV(csvFile))
+
+	f, err := os.Open(csvFile)
+	assert.NoError(err)
+	defer f.Close()
+
+	rows, err := csv.NewReader(f).ReadAll()
+	assert.NoError(err)
+	assert.Len(rows, 4)
+	assert.Equal([]string{"Name", "Parent", "Start", "End", "DurationSeconds"}, rows[0])
+	assert.Equal([]string{"test/A/B", "test/A"}, rows[3][:2])
+
+	duration, err := strconv.ParseFloat(rows[3][4], 64)
+	assert.NoError(err)
+	assert.Equal(events[2].DurationSeconds, duration)
+}
@@ -194,7 +194,8 @@ func ResumeTiming(toolName, outputFile string) error {
 	return nil
 }
 
-// Marks the end of collecting timing data. Perform any cleanup needed by the timestamp manager object
+// Marks the end of collecting timing data. Perform any cleanup needed by the timestamp manager object.
+// The completed timing data stays available to ExportJSON and ExportCSV.
 func CompleteTiming() (err error) {
 	if err = ensureManagerExists(); err != nil {
 		return
@@ -203,6 +204,7 @@ func CompleteTiming() (err error) {
 	StopEvent(timestampMgr.root)
 	FlushAndCleanUpResources()
 	logger.Log.Debugf("Completed recording timestamp, results written to %s", timestampMgr.filePath)
+	completedTimeStamps = timestampMgr.nodes
 	timestampMgr = nil
 	return
 }
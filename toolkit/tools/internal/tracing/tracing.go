@@ -0,0 +1,301 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+// Minimal OpenTelemetry span exporter using the OTLP/HTTP JSON protocol.
+//
+// All methods are safe to call on a nil *Tracer or *Span, in which case they do nothing. This allows tools to
+// unconditionally instrument their code and only pay for tracing when an endpoint is configured:
+//
+//	tracer, _ := tracing.NewTracer("tool", endpoint)  // tracer is nil if endpoint is empty
+//	rootSpan := tracer.StartSpan("step-A", nil)
+//	  childSpan := tracer.StartSpan("sub-step-of-step-A", rootSpan)
+//	  childSpan.SetAttribute("key", "value")
+//	  childSpan.End()
+//	rootSpan.End()
+//	tracer.Flush()                                    // sends all ended spans to the collector
+
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/randomization"
+)
+
+const (
+	tracesPath        = "/v1/traces"
+	traceIDLength     = 32
+	spanIDLength      = 16
+	spanKindInternal  = 1
+	exportTimeout     = 30 * time.Second
+	serviceNameAttrib = "service.name"
+)
+
+// Tracer records spans in memory and exports them to an OpenTelemetry collector.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+	traceID     string
+	client      *http.Client
+
+	spansLock sync.Mutex
+	spans     []*Span
+}
+
+// Span represents a single timed operation within a trace.
+type Span struct {
+	tracer       *Tracer
+	name         string
+	spanID       string
+	parentSpanID string
+	startTime    time.Time
+	endTime      time.Time
+
+	attributesLock sync.Mutex
+	attributes     map[string]interface{}
+}
+
+// NewTracer creates a tracer exporting spans for 'serviceName' to the OTLP/HTTP collector at 'endpoint'.
+// If 'endpoint' is empty, a nil tracer is returned which turns all tracing calls into no-ops.
+// If 'endpoint' has no path, the default OTLP traces path is used.
+func NewTracer(serviceName, endpoint string) (t *Tracer, err error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return
+	}
+
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		err = fmt.Errorf("invalid OpenTelemetry endpoint '%s':\n%w", endpoint, err)
+		return
+	}
+
+	if endpointURL.Scheme != "http" && endpointURL.Scheme != "https" {
+		err = fmt.Errorf("invalid OpenTelemetry endpoint '%s', expected an 'http' or 'https' URL", endpoint)
+		return
+	}
+
+	if endpointURL.Path == "" || endpointURL.Path == "/" {
+		endpointURL.Path = tracesPath
+	}
+
+	traceID, err := randomization.RandomString(traceIDLength, randomization.LegalCharactersHex)
+	if err != nil {
+		return
+	}
+
+	t = &Tracer{
+		endpoint:    endpointURL.String(),
+		serviceName: serviceName,
+		traceID:     traceID,
+		client:      &http.Client{Timeout: exportTimeout},
+	}
+
+	logger.Log.Debugf("Exporting OpenTelemetry spans for trace (%s) to (%s)", traceID, t.endpoint)
+	return
+}
+
+// StartSpan starts a new span. If 'parent' is nil, the span will be a root span of the trace.
+func (t *Tracer) StartSpan(name string, parent *Span) (span *Span) {
+	if t == nil {
+		return
+	}
+
+	spanID, err := randomization.RandomString(spanIDLength, randomization.LegalCharactersHex)
+	if err != nil {
+		logger.Log.Warnf("Failed to generate an ID for span (%s): %s", name, err)
+		return
+	}
+
+	span = &Span{
+		tracer:     t,
+		name:       name,
+		spanID:     spanID,
+		startTime:  time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+
+	if parent != nil {
+		span.parentSpanID = parent.spanID
+	}
+
+	return
+}
+
+// SetAttribute records a key-value pair on the span. Supported value types are strings, booleans, and integers,
+// any other type is recorded using its default string representation.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.attributesLock.Lock()
+	defer s.attributesLock.Unlock()
+
+	s.attributes[key] = value
+}
+
+// End marks the span as finished and queues it for export.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.endTime = time.Now()
+
+	s.tracer.spansLock.Lock()
+	defer s.tracer.spansLock.Unlock()
+
+	s.tracer.spans = append(s.tracer.spans, s)
+}
+
+// Flush sends all ended spans to the collector.
+func (t *Tracer) Flush() (err error) {
+	if t == nil {
+		return
+	}
+
+	t.spansLock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.spansLock.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(t.buildExportRequest(spans))
+	if err != nil {
+		return
+	}
+
+	logger.Log.Debugf("Exporting %d OpenTelemetry span(s) to (%s)", len(spans), t.endpoint)
+	response, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < http.StatusOK || response.StatusCode >= http.StatusMultipleChoices {
+		err = fmt.Errorf("collector at (%s) rejected spans with status: %s", t.endpoint, response.Status)
+	}
+
+	return
+}
+
+// The types below mirror the subset of the OTLP JSON encoding needed to export spans.
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanData `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type spanData struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func (t *Tracer) buildExportRequest(spans []*Span) exportRequest {
+	exportedSpans := make([]spanData, 0, len(spans))
+	for _, s := range spans {
+		exportedSpans = append(exportedSpans, s.toSpanData(t.traceID))
+	}
+
+	return exportRequest{
+		ResourceSpans: []resourceSpans{
+			{
+				Resource: resource{
+					Attributes: []keyValue{newKeyValue(serviceNameAttrib, t.serviceName)},
+				},
+				ScopeSpans: []scopeSpans{
+					{
+						Scope: scope{Name: t.serviceName},
+						Spans: exportedSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (s *Span) toSpanData(traceID string) spanData {
+	s.attributesLock.Lock()
+	defer s.attributesLock.Unlock()
+
+	attributes := make([]keyValue, 0, len(s.attributes))
+	for key, value := range s.attributes {
+		attributes = append(attributes, newKeyValue(key, value))
+	}
+
+	return spanData{
+		TraceID:           traceID,
+		SpanID:            s.spanID,
+		ParentSpanID:      s.parentSpanID,
+		Name:              s.name,
+		Kind:              spanKindInternal,
+		StartTimeUnixNano: fmt.Sprintf("%d", s.startTime.UnixNano()),
+		EndTimeUnixNano:   fmt.Sprintf("%d", s.endTime.UnixNano()),
+		Attributes:        attributes,
+	}
+}
+
+// newKeyValue converts a Go value into an OTLP attribute. OTLP encodes 64-bit integers as strings in JSON.
+func newKeyValue(key string, value interface{}) (kv keyValue) {
+	kv.Key = key
+
+	switch typedValue := value.(type) {
+	case string:
+		kv.Value.StringValue = &typedValue
+	case bool:
+		kv.Value.BoolValue = &typedValue
+	case int, int32, int64, uint, uint32, uint64:
+		intString := fmt.Sprintf("%d", typedValue)
+		kv.Value.IntValue = &intString
+	default:
+		stringValue := fmt.Sprintf("%v", typedValue)
+		kv.Value.StringValue = &stringValue
+	}
+
+	return
+}
@@ -0,0 +1,94 @@
+// Copyright (c) Microsoft Corporation.
+// Licensed under the MIT License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitStderrLog()
+	os.Exit(m.Run())
+}
+
+func TestShouldReturnNilTracerForEmptyEndpoint(t *testing.T) {
+	tracer, err := NewTracer("test", "")
+	assert.NoError(t, err)
+	assert.Nil(t, tracer)
+
+	// All calls on a nil tracer must be safe no-ops.
+	span := tracer.StartSpan("root", nil)
+	span.SetAttribute("key", "value")
+	span.End()
+	assert.NoError(t, tracer.Flush())
+}
+
+func TestShouldFailForNonHTTPEndpoint(t *testing.T) {
+	_, err := NewTracer("test", "ftp://collector:4318")
+	assert.Error(t, err)
+}
+
+func TestShouldAddDefaultTracesPath(t *testing.T) {
+	tracer, err := NewTracer("test", "http://collector:4318")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://collector:4318/v1/traces", tracer.endpoint)
+}
+
+func TestShouldExportChildSpans(t *testing.T) {
+	var received exportRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer server.Close()
+
+	tracer, err := NewTracer("test", server.URL)
+	assert.NoError(t, err)
+
+	rootSpan := tracer.StartSpan("fetch", nil)
+	childSpan := tracer.StartSpan("resolveSingleNode", rootSpan)
+	childSpan.SetAttribute("node", "pkgA")
+	childSpan.SetAttribute("bytes", int64(1024))
+	childSpan.End()
+	rootSpan.End()
+
+	assert.NoError(t, tracer.Flush())
+	assert.Len(t, received.ResourceSpans, 1)
+	assert.Len(t, received.ResourceSpans[0].ScopeSpans, 1)
+
+	spans := received.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "resolveSingleNode", spans[0].Name)
+	assert.Equal(t, spans[1].SpanID, spans[0].ParentSpanID)
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Len(t, spans[0].TraceID, traceIDLength)
+	assert.Empty(t, spans[1].ParentSpanID)
+
+	attributes := make(map[string]anyValue)
+	for _, attribute := range spans[0].Attributes {
+		attributes[attribute.Key] = attribute.Value
+	}
+	assert.Equal(t, "pkgA", *attributes["node"].StringValue)
+	assert.Equal(t, "1024", *attributes["bytes"].IntValue)
+}
+
+func TestShouldFailFlushOnCollectorError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	tracer, err := NewTracer("test", server.URL)
+	assert.NoError(t, err)
+
+	tracer.StartSpan("fetch", nil).End()
+	assert.Error(t, tracer.Flush())
+}
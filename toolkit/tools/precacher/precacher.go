@@ -19,6 +19,7 @@ import (
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/logger"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/network"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repocloner"
+	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/packagerepo/repoutils"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/randomization"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/retry"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/safechroot"
@@ -32,6 +33,7 @@ import (
 
 const (
 	defaultNetOpsCount = "20"
+	partialDownloadDir = "partial_downloads"
 )
 
 type downloadResultType int
@@ -65,6 +67,7 @@ var (
 	buildDir          = app.Flag("worker-dir", "Directory to store chroot while running repo query.").Required().ExistingDir()
 
 	concurrentNetOps = app.Flag("concurrent-net-ops", "Number of concurrent network operations to perform.").Default(defaultNetOpsCount).Uint()
+	maxBandwidth     = app.Flag("max-bandwidth", "Limit the combined throughput of all concurrent downloads to this many bytes per second (e.g. '10MB'). Unlimited by default.").Bytes()
 )
 
 func main() {
@@ -81,6 +84,8 @@ func main() {
 	timestamp.BeginTiming("precacher", *timestampFile)
 	defer timestamp.CompleteTiming()
 
+	network.SetMaxDownloadBandwidth(int64(*maxBandwidth))
+
 	rpmSnapshot, err := rpmSnapshotFromFile(*snapshot)
 	if err != nil {
 		logger.PanicOnError(err)
@@ -98,11 +103,17 @@ func main() {
 		}
 	}
 
-	downloadedPackages, err := downloadMissingPackages(rpmSnapshot, packagesAvailableFromRepos, *outDir, *concurrentNetOps)
+	// Keep the partial downloads next to the packages, outside of the query chroot removed by getAllRepoData(), so
+	// they survive for the next run and are moved into place on the same filesystem.
+	partDir := path.Join(*outDir, partialDownloadDir)
+	downloadedPackages, err := downloadMissingPackages(rpmSnapshot, packagesAvailableFromRepos, *outDir, partDir, *concurrentNetOps)
 	if err != nil {
 		logger.PanicOnError(err)
 	}
 
+	// Only succeeds once all downloads completed, failed ones keep their partial files for the next run.
+	os.Remove(partDir)
+
 	logger.Log.Infof("Downloaded %d packages into the cache", len(downloadedPackages))
 	err = writeSummaryFile(*outputSummaryFile, downloadedPackages)
 	if err != nil {
@@ -261,8 +272,8 @@ func getPackageRepoPaths(repoUrl string) (packages []string, err error) {
 // downloadMissingPackages will attemp to download each package listed in rpmSnapshot that is not already present in the
 // outDir. It will return a list of the packages that were downloaded. It will use concurrentNetOps to limit the number of
 // concurrent network operations used to download the missing packages. It will also monitor the results and print periodic
-// progress updates to the console.
-func downloadMissingPackages(rpmSnapshot *repocloner.RepoContents, packagesAvailableFromRepos map[string]string, outDir string, concurrentNetOps uint) (downloadedPackages []string, err error) {
+// progress updates to the console. Interrupted downloads are kept in partDir and resumed by the next attempt.
+func downloadMissingPackages(rpmSnapshot *repocloner.RepoContents, packagesAvailableFromRepos map[string]string, outDir, partDir string, concurrentNetOps uint) (downloadedPackages []string, err error) {
 	timestamp.StartEvent("download missing packages", nil)
 	defer timestamp.StopEvent(nil)
 
@@ -279,7 +290,7 @@ func downloadMissingPackages(rpmSnapshot *repocloner.RepoContents, packagesAvail
 	// Each worker is responsible for removing itself from the wait group once done.
 	for _, pkg := range rpmSnapshot.Repo {
 		wg.Add(1)
-		go precachePackage(pkg, packagesAvailableFromRepos, outDir, wg, results, netOpsSemaphore)
+		go precachePackage(pkg, packagesAvailableFromRepos, outDir, partDir, wg, results, netOpsSemaphore)
 	}
 
 	// Wait for all the workers to finish and signal the main thread when we are done
@@ -351,7 +362,7 @@ func monitorProgress(total int, results chan downloadResult, doneChannel chan st
 // The caller is expected to have added to the provided wait group, while this function is
 // responsible for removing itself from the wait group. As much processing as possible is done before acquiring the
 // network operations semaphore to minimize the time spent holding it.
-func precachePackage(pkg *repocloner.RepoPackage, packagesAvailableFromRepos map[string]string, outDir string, wg *sync.WaitGroup, results chan<- downloadResult, netOpsSemaphore chan struct{}) {
+func precachePackage(pkg *repocloner.RepoPackage, packagesAvailableFromRepos map[string]string, outDir, partDir string, wg *sync.WaitGroup, results chan<- downloadResult, netOpsSemaphore chan struct{}) {
 	const (
 		// With 5 attempts, initial delay of 1 second, and a backoff factor of 2.0 the total time spent retrying will be
 		// ~30 seconds.
@@ -401,7 +412,17 @@ func precachePackage(pkg *repocloner.RepoPackage, packagesAvailableFromRepos map
 
 	logger.Log.Debugf("Pre-caching '%s' from '%s'", fileName, url)
 	_, err = retry.RunWithExpBackoff(func() error {
-		err := network.DownloadFile(url, fullFilePath, nil, nil)
+		err := network.DownloadFileResumable(url, fullFilePath, partDir, nil, nil)
+		if err == nil && pkg.Checksum != "" {
+			err = repoutils.VerifyChecksum(fullFilePath, pkg.Checksum)
+			if err != nil {
+				// Remove the corrupted package, so the next attempt downloads it again.
+				cleanupErr := file.RemoveFileIfExists(fullFilePath)
+				if cleanupErr != nil {
+					logger.Log.Errorf("Failed to remove corrupted download '%s': %s", fullFilePath, cleanupErr)
+				}
+			}
+		}
 		if err != nil {
 			logger.Log.Warnf("Attempt to download (%s) failed. Error: %s", url, err)
 		}
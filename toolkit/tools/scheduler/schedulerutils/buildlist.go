@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/juliangruber/go-intersect"
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/imagegen/configuration"
@@ -18,6 +20,9 @@ import (
 	"github.com/microsoft/CBL-Mariner/toolkit/tools/internal/sliceutils"
 )
 
+// sha256Regex matches a hex encoded SHA-256 checksum.
+var sha256Regex = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
 // ParseAndGeneratePackageBuildList parses the common package request arguments and generates a list of packages to build based on the given dependency graph.
 // - dependencyGraph: the dependency graph of all packages. Used to convert package/spec names to PackageVers.
 // - pkgsToBuild: a list of package/spec names to build. If empty, all packages will be built.
@@ -56,35 +61,90 @@ func ParseAndGeneratePackageTestList(dependencyGraph *pkggraph.PkgGraph, testsTo
 	return parseAndGeneratePackageList(dependencyGraph, testsToRun, testsToRerun, testsToIgnore, imageConfig, baseDirPath, dependencyGraph.AllTestNodes(), testNodeGetter)
 }
 
-// ReadReservedFilesList reads the list of reserved files (such as toolchain RPMs) from the manifest file passed in.
-// Entries will be returned in the form '<rpm>-<version>-<release>.rpm' with any preceding path removed. If the file path is
-// empty, an empty list will be returned.
-func ReadReservedFilesList(path string) (reservedFiles []string, err error) {
+// ReadReservedFilesList reads the list of reserved files (such as toolchain RPMs) from the manifest files passed in.
+// Entries will be returned in the form '<rpm>-<version>-<release>.rpm' with any preceding path removed. Entries listed
+// in several manifests are only returned once. Empty file paths are skipped, if all are empty an empty list will be returned.
+func ReadReservedFilesList(paths ...string) (reservedFiles []string, err error) {
+	reservedFiles, _, err = ReadReservedFilesChecksums(paths...)
+	return
+}
+
+// ReadReservedFilesChecksums reads the manifests like ReadReservedFilesList, but also accepts entries in the format
+// written by 'sha256sum' ('<SHA-256>  <path>'). The checksums are returned keyed by the entries' file names. Entries
+// without a checksum are only added to the list. Manifests listing different checksums for the same file are an error.
+func ReadReservedFilesChecksums(paths ...string) (reservedFiles []string, checksums map[string]string, err error) {
+	checksums = make(map[string]string)
+	seenFiles := make(map[string]bool)
+
+	for _, path := range paths {
+		var (
+			manifestFiles     []string
+			manifestChecksums map[string]string
+		)
+
+		manifestFiles, manifestChecksums, err = readReservedFilesManifest(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for file, checksum := range manifestChecksums {
+			if previousChecksum, found := checksums[file]; found && previousChecksum != checksum {
+				return nil, nil, fmt.Errorf("conflicting checksums for '%s' (%s and %s), the second one in manifest %s", file, previousChecksum, checksum, path)
+			}
+			checksums[file] = checksum
+		}
+
+		for _, file := range manifestFiles {
+			if !seenFiles[file] {
+				seenFiles[file] = true
+				reservedFiles = append(reservedFiles, file)
+			}
+		}
+	}
+
+	return reservedFiles, checksums, nil
+}
+
+// readReservedFilesManifest reads the entries and checksums of a single manifest for ReadReservedFilesChecksums.
+func readReservedFilesManifest(path string) (reservedFiles []string, checksums map[string]string, err error) {
+	checksums = make(map[string]string)
+
 	// If the path is empty, return an empty list.
 	if len(path) == 0 {
-		return reservedFiles, nil
+		return reservedFiles, checksums, nil
 	}
 
 	file, err := os.Open(path)
 	if err != nil {
 		logger.Log.Errorf("Failed to open file manifest %s with error %s", path, err)
-		return nil, err
+		return nil, nil, err
 	}
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		strippedPath := filepath.Base(scanner.Text())
+		entry := scanner.Text()
+
+		fields := strings.Fields(entry)
+		if len(fields) == 2 && sha256Regex.MatchString(fields[0]) {
+			// 'sha256sum' marks files read in binary mode with a '*' in front of their path.
+			strippedPath := filepath.Base(strings.TrimPrefix(fields[1], "*"))
+			checksums[strippedPath] = strings.ToLower(fields[0])
+			reservedFiles = append(reservedFiles, strippedPath)
+			continue
+		}
+
+		strippedPath := filepath.Base(entry)
 		reservedFiles = append(reservedFiles, strippedPath)
 	}
 
 	err = scanner.Err()
 	if err != nil {
 		logger.Log.Errorf("Failed to scan file manifest %s with error %s", path, err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return reservedFiles, nil
+	return reservedFiles, checksums, nil
 }
 
 // IsReservedFile determines if a given file path or filename is found in a list of reserved RPMs.